@@ -17,8 +17,11 @@ import (
 	"encoding/base64"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/juju/zaputil/zapctx"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 
 	"github.com/wiregarden-io/wiregarden/agent/store"
 	"github.com/wiregarden-io/wiregarden/api"
@@ -42,6 +45,19 @@ type Agent struct {
 	newApi func(string) Client
 	nm     NetworkManager
 	wc     *watcherClient
+
+	// storeOptions are the options the agent opens its store with.
+	storeOptions []store.Option
+
+	// configOptions are the options the agent generates interface
+	// configurations with.
+	configOptions []store.ConfigOption
+
+	now              func() time.Time
+	expiryWarning    time.Duration
+	expiryClockSkew  time.Duration
+	teardownExpired  bool
+	handshakeTimeout time.Duration
 }
 
 type Params struct {
@@ -60,6 +76,11 @@ type Client interface {
 type NetworkManager interface {
 	EnsureInterface(iface *store.Interface) error
 	RemoveInterface(iface *store.Interface) error
+
+	// Handshakes returns the time of the latest handshake with each peer
+	// of the interface, keyed by the peer's public key. Peers which have
+	// not completed a handshake are omitted.
+	Handshakes(iface *store.Interface) (map[string]time.Time, error)
 }
 
 type AgentOption func(*Agent)
@@ -69,23 +90,26 @@ func New(dataDir, apiUrl string, options ...AgentOption) (*Agent, error) {
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	st, err := store.New(p.StorePath, p.StoreKey)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
 	a := &Agent{
 		dataDir: p.DataDir,
 		apiUrl:  p.ApiUrl,
-		st:      st,
 		newApi:  func(apiUrl string) Client { return newRetryClient(api.New(apiUrl), nil) },
-		nm:      &wireguardManager{dataDir: p.DataDir},
+
+		now:              time.Now,
+		expiryWarning:    DefaultExpiryWarning,
+		expiryClockSkew:  DefaultExpiryClockSkew,
+		handshakeTimeout: DefaultHandshakeTimeout,
 	}
 	for _, opt := range options {
 		opt(a)
 	}
+	if a.nm == nil {
+		a.nm = &wireguardManager{dataDir: p.DataDir, configOptions: a.configOptions}
+	}
+	a.st, err = store.New(p.StorePath, p.StoreKey, a.storeOptions...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 	return a, nil
 }
 
@@ -93,6 +117,84 @@ func NotifyWatcher(a *Agent) {
 	a.wc = &watcherClient{}
 }
 
+// InsecureAllowHTTP allows the agent to join devices with a plain http API
+// URL, such as for a controller under development.
+func InsecureAllowHTTP(a *Agent) {
+	a.storeOptions = append(a.storeOptions, store.InsecureAllowHTTP())
+}
+
+// WithClient sets how the agent creates clients for the API at a given URL.
+func WithClient(newApi func(apiUrl string) Client) AgentOption {
+	return func(a *Agent) {
+		a.newApi = newApi
+	}
+}
+
+// WithNetworkManager sets the network manager the agent uses to apply
+// interface changes to the host.
+func WithNetworkManager(nm NetworkManager) AgentOption {
+	return func(a *Agent) {
+		a.nm = nm
+	}
+}
+
+// DefaultClientKeepalive sets the persistent keepalive interval in seconds
+// the agent configures for connections to server peers which do not set
+// their own. Otherwise, keepalive is disabled for such peers.
+func DefaultClientKeepalive(seconds int) AgentOption {
+	return func(a *Agent) {
+		a.configOptions = append(a.configOptions, store.DefaultClientKeepalive(seconds))
+	}
+}
+
+const (
+	// DefaultExpiryWarning is how long before a subscription expires that
+	// the agent starts warning about it on refresh.
+	DefaultExpiryWarning = 7 * 24 * time.Hour
+
+	// DefaultExpiryClockSkew is how long past a subscription's expiration
+	// the agent waits before considering it expired, allowing for the local
+	// clock to be ahead of the API server's.
+	DefaultExpiryClockSkew = 5 * time.Minute
+
+	// DefaultHandshakeTimeout is how long the agent waits for a handshake
+	// with a peer on the endpoint selected for it, before falling back to
+	// the peer's next candidate endpoint.
+	DefaultHandshakeTimeout = 3 * time.Minute
+)
+
+// ExpiryWarning sets how long before a subscription expires that the agent
+// warns about it on refresh.
+func ExpiryWarning(window time.Duration) AgentOption {
+	return func(a *Agent) {
+		a.expiryWarning = window
+	}
+}
+
+// ExpiryClockSkew sets the allowance for clock skew when determining whether
+// a subscription has expired.
+func ExpiryClockSkew(skew time.Duration) AgentOption {
+	return func(a *Agent) {
+		a.expiryClockSkew = skew
+	}
+}
+
+// HandshakeTimeout sets how long the agent waits for a handshake with a
+// peer on the endpoint selected for it, before falling back to the peer's
+// next candidate endpoint.
+func HandshakeTimeout(timeout time.Duration) AgentOption {
+	return func(a *Agent) {
+		a.handshakeTimeout = timeout
+	}
+}
+
+// TeardownExpired brings down interfaces when the subscription backing them
+// has expired, logging the teardown as OpTeardownDevice. Otherwise, expired
+// interfaces are left as-is.
+func TeardownExpired(a *Agent) {
+	a.teardownExpired = true
+}
+
 const defaultDataDir = "/var/lib/wiregarden"
 
 func defaultParams(dataDir, apiUrl string) (Params, error) {
@@ -182,12 +284,26 @@ func generateStoreKey(keyPath string) (store.Key, error) {
 	return k, nil
 }
 
+// hostDeviceName returns the name of the device for this host, when none is
+// given, which is its host name normalized to a valid device name.
+func hostDeviceName() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot determine hostname, node name is required")
+	}
+	name := api.NormalizeName(hostname)
+	if name == "" {
+		return "", errors.Errorf("cannot derive a device name from hostname %q, node name is required", hostname)
+	}
+	return name, nil
+}
+
 func (a *Agent) JoinDevice(ctx context.Context, deviceName, networkName, endpoint string) (*store.Interface, error) {
 	var err error
 	if deviceName == "" {
-		deviceName, err = os.Hostname()
+		deviceName, err = hostDeviceName()
 		if err != nil {
-			return nil, errors.Wrap(err, "cannot determine hostname, node name is required")
+			return nil, errors.WithStack(err)
 		}
 	}
 
@@ -200,7 +316,7 @@ func (a *Agent) JoinDevice(ctx context.Context, deviceName, networkName, endpoin
 	var availAddr *wireguard.Address
 	var listenPort int
 
-	ifaceLog, err := a.st.LastLogByDevice(deviceName, networkName)
+	ifaceLog, err := a.st.LastLogByDeviceContext(ctx, deviceName, networkName)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			return nil, errors.Wrapf(err, "failed to query last log by device %q network %q", deviceName, networkName)
@@ -243,6 +359,14 @@ func (a *Agent) JoinDevice(ctx context.Context, deviceName, networkName, endpoin
 
 	// TODO: reuse previously downed interface!
 
+	// Check the API URL before joining, so that the device is not left
+	// registered with a controller whose interface cannot be stored.
+	if ifaceLog == nil || ifaceLog.ApiUrl != a.apiUrl {
+		err = a.st.ValidateApiUrl(a.apiUrl)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
 	cl := a.newApi(a.apiUrl)
 	joinResp, err := cl.JoinDevice(ctx, &api.JoinDeviceRequest{
 		Name:          deviceName,
@@ -257,21 +381,23 @@ func (a *Agent) JoinDevice(ctx context.Context, deviceName, networkName, endpoin
 		return nil, errors.Wrap(err, "failed to join device to network")
 	}
 
-	var iface store.Interface
-	iface.ApiUrl = a.apiUrl
+	iface, err := store.JoinResponseToInterface(joinResp, key, a.apiUrl)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid response joining device to network")
+	}
 	iface.ListenPort = listenPort
-	iface.Key = key
-	a.ifaceJoinDeviceResponse(&iface, joinResp)
-	err = a.st.WithLog(&iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+	iface.MachineId = machineId
+	a.setDeviceToken(iface, joinResp)
+	err = a.st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
 		if lastLog != nil {
 			return errors.Wrapf(ErrInterfaceStateChanging,
 				"expected no prior state, found %q at entry %d", lastLog.State, lastLog.Id)
 		}
-		err := a.st.EnsureInterfaceTx(tx, &iface)
+		err := a.st.EnsureInterfaceTx(tx, iface)
 		if err != nil {
 			return errors.Wrap(err, "failed to store interface")
 		}
-		err = store.AppendLogTx(tx, &iface, store.OpJoinDevice, store.StateInterfaceJoined, true, "")
+		err = store.AppendLogTx(tx, iface, store.OpJoinDevice, store.StateInterfaceJoined, true, "")
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -280,7 +406,7 @@ func (a *Agent) JoinDevice(ctx context.Context, deviceName, networkName, endpoin
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return &iface, nil
+	return iface, nil
 }
 
 func (a *Agent) ifaceJoinDeviceResponse(iface *store.Interface, joinResp *api.JoinDeviceResponse) {
@@ -291,17 +417,30 @@ func (a *Agent) ifaceJoinDeviceResponse(iface *store.Interface, joinResp *api.Jo
 	iface.Device = joinResp.Device
 	iface.Peers = joinResp.Peers
 	iface.Plan = joinResp.Plan
+	if joinResp.SubscriptionId != "" {
+		iface.SubscriptionId = joinResp.SubscriptionId
+	}
 	if joinResp.Token != nil {
-		iface.DeviceToken = joinResp.Token
+		a.setDeviceToken(iface, joinResp)
 	}
 }
 
+// setDeviceToken sets the device token of an interface from a response
+// issuing it, along with when it was issued and when it expires, so that
+// the interface may be refreshed before its token expires.
+func (a *Agent) setDeviceToken(iface *store.Interface, joinResp *api.JoinDeviceResponse) {
+	issuedAt := a.now()
+	iface.DeviceToken = joinResp.Token
+	iface.DeviceTokenIssuedAt = &issuedAt
+	iface.DeviceTokenExpiresAt = joinResp.TokenExpiresAt
+}
+
 func (a *Agent) RefreshDevice(ctx context.Context, deviceName, networkName, endpoint string) (*store.Interface, error) {
 	var err error
 	if deviceName == "" {
-		deviceName, err = os.Hostname()
+		deviceName, err = hostDeviceName()
 		if err != nil {
-			return nil, errors.Wrap(err, "cannot determine hostname, node name is required")
+			return nil, errors.WithStack(err)
 		}
 	}
 
@@ -309,7 +448,7 @@ func (a *Agent) RefreshDevice(ctx context.Context, deviceName, networkName, endp
 		networkName = "default"
 	}
 
-	ifaceLog, err := a.st.LastLogByDevice(deviceName, networkName)
+	ifaceLog, err := a.st.LastLogByDeviceContext(ctx, deviceName, networkName)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errors.Wrapf(ErrDeviceNotFound, "device %q network %q", deviceName, networkName)
@@ -326,7 +465,7 @@ func (a *Agent) RefreshInterface(ctx context.Context, iface *store.InterfaceWith
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		lastLog, err := a.st.LastLog(&iface.Interface)
+		lastLog, err := a.st.LastLogContext(ctx, &iface.Interface)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -348,6 +487,15 @@ func (a *Agent) RefreshInterface(ctx context.Context, iface *store.InterfaceWith
 		return nil, errors.WithStack(err)
 	}
 	a.ifaceJoinDeviceResponse(&iface.Interface, joinResp)
+	op, state, dirty, message := store.OpRefreshDevice, store.StateInterfaceUp, true, ""
+	expired := a.subscriptionExpired(ctx, &iface.Interface, joinResp.NotAfter)
+	if expired {
+		state, dirty = store.StateInterfaceExpired, a.teardownExpired
+		if a.teardownExpired {
+			op = store.OpTeardownDevice
+		}
+		message = "subscription expired at " + joinResp.NotAfter.Format(time.RFC3339)
+	}
 	err = a.st.WithLog(&iface.Interface, func(tx *sql.Tx, currentLastLog *store.InterfaceLog) error {
 		if iface.Log != *currentLastLog {
 			return errors.Wrapf(ErrInterfaceStateChanging,
@@ -358,7 +506,7 @@ func (a *Agent) RefreshInterface(ctx context.Context, iface *store.InterfaceWith
 		if err != nil {
 			return errors.Wrap(err, "failed to store interface")
 		}
-		err = store.AppendLogTx(tx, &iface.Interface, store.OpRefreshDevice, store.StateInterfaceUp, true, "")
+		err = store.AppendLogTx(tx, &iface.Interface, op, state, dirty, message)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -367,9 +515,76 @@ func (a *Agent) RefreshInterface(ctx context.Context, iface *store.InterfaceWith
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	if expired {
+		a.expireSubscription(ctx, &iface.Interface, op, dirty, message)
+	}
 	return &iface.Interface, nil
 }
 
+// expireSubscription logs the other interfaces backed by the same
+// subscription as expired, once a refresh of iface has found that it
+// expired, so that they are torn down along with it if TeardownExpired is
+// set. Only interfaces which are up without pending changes are logged;
+// the others are left to find the expiry when they are next refreshed.
+//
+// Failures are logged rather than returned, as iface itself has been
+// refreshed.
+func (a *Agent) expireSubscription(ctx context.Context, iface *store.Interface, op store.Operation, dirty bool, message string) {
+	if iface.SubscriptionId == "" {
+		return
+	}
+	others, err := a.st.InterfacesBySubscriptionContext(ctx, iface.SubscriptionId)
+	if err != nil {
+		zapctx.Warn(ctx, "failed to query interfaces of expired subscription",
+			zap.String("interface", iface.Name()),
+			zap.Error(err))
+		return
+	}
+	for i := range others {
+		other := &others[i].Interface
+		// Subscription ids are only unique to the API which issued them.
+		if other.Id == iface.Id || other.ApiUrl != iface.ApiUrl {
+			continue
+		}
+		err := a.st.WithLog(other, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+			if lastLog == nil || lastLog.Dirty || lastLog.State != store.StateInterfaceUp {
+				return nil
+			}
+			return store.AppendLogTx(tx, other, op, store.StateInterfaceExpired, dirty, message)
+		})
+		if err != nil {
+			zapctx.Warn(ctx, "failed to expire interface",
+				zap.String("interface", other.Name()),
+				zap.Error(err))
+		}
+	}
+}
+
+// subscriptionExpired returns whether the subscription backing an interface
+// has expired, allowing for clock skew. A warning is logged if the
+// subscription will expire soon.
+func (a *Agent) subscriptionExpired(ctx context.Context, iface *store.Interface, notAfter *time.Time) bool {
+	if notAfter == nil {
+		return false
+	}
+	now := a.now()
+	if now.After(notAfter.Add(a.expiryClockSkew)) {
+		zapctx.Warn(ctx, "subscription expired",
+			zap.String("interface", iface.Name()),
+			zap.Time("notAfter", *notAfter))
+		return true
+	}
+	// Within the clock skew allowance, the subscription may have already
+	// expired, leaving no remaining time to warn about.
+	if remaining := notAfter.Sub(now); remaining > 0 && remaining < a.expiryWarning {
+		zapctx.Warn(ctx, "subscription expiring soon",
+			zap.String("interface", iface.Name()),
+			zap.Time("notAfter", *notAfter),
+			zap.String("remaining", remaining.String()))
+	}
+	return false
+}
+
 func (a *Agent) revokedInterface(ctx context.Context, iface *store.InterfaceWithLog) (*store.Interface, error) {
 	err := a.st.WithLog(&iface.Interface, func(tx *sql.Tx, currentLastLog *store.InterfaceLog) error {
 		if iface.Log != *currentLastLog {
@@ -412,6 +627,10 @@ func (a *Agent) allowOperation(l *store.InterfaceLog, op store.Operation) error
 		if l.State == store.StateInterfaceBlocked && l.Operation == op {
 			return nil
 		}
+		// Allow refreshing an expired subscription, which may have been renewed
+		if l.State == store.StateInterfaceExpired {
+			return nil
+		}
 	case store.OpDeleteDevice:
 		if l.State == store.StateInterfaceUp {
 			return nil
@@ -420,6 +639,9 @@ func (a *Agent) allowOperation(l *store.InterfaceLog, op store.Operation) error
 		if l.State == store.StateInterfaceBlocked {
 			return nil
 		}
+		if l.State == store.StateInterfaceExpired {
+			return nil
+		}
 		if l.State == store.StateInterfaceDown {
 			return errors.Wrap(store.ErrInterfaceOperationInvalid, "interface already down")
 		}
@@ -431,9 +653,9 @@ func (a *Agent) allowOperation(l *store.InterfaceLog, op store.Operation) error
 func (a *Agent) DeleteDevice(ctx context.Context, deviceName, networkName string) (*store.Interface, error) {
 	var err error
 	if deviceName == "" {
-		deviceName, err = os.Hostname()
+		deviceName, err = hostDeviceName()
 		if err != nil {
-			return nil, errors.Wrap(err, "cannot determine hostname, node name is required")
+			return nil, errors.WithStack(err)
 		}
 	}
 
@@ -441,7 +663,7 @@ func (a *Agent) DeleteDevice(ctx context.Context, deviceName, networkName string
 		networkName = "default"
 	}
 
-	ifaceLog, err := a.st.LastLogByDevice(deviceName, networkName)
+	ifaceLog, err := a.st.LastLogByDeviceContext(ctx, deviceName, networkName)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errors.Wrapf(ErrDeviceNotFound, "device %q network %q not found", deviceName, networkName)
@@ -489,7 +711,7 @@ func (a *Agent) Interface(id int64) (*store.Interface, error) {
 }
 
 func (a *Agent) Interfaces() ([]store.InterfaceWithLog, error) {
-	ifaces, err := a.st.Interfaces()
+	ifaces, _, err := a.st.Interfaces(store.ListOptions{})
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -531,6 +753,11 @@ func (a *Agent) applyInterfaceChanges(iface *store.Interface, lastLog *store.Int
 			Operation: lastLog.Operation,
 			State:     store.StateInterfaceDown,
 		}, a.nm.RemoveInterface(iface)
+	case store.StateInterfaceExpired:
+		return &store.InterfaceLog{
+			Operation: lastLog.Operation,
+			State:     store.StateInterfaceDown,
+		}, a.nm.RemoveInterface(iface)
 	case store.StateInterfaceDeparted:
 		return &store.InterfaceLog{
 			Operation: lastLog.Operation,
@@ -543,7 +770,7 @@ func (a *Agent) applyInterfaceChanges(iface *store.Interface, lastLog *store.Int
 				Operation: lastLog.Operation,
 				State:     store.StateInterfaceUp,
 			}, a.nm.EnsureInterface(iface)
-		case store.OpDeleteDevice:
+		case store.OpDeleteDevice, store.OpTeardownDevice:
 			return &store.InterfaceLog{
 				Operation: lastLog.Operation,
 				State:     store.StateInterfaceDown,
@@ -553,6 +780,97 @@ func (a *Agent) applyInterfaceChanges(iface *store.Interface, lastLog *store.Int
 	return nil, errors.Wrapf(ErrInterfaceStateInvalid, "don't know how to apply changes for state %q operation %q", lastLog.State, lastLog.Operation)
 }
 
+// FallBackEndpoints moves peers of an interface which are not reachable on
+// the endpoint selected for them on to their next candidate endpoint, and
+// applies the new configuration if any peer moved.
+//
+// WireGuard takes a single endpoint for each peer, and does not try others
+// on its own. A peer is considered unreachable if no handshake with it has
+// completed within the handshake timeout of selecting its endpoint.
+// Candidates are tried in turn, starting over from the first once all have
+// been tried. Handshake times reported by the network manager are recorded
+// in the store, and the interface's SelectedEndpoints are updated to match
+// the selections made.
+//
+// Only interfaces which are up, with no changes pending, are checked.
+func (a *Agent) FallBackEndpoints(ctx context.Context, iface *store.InterfaceWithLog) error {
+	if iface.Log.State != store.StateInterfaceUp || iface.Log.Dirty {
+		return nil
+	}
+	handshakes, err := a.nm.Handshakes(&iface.Interface)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get handshakes of interface %q", iface.Name())
+	}
+	for i := range iface.Peers {
+		at, ok := handshakes[iface.Peers[i].PublicKey.String()]
+		if !ok {
+			continue
+		}
+		err := a.st.UpsertHandshakeContext(ctx, iface.Id, iface.Peers[i].Id, at)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	lastHandshakes, err := a.st.HandshakesContext(ctx, iface.Id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	now := a.now()
+	var moved bool
+	for i := range iface.Peers {
+		peer := &iface.Peers[i]
+		candidates := peer.CandidateEndpoints()
+		if len(candidates) < 2 {
+			continue
+		}
+		endpoint := iface.PeerEndpoint(peer)
+		selected, ok := iface.SelectedEndpoints[peer.Id]
+		switch {
+		case !ok || selected.Endpoint != endpoint:
+			// Start waiting for a handshake on the endpoint in use.
+		case !lastHandshakes[peer.Id].Before(selected.SelectedAt):
+			continue
+		case now.Sub(selected.SelectedAt) < a.handshakeTimeout:
+			continue
+		default:
+			endpoint = nextEndpoint(candidates, endpoint)
+			moved = true
+			zapctx.Info(ctx, "falling back to next peer endpoint",
+				zap.String("interface", iface.Name()),
+				zap.String("peer", peer.Name),
+				zap.String("from", selected.Endpoint),
+				zap.String("to", endpoint))
+		}
+		err := a.st.SelectEndpointContext(ctx, iface.Id, peer.Id, endpoint, now)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if iface.SelectedEndpoints == nil {
+			iface.SelectedEndpoints = map[string]store.SelectedEndpoint{}
+		}
+		iface.SelectedEndpoints[peer.Id] = store.SelectedEndpoint{Endpoint: endpoint, SelectedAt: now}
+	}
+	if !moved {
+		return nil
+	}
+	err = a.nm.EnsureInterface(&iface.Interface)
+	if err != nil {
+		return errors.Wrapf(err, "failed to apply peer endpoints of interface %q", iface.Name())
+	}
+	return nil
+}
+
+// nextEndpoint returns the candidate endpoint after endpoint, starting over
+// from the first after the last.
+func nextEndpoint(candidates []string, endpoint string) string {
+	for i := range candidates {
+		if candidates[i] == endpoint {
+			return candidates[(i+1)%len(candidates)]
+		}
+	}
+	return candidates[0]
+}
+
 func WithToken(ctx context.Context, token []byte) context.Context {
 	if ctx == nil {
 		ctx = context.Background()
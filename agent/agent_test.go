@@ -12,9 +12,13 @@ package agent_test
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
+	"github.com/pkg/errors"
 
 	"github.com/wiregarden-io/wiregarden/agent"
 	"github.com/wiregarden-io/wiregarden/agent/store"
@@ -24,6 +28,8 @@ import (
 
 func TestJoinApply(t *testing.T) {
 	c := qt.New(t)
+	now := time.Now().Truncate(time.Second)
+	expiresAt := now.Add(24 * time.Hour)
 	a, st := agent.NewTestAgent(c, &mockClient{
 		joinResponse: &api.JoinDeviceResponse{
 			Network: api.Network{
@@ -38,10 +44,12 @@ func TestJoinApply(t *testing.T) {
 				// throwaway key that we'll ignore when comparing expected interface below
 				PublicKey: generateKey(c).PublicKey(),
 			},
-			Peers: []api.Device{},
-			Token: []byte("device-token"),
+			Peers:          []api.Device{},
+			Token:          []byte("device-token"),
+			TokenExpiresAt: &expiresAt,
 		},
 	}, &mockNetworkManager{})
+	agent.SetNow(a, func() time.Time { return now })
 	ctx := testContext()
 	iface, err := a.JoinDevice(ctx, "test-device", "test-net", "")
 	c.Assert(err, qt.IsNil)
@@ -59,16 +67,27 @@ func TestJoinApply(t *testing.T) {
 			Addr:      parseAddress(c, "1.2.3.4/24"),
 			PublicKey: iface.Device.PublicKey, // not tested
 		},
-		Peers:       []api.Device{},
-		ListenPort:  iface.ListenPort, // not tested
-		Key:         iface.Key,        // not tested
-		DeviceToken: []byte("device-token"),
+		Peers:                []api.Device{},
+		ListenPort:           iface.ListenPort, // not tested
+		Key:                  iface.Key,        // not tested
+		DeviceToken:          []byte("device-token"),
+		DeviceTokenIssuedAt:  &now,
+		DeviceTokenExpiresAt: &expiresAt,
+		MachineId:            iface.MachineId, // derived from the host
+		CreatedAt:            iface.CreatedAt, // not tested
+		UpdatedAt:            iface.UpdatedAt, // not tested
 	})
+	c.Assert(iface.MachineId, qt.HasLen, api.MachineIdLen)
 	ifaceLog, err := st.LastLogByDevice("test-device", "test-net")
 	c.Assert(err, qt.IsNil)
+	c.Assert(ifaceLog.MachineId, qt.DeepEquals, iface.MachineId)
 	c.Assert(ifaceLog.Log.State, qt.Equals, store.StateInterfaceJoined)
 	c.Assert(ifaceLog.Log.Operation, qt.Equals, store.OpJoinDevice)
 	c.Assert(ifaceLog.Log.Dirty, qt.Equals, true)
+	needRefresh, err := st.InterfacesNeedingRefresh(48 * time.Hour)
+	c.Assert(err, qt.IsNil)
+	c.Assert(needRefresh, qt.HasLen, 1)
+	c.Assert(needRefresh[0].Id, qt.Equals, iface.Id)
 
 	err = a.ApplyInterfaceChanges(iface)
 	c.Assert(err, qt.IsNil)
@@ -87,6 +106,50 @@ func TestJoinApply(t *testing.T) {
 	c.Assert(ifaceLog, qt.DeepEquals, ifaceLog2)
 }
 
+func TestJoinInsecureHTTP(t *testing.T) {
+	c := qt.New(t)
+	const apiUrl = "http://localhost:8080/api"
+	var clientUrls []string
+	cl := &mockClient{
+		joinResponse: &api.JoinDeviceResponse{
+			Network: api.Network{
+				Id:   "test-net-id",
+				Name: "test-net",
+				CIDR: parseAddress(c, "1.2.3.0/24"),
+			},
+			Device: api.Device{
+				Id:        "test-device-id",
+				Name:      "test-device",
+				Addr:      parseAddress(c, "1.2.3.4/24"),
+				PublicKey: generateKey(c).PublicKey(),
+			},
+			Peers: []api.Device{},
+			Token: []byte("device-token"),
+		},
+	}
+	withClient := agent.WithClient(func(apiUrl string) agent.Client {
+		clientUrls = append(clientUrls, apiUrl)
+		return cl
+	})
+	ctx := testContext()
+
+	// The API URL is checked before the device joins, so that it is not
+	// left registered with a controller whose interface cannot be stored.
+	a, err := agent.New(c.Mkdir(), apiUrl, withClient, agent.WithNetworkManager(&mockNetworkManager{}))
+	c.Assert(err, qt.IsNil)
+	_, err = a.JoinDevice(ctx, "test-device", "test-net", "")
+	c.Assert(errors.Is(err, store.ErrInvalidApiUrl), qt.IsTrue)
+	c.Assert(clientUrls, qt.HasLen, 0)
+
+	a, err = agent.New(c.Mkdir(), apiUrl, withClient, agent.WithNetworkManager(&mockNetworkManager{}),
+		agent.InsecureAllowHTTP)
+	c.Assert(err, qt.IsNil)
+	iface, err := a.JoinDevice(ctx, "test-device", "test-net", "")
+	c.Assert(err, qt.IsNil)
+	c.Assert(iface.ApiUrl, qt.Equals, apiUrl)
+	c.Assert(clientUrls, qt.DeepEquals, []string{apiUrl})
+}
+
 func TestJoinRefreshDepart(t *testing.T) {
 	c := qt.New(t)
 	k := generateKey(c)
@@ -281,6 +344,358 @@ func TestRefreshEndpoint(t *testing.T) {
 	c.Assert(err, qt.IsNil)
 }
 
+func TestRefreshExpiry(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		about     string
+		notAfter  *time.Time
+		teardown  bool
+		op        store.Operation
+		state     store.State
+		dirty     bool
+		downState store.State
+	}{{
+		about:    "no expiration",
+		notAfter: nil,
+		op:       store.OpRefreshDevice,
+		state:    store.StateInterfaceUp,
+		dirty:    true,
+	}, {
+		about:    "not expired within clock skew",
+		notAfter: timePtr(now.Add(-agent.DefaultExpiryClockSkew)),
+		op:       store.OpRefreshDevice,
+		state:    store.StateInterfaceUp,
+		dirty:    true,
+	}, {
+		about:    "just expired",
+		notAfter: timePtr(now.Add(-agent.DefaultExpiryClockSkew - time.Second)),
+		op:       store.OpRefreshDevice,
+		state:    store.StateInterfaceExpired,
+		dirty:    false,
+	}, {
+		about:     "just expired with teardown",
+		notAfter:  timePtr(now.Add(-agent.DefaultExpiryClockSkew - time.Second)),
+		teardown:  true,
+		op:        store.OpTeardownDevice,
+		state:     store.StateInterfaceExpired,
+		dirty:     true,
+		downState: store.StateInterfaceDown,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			k := generateKey(c)
+			device := api.Device{
+				Id:        "test-device-id",
+				Name:      "test-device",
+				Addr:      parseAddress(c, "1.2.3.4/24"),
+				PublicKey: k.PublicKey(),
+			}
+			network := api.Network{
+				Id:   "test-net-id",
+				Name: "test-net",
+				CIDR: parseAddress(c, "1.2.3.0/24"),
+			}
+			var options []agent.AgentOption
+			if test.teardown {
+				options = append(options, agent.TeardownExpired)
+			}
+			a, st := agent.NewTestAgent(c, &mockClient{
+				refreshResponse: &api.JoinDeviceResponse{
+					Network:  network,
+					Device:   device,
+					Token:    []byte("device-token"),
+					NotAfter: test.notAfter,
+				},
+			}, &mockNetworkManager{}, options...)
+			agent.SetNow(a, func() time.Time { return now })
+			iface := &store.Interface{
+				ApiUrl:      "https://wiregarden.io/api",
+				Network:     network,
+				Device:      device,
+				Key:         k,
+				DeviceToken: []byte("device-token"),
+			}
+			err := st.EnsureInterface(iface)
+			c.Assert(err, qt.IsNil)
+			err = st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+				return store.AppendLogTx(tx, iface, store.OpJoinDevice, store.StateInterfaceUp, false, "")
+			})
+			c.Assert(err, qt.IsNil)
+
+			_, err = a.RefreshDevice(testContext(), "test-device", "test-net", "")
+			c.Assert(err, qt.IsNil)
+			ifaceLog, err := st.LastLogByDevice("test-device", "test-net")
+			c.Assert(err, qt.IsNil)
+			c.Assert(ifaceLog.Log.Operation, qt.Equals, test.op)
+			c.Assert(ifaceLog.Log.State, qt.Equals, test.state)
+			c.Assert(ifaceLog.Log.Dirty, qt.Equals, test.dirty)
+
+			if test.downState != "" {
+				err = a.ApplyInterfaceChanges(iface)
+				c.Assert(err, qt.IsNil)
+				lastLog, err := st.LastLog(iface)
+				c.Assert(err, qt.IsNil)
+				c.Assert(lastLog.State, qt.Equals, test.downState)
+				c.Assert(lastLog.Dirty, qt.IsFalse)
+			}
+		})
+	}
+}
+
+func TestRefreshExpiryTeardownFails(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	k := generateKey(c)
+	device := api.Device{
+		Id:        "test-device-id",
+		Name:      "test-device",
+		Addr:      parseAddress(c, "1.2.3.4/24"),
+		PublicKey: k.PublicKey(),
+	}
+	network := api.Network{
+		Id:   "test-net-id",
+		Name: "test-net",
+		CIDR: parseAddress(c, "1.2.3.0/24"),
+	}
+	nm := &mockNetworkManager{removeErr: errors.New("cannot remove interface")}
+	a, st := agent.NewTestAgent(c, &mockClient{
+		refreshResponse: &api.JoinDeviceResponse{
+			Network:  network,
+			Device:   device,
+			Token:    []byte("device-token"),
+			NotAfter: timePtr(now.Add(-time.Hour)),
+		},
+	}, nm, agent.TeardownExpired)
+	agent.SetNow(a, func() time.Time { return now })
+	iface := &store.Interface{
+		ApiUrl:      "https://wiregarden.io/api",
+		Network:     network,
+		Device:      device,
+		Key:         k,
+		DeviceToken: []byte("device-token"),
+	}
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	err = st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+		return store.AppendLogTx(tx, iface, store.OpJoinDevice, store.StateInterfaceUp, false, "")
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = a.RefreshDevice(testContext(), "test-device", "test-net", "")
+	c.Assert(err, qt.IsNil)
+
+	// A failed teardown is blocked, and retried as a teardown rather than
+	// bringing the interface back up.
+	err = a.ApplyInterfaceChanges(iface)
+	c.Assert(err, qt.IsNil)
+	lastLog, err := st.LastLog(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(lastLog.Operation, qt.Equals, store.OpTeardownDevice)
+	c.Assert(lastLog.State, qt.Equals, store.StateInterfaceBlocked)
+	c.Assert(lastLog.Dirty, qt.IsTrue)
+	err = a.ApplyInterfaceChanges(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(nm.removed, qt.Equals, 2)
+
+	nm.removeErr = nil
+	err = a.ApplyInterfaceChanges(iface)
+	c.Assert(err, qt.IsNil)
+	lastLog, err = st.LastLog(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(lastLog.Operation, qt.Equals, store.OpTeardownDevice)
+	c.Assert(lastLog.State, qt.Equals, store.StateInterfaceDown)
+	c.Assert(lastLog.Dirty, qt.IsFalse)
+	c.Assert(nm.removed, qt.Equals, 3)
+	c.Assert(nm.ensured, qt.Equals, 0)
+}
+
+func TestRefreshExpirySubscription(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	network := api.Network{
+		Id:   "test-net-id",
+		Name: "test-net",
+		CIDR: parseAddress(c, "1.2.3.0/24"),
+	}
+	newDevice := func(n int) (api.Device, wireguard.Key) {
+		k := generateKey(c)
+		return api.Device{
+			Id:        fmt.Sprintf("test-device-%d-id", n),
+			Name:      fmt.Sprintf("test-device-%d", n),
+			Addr:      parseAddress(c, fmt.Sprintf("1.2.3.%d/24", n)),
+			PublicKey: k.PublicKey(),
+		}, k
+	}
+	device1, key1 := newDevice(1)
+	a, st := agent.NewTestAgent(c, &mockClient{
+		refreshResponse: &api.JoinDeviceResponse{
+			Network:        network,
+			Device:         device1,
+			Token:          []byte("device-token"),
+			SubscriptionId: "test-sub",
+			NotAfter:       timePtr(now.Add(-time.Hour)),
+		},
+	}, &mockNetworkManager{}, agent.TeardownExpired)
+	agent.SetNow(a, func() time.Time { return now })
+	var ifaces []*store.Interface
+	for i, subId := range []string{"test-sub", "test-sub", "other-sub"} {
+		device, k := device1, key1
+		if i > 0 {
+			device, k = newDevice(i + 1)
+		}
+		iface := &store.Interface{
+			ApiUrl:         "https://wiregarden.io/api",
+			Network:        network,
+			Device:         device,
+			Key:            k,
+			DeviceToken:    []byte("device-token"),
+			SubscriptionId: subId,
+		}
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		err = st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+			return store.AppendLogTx(tx, iface, store.OpJoinDevice, store.StateInterfaceUp, false, "")
+		})
+		c.Assert(err, qt.IsNil)
+		ifaces = append(ifaces, iface)
+	}
+
+	_, err := a.RefreshDevice(testContext(), "test-device-1", "test-net", "")
+	c.Assert(err, qt.IsNil)
+	// The other interface of the expired subscription is torn down too.
+	for i, state := range []store.State{
+		store.StateInterfaceExpired, store.StateInterfaceExpired, store.StateInterfaceUp,
+	} {
+		lastLog, err := st.LastLog(ifaces[i])
+		c.Assert(err, qt.IsNil)
+		c.Assert(lastLog.State, qt.Equals, state, qt.Commentf("interface %d", i))
+		c.Assert(lastLog.Dirty, qt.Equals, state == store.StateInterfaceExpired)
+	}
+	err = a.ApplyInterfaceChanges(ifaces[1])
+	c.Assert(err, qt.IsNil)
+	lastLog, err := st.LastLog(ifaces[1])
+	c.Assert(err, qt.IsNil)
+	c.Assert(lastLog.Operation, qt.Equals, store.OpTeardownDevice)
+	c.Assert(lastLog.State, qt.Equals, store.StateInterfaceDown)
+}
+
+func TestFallBackEndpoints(t *testing.T) {
+	c := qt.New(t)
+	t0 := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	now := t0
+	k := generateKey(c)
+	peerKey := generateKey(c)
+	iface := &store.Interface{
+		ApiUrl: "https://wiregarden.io/api",
+		Network: api.Network{
+			Id:   "test-net-id",
+			Name: "test-net",
+			CIDR: parseAddress(c, "1.2.3.0/24"),
+		},
+		Device: api.Device{
+			Id:        "test-device-id",
+			Name:      "test-device",
+			Addr:      parseAddress(c, "1.2.3.4/24"),
+			PublicKey: k.PublicKey(),
+		},
+		Peers: []api.Device{{
+			Id:         "test-server-id",
+			Name:       "test-server",
+			Addr:       parseAddress(c, "1.2.3.1/24"),
+			PublicKey:  peerKey.PublicKey(),
+			Candidates: []string{"192.0.2.1:51820", "198.51.100.1:51820"},
+		}, {
+			Id:        "other-server-id",
+			Name:      "other-server",
+			Addr:      parseAddress(c, "1.2.3.2/24"),
+			PublicKey: generateKey(c).PublicKey(),
+			Endpoint:  "example.com:51820",
+		}},
+		Key:         k,
+		DeviceToken: []byte("device-token"),
+	}
+	nm := &mockNetworkManager{}
+	a, st := agent.NewTestAgent(c, &mockClient{}, nm, agent.HandshakeTimeout(3*time.Minute))
+	agent.SetNow(a, func() time.Time { return now })
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	err = st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+		return store.AppendLogTx(tx, iface, store.OpJoinDevice, store.StateInterfaceUp, false, "")
+	})
+	c.Assert(err, qt.IsNil)
+	fallBack := func() *store.Interface {
+		ifaces, err := a.Interfaces()
+		c.Assert(err, qt.IsNil)
+		c.Assert(ifaces, qt.HasLen, 1)
+		err = a.FallBackEndpoints(testContext(), &ifaces[0])
+		c.Assert(err, qt.IsNil)
+		result, err := st.Interface(iface.Id)
+		c.Assert(err, qt.IsNil)
+		c.Assert(result.SelectedEndpoints, qt.DeepEquals, ifaces[0].SelectedEndpoints)
+		return result
+	}
+
+	// The first candidate is selected, and waited on for a handshake.
+	result := fallBack()
+	c.Assert(result.SelectedEndpoints, qt.HasLen, 1)
+	c.Assert(result.Config().Peers[0].Endpoint, qt.Equals, "192.0.2.1:51820")
+	now = t0.Add(2 * time.Minute)
+	result = fallBack()
+	c.Assert(result.Config().Peers[0].Endpoint, qt.Equals, "192.0.2.1:51820")
+	c.Assert(nm.ensured, qt.Equals, 0)
+
+	// Without a handshake before the timeout, the next candidate is used.
+	now = t0.Add(4 * time.Minute)
+	result = fallBack()
+	c.Assert(result.Config().Peers[0].Endpoint, qt.Equals, "198.51.100.1:51820")
+	c.Assert(result.PeerEndpoint(&result.Peers[0]), qt.Equals, "198.51.100.1:51820")
+	c.Assert(nm.ensured, qt.Equals, 1)
+
+	// A peer which completes a handshake stays on its endpoint, and the
+	// handshake is recorded.
+	nm.handshakes = map[string]time.Time{peerKey.PublicKey().String(): t0.Add(5 * time.Minute)}
+	now = t0.Add(10 * time.Minute)
+	result = fallBack()
+	c.Assert(result.Config().Peers[0].Endpoint, qt.Equals, "198.51.100.1:51820")
+	c.Assert(nm.ensured, qt.Equals, 1)
+	handshakes, err := st.Handshakes(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(handshakes["test-server-id"].Equal(t0.Add(5*time.Minute)), qt.IsTrue)
+
+	// Once all candidates have been tried, they are tried again from the
+	// first.
+	nm.handshakes = nil
+	err = st.SelectEndpoint(iface.Id, "test-server-id", "198.51.100.1:51820", t0.Add(6*time.Minute))
+	c.Assert(err, qt.IsNil)
+	result = fallBack()
+	c.Assert(result.Config().Peers[0].Endpoint, qt.Equals, "192.0.2.1:51820")
+	c.Assert(nm.ensured, qt.Equals, 2)
+
+	// Interfaces with changes pending are left alone.
+	err = st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+		return store.AppendLogTx(tx, iface, store.OpRefreshDevice, store.StateInterfaceUp, true, "")
+	})
+	c.Assert(err, qt.IsNil)
+	now = t0.Add(time.Hour)
+	result = fallBack()
+	c.Assert(result.Config().Peers[0].Endpoint, qt.Equals, "192.0.2.1:51820")
+	c.Assert(nm.ensured, qt.Equals, 2)
+}
+
+func TestParseHandshakes(t *testing.T) {
+	c := qt.New(t)
+	k1, k2 := generateKey(c).PublicKey().String(), generateKey(c).PublicKey().String()
+	handshakes, err := agent.ParseHandshakes([]byte(k1 + "\t1593604800\n" + k2 + "\t0\n"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(handshakes, qt.DeepEquals, map[string]time.Time{k1: time.Unix(1593604800, 0)})
+	_, err = agent.ParseHandshakes([]byte(k1 + "\tsoon\n"))
+	c.Assert(err, qt.ErrorMatches, `invalid handshake ".*soon": .*`)
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
 func testContext() context.Context {
 	return agent.WithToken(context.Background(), []byte("test-token"))
 }
@@ -309,14 +724,23 @@ func (c *mockClient) DepartDevice(ctx context.Context) error {
 }
 
 type mockNetworkManager struct {
+	ensured, removed int
+	removeErr        error
+	handshakes       map[string]time.Time
 }
 
 func (m *mockNetworkManager) EnsureInterface(iface *store.Interface) error {
+	m.ensured++
 	return nil
 }
 
 func (m *mockNetworkManager) RemoveInterface(iface *store.Interface) error {
-	return nil
+	m.removed++
+	return m.removeErr
+}
+
+func (m *mockNetworkManager) Handshakes(iface *store.Interface) (map[string]time.Time, error) {
+	return m.handshakes, nil
 }
 
 func parseAddress(c *qt.C, addr string) wireguard.Address {
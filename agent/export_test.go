@@ -12,6 +12,7 @@ package agent
 
 import (
 	"crypto/rand"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 
@@ -19,17 +20,32 @@ import (
 	"github.com/wiregarden-io/wiregarden/api"
 )
 
-func NewTestAgent(c *qt.C, cl Client, nm NetworkManager) (*Agent, *store.Store) {
+func NewTestAgent(c *qt.C, cl Client, nm NetworkManager, options ...AgentOption) (*Agent, *store.Store) {
 	var k store.Key
 	_, err := rand.Reader.Read(k[:])
 	c.Assert(err, qt.IsNil)
 	st, err := store.New(c.Mkdir()+"/db", k)
 	c.Assert(err, qt.IsNil)
-	return &Agent{
+	a := &Agent{
 		dataDir: c.Mkdir(),
 		apiUrl:  api.DefaultApiUrl,
 		st:      st,
 		newApi:  func(string) Client { return cl },
 		nm:      nm,
-	}, st
+
+		now:              time.Now,
+		expiryWarning:    DefaultExpiryWarning,
+		expiryClockSkew:  DefaultExpiryClockSkew,
+		handshakeTimeout: DefaultHandshakeTimeout,
+	}
+	for _, opt := range options {
+		opt(a)
+	}
+	return a, st
+}
+
+func SetNow(a *Agent, now func() time.Time) {
+	a.now = now
 }
+
+var ParseHandshakes = parseHandshakes
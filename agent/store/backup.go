@@ -0,0 +1,442 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/wiregarden-io/wiregarden/api"
+	"github.com/wiregarden-io/wiregarden/wireguard"
+)
+
+const (
+	backupFormat  = "wiregarden-store-backup"
+	backupVersion = 1
+
+	// compressionGzip identifies backup records compressed with gzip.
+	compressionGzip = "gzip"
+)
+
+// ErrInvalidBackup indicates a backup stream which cannot be imported.
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// BackupOptions configure how a backup is encrypted.
+type BackupOptions struct {
+	// Passphrase, if set, is used to derive the key which encrypts secrets
+	// in the backup. Otherwise secrets are encrypted with the store's
+	// sealer, and the backup can only be imported into a store using the
+	// same sealer.
+	Passphrase []byte
+
+	// Compress, if set, compresses the records following the backup header
+	// with gzip. The header itself is never compressed, so that Import can
+	// detect how the records are encoded.
+	Compress bool
+}
+
+// BackupOption sets an option on how a backup is encrypted.
+type BackupOption func(*BackupOptions)
+
+// Passphrase sets a passphrase from which the backup key is derived.
+func Passphrase(passphrase []byte) BackupOption {
+	return func(o *BackupOptions) {
+		o.Passphrase = passphrase
+	}
+}
+
+// CompressGzip compresses the backup with gzip. Import detects compressed
+// backups automatically, so it need only be given to Export.
+func CompressGzip() BackupOption {
+	return func(o *BackupOptions) {
+		o.Compress = true
+	}
+}
+
+// backupHeader is the first record of a backup stream, describing the
+// records which follow it.
+type backupHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+
+	// Salt is the scrypt salt used to derive the backup key from a
+	// passphrase. If empty, secrets are encrypted with the store sealer.
+	Salt []byte `json:"salt,omitempty"`
+
+	// Compression is the encoding of the records which follow the header.
+	// If empty, the records are not compressed.
+	Compression string `json:"compression,omitempty"`
+}
+
+// backupInterface is a record of an interface and its logs in a backup
+// stream. Secrets are encrypted with the backup key.
+type backupInterface struct {
+	ApiUrl         string       `json:"apiUrl"`
+	Network        api.Network  `json:"network"`
+	Device         api.Device   `json:"device"`
+	Peers          []api.Device `json:"peers"`
+	SubscriptionId string       `json:"subscriptionId"`
+	ListenPort     int          `json:"listenPort"`
+	Key            secret       `json:"key"`
+	DeviceToken    secret       `json:"deviceToken"`
+	CreatedAt      time.Time    `json:"createdAt"`
+	UpdatedAt      time.Time    `json:"updatedAt"`
+	ArchivedAt     *time.Time   `json:"archivedAt,omitempty"`
+	Logs           []backupLog  `json:"logs"`
+
+	DeviceTokenIssuedAt  *time.Time `json:"deviceTokenIssuedAt,omitempty"`
+	DeviceTokenExpiresAt *time.Time `json:"deviceTokenExpiresAt,omitempty"`
+
+	MachineId []byte `json:"machineId,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// PinnedPeers are the device ids of peers which are kept when the
+	// interface's peers are replaced.
+	PinnedPeers []string `json:"pinnedPeers,omitempty"`
+}
+
+type backupLog struct {
+	Timestamp time.Time `json:"timestamp"`
+	Operation Operation `json:"operation"`
+	State     State     `json:"state"`
+	Dirty     bool      `json:"dirty"`
+	Message   string    `json:"message"`
+}
+
+func backupKey(passphrase, salt []byte) (*Key, error) {
+	buf, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, len(Key{}))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive backup key")
+	}
+	var k Key
+	copy(k[:], buf)
+	return &k, nil
+}
+
+// Export writes a backup of all interfaces, their peers and logs to w.
+//
+// The backup is a stream of JSON records, starting with a header identifying
+// the format, how its secrets are encrypted and whether the records which
+// follow it are compressed.
+func (s *Store) Export(w io.Writer, options ...BackupOption) error {
+	var opts BackupOptions
+	for i := range options {
+		options[i](&opts)
+	}
+	s.mu.RLock()
+	sealer := s.sealer
+	s.mu.RUnlock()
+	header := backupHeader{Format: backupFormat, Version: backupVersion}
+	if len(opts.Passphrase) > 0 {
+		header.Salt = make([]byte, 16)
+		if _, err := rand.Reader.Read(header.Salt); err != nil {
+			return errors.Wrap(err, "failed to read random bytes")
+		}
+		k, err := backupKey(opts.Passphrase, header.Salt)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		sealer = *k
+	}
+	if opts.Compress {
+		header.Compression = compressionGzip
+	}
+	err := json.NewEncoder(w).Encode(&header)
+	if err != nil {
+		return errors.Wrap(err, "failed to write backup header")
+	}
+	var gz *gzip.Writer
+	if opts.Compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	enc := json.NewEncoder(w)
+
+	ctx := context.Background()
+	ids, err := s.interfaceIds(ctx, `select id from iface order by id`)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, id := range ids {
+		iface, err := s.InterfaceContext(ctx, id)
+		if err != nil {
+			return errors.Wrapf(err, "failed to query interface %d", id)
+		}
+		rec := backupInterface{
+			ApiUrl:         iface.ApiUrl,
+			Network:        iface.Network,
+			Device:         iface.Device,
+			Peers:          iface.Peers,
+			SubscriptionId: iface.SubscriptionId,
+			ListenPort:     iface.ListenPort,
+			CreatedAt:      iface.CreatedAt,
+			UpdatedAt:      iface.UpdatedAt,
+			ArchivedAt:     iface.ArchivedAt,
+
+			DeviceTokenIssuedAt:  iface.DeviceTokenIssuedAt,
+			DeviceTokenExpiresAt: iface.DeviceTokenExpiresAt,
+
+			MachineId: iface.MachineId,
+
+			Labels: iface.Labels,
+		}
+		rec.Key, err = sealer.Seal(iface.Key)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encrypt key of interface %d", id)
+		}
+		rec.DeviceToken, err = sealer.Seal(iface.DeviceToken)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encrypt device token of interface %d", id)
+		}
+		rec.Logs, err = s.backupLogs(ctx, id)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		rec.PinnedPeers, err = s.PinnedPeersContext(ctx, id)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		sort.Strings(rec.PinnedPeers)
+		err = enc.Encode(&rec)
+		if err != nil {
+			return errors.Wrapf(err, "failed to write backup of interface %d", id)
+		}
+	}
+	if gz != nil {
+		err = gz.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to write compressed backup")
+		}
+	}
+	return nil
+}
+
+func (s *Store) interfaceIds(ctx context.Context, query string, args ...interface{}) ([]int64, error) {
+	rows, err := s.prepared(nil).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query interfaces")
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan interface id")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate over interface ids")
+	}
+	return ids, nil
+}
+
+func (s *Store) backupLogs(ctx context.Context, ifaceId int64) ([]backupLog, error) {
+	rows, err := s.prepared(nil).QueryContext(ctx, `
+select ts, operation, state, dirty, message
+from iface_log
+where iface_id = ?
+order by id`[1:], ifaceId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query logs for interface %d", ifaceId)
+	}
+	defer rows.Close()
+	logs := []backupLog{}
+	for rows.Next() {
+		var l backupLog
+		var ts int64
+		err := rows.Scan(&ts, &l.Operation, &l.State, &l.Dirty, &l.Message)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to scan log for interface %d", ifaceId)
+		}
+		l.Timestamp = time.Unix(ts, 0)
+		logs = append(logs, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to query logs for interface %d", ifaceId)
+	}
+	return logs, nil
+}
+
+// Import restores the interfaces in a backup written by Export. Imported
+// interfaces keep their creation, update and archival times, but are
+// assigned new ids, so that they do not collide with interfaces already in
+// the store. If any imported interface has the same device, network device
+// name or public key as one already in the store, nothing is imported.
+//
+// The backup is read and decrypted in full before the store is modified, and
+// is imported in a single transaction.
+func (s *Store) Import(r io.Reader, options ...BackupOption) error {
+	var opts BackupOptions
+	for i := range options {
+		options[i](&opts)
+	}
+	dec := json.NewDecoder(r)
+	var header backupHeader
+	err := dec.Decode(&header)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidBackup, "failed to read header: %v", err)
+	}
+	if header.Format != backupFormat {
+		return errors.Wrapf(ErrInvalidBackup, "unknown format %q", header.Format)
+	}
+	if header.Version != backupVersion {
+		return errors.Wrapf(ErrInvalidBackup, "unsupported version %d", header.Version)
+	}
+	switch header.Compression {
+	case "":
+	case compressionGzip:
+		// Continue from where the header decoder left off, skipping the
+		// newline which terminates the header.
+		br := bufio.NewReader(io.MultiReader(dec.Buffered(), r))
+		if b, err := br.ReadByte(); err == nil && b != '\n' {
+			br.UnreadByte()
+		}
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return errors.Wrapf(ErrInvalidBackup, "failed to read compressed records: %v", err)
+		}
+		defer gz.Close()
+		dec = json.NewDecoder(gz)
+	default:
+		return errors.Wrapf(ErrInvalidBackup, "unknown compression %q", header.Compression)
+	}
+	s.mu.RLock()
+	sealer := s.sealer
+	s.mu.RUnlock()
+	if len(header.Salt) > 0 {
+		if len(opts.Passphrase) == 0 {
+			return errors.New("backup is encrypted with a passphrase, none given")
+		}
+		k, err := backupKey(opts.Passphrase, header.Salt)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		sealer = *k
+	}
+
+	var recs []backupInterface
+	var ifaces []Interface
+	for {
+		var rec backupInterface
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(ErrInvalidBackup, "failed to read interface: %v", err)
+		}
+		for _, l := range rec.Logs {
+			if !l.Operation.IsValid() || !l.State.IsValid() {
+				return errors.Wrapf(ErrInvalidBackup, "invalid log operation %q state %q for device %q",
+					l.Operation, l.State, rec.Device.Name)
+			}
+		}
+		ifaceKey, err := sealer.Open(rec.Key)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decrypt key for device %q", rec.Device.Name)
+		}
+		deviceToken, err := sealer.Open(rec.DeviceToken)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decrypt device token for device %q", rec.Device.Name)
+		}
+		recs = append(recs, rec)
+		ifaces = append(ifaces, Interface{
+			ApiUrl:         rec.ApiUrl,
+			Network:        rec.Network,
+			Device:         rec.Device,
+			Peers:          rec.Peers,
+			SubscriptionId: rec.SubscriptionId,
+			ListenPort:     rec.ListenPort,
+			Key:            wireguard.Key(ifaceKey),
+			DeviceToken:    deviceToken,
+
+			DeviceTokenIssuedAt:  rec.DeviceTokenIssuedAt,
+			DeviceTokenExpiresAt: rec.DeviceTokenExpiresAt,
+
+			MachineId: rec.MachineId,
+		})
+	}
+
+	ctx := context.Background()
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	q := s.prepared(tx)
+	for i := range ifaces {
+		iface := &ifaces[i]
+		var id int64
+		err := q.QueryRowContext(ctx, `
+select id from iface where public_key = ? or device_id = ? or (net_name = ? and device_name = ?)`[1:],
+			iface.Device.PublicKey.String(), iface.Device.Id, iface.Network.Name, iface.Device.Name).Scan(&id)
+		if err == nil {
+			return errors.Errorf("cannot import device %q in network %q, conflicts with interface %d",
+				iface.Device.Name, iface.Network.Name, id)
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return errors.Wrap(err, "failed to query for existing interfaces")
+		}
+		err = s.ensureInterfaceTx(ctx, tx, iface)
+		if err != nil {
+			return errors.Wrapf(err, "failed to import device %q in network %q", iface.Device.Name, iface.Network.Name)
+		}
+		_, err = q.ExecContext(ctx, `
+update iface set created_at = ?, updated_at = ?, deleted_at = ? where id = ?`[1:],
+			recs[i].CreatedAt.Unix(), recs[i].UpdatedAt.Unix(), nullUnix(recs[i].ArchivedAt), iface.Id)
+		if err != nil {
+			return errors.Wrapf(err, "failed to import device %q in network %q", iface.Device.Name, iface.Network.Name)
+		}
+		for _, l := range recs[i].Logs {
+			_, err := q.ExecContext(ctx, `
+insert into iface_log (ts, iface_id, operation, state, dirty, message)
+values (?, ?, ?, ?, ?, ?)`[1:], l.Timestamp.Unix(), iface.Id, l.Operation, l.State, l.Dirty, l.Message)
+			if err != nil {
+				return errors.Wrapf(err, "failed to import log for interface %q", iface.Name())
+			}
+		}
+		for key, value := range recs[i].Labels {
+			_, err := q.ExecContext(ctx, `
+insert into iface_label (iface_id, key, value) values (?, ?, ?)`[1:], iface.Id, key, value)
+			if err != nil {
+				return errors.Wrapf(err, "failed to import label %q for interface %q", key, iface.Name())
+			}
+		}
+		for _, deviceId := range recs[i].PinnedPeers {
+			_, err := q.ExecContext(ctx, `
+update peer set pinned = ? where iface_id = ? and device_id = ?`[1:], true, iface.Id, deviceId)
+			if err != nil {
+				return errors.Wrapf(err, "failed to import pinned peer %q for interface %q", deviceId, iface.Name())
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
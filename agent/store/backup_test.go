@@ -0,0 +1,160 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+	"github.com/wiregarden-io/wiregarden/api"
+)
+
+func TestExportImport(t *testing.T) {
+	c := qt.New(t)
+	key := generateStoreKey(c)
+	st, err := store.New(c.Mkdir()+"/db", key)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	iface1 := newTestInterface(c, "test-net", 1, 2)
+	iface1.SubscriptionId = "test-sub"
+	iface1.MachineId = api.DeriveMachineId([]byte("test-host"), []byte("wiregarden"))
+	issuedAt, expiresAt := time.Unix(1600000000, 0), time.Unix(1600086400, 0)
+	iface1.DeviceTokenIssuedAt, iface1.DeviceTokenExpiresAt = &issuedAt, &expiresAt
+	iface1.Peers[0].Endpoints = []api.Endpoint{{Endpoint: "example.com:51820", Priority: 1}}
+	err = st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface1, 2)
+	err = st.SetLabel(iface1.Id, "env", "prod")
+	c.Assert(err, qt.IsNil)
+	iface2 := newTestInterface(c, "other-net", 2, 0)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface2, 1)
+	expected, _, err := st.Interfaces(store.ListOptions{})
+	c.Assert(err, qt.IsNil)
+
+	c.Run("passphrase", func(c *qt.C) {
+		var buf bytes.Buffer
+		err := st.Export(&buf, store.Passphrase([]byte("hunter2")))
+		c.Assert(err, qt.IsNil)
+
+		// A store with a different key imports the backup.
+		st2, err := store.New(c.Mkdir()+"/db", generateStoreKey(c))
+		c.Assert(err, qt.IsNil)
+		defer st2.Close()
+		err = st2.Import(bytes.NewReader(buf.Bytes()), store.Passphrase([]byte("wrong")))
+		c.Assert(err, qt.ErrorMatches, `.*decrypt failed`)
+		err = st2.Import(bytes.NewReader(buf.Bytes()), store.Passphrase([]byte("hunter2")))
+		c.Assert(err, qt.IsNil)
+		assertInterfacesImported(c, st2, expected)
+	})
+
+	c.Run("store key", func(c *qt.C) {
+		var buf bytes.Buffer
+		err := st.Export(&buf)
+		c.Assert(err, qt.IsNil)
+
+		st2, err := store.New(c.Mkdir()+"/db", key)
+		c.Assert(err, qt.IsNil)
+		defer st2.Close()
+		// Imported interfaces are assigned new ids after existing ones.
+		other := newTestInterface(c, "unrelated-net", 3, 0)
+		err = st2.EnsureInterface(other)
+		c.Assert(err, qt.IsNil)
+		err = st2.Import(&buf)
+		c.Assert(err, qt.IsNil)
+		iface, err := st2.InterfaceByDevice(iface1.Device.Name, "test-net")
+		c.Assert(err, qt.IsNil)
+		c.Assert(iface.Id, qt.Not(qt.Equals), other.Id)
+		assertInterfacesImported(c, st2, expected)
+	})
+
+	c.Run("compressed", func(c *qt.C) {
+		var buf bytes.Buffer
+		err := st.Export(&buf, store.CompressGzip(), store.Passphrase([]byte("hunter2")))
+		c.Assert(err, qt.IsNil)
+		var plain bytes.Buffer
+		err = st.Export(&plain, store.Passphrase([]byte("hunter2")))
+		c.Assert(err, qt.IsNil)
+		c.Assert(buf.Len() < plain.Len(), qt.IsTrue)
+
+		st2, err := store.New(c.Mkdir()+"/db", generateStoreKey(c))
+		c.Assert(err, qt.IsNil)
+		defer st2.Close()
+		err = st2.Import(&buf, store.Passphrase([]byte("hunter2")))
+		c.Assert(err, qt.IsNil)
+		assertInterfacesImported(c, st2, expected)
+	})
+
+	c.Run("detect compression", func(c *qt.C) {
+		// Import reads compressed and uncompressed backups alike, whether or
+		// not the option is given.
+		for i, exportOpts := range [][]store.BackupOption{nil, {store.CompressGzip()}} {
+			for j, importOpts := range [][]store.BackupOption{nil, {store.CompressGzip()}} {
+				var buf bytes.Buffer
+				err := st.Export(&buf, exportOpts...)
+				c.Assert(err, qt.IsNil)
+				c.Assert(strings.Contains(buf.String(), `"compression":"gzip"`), qt.Equals, i == 1)
+
+				st2, err := store.New(c.Mkdir()+"/db", key)
+				c.Assert(err, qt.IsNil)
+				err = st2.Import(&buf, importOpts...)
+				c.Assert(err, qt.IsNil, qt.Commentf("export %d import %d", i, j))
+				assertInterfacesImported(c, st2, expected)
+				c.Assert(st2.Close(), qt.IsNil)
+			}
+		}
+	})
+
+	c.Run("conflict", func(c *qt.C) {
+		var buf bytes.Buffer
+		err := st.Export(&buf)
+		c.Assert(err, qt.IsNil)
+		err = st.Import(&buf)
+		c.Assert(err, qt.ErrorMatches, `cannot import device "test-device-1" in network "test-net", conflicts with interface 1`)
+	})
+
+	c.Run("invalid", func(c *qt.C) {
+		err := st.Import(strings.NewReader(`{"format":"something-else","version":1}`))
+		c.Assert(errors.Is(err, store.ErrInvalidBackup), qt.IsTrue)
+		err = st.Import(strings.NewReader(`{"format":"wiregarden-store-backup","version":99}`))
+		c.Assert(errors.Is(err, store.ErrInvalidBackup), qt.IsTrue)
+		err = st.Import(strings.NewReader(`{"format":"wiregarden-store-backup","version":1,"compression":"lz4"}`))
+		c.Assert(errors.Is(err, store.ErrInvalidBackup), qt.IsTrue)
+		err = st.Import(strings.NewReader(`{"format":"wiregarden-store-backup","version":1,"compression":"gzip"}
+{"apiUrl":""}`))
+		c.Assert(errors.Is(err, store.ErrInvalidBackup), qt.IsTrue)
+		err = st.Import(strings.NewReader(`not json`))
+		c.Assert(errors.Is(err, store.ErrInvalidBackup), qt.IsTrue)
+	})
+}
+
+func assertInterfacesImported(c *qt.C, st *store.Store, expected []store.InterfaceWithLog) {
+	for i := range expected {
+		iface, err := st.InterfaceByDevice(expected[i].Device.Name, expected[i].Network.Name)
+		c.Assert(err, qt.IsNil)
+		// Compare everything but the id, which may be remapped.
+		want := expected[i].Interface
+		want.Id = iface.Id
+		c.Assert(iface, qt.DeepEquals, &want)
+		lastLog, err := st.LastLog(iface)
+		c.Assert(err, qt.IsNil)
+		c.Assert(lastLog.State, qt.Equals, expected[i].Log.State)
+		c.Assert(lastLog.Message, qt.Equals, expected[i].Log.Message)
+		c.Assert(lastLog.Timestamp.Equal(expected[i].Log.Timestamp), qt.IsTrue)
+	}
+}
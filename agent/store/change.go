@@ -0,0 +1,78 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+// ChangeKind is the kind of change made to an interface.
+type ChangeKind string
+
+const (
+	// ChangeSaved means an interface was created or updated.
+	ChangeSaved = ChangeKind("saved")
+
+	// ChangeDeleted means an interface was deleted.
+	ChangeDeleted = ChangeKind("deleted")
+)
+
+// Change describes a change made to an interface in the store.
+type Change struct {
+	Id   int64
+	Kind ChangeKind
+}
+
+// changeFunc is a function registered with OnChange, identified so that it
+// can be unregistered.
+type changeFunc struct {
+	id int
+	f  func(Change)
+}
+
+// OnChange registers f to be called after each interface is saved by
+// EnsureInterface, EnsureInterfaces or ReplaceInterface, or deleted by
+// DeleteInterface or Repair, returning a function which unregisters it.
+//
+// f is only called once the change is committed, from the goroutine which
+// made it, so it should return quickly and must not write to the store.
+// Functions are called in the order in which they were registered.
+// Changes made by the Tx variants of methods within a caller's transaction
+// are not notified.
+func (s *Store) OnChange(f func(Change)) (cancel func()) {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+	id := s.nextChangeFunc
+	s.nextChangeFunc++
+	s.changeFuncs = append(s.changeFuncs, changeFunc{id: id, f: f})
+	return func() {
+		s.changeMu.Lock()
+		defer s.changeMu.Unlock()
+		for i := range s.changeFuncs {
+			if s.changeFuncs[i].id == id {
+				// Copy rather than remove in place, as notify may be
+				// calling the registered functions.
+				funcs := make([]changeFunc, 0, len(s.changeFuncs)-1)
+				funcs = append(funcs, s.changeFuncs[:i]...)
+				s.changeFuncs = append(funcs, s.changeFuncs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// notify calls the functions registered with OnChange for each change.
+func (s *Store) notify(changes ...Change) {
+	s.changeMu.Lock()
+	funcs := s.changeFuncs
+	s.changeMu.Unlock()
+	for _, change := range changes {
+		for i := range funcs {
+			funcs[i].f(change)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+)
+
+func TestOnChange(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	var changes []store.Change
+	cancel := st.OnChange(func(change store.Change) {
+		changes = append(changes, change)
+	})
+
+	iface1 := newTestInterface(c, "test-net", 1, 1)
+	err := st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	iface1.SubscriptionId = "test-sub"
+	err = st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	iface2, iface3 := newTestInterface(c, "test-net", 2, 1), newTestInterface(c, "test-net", 3, 1)
+	err = st.EnsureInterfaces([]*store.Interface{iface2, iface3})
+	c.Assert(err, qt.IsNil)
+	err = st.DeleteInterface(iface2.Id)
+	c.Assert(err, qt.IsNil)
+	err = st.ReplaceInterface(iface3.Id, newTestInterface(c, "test-net", 4, 1))
+	c.Assert(err, qt.IsNil)
+	c.Assert(changes, qt.DeepEquals, []store.Change{
+		{Id: iface1.Id, Kind: store.ChangeSaved},
+		{Id: iface1.Id, Kind: store.ChangeSaved},
+		{Id: iface2.Id, Kind: store.ChangeSaved},
+		{Id: iface3.Id, Kind: store.ChangeSaved},
+		{Id: iface2.Id, Kind: store.ChangeDeleted},
+		{Id: iface3.Id, Kind: store.ChangeSaved},
+	})
+
+	// Changes which are rolled back are not notified.
+	changes = nil
+	invalid := newTestInterface(c, "test-net", 5, 1)
+	invalid.Peers[0].Addr = invalid.Device.Addr
+	err = st.EnsureInterfaces([]*store.Interface{newTestInterface(c, "test-net", 6, 1), invalid})
+	c.Assert(err, qt.Not(qt.IsNil))
+	err = st.DeleteInterface(iface2.Id)
+	c.Assert(err, qt.Not(qt.IsNil))
+	c.Assert(changes, qt.HasLen, 0)
+
+	// Nothing is notified once cancelled.
+	cancel()
+	err = st.DeleteInterface(iface1.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(changes, qt.HasLen, 0)
+}
+
+func TestOnChangeOrder(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	var calls []int
+	var cancels []func()
+	for i := 0; i < 5; i++ {
+		i := i
+		cancels = append(cancels, st.OnChange(func(store.Change) {
+			calls = append(calls, i)
+		}))
+	}
+	err := st.EnsureInterface(newTestInterface(c, "test-net", 1, 1))
+	c.Assert(err, qt.IsNil)
+	c.Assert(calls, qt.DeepEquals, []int{0, 1, 2, 3, 4})
+
+	// Functions remain in order as others are cancelled.
+	calls = nil
+	cancels[1]()
+	cancels[3]()
+	cancels[3]()
+	err = st.EnsureInterface(newTestInterface(c, "test-net", 2, 1))
+	c.Assert(err, qt.IsNil)
+	c.Assert(calls, qt.DeepEquals, []int{0, 2, 4})
+}
@@ -12,12 +12,23 @@
 package store
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/nacl/secretbox"
 
@@ -25,58 +36,6 @@ import (
 	"github.com/wiregarden-io/wiregarden/wireguard"
 )
 
-const createPublicSchemaSql = `
-create table if not exists iface (
-	id integer primary key autoincrement,
-	created_at integer,
-	updated_at integer,
-
-	api_url text not null,
-
-	net_id text not null,
-	net_name text not null,
-	net_cidr text not null,
-
-	device_id text not null,
-	device_name text not null,
-	device_endpoint text not null,
-	device_addr text not null,
-	public_key text not null,
-
-	listen_port integer
-);
-
-create unique index if not exists iface_device_id_unique
-on iface(device_id);
-
-create unique index if not exists iface_device_net_name_unique
-on iface(net_name, device_name);
-
-create unique index if not exists iface_public_key_unique
-on iface(public_key);
-
-create table if not exists peer (
-	iface_id integer not null,
-	device_id text not null,
-	device_name text not null,
-	device_endpoint text not null,
-	device_addr text not null,
-	public_key blob not null,
-	foreign key(iface_id) references iface(id)
-);
-
-create table if not exists iface_log (
-	id integer primary key autoincrement,
-	ts integer,
-	iface_id integer not null,
-	operation text not null,
-    state text not null,
-	dirty bool not null default false,
-    message text not null,
-	foreign key(iface_id) references iface(id)
-);
-`
-
 const createSecretSchemaSql = `
 create table if not exists iface_secrets (
 	iface_id integer primary key,
@@ -87,42 +46,309 @@ create table if not exists iface_secrets (
 
 type secret []byte
 
+// secretVersionSecretbox is the format version of secrets sealed with
+// secretbox. The version byte is followed by a random 24 byte nonce and the
+// sealed box. Secrets sealed before the format was versioned have no version
+// byte; they are re-sealed when the store is opened, see
+// resealLegacySecrets.
+const secretVersionSecretbox = 1
+
+// nonceReader is the source of nonces for sealing secrets. It is only
+// replaced by tests, which need stable ciphertext; a predictable nonce is
+// otherwise unsafe.
+var nonceReader io.Reader = rand.Reader
+
 func encryptSecret(s []byte, k *Key) (secret, error) {
+	// A short read would leave the nonce partly zero, risking its reuse.
 	var nonce [24]byte
-	if _, err := rand.Reader.Read(nonce[:]); err != nil {
+	if _, err := io.ReadFull(nonceReader, nonce[:]); err != nil {
 		return nil, errors.Wrap(err, "failed to read random bytes")
 	}
-	return secret(secretbox.Seal(nonce[:], s, &nonce, k)), nil
+	sealed := append([]byte{secretVersionSecretbox}, nonce[:]...)
+	return secret(secretbox.Seal(sealed, s, &nonce, (*[32]byte)(k))), nil
 }
 
-func mustEncryptSecret(s []byte, k *Key) secret {
-	sec, err := encryptSecret(s, k)
+func (sv secret) decrypt(k *Key) ([]byte, error) {
+	if len(sv) == 0 {
+		return nil, errors.Wrap(ErrDecrypt, "invalid secret value")
+	}
+	if sv[0] != secretVersionSecretbox {
+		return nil, errors.Wrapf(ErrDecrypt, "unknown format version %d", sv[0])
+	}
+	decrypted, ok := openSecretbox(sv[1:], k)
+	if !ok {
+		return nil, errors.WithStack(ErrDecrypt)
+	}
+	return decrypted, nil
+}
+
+// resealLegacy returns the secret re-sealed with k in the current format,
+// if it is a secret sealed with k before the format was versioned. The
+// first byte of such a secret is part of its random nonce, so it may also
+// look like a version; a secret which opens as versioned is left as it is.
+func (sv secret) resealLegacy(k *Key) (secret, bool, error) {
+	if len(sv) > 0 && sv[0] == secretVersionSecretbox {
+		if _, ok := openSecretbox(sv[1:], k); ok {
+			return nil, false, nil
+		}
+	}
+	decrypted, ok := openSecretbox(sv, k)
+	if !ok {
+		return nil, false, nil
+	}
+	resealed, err := encryptSecret(decrypted, k)
 	if err != nil {
-		panic(err)
+		return nil, false, errors.WithStack(err)
 	}
-	return sec
+	return resealed, true, nil
 }
 
-func (sv secret) decrypt(k *Key) ([]byte, error) {
+// openSecretbox opens a secretbox prefixed by its nonce.
+func openSecretbox(sv []byte, k *Key) ([]byte, bool) {
 	if len(sv) < 24 {
-		return nil, errors.New("invalid secret value")
+		return nil, false
 	}
 	var nonce [24]byte
 	copy(nonce[:], sv[:24])
-	decrypted, ok := secretbox.Open(nil, sv[24:], &nonce, k)
-	if !ok {
-		return nil, errors.New("decrypt failed")
-	}
-	return decrypted, nil
+	return secretbox.Open(nil, sv[24:], &nonce, (*[32]byte)(k))
 }
 
 type Store struct {
-	db  *sql.DB
-	key Key
+	db      *sql.DB
+	dialect Dialect
+
+	// mu guards sealer and tokenSealer, so that secrets are never read or
+	// written with a key that does not match the stored ciphertext while it
+	// is being rotated.
+	mu     sync.RWMutex
+	sealer Sealer
+	// tokenSealer, if set, seals device tokens separately from private
+	// keys.
+	tokenSealer Sealer
+
+	// stmtsMu guards stmts, the statements prepared by the store, keyed by
+	// their query before it is rebound, and warming, the queries being
+	// prepared in the background.
+	stmtsMu sync.Mutex
+	stmts   map[string]*sql.Stmt
+	warming map[string]bool
+
+	// warmWg waits for the statements being prepared in the background
+	// when the store is closed.
+	warmWg sync.WaitGroup
+
+	now func() time.Time
+
+	// writeMu serializes writes in this process if serializeWrites is set.
+	serializeWrites bool
+	writeMu         sync.Mutex
+
+	// readOnly is set if the store was opened read-only, in which case
+	// writes fail with ErrReadOnly.
+	readOnly bool
+
+	// insecureAllowHTTP and apiHosts restrict the API URLs of interfaces
+	// saved to the store, as set by the options of the same names.
+	insecureAllowHTTP bool
+	apiHosts          []string
+
+	// changeMu guards changeFuncs, the functions registered with OnChange
+	// in the order in which they were registered.
+	changeMu       sync.Mutex
+	changeFuncs    []changeFunc
+	nextChangeFunc int
+
+	// closed is set atomically once the store is closed, after which its
+	// methods fail with ErrStoreClosed.
+	closed int32
+
+	// stopVacuum stops periodic incremental vacuuming, if enabled, and
+	// vacuumDone is closed once it has stopped.
+	stopVacuum context.CancelFunc
+	vacuumDone chan struct{}
+}
+
+// DefaultBusyTimeout is the default time to wait for a lock on the database
+// held by another connection or process before failing.
+const DefaultBusyTimeout = 5 * time.Second
+
+// Options configure how a Store opens its database.
+type Options struct {
+	// BusyTimeout is how long to wait for a lock on the database held by
+	// another connection or process, before failing with "database is
+	// locked". A longer timeout tolerates more contention, such as the CLI
+	// querying status while the agent applies changes, at the cost of
+	// blocking callers for longer when a lock is held.
+	BusyTimeout time.Duration
+
+	// AutoVacuumInterval, if non-zero, enables incremental auto-vacuum on
+	// the databases, and is how often pages freed by deletes are reclaimed,
+	// shrinking the database files.
+	AutoVacuumInterval time.Duration
+
+	// SerializeWrites, if set, makes the store's write methods take an
+	// in-process mutex, so that goroutines sharing a store write one at a
+	// time, while reads remain concurrent.
+	//
+	// WAL mode already lets readers proceed alongside a writer, and writers
+	// wait for each other up to the busy timeout, which is enough for most
+	// uses, and the only option for separate processes. Serializing writes
+	// makes their order predictable and keeps goroutines from failing with
+	// "database is locked" after the busy timeout under heavy contention.
+	// As the mutex is not reentrant, callbacks of WithLog and Transaction
+	// must write with the Tx variants of methods, such as
+	// EnsureInterfaceTx, rather than calling other write methods.
+	SerializeWrites bool
+
+	// MaxOpenConns, if positive, limits the number of open connections to
+	// the databases. Callers wait for a connection once the limit is
+	// reached.
+	MaxOpenConns int
+
+	// MaxIdleConns, if positive, is the number of idle connections kept
+	// open for reuse, or if negative, no idle connections are kept.
+	MaxIdleConns int
+
+	// ConnMaxLifetime, if positive, is how long a connection may be reused
+	// before it is closed.
+	ConnMaxLifetime time.Duration
+
+	// ReadOnly, if set, opens an existing store without writing to it,
+	// such as for monitoring a store used by another process. The schema is
+	// neither created nor migrated, and write methods fail with
+	// ErrReadOnly. Auto-vacuum and serialized writes do not apply.
+	ReadOnly bool
+
+	// TokenSealer, if set, encrypts device tokens instead of the store
+	// sealer, so that compromising one key does not expose both the
+	// private keys and the device tokens. Device tokens sealed by the store
+	// sealer before TokenSealer was set are still opened, and are re-sealed
+	// with TokenSealer when their interface is next saved.
+	TokenSealer Sealer
+
+	// InsecureAllowHTTP, if set, allows interfaces to be saved with a plain
+	// http API URL, such as for a controller under development. Otherwise
+	// the API URL must be https, so that device tokens are never sent in
+	// the clear.
+	InsecureAllowHTTP bool
+
+	// ApiHosts, if set, are the only hosts an interface's API URL may
+	// refer to, so that a mistyped or hostile URL cannot point the agent at
+	// the wrong controller.
+	ApiHosts []string
+}
+
+// Option sets an option on how a Store is opened.
+type Option func(*Options)
+
+// BusyTimeout sets how long to wait for a database lock before failing.
+func BusyTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.BusyTimeout = d
+	}
+}
+
+// AutoVacuum enables incremental auto-vacuum, reclaiming free pages at the
+// given interval.
+func AutoVacuum(interval time.Duration) Option {
+	return func(o *Options) {
+		o.AutoVacuumInterval = interval
+	}
+}
+
+// SerializeWrites makes the store's writes take an in-process mutex.
+func SerializeWrites() Option {
+	return func(o *Options) {
+		o.SerializeWrites = true
+	}
 }
 
-func New(path string, key Key) (*Store, error) {
-	err := ensureDB(path, createPublicSchemaSql)
+// MaxOpenConns limits the number of open database connections.
+func MaxOpenConns(n int) Option {
+	return func(o *Options) {
+		o.MaxOpenConns = n
+	}
+}
+
+// MaxIdleConns sets the number of idle database connections kept for reuse.
+func MaxIdleConns(n int) Option {
+	return func(o *Options) {
+		o.MaxIdleConns = n
+	}
+}
+
+// ConnMaxLifetime sets how long a database connection may be reused.
+func ConnMaxLifetime(d time.Duration) Option {
+	return func(o *Options) {
+		o.ConnMaxLifetime = d
+	}
+}
+
+// ReadOnly opens the store without writing to it.
+func ReadOnly() Option {
+	return func(o *Options) {
+		o.ReadOnly = true
+	}
+}
+
+// TokenSealer encrypts device tokens with a separate sealer.
+func TokenSealer(sealer Sealer) Option {
+	return func(o *Options) {
+		o.TokenSealer = sealer
+	}
+}
+
+// InsecureAllowHTTP allows interfaces to be saved with plain http API URLs.
+func InsecureAllowHTTP() Option {
+	return func(o *Options) {
+		o.InsecureAllowHTTP = true
+	}
+}
+
+// ApiHosts restricts the hosts interface API URLs may refer to.
+func ApiHosts(hosts ...string) Option {
+	return func(o *Options) {
+		o.ApiHosts = append(o.ApiHosts, hosts...)
+	}
+}
+
+// New opens the store at path, creating and migrating it as necessary.
+// Secrets are kept in a separate database alongside it, encrypted with
+// sealer. A Key seals secrets with secretbox.
+//
+// The sealer, and the token sealer if any, are tested by sealing and opening
+// a secret before the store is opened, so that a bad key fails here with
+// ErrInvalidSealer rather than on first use. An all-zero Key is rejected.
+//
+// The databases are opened in write-ahead log (WAL) journal mode, so that
+// readers do not block writers or each other. WAL keeps -wal and -shm files
+// alongside each database, which share the database file's permissions, and
+// requires shared memory, so the store should not be placed on a network
+// filesystem.
+//
+// Transactions take the write lock when they begin, waiting up to the busy
+// timeout for it. Otherwise a transaction which reads before writing cannot
+// wait for a concurrent writer without risking deadlock, and sqlite fails it
+// immediately.
+func New(path string, sealer Sealer, options ...Option) (*Store, error) {
+	opts := Options{BusyTimeout: DefaultBusyTimeout}
+	for i := range options {
+		options[i](&opts)
+	}
+	err := selfTestSealer(sealer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open database %q", path)
+	}
+	if opts.TokenSealer != nil {
+		err = selfTestSealer(opts.TokenSealer)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open database %q: token sealer", path)
+		}
+	}
+	if opts.ReadOnly {
+		return newReadOnly(path, sealer, &opts)
+	}
+	err = ensureDB(path, createSchemaVersionSql)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to ensure database %q", path)
 	}
@@ -139,253 +365,2377 @@ func New(path string, key Key) (*Store, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to set permissions on database %q", secretPath)
 	}
-	db, err := sql.Open("sqlite3", "file:"+path+"?_fk=true")
+	db := openSQLite(path, &opts)
+	st, err := NewWithDB(db, SQLite, sealer, options...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to open database %q", path)
 	}
-	_, err = db.Exec("attach database ? as secret", secretPath)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to attach database %q", secretPath)
-	}
-	return &Store{db: db, key: key}, nil
+	return st, nil
 }
 
-func ensureDB(path, createSchemaSql string) error {
-	db, err := sql.Open("sqlite3", "file:"+path+"?_fk=true")
+// newReadOnly opens an existing store at path without writing to it. The
+// schema must already be fully migrated.
+func newReadOnly(path string, sealer Sealer, opts *Options) (*Store, error) {
+	db := openSQLite(path, opts)
+	var version int
+	err := db.QueryRow(`select coalesce(max(version), 0) from schema_version`).Scan(&version)
 	if err != nil {
-		return errors.Wrapf(err, "failed to open database %q", path)
+		db.Close()
+		return nil, errors.Wrapf(err, "failed to open database %q: failed to query schema version", path)
 	}
-	defer db.Close()
-	_, err = db.Exec(createSchemaSql)
-	if err != nil {
-		return errors.Wrapf(err, "failed to create schema in database %q", path)
+	if version != latestSchemaVersion {
+		db.Close()
+		return nil, errors.Errorf("failed to open database %q read-only: schema version %d is not the supported version %d",
+			path, version, latestSchemaVersion)
 	}
-	return nil
-}
-
-func (st *Store) Close() error {
-	return st.db.Close()
+	return &Store{
+		db:          db,
+		dialect:     SQLite,
+		sealer:      sealer,
+		tokenSealer: opts.TokenSealer,
+		stmts:       map[string]*sql.Stmt{},
+		warming:     map[string]bool{},
+		now:         time.Now,
+		readOnly:    true,
+	}, nil
 }
 
-func (s *Store) EnsureInterface(iface *Interface) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "failed to begin transaction")
+// openSQLite opens the sqlite database at path, with its secret database
+// attached to every connection.
+func openSQLite(path string, opts *Options) *sql.DB {
+	secretPath := path + ".secret"
+	params := "_fk=true&_busy_timeout=" + strconv.FormatInt(int64(opts.BusyTimeout/time.Millisecond), 10)
+	secretURI := secretPath
+	if opts.ReadOnly {
+		// Read-only connections cannot take the write lock when beginning
+		// transactions, nor change the journal mode.
+		params = "mode=ro&_query_only=true&" + params
+		secretURI = "file:" + secretPath + "?mode=ro"
+	} else {
+		params += "&_journal_mode=WAL&_txlock=immediate"
 	}
-	defer tx.Rollback()
-	err = s.EnsureInterfaceTx(tx, iface)
-	if err != nil {
-		return errors.WithStack(err)
+	db := sql.OpenDB(&connector{
+		dsn: "file:" + path + "?" + params,
+		driver: &sqlite3.SQLiteDriver{
+			// Every connection in the pool needs the secret database
+			// attached, not just the first one opened.
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				_, err := conn.Exec("attach database ? as secret", []driver.Value{secretURI})
+				if err != nil {
+					return errors.Wrapf(err, "failed to attach database %q", secretPath)
+				}
+				if opts.ReadOnly {
+					return nil
+				}
+				_, err = conn.Exec("pragma secret.journal_mode = WAL", nil)
+				if err != nil {
+					return errors.Wrapf(err, "failed to set journal mode on database %q", secretPath)
+				}
+				return nil
+			},
+		},
+	})
+	if opts.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(opts.MaxOpenConns)
 	}
-	err = tx.Commit()
-	if err != nil {
-		return errors.Wrap(err, "failed to commit transaction")
+	if opts.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
 	}
-	return nil
+	if opts.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	}
+	return db
 }
 
-func (s *Store) EnsureInterfaceTx(tx *sql.Tx, iface *Interface) error {
-	now := time.Now().Unix()
-	id := sql.NullInt64{}
-	if iface.Id > 0 {
-		id.Valid = true
-		id.Int64 = iface.Id
-	} else {
-		// Because sqlite only upserts on one conflicting constraint, match
-		// the id of any other conflicts ahead of time.
-		err := tx.QueryRow(`
-select id from iface where public_key = ? or device_id = ? or (net_name = ? and device_name = ?)
-`, iface.Device.PublicKey.String(), iface.Device.Id, iface.Network.Name, iface.Device.Name).Scan(&id)
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return errors.Wrap(err, "failed to query for existing interfaces")
+// enableAutoVacuum switches the sqlite databases to incremental auto-vacuum,
+// and starts reclaiming their free pages periodically until the store is
+// closed.
+func (s *Store) enableAutoVacuum(interval time.Duration) error {
+	for _, schema := range []string{"main", "secret"} {
+		var mode int
+		err := s.db.QueryRow(`pragma ` + schema + `.auto_vacuum`).Scan(&mode)
+		if err != nil {
+			return errors.Wrapf(err, "failed to query auto-vacuum mode of %q", schema)
 		}
-	}
-	result, err := tx.Exec(`
-insert into iface (
-	id, created_at, updated_at,
-	api_url,
-	net_id, net_name, net_cidr,
-	device_id, device_name, device_endpoint, device_addr, public_key,
-	listen_port
-)
-values (
-	?, ?, ?,
-	?,
-	?, ?, ?,
-	?, ?, ?, ?, ?,
-	?)
-on conflict (id) do update set
-	id = excluded.id,
-	updated_at = excluded.updated_at,
-	api_url = excluded.api_url,
-	net_id = excluded.net_id,
-	net_name = excluded.net_name,
-	net_cidr = excluded.net_cidr,
-	device_id = excluded.device_id,
-	device_name = excluded.device_name,
-	device_endpoint = excluded.device_endpoint,
-	device_addr = excluded.device_addr,
-	public_key = excluded.public_key,
-	listen_port = excluded.listen_port;
-`[1:], id, now, now,
-		iface.ApiUrl,
-		iface.Network.Id, iface.Network.Name, iface.Network.CIDR.String(),
-		iface.Device.Id, iface.Device.Name,
-		iface.Device.Endpoint, iface.Device.Addr.String(),
-		iface.Device.PublicKey.String(),
-		iface.ListenPort)
-	if err != nil {
-		return errors.Wrap(err, "failed to upsert interface")
-	}
-	if !id.Valid {
-		ifaceId, err := result.LastInsertId()
+		if mode == autoVacuumIncremental {
+			continue
+		}
+		// Changing the auto-vacuum mode of an existing database only takes
+		// effect once it is vacuumed.
+		_, err = s.db.Exec(`pragma ` + schema + `.auto_vacuum = incremental`)
 		if err != nil {
-			return errors.Wrap(err, "failed to obtain new interface id")
+			return errors.Wrapf(err, "failed to set auto-vacuum mode of %q", schema)
 		}
-		iface.Id = ifaceId
-	} else {
-		iface.Id = id.Int64
-	}
-	_, err = tx.Exec(`
-insert into secret.iface_secrets (iface_id, key, device_token)
-values (?, ?, ?)
-on conflict (iface_id) do update set
-	iface_id = excluded.iface_id,
-	key = excluded.key,
-	device_token = excluded.device_token;
-`[1:], iface.Id,
-		mustEncryptSecret(iface.Key, &s.key),
-		mustEncryptSecret(iface.DeviceToken, &s.key))
-	if err != nil {
-		return errors.Wrap(err, "failed to upsert interface secrets")
-	}
-	_, err = tx.Exec(`delete from peer where iface_id = ?`, iface.Id)
-	if err != nil {
-		return errors.Wrap(err, "failed to replace existing peers")
-	}
-	for i := range iface.Peers {
-		_, err = tx.Exec(`
-insert into peer (iface_id, device_id, device_name, device_endpoint, device_addr, public_key)
-values (?, ?, ?, ?, ?, ?)`[1:],
-			iface.Id, iface.Peers[i].Id, iface.Peers[i].Name, iface.Peers[i].Endpoint,
-			iface.Peers[i].Addr.String(), iface.Peers[i].PublicKey.String())
+		_, err = s.db.Exec(`vacuum ` + schema)
 		if err != nil {
-			return errors.Wrapf(err, "failed to insert peer %q", iface.Peers[i].Id)
+			return errors.Wrapf(err, "failed to vacuum %q", schema)
 		}
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopVacuum, s.vacuumDone = cancel, make(chan struct{})
+	ticks, stop := vacuumTicker(interval)
+	go func() {
+		defer close(s.vacuumDone)
+		defer stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticks:
+				// Failures, such as the database being busy, are retried
+				// at the next interval.
+				s.db.ExecContext(ctx, `
+pragma main.incremental_vacuum;
+pragma secret.incremental_vacuum;
+`[1:])
+			}
+		}
+	}()
 	return nil
 }
 
-func (s *Store) Interface(id int64) (*Interface, error) {
-	var (
-		iface                                      Interface
-		netCIDRText, deviceAddrText, publicKeyText string
-		keyBytes                                   []byte
-		deviceTokenBytes                           []byte
-	)
-	err := s.db.QueryRow(`
-select
-	i.api_url,
-	i.net_id, i.net_name, i.net_cidr,
-	i.device_id, i.device_name, i.device_endpoint, i.device_addr, i.public_key,
-	i.listen_port, s.key, s.device_token
-from iface i join secret.iface_secrets s on (i.id = s.iface_id)
-where id = ?`[1:], id).Scan(
-		&iface.ApiUrl,
-		&iface.Network.Id, &iface.Network.Name, &netCIDRText,
-		&iface.Device.Id, &iface.Device.Name, &iface.Device.Endpoint, &deviceAddrText, &publicKeyText,
-		&iface.ListenPort, &keyBytes, &deviceTokenBytes)
+// beginWrite checks that the store may be written, and locks the write mutex
+// if writes are serialized, returning a function which unlocks it.
+func (s *Store) beginWrite() (func(), error) {
+	err := s.checkOpen()
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to query interface %q", id)
+		return nil, errors.WithStack(err)
 	}
-	iface.Id = id
-	// parse net cidr
-	netCIDR, err := wireguard.ParseAddress(netCIDRText)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to query interface: invalid network CIDR %q", netCIDRText)
+	if s.readOnly {
+		return nil, errors.WithStack(ErrReadOnly)
 	}
-	iface.Network.CIDR = *netCIDR
-	// parse device addr
-	deviceAddr, err := wireguard.ParseAddress(deviceAddrText)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to query interface: invalid device address %q", deviceAddrText)
+	if !s.serializeWrites {
+		return func() {}, nil
 	}
-	iface.Device.Addr = *deviceAddr
-	// parse public key
-	publicKey, err := wireguard.ParseKey(publicKeyText)
+	s.writeMu.Lock()
+	return s.writeMu.Unlock, nil
+}
+
+// vacuumTicker returns a channel which receives the times to reclaim free
+// pages at the given interval, and a function which stops it. It is only
+// replaced by tests, which need to control when pages are reclaimed.
+var vacuumTicker = func(interval time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(interval)
+	return t.C, t.Stop
+}
+
+// autoVacuumIncremental is the value of the sqlite auto_vacuum pragma in
+// incremental mode.
+const autoVacuumIncremental = 2
+
+// NewWithDB returns a store using an open database of the given dialect,
+// creating and migrating its schema as necessary. Secrets are kept in a
+// "secret" schema, encrypted with sealer; for sqlite, this is a database
+// attached to every connection.
+//
+// Options which configure how the database is opened, such as BusyTimeout
+// and ReadOnly, are left to the caller and ignored. AutoVacuum is only
+// supported by sqlite.
+//
+// The store takes ownership of db, closing it when the store is closed, or
+// if it cannot be opened.
+func NewWithDB(db *sql.DB, dialect Dialect, sealer Sealer, options ...Option) (*Store, error) {
+	st, err := newWithDB(db, dialect, sealer, options...)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to query interface: invalid public key %q", publicKeyText)
+		db.Close()
+		return nil, errors.WithStack(err)
 	}
-	iface.Device.PublicKey = publicKey
-	// decrypt key
-	keyDecrypted, err := secret(keyBytes).decrypt(&s.key)
+	return st, nil
+}
+
+func newWithDB(db *sql.DB, dialect Dialect, sealer Sealer, options ...Option) (*Store, error) {
+	var opts Options
+	for i := range options {
+		options[i](&opts)
+	}
+	if opts.AutoVacuumInterval > 0 && dialect.name != SQLite.name {
+		return nil, errors.Errorf("auto-vacuum is not supported by %s", dialect.name)
+	}
+	_, err := db.Exec(dialect.secretSchemaSql)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to query interface: failed to decrypt key")
+		return nil, errors.Wrap(err, "failed to create secret schema")
 	}
-	iface.Key = keyDecrypted
-	// decrypt device token
-	deviceToken, err := secret(deviceTokenBytes).decrypt(&s.key)
+	err = migrate(db, dialect)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to query interface: failed to decrypt key")
+		return nil, errors.Wrap(err, "failed to migrate database")
 	}
-	iface.DeviceToken = deviceToken
+	st := &Store{
+		db:      db,
+		dialect: dialect,
+		sealer:  sealer,
+		stmts:   map[string]*sql.Stmt{},
+		warming: map[string]bool{},
+		now:     time.Now,
 
-	rows, err := s.db.Query(`
-select
-	device_id, device_name, device_endpoint, device_addr, public_key
-from peer
-where iface_id = ?`[1:], iface.Id)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to query peers")
+		serializeWrites:   opts.SerializeWrites,
+		tokenSealer:       opts.TokenSealer,
+		insecureAllowHTTP: opts.InsecureAllowHTTP,
+		apiHosts:          opts.ApiHosts,
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var peer api.Device
-		var peerAddrText, peerKeyText string
-		err := rows.Scan(&peer.Id, &peer.Name, &peer.Endpoint, &peerAddrText, &peerKeyText)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to scan peer result row")
-		}
-		peerAddr, err := wireguard.ParseAddress(peerAddrText)
+	for _, sealer := range []Sealer{sealer, opts.TokenSealer} {
+		err = st.resealLegacySecrets(sealer)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to query interface: invalid peer address %q", peerAddrText)
+			return nil, errors.WithStack(err)
 		}
-		peer.Addr = *peerAddr
-		peerKey, err := wireguard.ParseKey(peerKeyText)
+	}
+	if opts.AutoVacuumInterval > 0 {
+		err = st.enableAutoVacuum(opts.AutoVacuumInterval)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to query interface: invalid public key %q", peerKeyText)
+			return nil, errors.Wrap(err, "failed to enable auto-vacuum")
 		}
-		peer.PublicKey = peerKey
-		iface.Peers = append(iface.Peers, peer)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, errors.Wrap(err, "failed to query peers")
 	}
-	return &iface, nil
+	return st, nil
 }
 
-func (s *Store) InterfaceByDevice(deviceName, networkName string) (*Interface, error) {
-	var id int64
-	err := s.db.QueryRow(`
-select id from iface
-where device_name = ? and net_name = ?`[1:], deviceName, networkName).Scan(&id)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to query interface device name %q network name %q", deviceName, networkName)
-	}
-	iface, err := s.Interface(id)
-	if err != nil {
-		return nil, errors.WithStack(err)
+// resealLegacySecrets re-seals the interface secrets which sealer sealed
+// before the secret format was versioned, if sealer is a Key, so that
+// Key.Open need not guess at their format. Other secrets are left as they
+// are. It is a migration of the secret schema which needs the key, and
+// finds nothing to do once it has run.
+func (s *Store) resealLegacySecrets(sealer Sealer) error {
+	var k Key
+	switch sealer := sealer.(type) {
+	case Key:
+		k = sealer
+	case *Key:
+		k = *sealer
+	default:
+		return nil
 	}
-	return iface, nil
-}
-
-func (s *Store) WithLog(iface *Interface, f func(tx *sql.Tx, lastLog *InterfaceLog) error) error {
-	tx, err := s.db.Begin()
+	ctx := context.Background()
+	tx, err := s.beginTx(ctx)
 	if err != nil {
 		return errors.Wrap(err, "failed to begin transaction")
 	}
 	defer tx.Rollback()
-	lastLog, err := LastLogTx(tx, iface)
+	q := s.prepared(tx)
+	rows, err := q.QueryContext(ctx, `select iface_id, key, device_token from secret.iface_secrets`)
+	if err != nil {
+		return errors.Wrap(err, "failed to query interface secrets")
+	}
+	type ifaceSecrets struct {
+		id               int64
+		key, deviceToken secret
+	}
+	var resealed []ifaceSecrets
+	for rows.Next() {
+		var sec ifaceSecrets
+		err := rows.Scan(&sec.id, &sec.key, &sec.deviceToken)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "failed to scan interface secrets")
+		}
+		key, keyChanged, err := sec.key.resealLegacy(&k)
+		if err != nil {
+			rows.Close()
+			return errors.Wrapf(err, "failed to re-seal key for interface %d", sec.id)
+		}
+		deviceToken, tokenChanged, err := sec.deviceToken.resealLegacy(&k)
+		if err != nil {
+			rows.Close()
+			return errors.Wrapf(err, "failed to re-seal device token for interface %d", sec.id)
+		}
+		if keyChanged {
+			sec.key = key
+		}
+		if tokenChanged {
+			sec.deviceToken = deviceToken
+		}
+		if keyChanged || tokenChanged {
+			resealed = append(resealed, sec)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to query interface secrets")
+	}
+	for _, sec := range resealed {
+		_, err = q.ExecContext(ctx, `
+update secret.iface_secrets set key = ?, device_token = ? where iface_id = ?`[1:],
+			[]byte(sec.key), []byte(sec.deviceToken), sec.id)
+		if err != nil {
+			return errors.Wrapf(err, "failed to update secrets for interface %d", sec.id)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+// connector opens sqlite connections with a custom driver.
+type connector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+func ensureDB(path, createSchemaSql string) error {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_fk=true")
+	if err != nil {
+		return errors.Wrapf(err, "failed to open database %q", path)
+	}
+	defer db.Close()
+	_, err = db.Exec(createSchemaSql)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create schema in database %q", path)
+	}
+	return nil
+}
+
+// splitEndpoint splits a host:port endpoint into its host and port for
+// storage. An endpoint without a valid port is stored as a host with a zero
+// port.
+func splitEndpoint(endpoint string) (string, int) {
+	host, portText, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return endpoint, 0
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port <= 0 || port > 65535 {
+		return endpoint, 0
+	}
+	return host, port
+}
+
+// joinEndpoint reconstructs the combined host:port form of a stored endpoint.
+func joinEndpoint(host string, port int) string {
+	if port == 0 {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// nullUnix returns the Unix time of t for storing in an integer column, or
+// null if t is nil.
+func nullUnix(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
+
+// unixTime returns the time stored in an integer column by nullUnix.
+func unixTime(n sql.NullInt64) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+	t := time.Unix(n.Int64, 0)
+	return &t
+}
+
+// Close closes the store and its database. Closing a store more than once
+// has no effect, and its other methods fail with ErrStoreClosed once it is
+// closed.
+func (st *Store) Close() error {
+	if !atomic.CompareAndSwapInt32(&st.closed, 0, 1) {
+		return nil
+	}
+	if st.stopVacuum != nil {
+		st.stopVacuum()
+		<-st.vacuumDone
+	}
+	st.stmtsMu.Lock()
+	for query, stmt := range st.stmts {
+		stmt.Close()
+		delete(st.stmts, query)
+	}
+	st.stmtsMu.Unlock()
+	// Statements still being prepared are closed rather than cached, but
+	// their connections must be released before the database is closed.
+	st.warmWg.Wait()
+	return st.db.Close()
+}
+
+// Vacuum rebuilds the databases to reclaim the space left unused by deleted
+// interfaces and pruned logs, shrinking the database files.
+//
+// Vacuuming cannot be done within a transaction, and requires exclusive
+// access to the database while it runs.
+func (s *Store) Vacuum() error {
+	return s.VacuumContext(context.Background())
+}
+
+// VacuumContext is like Vacuum, but aborts if the context is cancelled.
+func (s *Store) VacuumContext(ctx context.Context) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	_, err = s.db.ExecContext(ctx, s.dialect.vacuumSql)
+	if err != nil {
+		return errors.Wrap(err, "failed to vacuum database")
+	}
+	return nil
+}
+
+var (
+	// ErrDatabaseUnreachable indicates that the store database cannot be
+	// queried.
+	ErrDatabaseUnreachable = errors.New("database unreachable")
+
+	// ErrKeyMismatch indicates that secrets in the store cannot be
+	// decrypted with the store key.
+	ErrKeyMismatch = errors.New("key mismatch")
+
+	// ErrInterfaceNotFound indicates that an interface looked up does not
+	// exist. It wraps sql.ErrNoRows, which callers may also check for.
+	ErrInterfaceNotFound = errors.WithMessage(sql.ErrNoRows, "interface not found")
+
+	// ErrReadOnly indicates that a store opened read-only cannot be
+	// written.
+	ErrReadOnly = errors.New("store is read-only")
+
+	// ErrStoreClosed indicates that the store was used after it was closed.
+	ErrStoreClosed = errors.New("store is closed")
+
+	// ErrDecrypt indicates that a secret of an interface could not be
+	// decrypted, such as when it was sealed with a different key.
+	ErrDecrypt = errors.New("decrypt failed")
+)
+
+// kindError is an error of a kind, such as ErrDatabaseUnreachable, caused by
+// another error. Both the kind and the cause match it with errors.Is.
+type kindError struct {
+	kind, cause error
+}
+
+// withKind returns an error of the given kind caused by cause.
+func withKind(kind, cause error) error {
+	return errors.WithStack(&kindError{kind: kind, cause: cause})
+}
+
+func (e *kindError) Error() string {
+	return e.cause.Error() + ": " + e.kind.Error()
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.cause
+}
+
+// Ping checks that the store database is reachable and, if the store has any
+// interfaces, that the store key decrypts their secrets. Errors wrap
+// ErrDatabaseUnreachable or ErrKeyMismatch to distinguish the cause.
+func (s *Store) Ping(ctx context.Context) error {
+	err := s.checkOpen()
+	if err != nil {
+		return withKind(ErrDatabaseUnreachable, err)
+	}
+	err = s.db.PingContext(ctx)
+	if err != nil {
+		return withKind(ErrDatabaseUnreachable, err)
+	}
+	var keyBytes []byte
+	err = s.db.QueryRowContext(ctx, `select key from secret.iface_secrets limit 1`).Scan(&keyBytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return withKind(ErrDatabaseUnreachable, errors.Wrap(err, "failed to query secrets"))
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, err = s.sealer.Open(keyBytes)
+	if err != nil {
+		return withKind(ErrKeyMismatch, err)
+	}
+	return nil
+}
+
+// RotateKey re-encrypts all interface secrets with newSealer in a single
+// transaction, after which the store uses newSealer. If rotation fails, the
+// secrets and the store are left using the current sealer.
+//
+// If the store has a separate token sealer, device tokens remain sealed
+// with it rather than newSealer.
+//
+// Other stores open on the same database must be reopened with newSealer
+// after it is rotated.
+func (s *Store) RotateKey(newSealer Sealer) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	// Beginning the transaction takes the database write lock, so no other
+	// transaction in this store may write secrets until the key is rotated.
+	tx, err := s.beginTx(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	newTokenSealer := s.tokenSealer
+	if newTokenSealer == nil {
+		newTokenSealer = newSealer
+	}
+	ctx := context.Background()
+	q := s.prepared(tx)
+	rows, err := q.QueryContext(ctx, `select iface_id, key, device_token from secret.iface_secrets`)
+	if err != nil {
+		return errors.Wrap(err, "failed to query interface secrets")
+	}
+	type ifaceSecrets struct {
+		id               int64
+		key, deviceToken secret
+	}
+	var secrets []ifaceSecrets
+	for rows.Next() {
+		var sec ifaceSecrets
+		err := rows.Scan(&sec.id, &sec.key, &sec.deviceToken)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "failed to scan interface secrets")
+		}
+		secrets = append(secrets, sec)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to query interface secrets")
+	}
+	for _, sec := range secrets {
+		key, err := s.sealer.Open(sec.key)
+		if err != nil {
+			return withKind(ErrDecrypt, errors.Wrapf(err, "failed to decrypt key for interface %d", sec.id))
+		}
+		deviceToken, err := s.openDeviceToken(sec.deviceToken)
+		if err != nil {
+			return withKind(ErrDecrypt, errors.Wrapf(err, "failed to decrypt device token for interface %d", sec.id))
+		}
+		encKey, err := newSealer.Seal(key)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encrypt key for interface %d", sec.id)
+		}
+		encDeviceToken, err := newTokenSealer.Seal(deviceToken)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encrypt device token for interface %d", sec.id)
+		}
+		_, err = q.ExecContext(ctx, `
+update secret.iface_secrets set key = ?, device_token = ? where iface_id = ?`[1:],
+			encKey, encDeviceToken, sec.id)
+		if err != nil {
+			return errors.Wrapf(err, "failed to update secrets for interface %d", sec.id)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	s.sealer = newSealer
+	return nil
+}
+
+// deviceTokenSealer returns the sealer which encrypts device tokens. The
+// caller must hold mu.
+func (s *Store) deviceTokenSealer() Sealer {
+	if s.tokenSealer != nil {
+		return s.tokenSealer
+	}
+	return s.sealer
+}
+
+// openDeviceToken decrypts a device token with the token sealer, falling
+// back to the store sealer for tokens sealed before a separate token sealer
+// was used. The caller must hold mu.
+func (s *Store) openDeviceToken(sealed []byte) ([]byte, error) {
+	if s.tokenSealer == nil {
+		return s.sealer.Open(sealed)
+	}
+	deviceToken, err := s.tokenSealer.Open(sealed)
+	if err == nil {
+		return deviceToken, nil
+	}
+	deviceToken, fallbackErr := s.sealer.Open(sealed)
+	if fallbackErr != nil {
+		return nil, err
+	}
+	return deviceToken, nil
+}
+
+// ErrInvalidSealer indicates that a sealer cannot be used, such as an
+// all-zero Key, or one which cannot open the secrets it seals.
+var ErrInvalidSealer = errors.New("invalid sealer")
+
+// sealerSelfTestPlaintext is sealed and opened to test a sealer.
+var sealerSelfTestPlaintext = []byte("wiregarden sealer self-test")
+
+// selfTestSealer checks that sealer can seal and open a secret, so that a
+// broken key is reported when the store is opened rather than when the first
+// secret is read.
+func selfTestSealer(sealer Sealer) error {
+	if sealer == nil {
+		return errors.Wrap(ErrInvalidSealer, "missing sealer")
+	}
+	var zero Key
+	if k, ok := sealer.(Key); ok && k == zero {
+		return errors.Wrap(ErrInvalidSealer, "key is all zeros")
+	}
+	if k, ok := sealer.(*Key); ok && (k == nil || *k == zero) {
+		return errors.Wrap(ErrInvalidSealer, "key is all zeros")
+	}
+	sealed, err := sealer.Seal(sealerSelfTestPlaintext)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidSealer, "self-test failed to seal: %v", err)
+	}
+	opened, err := sealer.Open(sealed)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidSealer, "self-test failed to open: %v", err)
+	}
+	if !bytes.Equal(opened, sealerSelfTestPlaintext) {
+		return errors.Wrap(ErrInvalidSealer, "self-test opened the wrong plaintext")
+	}
+	return nil
+}
+
+// ErrInvalidApiUrl indicates that an interface's API URL is not an https
+// URL, or refers to a host which is not allowed by the store's options.
+var ErrInvalidApiUrl = errors.New("invalid API URL")
+
+// ValidateApiUrl checks that apiUrl is an https URL, or http if allowed,
+// referring to an allowed host. An empty URL is valid, for interfaces which
+// are not managed by a controller, such as those imported from wg-quick
+// configuration.
+//
+// Interfaces are checked when saved, but callers may check a URL sooner,
+// such as before joining a device with it, so that the device is not left
+// registered with a controller the store will not save.
+func (s *Store) ValidateApiUrl(apiUrl string) error {
+	if apiUrl == "" {
+		return nil
+	}
+	u, err := url.Parse(apiUrl)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidApiUrl, "%v", err)
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && s.insecureAllowHTTP:
+	case u.Scheme == "http":
+		return errors.Wrapf(ErrInvalidApiUrl, "%q is not https", apiUrl)
+	default:
+		return errors.Wrapf(ErrInvalidApiUrl, "%q has unsupported scheme %q", apiUrl, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.Wrapf(ErrInvalidApiUrl, "%q has no host", apiUrl)
+	}
+	if len(s.apiHosts) == 0 {
+		return nil
+	}
+	for _, host := range s.apiHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrInvalidApiUrl, "%q host %q is not allowed", apiUrl, u.Hostname())
+}
+
+// ErrListenPortInUse indicates that an interface cannot be stored because
+// another active interface listens on the same port.
+var ErrListenPortInUse = errors.New("listen port in use")
+
+// EnsureInterface creates or updates an interface. Interfaces are matched by
+// id, or if it is not set, by their device, network device name or public
+// key. Its listen port must not be used by any other active interface.
+// The interface's peers replace those stored, except for pinned peers,
+// which are kept whether or not they are given.
+func (s *Store) EnsureInterface(iface *Interface) error {
+	return s.EnsureInterfaceContext(context.Background(), iface)
+}
+
+// EnsureInterfaceContext is like EnsureInterface, but aborts if the context
+// is cancelled.
+func (s *Store) EnsureInterfaceContext(ctx context.Context, iface *Interface) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	err = s.ensureInterfaceTx(ctx, tx, iface)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	s.notify(Change{Id: iface.Id, Kind: ChangeSaved})
+	return nil
+}
+
+// EnsureInterfaces creates or updates several interfaces in a single
+// transaction, as EnsureInterface does. If any interface cannot be saved,
+// none of them are, and the interfaces are left unchanged.
+func (s *Store) EnsureInterfaces(ifaces []*Interface) error {
+	return s.EnsureInterfacesContext(context.Background(), ifaces)
+}
+
+// EnsureInterfacesContext is like EnsureInterfaces, but aborts if the context
+// is cancelled.
+func (s *Store) EnsureInterfacesContext(ctx context.Context, ifaces []*Interface) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	// Save copies, so that the ids and times assigned to the interfaces are
+	// only updated once they are committed.
+	saved := make([]Interface, len(ifaces))
+	for i := range ifaces {
+		saved[i] = *ifaces[i]
+		err = s.ensureInterfaceTx(ctx, tx, &saved[i])
+		if err != nil {
+			return errors.Wrapf(err, "failed to ensure interface %d of %d", i+1, len(ifaces))
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	changes := make([]Change, len(ifaces))
+	for i := range ifaces {
+		*ifaces[i] = saved[i]
+		changes[i] = Change{Id: saved[i].Id, Kind: ChangeSaved}
+	}
+	s.notify(changes...)
+	return nil
+}
+
+func (s *Store) EnsureInterfaceTx(tx *sql.Tx, iface *Interface) error {
+	return s.ensureInterfaceTx(context.Background(), tx, iface)
+}
+
+func (s *Store) ensureInterfaceTx(ctx context.Context, tx *sql.Tx, iface *Interface) error {
+	err := iface.validate()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	now := s.now().Unix()
+	q := s.prepared(tx)
+	id := sql.NullInt64{}
+	if iface.Id > 0 {
+		id.Valid = true
+		id.Int64 = iface.Id
+	} else {
+		// Because sqlite only upserts on one conflicting constraint, match
+		// the id of any other conflicts ahead of time.
+		err := q.QueryRowContext(ctx, `
+select id from iface where public_key = ? or device_id = ? or (net_name = ? and device_name = ?)
+`, iface.Device.PublicKey.String(), iface.Device.Id, iface.Network.Name, iface.Device.Name).Scan(&id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return errors.Wrap(err, "failed to query for existing interfaces")
+		}
+	}
+	// An interface keeps the API URL it was saved with even if the store's
+	// options would no longer allow it, so that it may still be refreshed.
+	var storedApiUrl sql.NullString
+	if id.Valid {
+		err := q.QueryRowContext(ctx, `select api_url from iface where id = ?`, id.Int64).Scan(&storedApiUrl)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return errors.Wrap(err, "failed to query interface API URL")
+		}
+	}
+	if !storedApiUrl.Valid || storedApiUrl.String != iface.ApiUrl {
+		err = s.ValidateApiUrl(iface.ApiUrl)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if !id.Valid && s.dialect.nextIdSql != "" {
+		err := q.QueryRowContext(ctx, s.dialect.nextIdSql).Scan(&id)
+		if err != nil {
+			return errors.Wrap(err, "failed to allocate interface id")
+		}
+	}
+	if iface.ListenPort != 0 {
+		var otherId int64
+		err := q.QueryRowContext(ctx, `
+select id from iface where listen_port = ? and id != ? and deleted_at is null`[1:],
+			iface.ListenPort, id.Int64).Scan(&otherId)
+		if err == nil {
+			return errors.Wrapf(ErrListenPortInUse, "port %d is used by interface %d", iface.ListenPort, otherId)
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return errors.Wrap(err, "failed to query for listen port conflicts")
+		}
+	}
+	endpointHost, endpointPort := splitEndpoint(iface.Device.Endpoint)
+	result, err := q.ExecContext(ctx, `
+insert into iface (
+	id, created_at, updated_at,
+	api_url,
+	net_id, net_name, net_cidr,
+	device_id, device_name, device_endpoint, endpoint_host, endpoint_port,
+	device_addr, public_key,
+	listen_port, subscription_id,
+	device_token_issued_at, device_token_expires_at,
+	machine_id
+)
+values (
+	?, ?, ?,
+	?,
+	?, ?, ?,
+	?, ?, ?, ?, ?,
+	?, ?,
+	?, ?,
+	?, ?,
+	?)
+on conflict (id) do update set
+	id = excluded.id,
+	updated_at = excluded.updated_at,
+	api_url = excluded.api_url,
+	net_id = excluded.net_id,
+	net_name = excluded.net_name,
+	net_cidr = excluded.net_cidr,
+	device_id = excluded.device_id,
+	device_name = excluded.device_name,
+	device_endpoint = excluded.device_endpoint,
+	endpoint_host = excluded.endpoint_host,
+	endpoint_port = excluded.endpoint_port,
+	device_addr = excluded.device_addr,
+	public_key = excluded.public_key,
+	listen_port = excluded.listen_port,
+	subscription_id = excluded.subscription_id,
+	device_token_issued_at = coalesce(excluded.device_token_issued_at, iface.device_token_issued_at),
+	device_token_expires_at = coalesce(excluded.device_token_expires_at, iface.device_token_expires_at),
+	machine_id = excluded.machine_id,
+	deleted_at = null;
+`[1:], id, now, now,
+		iface.ApiUrl,
+		iface.Network.Id, iface.Network.Name, iface.Network.CIDR.String(),
+		iface.Device.Id, iface.Device.Name,
+		iface.Device.Endpoint, endpointHost, endpointPort,
+		iface.Device.Addr.String(), iface.Device.PublicKey.String(),
+		iface.ListenPort, iface.SubscriptionId,
+		nullUnix(iface.DeviceTokenIssuedAt), nullUnix(iface.DeviceTokenExpiresAt),
+		hex.EncodeToString(iface.MachineId))
+	if err != nil {
+		return errors.Wrap(err, "failed to upsert interface")
+	}
+	if !id.Valid {
+		ifaceId, err := result.LastInsertId()
+		if err != nil {
+			return errors.Wrap(err, "failed to obtain new interface id")
+		}
+		iface.Id = ifaceId
+	} else {
+		iface.Id = id.Int64
+	}
+	var createdAt int64
+	err = q.QueryRowContext(ctx, `select created_at from iface where id = ?`, iface.Id).Scan(&createdAt)
+	if err != nil {
+		return errors.Wrap(err, "failed to query interface creation time")
+	}
+	iface.CreatedAt, iface.UpdatedAt = time.Unix(createdAt, 0), time.Unix(now, 0)
+	iface.ArchivedAt = nil
+	s.mu.RLock()
+	encKey, err := s.sealer.Seal(iface.Key)
+	if err != nil {
+		s.mu.RUnlock()
+		return errors.Wrap(err, "failed to encrypt key")
+	}
+	encDeviceToken, err := s.deviceTokenSealer().Seal(iface.DeviceToken)
+	s.mu.RUnlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt device token")
+	}
+	_, err = q.ExecContext(ctx, `
+insert into secret.iface_secrets (iface_id, key, device_token)
+values (?, ?, ?)
+on conflict (iface_id) do update set
+	iface_id = excluded.iface_id,
+	key = excluded.key,
+	device_token = excluded.device_token;
+`[1:], iface.Id, encKey, encDeviceToken)
+	if err != nil {
+		return errors.Wrap(err, "failed to upsert interface secrets")
+	}
+	_, err = q.ExecContext(ctx, `
+delete from device_endpoint
+where iface_id = ?
+and device_id not in (select device_id from peer where iface_id = ? and pinned)`[1:], iface.Id, iface.Id)
+	if err != nil {
+		return errors.Wrap(err, "failed to replace existing device endpoints")
+	}
+	err = insertEndpointsTx(ctx, q, iface.Id, &iface.Device)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = replacePeersTx(ctx, q, iface.Id, iface.Peers)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = recordPeerNamesTx(ctx, q, iface.Id, iface.Peers, now)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// AllocateListenPort returns the lowest port from min to max, inclusive, which
+// is not the listen port of an active interface.
+func (s *Store) AllocateListenPort(min, max int) (int, error) {
+	return s.AllocateListenPortContext(context.Background(), min, max)
+}
+
+// AllocateListenPortContext is like AllocateListenPort, but aborts if the
+// context is cancelled.
+func (s *Store) AllocateListenPortContext(ctx context.Context, min, max int) (int, error) {
+	if min < 1 || max > 65535 || min > max {
+		return 0, errors.Errorf("invalid listen port range %d-%d", min, max)
+	}
+	rows, err := s.prepared(nil).QueryContext(ctx, `
+select distinct listen_port from iface
+where listen_port between ? and ? and deleted_at is null
+order by listen_port`[1:], min, max)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to query listen ports")
+	}
+	defer rows.Close()
+	port := min
+	for rows.Next() {
+		var taken int
+		err := rows.Scan(&taken)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to scan listen port")
+		}
+		if taken > port {
+			break
+		}
+		port = taken + 1
+	}
+	if err := rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "failed to query listen ports")
+	}
+	if port > max {
+		return 0, errors.Wrapf(ErrListenPortInUse, "no listen port available in range %d-%d", min, max)
+	}
+	return port, nil
+}
+
+// replacePeersTx replaces the peers of an interface, along with their
+// endpoints. Pinned peers are kept as they are, and any of the given peers
+// with the same device id as a pinned peer are not inserted. The remaining
+// peers must not duplicate the address or public key of a pinned peer.
+func replacePeersTx(ctx context.Context, q querier, ifaceId int64, peers []api.Device) error {
+	_, err := q.ExecContext(ctx, `delete from peer where iface_id = ? and not pinned`, ifaceId)
+	if err != nil {
+		return errors.Wrap(err, "failed to replace existing peers")
+	}
+	_, err = q.ExecContext(ctx, `
+delete from device_endpoint
+where iface_id = ?
+and device_id != (select device_id from iface where id = ?)
+and device_id not in (select device_id from peer where iface_id = ? and pinned)`[1:], ifaceId, ifaceId, ifaceId)
+	if err != nil {
+		return errors.Wrap(err, "failed to replace existing peer endpoints")
+	}
+	pinned, err := pinnedPeersTx(ctx, q, ifaceId)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(pinned) > 0 {
+		dynamic := make([]api.Device, 0, len(peers))
+		for i := range peers {
+			if !pinned[peers[i].Id] {
+				dynamic = append(dynamic, peers[i])
+			}
+		}
+		peers = dynamic
+	}
+	err = checkPeersTx(ctx, q, ifaceId, peers)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return insertPeersTx(ctx, q, ifaceId, peers, false)
+}
+
+// insertPeersTx inserts peers of an interface, along with their endpoints.
+func insertPeersTx(ctx context.Context, q querier, ifaceId int64, peers []api.Device, pinned bool) error {
+	// Candidates are stored newline-separated, so they cannot be empty or
+	// contain newlines themselves.
+	for i := range peers {
+		for _, candidate := range peers[i].Candidates {
+			if candidate == "" || strings.Contains(candidate, "\n") {
+				return errors.Errorf("peer %q has invalid candidate endpoint %q", peers[i].Id, candidate)
+			}
+		}
+	}
+	// Insert peers in batches of rows per statement, staying under sqlite's
+	// default limit of 999 bound parameters.
+	for start := 0; start < len(peers); start += peerInsertBatchSize {
+		end := start + peerInsertBatchSize
+		if end > len(peers) {
+			end = len(peers)
+		}
+		batch := peers[start:end]
+		var args []interface{}
+		for i := range batch {
+			peerHost, peerPort := splitEndpoint(batch[i].Endpoint)
+			args = append(args,
+				ifaceId, batch[i].Id, batch[i].Name,
+				batch[i].Endpoint, peerHost, peerPort,
+				batch[i].Addr.String(), batch[i].PublicKey.String(),
+				formatAddresses(batch[i].AllowedIPs), batch[i].Keepalive,
+				strings.Join(batch[i].Candidates, "\n"), pinned)
+		}
+		_, err := q.ExecContext(ctx, `
+insert into peer (
+	iface_id, device_id, device_name,
+	device_endpoint, endpoint_host, endpoint_port,
+	device_addr, public_key, allowed_ips, keepalive_seconds,
+	candidates, pinned)
+values `[1:]+strings.TrimSuffix(strings.Repeat(`(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?), `, len(batch)), `, `),
+			args...)
+		if err != nil {
+			return errors.Wrapf(err, "failed to insert peers %q through %q", batch[0].Id, batch[len(batch)-1].Id)
+		}
+	}
+	for i := range peers {
+		err := insertEndpointsTx(ctx, q, ifaceId, &peers[i])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// formatAddresses formats addresses as a comma-separated list for storing
+// in a text column.
+func formatAddresses(addrs []wireguard.Address) string {
+	texts := make([]string, len(addrs))
+	for i := range addrs {
+		texts[i] = addrs[i].String()
+	}
+	return strings.Join(texts, ",")
+}
+
+// parseAddresses parses a list of addresses stored by formatAddresses.
+func parseAddresses(s string) ([]wireguard.Address, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var addrs []wireguard.Address
+	for _, text := range strings.Split(s, ",") {
+		addr, err := wireguard.ParseAddress(text)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		addrs = append(addrs, *addr)
+	}
+	return addrs, nil
+}
+
+// peerInsertBatchSize is the number of peers inserted per statement. Each
+// peer binds 12 parameters.
+const peerInsertBatchSize = 80
+
+func insertEndpointsTx(ctx context.Context, q querier, ifaceId int64, device *api.Device) error {
+	for _, endpoint := range device.Endpoints {
+		_, err := q.ExecContext(ctx, `
+insert into device_endpoint (iface_id, device_id, endpoint, priority)
+values (?, ?, ?, ?)`[1:],
+			ifaceId, device.Id, endpoint.Endpoint, endpoint.Priority)
+		if err != nil {
+			return errors.Wrapf(err, "failed to insert endpoint for device %q", device.Id)
+		}
+	}
+	return nil
+}
+
+// UpdatePeers replaces the peers of an interface, leaving the rest of the
+// interface unchanged. Pinned peers are kept, see PinPeer. If the interface
+// does not exist, an error wrapping sql.ErrNoRows is returned.
+func (s *Store) UpdatePeers(ifaceId int64, peers []api.Device) error {
+	return s.UpdatePeersContext(context.Background(), ifaceId, peers)
+}
+
+// UpdatePeersContext is like UpdatePeers, but aborts if the context is
+// cancelled.
+func (s *Store) UpdatePeersContext(ctx context.Context, ifaceId int64, peers []api.Device) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	now := s.now().Unix()
+	result, err := s.prepared(tx).ExecContext(ctx, `update iface set updated_at = ? where id = ?`, now, ifaceId)
+	if err != nil {
+		return errors.Wrapf(err, "failed to update peers of interface %d", ifaceId)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to update peers of interface %d", ifaceId)
+	}
+	if n == 0 {
+		return errors.Wrapf(sql.ErrNoRows, "failed to update peers of interface %d", ifaceId)
+	}
+	err = replacePeersTx(ctx, s.prepared(tx), ifaceId, peers)
+	if err != nil {
+		return errors.Wrapf(err, "failed to update peers of interface %d", ifaceId)
+	}
+	err = recordPeerNamesTx(ctx, s.prepared(tx), ifaceId, peers, now)
+	if err != nil {
+		return errors.Wrapf(err, "failed to update peers of interface %d", ifaceId)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+// ReKeyInterface replaces the WireGuard key pair of an interface's device,
+// leaving the rest of the interface unchanged. If the public key is already
+// used by another interface, an error is returned and the interface is not
+// changed. If the interface does not exist, an error wrapping sql.ErrNoRows
+// is returned.
+func (s *Store) ReKeyInterface(id int64, newPrivKey []byte, newPubKey wireguard.Key) error {
+	return s.ReKeyInterfaceContext(context.Background(), id, newPrivKey, newPubKey)
+}
+
+// ReKeyInterfaceContext is like ReKeyInterface, but aborts if the context is
+// cancelled.
+func (s *Store) ReKeyInterfaceContext(ctx context.Context, id int64, newPrivKey []byte, newPubKey wireguard.Key) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	q := s.prepared(tx)
+	var otherId int64
+	err = q.QueryRowContext(ctx, `
+select id from iface where public_key = ? and id != ?`[1:], newPubKey.String(), id).Scan(&otherId)
+	if err == nil {
+		return errors.Errorf("cannot rekey interface %d, public key %q is used by interface %d", id, newPubKey.String(), otherId)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrapf(err, "failed to rekey interface %d", id)
+	}
+	result, err := q.ExecContext(ctx, `
+update iface set public_key = ?, updated_at = ? where id = ?`[1:], newPubKey.String(), s.now().Unix(), id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to rekey interface %d", id)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to rekey interface %d", id)
+	}
+	if n == 0 {
+		return errors.Wrapf(sql.ErrNoRows, "failed to rekey interface %d", id)
+	}
+	s.mu.RLock()
+	encKey, err := s.sealer.Seal(newPrivKey)
+	s.mu.RUnlock()
+	if err != nil {
+		return errors.Wrapf(err, "failed to encrypt key for interface %d", id)
+	}
+	_, err = q.ExecContext(ctx, `
+update secret.iface_secrets set key = ? where iface_id = ?`[1:], encKey, id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to rekey interface %d", id)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+// SetDeviceEndpoint updates the endpoint of a peer device of an interface,
+// leaving the rest of the interface unchanged. The endpoint must be a
+// host:port. If the interface has no such peer, an error wrapping
+// sql.ErrNoRows is returned.
+func (s *Store) SetDeviceEndpoint(ifaceId int64, deviceId string, endpoint string) error {
+	return s.SetDeviceEndpointContext(context.Background(), ifaceId, deviceId, endpoint)
+}
+
+// SetDeviceEndpointContext is like SetDeviceEndpoint, but aborts if the
+// context is cancelled.
+func (s *Store) SetDeviceEndpointContext(ctx context.Context, ifaceId int64, deviceId string, endpoint string) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	_, _, err = net.SplitHostPort(endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "invalid endpoint %q for device %q", endpoint, deviceId)
+	}
+	endpointHost, endpointPort := splitEndpoint(endpoint)
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	result, err := s.prepared(tx).ExecContext(ctx, `
+update peer set device_endpoint = ?, endpoint_host = ?, endpoint_port = ?
+where iface_id = ? and device_id = ?`[1:], endpoint, endpointHost, endpointPort, ifaceId, deviceId)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set endpoint of device %q in interface %d", deviceId, ifaceId)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to set endpoint of device %q in interface %d", deviceId, ifaceId)
+	}
+	if n == 0 {
+		return errors.Wrapf(sql.ErrNoRows, "failed to set endpoint of device %q in interface %d", deviceId, ifaceId)
+	}
+	_, err = s.prepared(tx).ExecContext(ctx, `update iface set updated_at = ? where id = ?`, s.now().Unix(), ifaceId)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set endpoint of device %q in interface %d", deviceId, ifaceId)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+// RebindEndpoint updates the endpoint of an interface's own device, such as
+// when the host's public address changes, leaving its peers and secrets
+// unchanged. The endpoint must be a host:port. If the interface does not
+// exist, an error wrapping sql.ErrNoRows is returned.
+func (s *Store) RebindEndpoint(id int64, endpoint string) error {
+	return s.RebindEndpointContext(context.Background(), id, endpoint)
+}
+
+// RebindEndpointContext is like RebindEndpoint, but aborts if the context is
+// cancelled.
+func (s *Store) RebindEndpointContext(ctx context.Context, id int64, endpoint string) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	_, _, err = net.SplitHostPort(endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "invalid endpoint %q for interface %d", endpoint, id)
+	}
+	endpointHost, endpointPort := splitEndpoint(endpoint)
+	result, err := s.prepared(nil).ExecContext(ctx, `
+update iface set device_endpoint = ?, endpoint_host = ?, endpoint_port = ?, updated_at = ?
+where id = ?`[1:], endpoint, endpointHost, endpointPort, s.now().Unix(), id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to rebind endpoint of interface %d", id)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to rebind endpoint of interface %d", id)
+	}
+	if n == 0 {
+		return errors.Wrapf(sql.ErrNoRows, "failed to rebind endpoint of interface %d", id)
+	}
+	return nil
+}
+
+// ErrDeviceNameInUse indicates that an interface cannot be moved to a network
+// because another interface has the same device name in it.
+var ErrDeviceNameInUse = errors.New("device name in use")
+
+// MoveInterfaceToNetwork moves an interface to another network, such as one
+// which has been renamed, keeping its device, peers and secrets. The
+// addresses of the device and its peers must be within the new network's
+// CIDR. If another interface has the same device name in the new network,
+// an error wrapping ErrDeviceNameInUse is returned. If the interface does
+// not exist, an error wrapping ErrInterfaceNotFound is returned.
+func (s *Store) MoveInterfaceToNetwork(id int64, newNet api.Network) error {
+	return s.MoveInterfaceToNetworkContext(context.Background(), id, newNet)
+}
+
+// MoveInterfaceToNetworkContext is like MoveInterfaceToNetwork, but aborts if
+// the context is cancelled.
+func (s *Store) MoveInterfaceToNetworkContext(ctx context.Context, id int64, newNet api.Network) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	q := s.prepared(tx)
+	var deviceName, deviceAddrText string
+	err = q.QueryRowContext(ctx, `select device_name, device_addr from iface where id = ?`, id).Scan(&deviceName, &deviceAddrText)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrapf(ErrInterfaceNotFound, "failed to move interface %d", id)
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to move interface %d", id)
+	}
+	network := &newNet.CIDR
+	deviceAddr, err := wireguard.ParseAddress(deviceAddrText)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse device address %q of interface %d", deviceAddrText, id)
+	}
+	if !network.ContainsIP(*deviceAddr) {
+		return errors.Errorf("failed to move interface %d: device address %q is not in network %q CIDR %q",
+			id, deviceAddrText, newNet.Name, network.CIDR().String())
+	}
+	rows, err := q.QueryContext(ctx, `select device_id, device_addr from peer where iface_id = ?`, id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query peers of interface %d", id)
+	}
+	for rows.Next() {
+		var peerId, peerAddrText string
+		err := rows.Scan(&peerId, &peerAddrText)
+		if err != nil {
+			rows.Close()
+			return errors.Wrapf(err, "failed to scan peer of interface %d", id)
+		}
+		peerAddr, err := wireguard.ParseAddress(peerAddrText)
+		if err != nil {
+			rows.Close()
+			return errors.Wrapf(err, "failed to parse peer %q address %q of interface %d", peerId, peerAddrText, id)
+		}
+		if !network.ContainsIP(*peerAddr) {
+			rows.Close()
+			return errors.Errorf("failed to move interface %d: peer %q address %q is not in network %q CIDR %q",
+				id, peerId, peerAddrText, newNet.Name, network.CIDR().String())
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrapf(err, "failed to query peers of interface %d", id)
+	}
+	var otherId int64
+	err = q.QueryRowContext(ctx, `
+select id from iface where net_name = ? and device_name = ? and id != ?`[1:],
+		newNet.Name, deviceName, id).Scan(&otherId)
+	if err == nil {
+		return errors.Wrapf(ErrDeviceNameInUse, "failed to move interface %d: device %q is interface %d in network %q",
+			id, deviceName, otherId, newNet.Name)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrap(err, "failed to query for device name conflicts")
+	}
+	_, err = q.ExecContext(ctx, `
+update iface set net_id = ?, net_name = ?, net_cidr = ?, updated_at = ?
+where id = ?`[1:], newNet.Id, newNet.Name, newNet.CIDR.String(), s.now().Unix(), id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to move interface %d", id)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+// Touch marks an interface as updated now, such as when it has been seen to
+// be live, without rewriting the rest of the interface or its secrets.
+func (s *Store) Touch(id int64) error {
+	return s.TouchContext(context.Background(), id)
+}
+
+// TouchContext is like Touch, but aborts if the context is cancelled.
+func (s *Store) TouchContext(ctx context.Context, id int64) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	result, err := s.prepared(nil).ExecContext(ctx, `update iface set updated_at = ? where id = ?`, s.now().Unix(), id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to touch interface %d", id)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to touch interface %d", id)
+	}
+	if n == 0 {
+		return errors.Wrapf(sql.ErrNoRows, "failed to touch interface %d", id)
+	}
+	return nil
+}
+
+// Interface returns the interface with the given id. If there is no such
+// interface, an error wrapping ErrInterfaceNotFound is returned, or if its
+// secrets cannot be decrypted, an error wrapping ErrDecrypt.
+func (s *Store) Interface(id int64) (*Interface, error) {
+	return s.InterfaceContext(context.Background(), id)
+}
+
+// InterfaceContext is like Interface, but aborts if the context is
+// cancelled.
+func (s *Store) InterfaceContext(ctx context.Context, id int64) (*Interface, error) {
+	result, err := s.queryInterfaces(ctx, s.prepared(nil), ` where i.id = ?`, id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query interface %q", id)
+	}
+	if len(result) == 0 {
+		return nil, errors.Wrapf(ErrInterfaceNotFound, "failed to query interface %q", id)
+	}
+	return &result[0].Interface, nil
+}
+
+// DeviceTokenFor returns the decrypted device token of the interface with
+// the given id, without loading its peers or decrypting its private key, such
+// as for authenticating API requests on its behalf. If there is no such
+// interface, an error wrapping ErrInterfaceNotFound is returned, or if the
+// token cannot be decrypted, an error wrapping ErrDecrypt.
+func (s *Store) DeviceTokenFor(id int64) ([]byte, error) {
+	return s.DeviceTokenForContext(context.Background(), id)
+}
+
+// DeviceTokenForContext is like DeviceTokenFor, but aborts if the context is
+// cancelled.
+func (s *Store) DeviceTokenForContext(ctx context.Context, id int64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var sealed []byte
+	err := s.prepared(nil).QueryRowContext(ctx, `
+select s.device_token from iface i
+join secret.iface_secrets s on (s.iface_id = i.id)
+where i.id = ?`[1:], id).Scan(&sealed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.Wrapf(ErrInterfaceNotFound, "failed to query device token of interface %d", id)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to query device token of interface %d", id)
+	}
+	deviceToken, err := s.openDeviceToken(sealed)
+	if err != nil {
+		return nil, withKind(ErrDecrypt, errors.Wrapf(err, "failed to decrypt device token of interface %d", id))
+	}
+	return deviceToken, nil
+}
+
+// querier runs queries on a database or in a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// prepared returns a querier which runs queries with statements prepared
+// once and cached by the store, rebinding their placeholders for the store's
+// dialect. Queries are run in tx if it is not nil.
+func (s *Store) prepared(tx *sql.Tx) querier {
+	return &preparedQuerier{s: s, tx: tx}
+}
+
+// prepare returns the cached statement for query, preparing it if it has
+// not been used before.
+//
+// The statement is prepared without holding stmtsMu, as preparing it may
+// wait for a connection to be released.
+func (s *Store) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	if stmt := s.cachedStmt(query); stmt != nil {
+		return stmt, nil
+	}
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.rebind(query))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare statement")
+	}
+	return s.cacheStmt(query, stmt)
+}
+
+// cachedStmt returns the cached statement for query, or nil if it has not
+// been prepared.
+func (s *Store) cachedStmt(query string) *sql.Stmt {
+	s.stmtsMu.Lock()
+	defer s.stmtsMu.Unlock()
+	return s.stmts[query]
+}
+
+// cacheStmt caches stmt, prepared for query, and returns it. If another
+// statement was cached for query while stmt was being prepared, stmt is
+// closed and the cached statement is returned instead.
+func (s *Store) cacheStmt(query string, stmt *sql.Stmt) (*sql.Stmt, error) {
+	s.stmtsMu.Lock()
+	defer s.stmtsMu.Unlock()
+	// Close empties the cache after the store is marked closed, so a
+	// statement cached after that would never be closed.
+	if err := s.checkOpen(); err != nil {
+		stmt.Close()
+		return nil, errors.WithStack(err)
+	}
+	if cached, ok := s.stmts[query]; ok {
+		stmt.Close()
+		return cached, nil
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
+// warmStmt prepares and caches the statement for query in the background,
+// unless it is already being prepared.
+func (s *Store) warmStmt(query string) {
+	s.stmtsMu.Lock()
+	defer s.stmtsMu.Unlock()
+	if _, ok := s.stmts[query]; ok || s.warming[query] || s.checkOpen() != nil {
+		return
+	}
+	s.warming[query] = true
+	s.warmWg.Add(1)
+	go func() {
+		defer s.warmWg.Done()
+		defer func() {
+			s.stmtsMu.Lock()
+			delete(s.warming, query)
+			s.stmtsMu.Unlock()
+		}()
+		// Failures are not reported, as the statement will be prepared
+		// again when it is next used.
+		s.prepare(context.Background(), query)
+	}()
+}
+
+// checkOpen returns ErrStoreClosed if the store has been closed.
+func (s *Store) checkOpen() error {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return ErrStoreClosed
+	}
+	return nil
+}
+
+// beginTx begins a transaction, unless the store has been closed.
+func (s *Store) beginTx(ctx context.Context) (*sql.Tx, error) {
+	err := s.checkOpen()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return s.db.BeginTx(ctx, nil)
+}
+
+// closedDB fails every query with ErrStoreClosed, for queries on a closed
+// store which must return a row.
+var closedDB = sql.OpenDB(closedConnector{})
+
+type closedConnector struct{}
+
+func (closedConnector) Connect(context.Context) (driver.Conn, error) {
+	return nil, ErrStoreClosed
+}
+
+func (closedConnector) Driver() driver.Driver {
+	return closedDriver{}
+}
+
+type closedDriver struct{}
+
+func (closedDriver) Open(string) (driver.Conn, error) {
+	return nil, ErrStoreClosed
+}
+
+type preparedQuerier struct {
+	s  *Store
+	tx *sql.Tx
+}
+
+func (q *preparedQuerier) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	err := q.s.checkOpen()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if q.tx == nil {
+		stmt, err := q.s.prepare(ctx, query)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return stmt, nil
+	}
+	if stmt := q.s.cachedStmt(query); stmt != nil {
+		return q.tx.StmtContext(ctx, stmt), nil
+	}
+	// Preparing on the database may need a connection of its own, which
+	// would wait forever if this and other transactions hold the rest.
+	// Prepare the statement for the transaction only, and cache it for
+	// later use once a connection is free.
+	q.s.warmStmt(query)
+	stmt, err := q.tx.PrepareContext(ctx, q.s.dialect.rebind(query))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare statement")
+	}
+	return stmt, nil
+}
+
+func (q *preparedQuerier) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := q.stmt(ctx, query)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (q *preparedQuerier) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := q.stmt(ctx, query)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+func (q *preparedQuerier) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	stmt, err := q.stmt(ctx, query)
+	if err != nil {
+		// A row cannot be constructed with an error, so run the query
+		// unprepared for it to fail the same way when scanned.
+		if q.tx == nil && errors.Is(err, ErrStoreClosed) {
+			return closedDB.QueryRowContext(ctx, query, args...)
+		}
+		if q.tx != nil {
+			return q.tx.QueryRowContext(ctx, q.s.dialect.rebind(query), args...)
+		}
+		return q.s.db.QueryRowContext(ctx, q.s.dialect.rebind(query), args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+// interfacesFrom joins each interface i with its secrets s and its most
+// recent log entry l, if it has any.
+const interfacesFrom = `
+from iface i
+join secret.iface_secrets s on (i.id = s.iface_id)
+left join iface_log l on (l.id = (
+	select max(id) from iface_log where iface_id = i.id
+))`
+
+// queryInterfaces returns the interfaces selected by the given where and
+// order clauses on iface i, its secrets s and its most recent log entry l,
+// along with that log entry. Interfaces without any log entries have a zero
+// log.
+//
+// Interfaces, their peers and their device endpoints are each fetched in a
+// single query, regardless of how many interfaces are selected.
+func (s *Store) queryInterfaces(ctx context.Context, q querier, clauses string, args ...interface{}) ([]InterfaceWithLog, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := q.QueryContext(ctx, `
+select
+	i.id, i.api_url,
+	i.net_id, i.net_name, i.net_cidr,
+	i.device_id, i.device_name, i.endpoint_host, i.endpoint_port, i.device_addr, i.public_key,
+	i.listen_port, i.subscription_id, s.key, s.device_token,
+	i.created_at, i.updated_at, i.deleted_at,
+	i.device_token_issued_at, i.device_token_expires_at, i.machine_id,
+	l.id, l.ts, l.operation, l.state, l.dirty, l.message`[1:]+interfacesFrom+clauses, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query interfaces")
+	}
+	var result []InterfaceWithLog
+	for rows.Next() {
+		ifaceLog, err := s.scanInterface(rows)
+		if err != nil {
+			rows.Close()
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, *ifaceLog)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to query interfaces")
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	byId := map[int64]*Interface{}
+	for i := range result {
+		byId[result[i].Id] = &result[i].Interface
+	}
+	selected := ` where iface_id in (select i.id` + interfacesFrom + clauses + `)`
+	err = queryPeers(ctx, q, byId, selected, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = queryEndpoints(ctx, q, byId, selected, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = queryLabels(ctx, q, byId, selected, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = querySelectedEndpoints(ctx, q, byId, selected, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+func (s *Store) scanInterface(rows *sql.Rows) (*InterfaceWithLog, error) {
+	var (
+		ifaceLog                                   InterfaceWithLog
+		iface                                      = &ifaceLog.Interface
+		netCIDRText, deviceAddrText, publicKeyText string
+		endpointHost                               string
+		endpointPort                               int
+		keyBytes                                   []byte
+		deviceTokenBytes                           []byte
+		createdAt, updatedAt, deletedAt            sql.NullInt64
+		tokenIssuedAt, tokenExpiresAt              sql.NullInt64
+		machineIdText                              string
+		logId, logTs                               sql.NullInt64
+		logOperation, logState                     sql.NullString
+		logDirty                                   sql.NullBool
+		logMessage                                 sql.NullString
+	)
+	err := rows.Scan(
+		&iface.Id, &iface.ApiUrl,
+		&iface.Network.Id, &iface.Network.Name, &netCIDRText,
+		&iface.Device.Id, &iface.Device.Name, &endpointHost, &endpointPort, &deviceAddrText, &publicKeyText,
+		&iface.ListenPort, &iface.SubscriptionId, &keyBytes, &deviceTokenBytes,
+		&createdAt, &updatedAt, &deletedAt,
+		&tokenIssuedAt, &tokenExpiresAt, &machineIdText,
+		&logId, &logTs, &logOperation, &logState, &logDirty, &logMessage)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to scan interface result row")
+	}
+	iface.Device.Endpoint = joinEndpoint(endpointHost, endpointPort)
+	iface.CreatedAt, iface.UpdatedAt = time.Unix(createdAt.Int64, 0), time.Unix(updatedAt.Int64, 0)
+	iface.ArchivedAt = unixTime(deletedAt)
+	iface.DeviceTokenIssuedAt = unixTime(tokenIssuedAt)
+	iface.DeviceTokenExpiresAt = unixTime(tokenExpiresAt)
+	if machineIdText != "" {
+		iface.MachineId, err = hex.DecodeString(machineIdText)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query interface: invalid machine id %q", machineIdText)
+		}
+	}
+	// parse net cidr
+	netCIDR, err := wireguard.ParseAddress(netCIDRText)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query interface: invalid network CIDR %q", netCIDRText)
+	}
+	iface.Network.CIDR = *netCIDR
+	// parse device addr
+	deviceAddr, err := wireguard.ParseAddress(deviceAddrText)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query interface: invalid device address %q", deviceAddrText)
+	}
+	iface.Device.Addr = *deviceAddr
+	// parse public key
+	publicKey, err := wireguard.ParseKey(publicKeyText)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query interface: invalid public key %q", publicKeyText)
+	}
+	iface.Device.PublicKey = publicKey
+	// decrypt key
+	keyDecrypted, err := s.sealer.Open(keyBytes)
+	if err != nil {
+		return nil, withKind(ErrDecrypt, errors.Wrap(err, "failed to query interface: failed to decrypt key"))
+	}
+	iface.Key = keyDecrypted
+	// decrypt device token
+	deviceToken, err := s.openDeviceToken(deviceTokenBytes)
+	if err != nil {
+		return nil, withKind(ErrDecrypt, errors.Wrap(err, "failed to query interface: failed to decrypt device token"))
+	}
+	iface.DeviceToken = deviceToken
+	if logId.Valid {
+		ifaceLog.Log = InterfaceLog{
+			Id:        logId.Int64,
+			Timestamp: time.Unix(logTs.Int64, 0),
+			Operation: Operation(logOperation.String),
+			State:     State(logState.String),
+			Dirty:     logDirty.Bool,
+			Message:   logMessage.String,
+		}
+	}
+	return &ifaceLog, nil
+}
+
+// ListPeers returns the peers of an interface, without loading or
+// decrypting the rest of the interface. If the interface does not exist, an
+// error wrapping sql.ErrNoRows is returned.
+func (s *Store) ListPeers(ifaceId int64) ([]api.Device, error) {
+	return s.ListPeersContext(context.Background(), ifaceId)
+}
+
+// ListPeersContext is like ListPeers, but aborts if the context is
+// cancelled.
+func (s *Store) ListPeersContext(ctx context.Context, ifaceId int64) ([]api.Device, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	// Only the interface id is needed to match peers and their endpoints.
+	iface := &Interface{Id: ifaceId}
+	byId := map[int64]*Interface{ifaceId: iface}
+	err = queryPeers(ctx, tx, byId, ` where iface_id = ?`, ifaceId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list peers of interface %d", ifaceId)
+	}
+	if len(iface.Peers) == 0 {
+		var exists bool
+		err := s.prepared(tx).QueryRowContext(ctx, `select exists(select 1 from iface where id = ?)`, ifaceId).Scan(&exists)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list peers of interface %d", ifaceId)
+		}
+		if !exists {
+			return nil, errors.Wrapf(sql.ErrNoRows, "failed to list peers of interface %d", ifaceId)
+		}
+		return nil, nil
+	}
+	err = queryEndpoints(ctx, tx, byId, ` where iface_id = ?`, ifaceId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list peers of interface %d", ifaceId)
+	}
+	return iface.Peers, nil
+}
+
+// queryPeers adds the peers of the selected interfaces to the interfaces by
+// id.
+func queryPeers(ctx context.Context, q querier, byId map[int64]*Interface, selected string, args ...interface{}) error {
+	rows, err := q.QueryContext(ctx, `
+select
+	iface_id, device_id, device_name, endpoint_host, endpoint_port, device_addr, public_key, allowed_ips, keepalive_seconds,
+	candidates
+from peer`[1:]+selected+`
+order by rowid`, args...)
+	if err != nil {
+		return errors.Wrap(err, "failed to query peers")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ifaceId int64
+		var peer api.Device
+		var peerHost, peerAddrText, peerKeyText, allowedIPsText, candidatesText string
+		var peerPort int
+		err := rows.Scan(&ifaceId, &peer.Id, &peer.Name, &peerHost, &peerPort, &peerAddrText, &peerKeyText, &allowedIPsText, &peer.Keepalive, &candidatesText)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan peer result row")
+		}
+		peer.Endpoint = joinEndpoint(peerHost, peerPort)
+		peerAddr, err := wireguard.ParseAddress(peerAddrText)
+		if err != nil {
+			return errors.Wrapf(err, "failed to query interface: invalid peer address %q", peerAddrText)
+		}
+		peer.Addr = *peerAddr
+		peerKey, err := wireguard.ParseKey(peerKeyText)
+		if err != nil {
+			return errors.Wrapf(err, "failed to query interface: invalid public key %q", peerKeyText)
+		}
+		peer.PublicKey = peerKey
+		peer.AllowedIPs, err = parseAddresses(allowedIPsText)
+		if err != nil {
+			return errors.Wrapf(err, "failed to query interface: invalid peer allowed IPs %q", allowedIPsText)
+		}
+		if candidatesText != "" {
+			peer.Candidates = strings.Split(candidatesText, "\n")
+		}
+		if iface, ok := byId[ifaceId]; ok {
+			iface.Peers = append(iface.Peers, peer)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to query peers")
+	}
+	return nil
+}
+
+// queryLabels adds the labels of the selected interfaces to the interfaces
+// by id.
+func queryLabels(ctx context.Context, q querier, byId map[int64]*Interface, selected string, args ...interface{}) error {
+	rows, err := q.QueryContext(ctx, `
+select iface_id, key, value
+from iface_label`[1:]+selected, args...)
+	if err != nil {
+		return errors.Wrap(err, "failed to query labels")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ifaceId int64
+		var key, value string
+		err := rows.Scan(&ifaceId, &key, &value)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan label result row")
+		}
+		iface, ok := byId[ifaceId]
+		if !ok {
+			continue
+		}
+		if iface.Labels == nil {
+			iface.Labels = map[string]string{}
+		}
+		iface.Labels[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to query labels")
+	}
+	return nil
+}
+
+// queryEndpoints adds the prioritized endpoints of the selected interfaces'
+// devices and peers to the interfaces by id.
+func queryEndpoints(ctx context.Context, q querier, byId map[int64]*Interface, selected string, args ...interface{}) error {
+	rows, err := q.QueryContext(ctx, `
+select iface_id, device_id, endpoint, priority
+from device_endpoint`[1:]+selected+`
+order by rowid`, args...)
+	if err != nil {
+		return errors.Wrap(err, "failed to query device endpoints")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ifaceId int64
+		var deviceId string
+		var endpoint api.Endpoint
+		err := rows.Scan(&ifaceId, &deviceId, &endpoint.Endpoint, &endpoint.Priority)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan device endpoint result row")
+		}
+		iface, ok := byId[ifaceId]
+		if !ok {
+			continue
+		}
+		if deviceId == iface.Device.Id {
+			iface.Device.Endpoints = append(iface.Device.Endpoints, endpoint)
+		}
+		for i := range iface.Peers {
+			if deviceId == iface.Peers[i].Id {
+				iface.Peers[i].Endpoints = append(iface.Peers[i].Endpoints, endpoint)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to query device endpoints")
+	}
+	return nil
+}
+
+// LookupOptions configure how interfaces are looked up.
+type LookupOptions struct {
+	// IncludeArchived looks up archived interfaces as well as active ones.
+	IncludeArchived bool
+}
+
+// LookupOption sets an option on how interfaces are looked up.
+type LookupOption func(*LookupOptions)
+
+// IncludeArchived looks up archived interfaces as well as active ones.
+func IncludeArchived(o *LookupOptions) {
+	o.IncludeArchived = true
+}
+
+// archivedClause returns a condition on iface i which excludes archived
+// interfaces, unless they are included by the options.
+func archivedClause(options []LookupOption) string {
+	var opts LookupOptions
+	for i := range options {
+		options[i](&opts)
+	}
+	if opts.IncludeArchived {
+		return ""
+	}
+	return " and i.deleted_at is null"
+}
+
+// InterfaceByDevice returns the interface for a device name in a network.
+// Archived interfaces are not found unless the IncludeArchived option is
+// given. If there is no such interface, an error wrapping
+// ErrInterfaceNotFound is returned.
+func (s *Store) InterfaceByDevice(deviceName, networkName string, options ...LookupOption) (*Interface, error) {
+	return s.InterfaceByDeviceContext(context.Background(), deviceName, networkName, options...)
+}
+
+// InterfaceByDeviceContext is like InterfaceByDevice, but aborts if the
+// context is cancelled.
+func (s *Store) InterfaceByDeviceContext(ctx context.Context, deviceName, networkName string, options ...LookupOption) (*Interface, error) {
+	var id int64
+	err := s.prepared(nil).QueryRowContext(ctx, `
+select i.id from iface i
+where i.device_name = ? and i.net_name = ?`[1:]+archivedClause(options), deviceName, networkName).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.Wrapf(ErrInterfaceNotFound, "failed to query interface device name %q network name %q", deviceName, networkName)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to query interface device name %q network name %q", deviceName, networkName)
+	}
+	iface, err := s.InterfaceContext(ctx, id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return iface, nil
+}
+
+// InterfaceExists returns whether there is an interface for a device name in
+// a network, without loading or decrypting it. Archived interfaces are not
+// found unless the IncludeArchived option is given.
+func (s *Store) InterfaceExists(deviceName, networkName string, options ...LookupOption) (bool, error) {
+	return s.InterfaceExistsContext(context.Background(), deviceName, networkName, options...)
+}
+
+// InterfaceExistsContext is like InterfaceExists, but aborts if the context
+// is cancelled.
+func (s *Store) InterfaceExistsContext(ctx context.Context, deviceName, networkName string, options ...LookupOption) (bool, error) {
+	var exists bool
+	err := s.prepared(nil).QueryRowContext(ctx, `
+select exists (
+select 1 from iface i
+where i.device_name = ? and i.net_name = ?`[1:]+archivedClause(options)+`)`, deviceName, networkName).Scan(&exists)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to query interface device name %q network name %q", deviceName, networkName)
+	}
+	return exists, nil
+}
+
+// InterfaceByPublicKey returns the interface whose device has the given
+// public key. If there is no such interface, an error wrapping
+// ErrInterfaceNotFound is returned.
+func (s *Store) InterfaceByPublicKey(key wireguard.Key) (*Interface, error) {
+	return s.InterfaceByPublicKeyContext(context.Background(), key)
+}
+
+// InterfaceByPublicKeyContext is like InterfaceByPublicKey, but aborts if the
+// context is cancelled.
+func (s *Store) InterfaceByPublicKeyContext(ctx context.Context, key wireguard.Key) (*Interface, error) {
+	var id int64
+	err := s.prepared(nil).QueryRowContext(ctx, `
+select id from iface
+where public_key = ?`[1:], key.String()).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.Wrapf(ErrInterfaceNotFound, "failed to query interface public key %q", key.String())
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to query interface public key %q", key.String())
+	}
+	iface, err := s.InterfaceContext(ctx, id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return iface, nil
+}
+
+// DeleteInterface removes an interface along with its peers, secrets and
+// logs. If the interface does not exist, an error wrapping sql.ErrNoRows is
+// returned.
+func (s *Store) DeleteInterface(id int64) error {
+	return s.DeleteInterfaceContext(context.Background(), id)
+}
+
+// DeleteInterfaceContext is like DeleteInterface, but aborts if the context
+// is cancelled.
+func (s *Store) DeleteInterfaceContext(ctx context.Context, id int64) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	err = deleteInterfaceTx(ctx, s.prepared(tx), id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	s.notify(Change{Id: id, Kind: ChangeDeleted})
+	return nil
+}
+
+// SetLabel sets a label on an interface, replacing any existing value for
+// the key. If the interface does not exist, an error wrapping
+// ErrInterfaceNotFound is returned.
+func (s *Store) SetLabel(ifaceId int64, key, value string) error {
+	return s.SetLabelContext(context.Background(), ifaceId, key, value)
+}
+
+// SetLabelContext is like SetLabel, but aborts if the context is cancelled.
+func (s *Store) SetLabelContext(ctx context.Context, ifaceId int64, key, value string) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	if key == "" {
+		return errors.Errorf("cannot set label on interface %d: missing key", ifaceId)
+	}
+	result, err := s.prepared(nil).ExecContext(ctx, `
+insert into iface_label (iface_id, key, value)
+select id, ?, ? from iface where id = ?
+on conflict (iface_id, key) do update set value = excluded.value`[1:], key, value, ifaceId)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set label %q on interface %d", key, ifaceId)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to set label %q on interface %d", key, ifaceId)
+	}
+	if n == 0 {
+		return errors.Wrapf(ErrInterfaceNotFound, "failed to set label %q on interface %d", key, ifaceId)
+	}
+	return nil
+}
+
+// GetLabels returns the labels of an interface, without loading or
+// decrypting the rest of the interface. If the interface does not exist, an
+// error wrapping ErrInterfaceNotFound is returned.
+func (s *Store) GetLabels(ifaceId int64) (map[string]string, error) {
+	return s.GetLabelsContext(context.Background(), ifaceId)
+}
+
+// GetLabelsContext is like GetLabels, but aborts if the context is
+// cancelled.
+func (s *Store) GetLabelsContext(ctx context.Context, ifaceId int64) (map[string]string, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	q := s.prepared(tx)
+	var exists bool
+	err = q.QueryRowContext(ctx, `select exists(select 1 from iface where id = ?)`, ifaceId).Scan(&exists)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get labels of interface %d", ifaceId)
+	}
+	if !exists {
+		return nil, errors.Wrapf(ErrInterfaceNotFound, "failed to get labels of interface %d", ifaceId)
+	}
+	iface := &Interface{Id: ifaceId}
+	err = queryLabels(ctx, q, map[int64]*Interface{ifaceId: iface}, ` where iface_id = ?`, ifaceId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get labels of interface %d", ifaceId)
+	}
+	return iface.Labels, nil
+}
+
+// DeleteLabel removes a label from an interface. If the interface has no
+// such label, an error wrapping sql.ErrNoRows is returned.
+func (s *Store) DeleteLabel(ifaceId int64, key string) error {
+	return s.DeleteLabelContext(context.Background(), ifaceId, key)
+}
+
+// DeleteLabelContext is like DeleteLabel, but aborts if the context is
+// cancelled.
+func (s *Store) DeleteLabelContext(ctx context.Context, ifaceId int64, key string) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	result, err := s.prepared(nil).ExecContext(ctx, `
+delete from iface_label where iface_id = ? and key = ?`[1:], ifaceId, key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete label %q from interface %d", key, ifaceId)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete label %q from interface %d", key, ifaceId)
+	}
+	if n == 0 {
+		return errors.Wrapf(sql.ErrNoRows, "failed to delete label %q from interface %d", key, ifaceId)
+	}
+	return nil
+}
+
+// ReplaceInterface removes an interface along with its peers, secrets and
+// logs, and saves iface in its place in a single transaction, such as when a
+// device rejoins a network with a new device id. iface takes the id of the
+// interface it replaces, so it keeps the same network interface name. If the
+// interface being replaced does not exist, an error wrapping sql.ErrNoRows is
+// returned.
+func (s *Store) ReplaceInterface(oldId int64, iface *Interface) error {
+	return s.ReplaceInterfaceContext(context.Background(), oldId, iface)
+}
+
+// ReplaceInterfaceContext is like ReplaceInterface, but aborts if the context
+// is cancelled.
+func (s *Store) ReplaceInterfaceContext(ctx context.Context, oldId int64, iface *Interface) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	err = deleteInterfaceTx(ctx, s.prepared(tx), oldId)
+	if err != nil {
+		return errors.Wrapf(err, "failed to replace interface %d", oldId)
+	}
+	// Save a copy, so that iface is only updated once it is committed.
+	saved := *iface
+	saved.Id = oldId
+	err = s.ensureInterfaceTx(ctx, tx, &saved)
+	if err != nil {
+		return errors.Wrapf(err, "failed to replace interface %d", oldId)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	*iface = saved
+	s.notify(Change{Id: oldId, Kind: ChangeSaved})
+	return nil
+}
+
+// DeleteInterfaceByDevice removes the interface for a device name in a
+// network, along with its peers, secrets and logs.
+func (s *Store) DeleteInterfaceByDevice(deviceName, networkName string) error {
+	return s.DeleteInterfaceByDeviceContext(context.Background(), deviceName, networkName)
+}
+
+// DeleteInterfaceByDeviceContext is like DeleteInterfaceByDevice, but aborts
+// if the context is cancelled.
+func (s *Store) DeleteInterfaceByDeviceContext(ctx context.Context, deviceName, networkName string) error {
+	var id int64
+	err := s.prepared(nil).QueryRowContext(ctx, `
+select id from iface
+where device_name = ? and net_name = ?`[1:], deviceName, networkName).Scan(&id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query interface device name %q network name %q", deviceName, networkName)
+	}
+	return errors.WithStack(s.DeleteInterfaceContext(ctx, id))
+}
+
+// ArchiveInterface marks an interface as archived, keeping it and its logs
+// for auditing. Archived interfaces are excluded from listings and lookups by
+// device unless explicitly included. Ensuring the interface again restores it.
+// If the interface does not exist, an error wrapping sql.ErrNoRows is
+// returned.
+func (s *Store) ArchiveInterface(id int64) error {
+	return s.ArchiveInterfaceContext(context.Background(), id)
+}
+
+// ArchiveInterfaceContext is like ArchiveInterface, but aborts if the context
+// is cancelled.
+func (s *Store) ArchiveInterfaceContext(ctx context.Context, id int64) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	result, err := s.prepared(nil).ExecContext(ctx, `
+update iface set deleted_at = ? where id = ? and deleted_at is null`[1:], s.now().Unix(), id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to archive interface %d", id)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to archive interface %d", id)
+	}
+	if n == 0 {
+		var exists bool
+		err := s.prepared(nil).QueryRowContext(ctx, `select exists(select 1 from iface where id = ?)`, id).Scan(&exists)
+		if err != nil {
+			return errors.Wrapf(err, "failed to archive interface %d", id)
+		}
+		if !exists {
+			return errors.Wrapf(sql.ErrNoRows, "failed to archive interface %d", id)
+		}
+	}
+	return nil
+}
+
+func deleteInterfaceTx(ctx context.Context, q querier, id int64) error {
+	// Delete dependent rows first, to satisfy foreign key constraints.
+	for _, stmt := range []string{
+		`delete from device_endpoint where iface_id = ?`,
+		`delete from peer where iface_id = ?`,
+		`delete from iface_log where iface_id = ?`,
+		`delete from secret.iface_secrets where iface_id = ?`,
+	} {
+		_, err := q.ExecContext(ctx, stmt, id)
+		if err != nil {
+			return errors.Wrapf(err, "failed to delete interface %d", id)
+		}
+	}
+	result, err := q.ExecContext(ctx, `delete from iface where id = ?`, id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete interface %d", id)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete interface %d", id)
+	}
+	if n == 0 {
+		return errors.Wrapf(sql.ErrNoRows, "failed to delete interface %d", id)
+	}
+	return nil
+}
+
+// Transaction calls f with a new transaction, so that the store's *Tx
+// functions may be composed atomically. The transaction is committed if f
+// returns nil, and rolled back otherwise.
+func (s *Store) Transaction(f func(tx *sql.Tx) error) error {
+	return s.TransactionContext(context.Background(), f)
+}
+
+// TransactionContext is like Transaction, but the transaction is rolled back
+// if the context is cancelled before it is committed.
+func (s *Store) TransactionContext(ctx context.Context, f func(tx *sql.Tx) error) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	txDialects.Store(tx, s.dialect)
+	defer txDialects.Delete(tx)
+	err = f(tx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+// WithLog calls f with a new transaction and the most recent log entry of
+// iface, or nil if it has none, so that its state may be checked and changed
+// atomically. The transaction is committed if f succeeds, and otherwise
+// rolled back.
+func (s *Store) WithLog(iface *Interface, f func(tx *sql.Tx, lastLog *InterfaceLog) error) error {
+	return s.WithLogContext(context.Background(), iface, f)
+}
+
+// WithLogContext is like WithLog, but the transaction is rolled back if the
+// context is cancelled before it is committed.
+func (s *Store) WithLogContext(ctx context.Context, iface *Interface, f func(tx *sql.Tx, lastLog *InterfaceLog) error) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	lastLog, err := lastLogTx(ctx, s.prepared(tx), iface)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			lastLog = nil
@@ -393,94 +2743,539 @@ func (s *Store) WithLog(iface *Interface, f func(tx *sql.Tx, lastLog *InterfaceL
 			return errors.Wrapf(err, "failed to query last log for interface %q", iface.Name())
 		}
 	}
-	err = f(tx, lastLog)
+	txDialects.Store(tx, s.dialect)
+	defer txDialects.Delete(tx)
+	err = f(tx, lastLog)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+// txDialects maps the transactions passed to Transaction and WithLog
+// callbacks to the dialect of their store, so that functions given only the
+// transaction, such as AppendLogTx, can rebind their queries.
+var txDialects sync.Map
+
+// txQuerier returns a querier which runs queries in tx, rebinding them for
+// the dialect of the store which began it. Transactions not begun by a store
+// are assumed to be sqlite.
+func txQuerier(tx *sql.Tx) querier {
+	d := SQLite
+	if v, ok := txDialects.Load(tx); ok {
+		d = v.(Dialect)
+	}
+	return &rebindingQuerier{tx: tx, dialect: d}
+}
+
+type rebindingQuerier struct {
+	tx      *sql.Tx
+	dialect Dialect
+}
+
+func (q *rebindingQuerier) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return q.tx.ExecContext(ctx, q.dialect.rebind(query), args...)
+}
+
+func (q *rebindingQuerier) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return q.tx.QueryContext(ctx, q.dialect.rebind(query), args...)
+}
+
+func (q *rebindingQuerier) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return q.tx.QueryRowContext(ctx, q.dialect.rebind(query), args...)
+}
+
+// AppendLogTx appends a log entry for iface in tx. The operation and state
+// must be valid.
+func AppendLogTx(tx *sql.Tx, iface *Interface, operation Operation, state State, dirty bool, message string) error {
+	return AppendLogTxContext(context.Background(), tx, iface, operation, state, dirty, message)
+}
+
+// AppendLogTxContext is like AppendLogTx, but aborts if the context is
+// cancelled.
+func AppendLogTxContext(ctx context.Context, tx *sql.Tx, iface *Interface, operation Operation, state State, dirty bool, message string) error {
+	if !operation.IsValid() {
+		return errors.Errorf("cannot append log for interface %q: invalid operation %q", iface.Name(), operation)
+	}
+	if !state.IsValid() {
+		return errors.Errorf("cannot append log for interface %q: invalid state %q", iface.Name(), state)
+	}
+	_, err := txQuerier(tx).ExecContext(ctx, `
+insert into iface_log (ts, iface_id, operation, state, dirty, message)
+values (?, ?, ?, ?, ?, ?)`[1:], time.Now().Unix(), iface.Id, operation, state, dirty, message)
+	if err != nil {
+		return errors.Wrapf(err, "failed to append log for interface %q", iface.Name())
+	}
+	return nil
+}
+
+// MarkDirty appends a log entry for iface which repeats the operation and
+// state of its most recent entry, but marks it dirty, so that it will be
+// reconciled. If iface has no log entries, an error wrapping sql.ErrNoRows is
+// returned.
+func (s *Store) MarkDirty(iface *Interface, message string) error {
+	return s.MarkDirtyContext(context.Background(), iface, message)
+}
+
+// MarkDirtyContext is like MarkDirty, but aborts if the context is
+// cancelled.
+func (s *Store) MarkDirtyContext(ctx context.Context, iface *Interface, message string) error {
+	return s.markDirty(ctx, iface, true, message)
+}
+
+// MarkClean appends a log entry for iface which repeats the operation and
+// state of its most recent entry, but marks it clean, such as once it has
+// been reconciled. If iface has no log entries, an error wrapping
+// sql.ErrNoRows is returned.
+func (s *Store) MarkClean(iface *Interface, message string) error {
+	return s.MarkCleanContext(context.Background(), iface, message)
+}
+
+// MarkCleanContext is like MarkClean, but aborts if the context is
+// cancelled.
+func (s *Store) MarkCleanContext(ctx context.Context, iface *Interface, message string) error {
+	return s.markDirty(ctx, iface, false, message)
+}
+
+func (s *Store) markDirty(ctx context.Context, iface *Interface, dirty bool, message string) error {
+	return s.WithLogContext(ctx, iface, func(tx *sql.Tx, lastLog *InterfaceLog) error {
+		if lastLog == nil {
+			return errors.Wrapf(sql.ErrNoRows, "cannot mark interface %q: no log entries", iface.Name())
+		}
+		return AppendLogTxContext(ctx, tx, iface, lastLog.Operation, lastLog.State, dirty, message)
+	})
+}
+
+// LastLogByDevice returns the interface for a device name in a network,
+// along with its most recent log entry. Archived interfaces are not found
+// unless the IncludeArchived option is given.
+func (s *Store) LastLogByDevice(deviceName, networkName string, options ...LookupOption) (*InterfaceWithLog, error) {
+	return s.LastLogByDeviceContext(context.Background(), deviceName, networkName, options...)
+}
+
+// LastLogByDeviceContext is like LastLogByDevice, but aborts if the context
+// is cancelled.
+func (s *Store) LastLogByDeviceContext(ctx context.Context, deviceName, networkName string, options ...LookupOption) (*InterfaceWithLog, error) {
+	var l InterfaceLog
+	var ifaceId int64
+	err := scanLog(s.prepared(nil).QueryRowContext(ctx, `
+select
+	l.id, l.ts,
+	l.operation, l.state, l.dirty, l.message,
+	i.id
+from iface_log l join iface i on (i.id = l.iface_id)
+where i.device_name = ? and i.net_name = ?`[1:]+archivedClause(options)+`
+order by l.id desc
+limit 1`, deviceName, networkName), &l, &ifaceId)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query interface last log")
+	}
+	iface, err := s.InterfaceContext(ctx, ifaceId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query interface %d", ifaceId)
+	}
+	return &InterfaceWithLog{Interface: *iface, Log: l}, nil
+}
+
+// ListOptions select a page of interfaces to list.
+type ListOptions struct {
+	// Limit is the maximum number of interfaces to list. If zero, all
+	// interfaces are listed.
+	Limit int
+
+	// Offset is the number of interfaces to skip, in order of id.
+	Offset int
+
+	// NetworkName, if set, lists only interfaces in the named network.
+	NetworkName string
+
+	// DeviceName, if set, lists only interfaces with the device name.
+	DeviceName string
+
+	// IncludeArchived lists archived interfaces as well as active ones.
+	IncludeArchived bool
+}
+
+// Interfaces returns the interfaces selected by opts along with the most
+// recent log entry of each, and the total number of interfaces matching
+// opts regardless of limit and offset.
+func (s *Store) Interfaces(opts ListOptions) ([]InterfaceWithLog, int, error) {
+	return s.InterfacesContext(context.Background(), opts)
+}
+
+// InterfacesContext is like Interfaces, but aborts if the context is
+// cancelled.
+func (s *Store) InterfacesContext(ctx context.Context, opts ListOptions) ([]InterfaceWithLog, int, error) {
+	var where []string
+	var args []interface{}
+	if !opts.IncludeArchived {
+		where = append(where, "i.deleted_at is null")
+	}
+	if opts.NetworkName != "" {
+		where = append(where, "i.net_name = ?")
+		args = append(args, opts.NetworkName)
+	}
+	if opts.DeviceName != "" {
+		where = append(where, "i.device_name = ?")
+		args = append(args, opts.DeviceName)
+	}
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = " where " + strings.Join(where, " and ")
+	}
+	var limit interface{} = opts.Limit
+	if opts.Limit <= 0 {
+		limit = s.dialect.noLimit
+	}
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	var total int
+	err = s.prepared(tx).QueryRowContext(ctx, `select count(*) from iface i`+whereClause, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to count interfaces")
+	}
+	result, err := s.queryInterfaces(ctx, s.prepared(tx), whereClause+` order by i.id limit ? offset ?`,
+		append(args, limit, opts.Offset)...)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	return result, total, nil
+}
+
+// iterateBatchSize is the number of interfaces loaded at a time by
+// IterateInterfaces.
+var iterateBatchSize = 100
+
+// IterateInterfaces calls f with each active interface in order of id, along
+// with its most recent log entry. Unlike Interfaces, only a batch of
+// interfaces is held in memory at a time, regardless of how many are in the
+// store. Iteration stops at the first error returned by f, which is
+// returned.
+//
+// The store is not locked while f is called, so interfaces saved or deleted
+// during iteration may or may not be seen.
+func (s *Store) IterateInterfaces(f func(InterfaceWithLog) error) error {
+	return s.IterateInterfacesContext(context.Background(), f)
+}
+
+// IterateInterfacesContext is like IterateInterfaces, but aborts if the
+// context is cancelled.
+func (s *Store) IterateInterfacesContext(ctx context.Context, f func(InterfaceWithLog) error) error {
+	var lastId int64
+	for {
+		batch, err := s.queryInterfaceBatch(ctx, lastId)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for i := range batch {
+			err := f(batch[i])
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if len(batch) < iterateBatchSize {
+			return nil
+		}
+		lastId = batch[len(batch)-1].Id
+	}
+}
+
+// queryInterfaceBatch returns the next batch of active interfaces after
+// lastId.
+func (s *Store) queryInterfaceBatch(ctx context.Context, lastId int64) ([]InterfaceWithLog, error) {
+	tx, err := s.beginTx(ctx)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.Wrap(err, "failed to begin transaction")
 	}
-	err = tx.Commit()
+	defer tx.Rollback()
+	batch, err := s.queryInterfaces(ctx, s.prepared(tx), ` where i.id > ? and i.deleted_at is null order by i.id limit ?`,
+		lastId, iterateBatchSize)
 	if err != nil {
-		return errors.Wrap(err, "failed to commit transaction")
+		return nil, errors.Wrapf(err, "failed to query interfaces after %d", lastId)
 	}
-	return nil
+	return batch, nil
 }
 
-func AppendLogTx(tx *sql.Tx, iface *Interface, operation Operation, state State, dirty bool, message string) error {
-	_, err := tx.Exec(`
-insert into iface_log (ts, iface_id, operation, state, dirty, message)
-values (?, ?, ?, ?, ?, ?)`[1:], time.Now().Unix(), iface.Id, operation, state, dirty, message)
+// CountInterfaces returns the number of active interfaces in the store.
+func (s *Store) CountInterfaces() (int, error) {
+	return s.CountInterfacesContext(context.Background())
+}
+
+// CountInterfacesContext is like CountInterfaces, but aborts if the context
+// is cancelled.
+func (s *Store) CountInterfacesContext(ctx context.Context) (int, error) {
+	var n int
+	err := s.prepared(nil).QueryRowContext(ctx, `select count(*) from iface where deleted_at is null`).Scan(&n)
 	if err != nil {
-		return errors.Wrapf(err, "failed to append log for interface %q", iface.Name())
+		return 0, errors.Wrap(err, "failed to count interfaces")
 	}
-	return nil
+	return n, nil
 }
 
-func (s *Store) LastLogByDevice(deviceName, networkName string) (*InterfaceWithLog, error) {
-	var l InterfaceLog
-	var ifaceId, ts int64
-	err := s.db.QueryRow(`
-select
-	l.id, l.ts,
-	l.operation, l.state, l.dirty, l.message,
-	i.id
-from iface_log l join iface i on (i.id = l.iface_id)
-where i.device_name = ? and i.net_name = ?
-order by l.id desc
-limit 1`[1:], deviceName, networkName).Scan(
-		&l.Id, &ts,
-		&l.Operation, &l.State, &l.Dirty, &l.Message,
-		&ifaceId)
+// CountInterfacesByNetwork returns the number of active interfaces in the
+// named network.
+func (s *Store) CountInterfacesByNetwork(networkName string) (int, error) {
+	return s.CountInterfacesByNetworkContext(context.Background(), networkName)
+}
+
+// CountInterfacesByNetworkContext is like CountInterfacesByNetwork, but
+// aborts if the context is cancelled.
+func (s *Store) CountInterfacesByNetworkContext(ctx context.Context, networkName string) (int, error) {
+	var n int
+	err := s.prepared(nil).QueryRowContext(ctx, `select count(*) from iface where net_name = ? and deleted_at is null`, networkName).Scan(&n)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to query interface last log")
+		return 0, errors.Wrapf(err, "failed to count interfaces in network %q", networkName)
 	}
-	l.Timestamp = time.Unix(ts, 0)
-	iface, err := s.Interface(ifaceId)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to query interface %d", ifaceId)
+	return n, nil
+}
+
+// PeerCount returns the number of peers of an interface, without loading
+// or decrypting it. If the interface does not exist, an error wrapping
+// ErrInterfaceNotFound is returned.
+func (s *Store) PeerCount(ifaceId int64) (int, error) {
+	return s.PeerCountContext(context.Background(), ifaceId)
+}
+
+// PeerCountContext is like PeerCount, but aborts if the context is
+// cancelled.
+func (s *Store) PeerCountContext(ctx context.Context, ifaceId int64) (int, error) {
+	var n int
+	err := s.prepared(nil).QueryRowContext(ctx, `
+select (select count(*) from peer p where p.iface_id = i.id)
+from iface i where i.id = ?`[1:], ifaceId).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errors.Wrapf(ErrInterfaceNotFound, "failed to count peers of interface %d", ifaceId)
+	} else if err != nil {
+		return 0, errors.Wrapf(err, "failed to count peers of interface %d", ifaceId)
 	}
-	return &InterfaceWithLog{Interface: *iface, Log: l}, nil
+	return n, nil
+}
+
+// PeerCounts returns the number of peers of each active interface, keyed by
+// interface id, without loading or decrypting them. Interfaces without peers
+// have a count of zero.
+func (s *Store) PeerCounts() (map[int64]int, error) {
+	return s.PeerCountsContext(context.Background())
 }
 
-func (s *Store) Interfaces() ([]InterfaceWithLog, error) {
-	var ifaceIds []int64
-	rows, err := s.db.Query(`select id from iface`)
+// PeerCountsContext is like PeerCounts, but aborts if the context is
+// cancelled.
+func (s *Store) PeerCountsContext(ctx context.Context) (map[int64]int, error) {
+	rows, err := s.prepared(nil).QueryContext(ctx, `
+select i.id, count(p.iface_id) from iface i
+left join peer p on (p.iface_id = i.id)
+where i.deleted_at is null
+group by i.id`[1:])
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to query interfaces")
+		return nil, errors.Wrap(err, "failed to count peers")
 	}
 	defer rows.Close()
+	counts := map[int64]int{}
 	for rows.Next() {
 		var id int64
-		err := rows.Scan(&id)
+		var n int
+		err := rows.Scan(&id, &n)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to scan interface id")
+			return nil, errors.Wrap(err, "failed to scan peer count")
 		}
-		ifaceIds = append(ifaceIds, id)
+		counts[id] = n
 	}
 	if err := rows.Err(); err != nil {
-		return nil, errors.Wrap(err, "failed to iterate over interface ids")
+		return nil, errors.Wrap(err, "failed to count peers")
 	}
-	result := make([]InterfaceWithLog, len(ifaceIds))
-	for i := range ifaceIds {
-		iface, err := s.Interface(ifaceIds[i])
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to query interface %d", ifaceIds[i])
-		}
-		result[i] = InterfaceWithLog{Interface: *iface}
-		lastLog, err := s.LastLog(iface)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to query last log for interface %d", ifaceIds[i])
-		}
-		result[i].Log = *lastLog
+	return counts, nil
+}
+
+// InterfacesBySubscription returns all active interfaces backed by the given
+// subscription.
+func (s *Store) InterfacesBySubscription(subId string) ([]InterfaceWithLog, error) {
+	return s.InterfacesBySubscriptionContext(context.Background(), subId)
+}
+
+// InterfacesBySubscriptionContext is like InterfacesBySubscription, but
+// aborts if the context is cancelled.
+func (s *Store) InterfacesBySubscriptionContext(ctx context.Context, subId string) ([]InterfaceWithLog, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
 	}
-	return result, nil
+	defer tx.Rollback()
+	ifaces, err := s.queryInterfaces(ctx, s.prepared(tx), ` where i.subscription_id = ? and i.deleted_at is null order by i.id`, subId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query interfaces by subscription %q", subId)
+	}
+	return ifaces, nil
+}
+
+// InterfacesByApiUrl returns all active interfaces joined through the
+// controller at the given API URL, so that an agent using several
+// controllers can refresh each interface against its own.
+func (s *Store) InterfacesByApiUrl(apiUrl string) ([]InterfaceWithLog, error) {
+	return s.InterfacesByApiUrlContext(context.Background(), apiUrl)
+}
+
+// InterfacesByApiUrlContext is like InterfacesByApiUrl, but aborts if the
+// context is cancelled.
+func (s *Store) InterfacesByApiUrlContext(ctx context.Context, apiUrl string) ([]InterfaceWithLog, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	ifaces, err := s.queryInterfaces(ctx, s.prepared(tx), ` where i.api_url = ? and i.deleted_at is null order by i.id`, apiUrl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query interfaces by API URL %q", apiUrl)
+	}
+	return ifaces, nil
+}
+
+// InterfacesByMachineId returns all active interfaces joined from the host
+// with the given machine id, such as to show every network a host is part
+// of.
+func (s *Store) InterfacesByMachineId(machineId []byte) ([]InterfaceWithLog, error) {
+	return s.InterfacesByMachineIdContext(context.Background(), machineId)
+}
+
+// InterfacesByMachineIdContext is like InterfacesByMachineId, but aborts if
+// the context is cancelled.
+func (s *Store) InterfacesByMachineIdContext(ctx context.Context, machineId []byte) ([]InterfaceWithLog, error) {
+	if len(machineId) == 0 {
+		return nil, errors.New("cannot query interfaces by machine id: missing machine id")
+	}
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	ifaces, err := s.queryInterfaces(ctx, s.prepared(tx), ` where i.machine_id = ? and i.deleted_at is null order by i.id`,
+		hex.EncodeToString(machineId))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query interfaces by machine id %x", machineId)
+	}
+	return ifaces, nil
+}
+
+// Search returns the active interfaces whose device or network name
+// contains query, along with the most recent log entry of each, ordered by
+// network and then device name. Wildcard characters in query are matched
+// literally.
+func (s *Store) Search(query string) ([]InterfaceWithLog, error) {
+	return s.SearchContext(context.Background(), query)
+}
+
+// SearchContext is like Search, but aborts if the context is cancelled.
+func (s *Store) SearchContext(ctx context.Context, query string) ([]InterfaceWithLog, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	pattern := "%" + escapeLike(query) + "%"
+	ifaces, err := s.queryInterfaces(ctx, s.prepared(tx), `
+where (i.device_name like ? escape '\' or i.net_name like ? escape '\') and i.deleted_at is null
+order by i.net_name, i.device_name`, pattern, pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to search interfaces for %q", query)
+	}
+	return ifaces, nil
+}
+
+// likeEscaper escapes the wildcard characters of a like pattern with a
+// backslash.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// InterfacesByNetwork returns all active interfaces in the named network,
+// along with the most recent log entry of each.
+func (s *Store) InterfacesByNetwork(networkName string) ([]InterfaceWithLog, error) {
+	return s.InterfacesByNetworkContext(context.Background(), networkName)
+}
+
+// InterfacesByNetworkContext is like InterfacesByNetwork, but aborts if the
+// context is cancelled.
+func (s *Store) InterfacesByNetworkContext(ctx context.Context, networkName string) ([]InterfaceWithLog, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	ifaces, err := s.queryInterfaces(ctx, s.prepared(tx), ` where i.net_name = ? and i.deleted_at is null order by i.id`, networkName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query interfaces in network %q", networkName)
+	}
+	return ifaces, nil
+}
+
+// InterfacesNeedingRefresh returns the active interfaces whose device token
+// expires within the given duration from now, or has already expired, along
+// with the most recent log entry of each. Interfaces are ordered by when
+// their token expires, soonest first. Interfaces whose token expiry is
+// unknown are not included.
+func (s *Store) InterfacesNeedingRefresh(within time.Duration) ([]InterfaceWithLog, error) {
+	return s.InterfacesNeedingRefreshContext(context.Background(), within)
+}
+
+// InterfacesNeedingRefreshContext is like InterfacesNeedingRefresh, but
+// aborts if the context is cancelled.
+func (s *Store) InterfacesNeedingRefreshContext(ctx context.Context, within time.Duration) ([]InterfaceWithLog, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	ifaces, err := s.queryInterfaces(ctx, s.prepared(tx), `
+ where i.device_token_expires_at <= ? and i.deleted_at is null
+order by i.device_token_expires_at, i.id`[1:], s.now().Add(within).Unix())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query interfaces needing refresh")
+	}
+	return ifaces, nil
+}
+
+// DirtyInterfaces returns the active interfaces whose most recent log entry
+// is dirty, along with that entry, so that their pending changes may be
+// applied.
+func (s *Store) DirtyInterfaces() ([]InterfaceWithLog, error) {
+	return s.DirtyInterfacesContext(context.Background())
+}
+
+// DirtyInterfacesContext is like DirtyInterfaces, but aborts if the context
+// is cancelled.
+func (s *Store) DirtyInterfacesContext(ctx context.Context) ([]InterfaceWithLog, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	ifaces, err := s.queryInterfaces(ctx, s.prepared(tx), ` where i.deleted_at is null and l.dirty order by i.id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query dirty interfaces")
+	}
+	return ifaces, nil
 }
 
 func (s *Store) LastLog(iface *Interface) (*InterfaceLog, error) {
-	tx, err := s.db.Begin()
+	return s.LastLogContext(context.Background(), iface)
+}
+
+// LastLogContext is like LastLog, but aborts if the context is cancelled.
+func (s *Store) LastLogContext(ctx context.Context, iface *Interface) (*InterfaceLog, error) {
+	tx, err := s.beginTx(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to begin transaction")
 	}
 	defer tx.Rollback()
-	l, err := LastLogTx(tx, iface)
+	l, err := lastLogTx(ctx, s.prepared(tx), iface)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get last log for interface %d", iface.Id)
 	}
@@ -488,21 +3283,346 @@ func (s *Store) LastLog(iface *Interface) (*InterfaceLog, error) {
 }
 
 func LastLogTx(tx *sql.Tx, iface *Interface) (*InterfaceLog, error) {
+	return lastLogTx(context.Background(), txQuerier(tx), iface)
+}
+
+func lastLogTx(ctx context.Context, q querier, iface *Interface) (*InterfaceLog, error) {
 	var lastLog InterfaceLog
-	var ts int64
-	err := tx.QueryRow(`
+	err := scanLog(q.QueryRowContext(ctx, `
 select
 	id, ts,
 	operation, state, dirty, message
 from iface_log
 where iface_id = ?
 order by id desc
-limit 1`[1:], iface.Id).Scan(
-		&lastLog.Id, &ts,
-		&lastLog.Operation, &lastLog.State, &lastLog.Dirty, &lastLog.Message)
+limit 1`[1:], iface.Id), &lastLog)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to query interface last log")
 	}
-	lastLog.Timestamp = time.Unix(ts, 0)
 	return &lastLog, nil
 }
+
+// LatestByOperation returns the most recent log entry for an interface
+// recording the given operation and state, such as when it last joined
+// successfully. If there is no such entry, the error wraps sql.ErrNoRows.
+func (s *Store) LatestByOperation(ifaceId int64, op Operation, state State) (*InterfaceLog, error) {
+	return s.LatestByOperationContext(context.Background(), ifaceId, op, state)
+}
+
+// LatestByOperationContext is like LatestByOperation, but aborts if the
+// context is cancelled.
+func (s *Store) LatestByOperationContext(ctx context.Context, ifaceId int64, op Operation, state State) (*InterfaceLog, error) {
+	var l InterfaceLog
+	err := scanLog(s.prepared(nil).QueryRowContext(ctx, `
+select
+	id, ts,
+	operation, state, dirty, message
+from iface_log
+where iface_id = ? and operation = ? and state = ?
+order by id desc
+limit 1`[1:], ifaceId, op, state), &l)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query latest %q %q log for interface %d", op, state, ifaceId)
+	}
+	return &l, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanLog scans the id, ts, operation, state, dirty and message columns of
+// an iface_log row into l, followed by any extra columns into dest.
+func scanLog(row rowScanner, l *InterfaceLog, dest ...interface{}) error {
+	var ts int64
+	err := row.Scan(append([]interface{}{
+		&l.Id, &ts,
+		&l.Operation, &l.State, &l.Dirty, &l.Message,
+	}, dest...)...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	l.Timestamp = time.Unix(ts, 0)
+	return nil
+}
+
+// LogHistory returns up to limit of the most recent log entries of an
+// interface, most recent first. If limit is zero, all entries are returned.
+func (s *Store) LogHistory(iface *Interface, limit int) ([]InterfaceLog, error) {
+	return s.LogHistoryContext(context.Background(), iface, limit)
+}
+
+// LogHistoryContext is like LogHistory, but aborts if the context is
+// cancelled.
+func (s *Store) LogHistoryContext(ctx context.Context, iface *Interface, limit int) ([]InterfaceLog, error) {
+	var limitArg interface{} = limit
+	if limit <= 0 {
+		limitArg = s.dialect.noLimit
+	}
+	rows, err := s.prepared(nil).QueryContext(ctx, `
+select
+	id, ts,
+	operation, state, dirty, message
+from iface_log
+where iface_id = ?
+order by id desc
+limit ?`[1:], iface.Id, limitArg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query log history for interface %q", iface.Name())
+	}
+	defer rows.Close()
+	var logs []InterfaceLog
+	for rows.Next() {
+		var l InterfaceLog
+		err := scanLog(rows, &l)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to scan log for interface %q", iface.Name())
+		}
+		logs = append(logs, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to query log history for interface %q", iface.Name())
+	}
+	return logs, nil
+}
+
+// PruneLogs deletes interface log entries recorded before the given time,
+// returning the number of entries deleted. The most recent entry of each
+// interface is always kept, since it holds the interface's current state.
+func (s *Store) PruneLogs(before time.Time) (int64, error) {
+	return s.PruneLogsContext(context.Background(), before)
+}
+
+// PruneLogsContext is like PruneLogs, but aborts if the context is
+// cancelled.
+func (s *Store) PruneLogsContext(ctx context.Context, before time.Time) (int64, error) {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer unlock()
+	result, err := s.prepared(nil).ExecContext(ctx, `
+delete from iface_log
+where ts < ?
+and id not in (select max(id) from iface_log group by iface_id)`[1:], before.Unix())
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to prune logs")
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to prune logs")
+	}
+	return n, nil
+}
+
+// PruneLogsKeepLast deletes all but the most recent n log entries of an
+// interface, returning the number of entries deleted. At least one entry must
+// be kept.
+func (s *Store) PruneLogsKeepLast(iface *Interface, n int) (int64, error) {
+	return s.PruneLogsKeepLastContext(context.Background(), iface, n)
+}
+
+// PruneLogsKeepLastContext is like PruneLogsKeepLast, but aborts if the
+// context is cancelled.
+func (s *Store) PruneLogsKeepLastContext(ctx context.Context, iface *Interface, n int) (int64, error) {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer unlock()
+	if n < 1 {
+		return 0, errors.Errorf("cannot keep %d log entries for interface %q, must keep at least one", n, iface.Name())
+	}
+	result, err := s.prepared(nil).ExecContext(ctx, `
+delete from iface_log
+where iface_id = ?
+and id not in (select id from iface_log where iface_id = ? order by id desc limit ?)`[1:],
+		iface.Id, iface.Id, n)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to prune logs for interface %q", iface.Name())
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to prune logs for interface %q", iface.Name())
+	}
+	return deleted, nil
+}
+
+// CompactLogs collapses runs of consecutive log entries of an interface with
+// the same operation, state, dirty flag and message, such as those recorded
+// by retry loops, into the earliest entry of each run. The first and last
+// entries are always kept, so the interface's current state is preserved.
+// Returns the number of entries deleted.
+func (s *Store) CompactLogs(ifaceId int64) (int64, error) {
+	return s.CompactLogsContext(context.Background(), ifaceId)
+}
+
+// CompactLogsContext is like CompactLogs, but aborts if the context is
+// cancelled.
+func (s *Store) CompactLogsContext(ctx context.Context, ifaceId int64) (int64, error) {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	q := s.prepared(tx)
+	rows, err := q.QueryContext(ctx, `
+select
+	id, ts,
+	operation, state, dirty, message
+from iface_log
+where iface_id = ?
+order by id`[1:], ifaceId)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to query logs for interface %d", ifaceId)
+	}
+	var logs []InterfaceLog
+	for rows.Next() {
+		var l InterfaceLog
+		err := scanLog(rows, &l)
+		if err != nil {
+			rows.Close()
+			return 0, errors.Wrapf(err, "failed to scan log for interface %d", ifaceId)
+		}
+		logs = append(logs, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, errors.Wrapf(err, "failed to query logs for interface %d", ifaceId)
+	}
+	var deleted int64
+	for i := 1; i < len(logs)-1; i++ {
+		prev, l := &logs[i-1], &logs[i]
+		if l.Operation != prev.Operation || l.State != prev.State || l.Dirty != prev.Dirty || l.Message != prev.Message {
+			continue
+		}
+		_, err := q.ExecContext(ctx, `delete from iface_log where id = ?`, l.Id)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to delete log %d for interface %d", l.Id, ifaceId)
+		}
+		deleted++
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to commit transaction")
+	}
+	return deleted, nil
+}
+
+// DBStats returns statistics of the database connection pool, for tuning and
+// monitoring its saturation.
+func (s *Store) DBStats() sql.DBStats {
+	return s.db.Stats()
+}
+
+// Stats returns counts of the interfaces, peers and logs in the store.
+func (s *Store) Stats() (StoreStats, error) {
+	return s.StatsContext(context.Background())
+}
+
+// StatsContext is like Stats, but aborts if the context is cancelled.
+func (s *Store) StatsContext(ctx context.Context) (StoreStats, error) {
+	var stats StoreStats
+	var oldestLog, newestLog sql.NullInt64
+	err := s.prepared(nil).QueryRowContext(ctx, `
+select
+	(select count(*) from iface where deleted_at is null),
+	(select count(*) from iface where deleted_at is not null),
+	(select count(*) from peer),
+	(select count(*) from iface_log),
+	(select min(ts) from iface_log),
+	(select max(ts) from iface_log)`[1:]).Scan(
+		&stats.Interfaces, &stats.ArchivedInterfaces, &stats.Peers, &stats.Logs, &oldestLog, &newestLog)
+	if err != nil {
+		return StoreStats{}, errors.Wrap(err, "failed to query store stats")
+	}
+	if oldestLog.Valid {
+		stats.OldestLog, stats.NewestLog = time.Unix(oldestLog.Int64, 0), time.Unix(newestLog.Int64, 0)
+	}
+	return stats, nil
+}
+
+// StatusOverview returns a status summary of all active interfaces,
+// including the most recent log entry and number of peers of each, in a
+// single query.
+func (s *Store) StatusOverview() ([]StatusRow, error) {
+	return s.StatusOverviewContext(context.Background())
+}
+
+// StatusOverviewContext is like StatusOverview, but aborts if the context is
+// cancelled.
+func (s *Store) StatusOverviewContext(ctx context.Context) ([]StatusRow, error) {
+	rows, err := s.prepared(nil).QueryContext(ctx, `
+select
+	i.id, i.net_name, i.net_cidr,
+	i.device_name, i.device_addr, i.endpoint_host, i.endpoint_port,
+	i.listen_port, coalesce(pc.n, 0),
+	l.id, l.ts, l.operation, l.state, l.dirty, l.message
+from iface i
+left join (
+	select iface_id, count(*) as n from peer group by iface_id
+) pc on (pc.iface_id = i.id)
+left join iface_log l on (l.id = (
+	select max(id) from iface_log where iface_id = i.id
+))
+where i.deleted_at is null
+order by i.id`[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query interface status")
+	}
+	defer rows.Close()
+	var result []StatusRow
+	for rows.Next() {
+		var (
+			row                         StatusRow
+			netCIDRText, deviceAddrText string
+			endpointHost                string
+			endpointPort                int
+			listenPort                  sql.NullInt64
+			logId, logTs                sql.NullInt64
+			logOperation, logState      sql.NullString
+			logDirty                    sql.NullBool
+			logMessage                  sql.NullString
+		)
+		err := rows.Scan(
+			&row.Id, &row.NetworkName, &netCIDRText,
+			&row.DeviceName, &deviceAddrText, &endpointHost, &endpointPort,
+			&listenPort, &row.PeerCount,
+			&logId, &logTs, &logOperation, &logState, &logDirty, &logMessage)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan interface status result row")
+		}
+		netCIDR, err := wireguard.ParseAddress(netCIDRText)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query interface status: invalid network CIDR %q", netCIDRText)
+		}
+		row.NetworkCIDR = *netCIDR
+		deviceAddr, err := wireguard.ParseAddress(deviceAddrText)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query interface status: invalid device address %q", deviceAddrText)
+		}
+		row.DeviceAddr = *deviceAddr
+		row.Endpoint = joinEndpoint(endpointHost, endpointPort)
+		row.ListenPort = int(listenPort.Int64)
+		if logId.Valid {
+			row.Log = &InterfaceLog{
+				Id:        logId.Int64,
+				Timestamp: time.Unix(logTs.Int64, 0),
+				Operation: Operation(logOperation.String),
+				State:     State(logState.String),
+				Dirty:     logDirty.Bool,
+				Message:   logMessage.String,
+			}
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to query interface status")
+	}
+	return result, nil
+}
@@ -11,12 +11,23 @@
 package store_test
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
+	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/secretbox"
 
 	"github.com/wiregarden-io/wiregarden/agent/store"
 	"github.com/wiregarden-io/wiregarden/api"
@@ -29,6 +40,130 @@ func TestNewStore(t *testing.T) {
 	c.Assert(err, qt.IsNil)
 }
 
+func TestCloseTwice(t *testing.T) {
+	c := qt.New(t)
+	st, err := store.New(c.Mkdir()+"/db", generateStoreKey(c), store.AutoVacuum(time.Hour))
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Close(), qt.IsNil)
+	c.Assert(st.Close(), qt.IsNil)
+}
+
+func TestUseAfterClose(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	iface := newTestInterface(c, "test-net", 1, 1)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Close(), qt.IsNil)
+
+	for _, test := range []struct {
+		about string
+		f     func() error
+	}{{
+		about: "write",
+		f: func() error {
+			return st.EnsureInterface(newTestInterface(c, "test-net", 2, 1))
+		},
+	}, {
+		about: "query",
+		f: func() error {
+			_, err := st.Interface(iface.Id)
+			return err
+		},
+	}, {
+		about: "query row",
+		f: func() error {
+			_, err := st.CountInterfaces()
+			return err
+		},
+	}, {
+		about: "transaction",
+		f: func() error {
+			_, err := st.Verify()
+			return err
+		},
+	}} {
+		c.Run(test.about, func(c *qt.C) {
+			err := test.f()
+			c.Assert(errors.Is(err, store.ErrStoreClosed), qt.IsTrue, qt.Commentf("%v", err))
+		})
+	}
+	err = st.Ping(context.Background())
+	c.Assert(err, qt.ErrorMatches, `store is closed: database unreachable`)
+}
+
+func TestNewStoreReopen(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	key := generateStoreKey(c)
+	for i := 0; i < 2; i++ {
+		st, err := store.New(path, key)
+		c.Assert(err, qt.IsNil)
+		c.Assert(st.Close(), qt.IsNil)
+	}
+
+	// Every migration tolerates an existing schema, so the schema may be
+	// applied again from scratch.
+	db, err := sql.Open("sqlite3", "file:"+path)
+	c.Assert(err, qt.IsNil)
+	defer db.Close()
+	_, err = db.Exec(`delete from schema_version`)
+	c.Assert(err, qt.IsNil)
+	st, err := store.New(path, key)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	version, err := st.SchemaVersion()
+	c.Assert(err, qt.IsNil)
+	c.Assert(version, qt.Equals, store.LatestSchemaVersion)
+}
+
+func TestReadOnly(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	key := generateStoreKey(c)
+
+	// A read-only store is not created.
+	_, err := store.New(path, key, store.ReadOnly())
+	c.Assert(err, qt.Not(qt.IsNil))
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+
+	st, err := store.New(path, key)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 2)
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface, 1)
+
+	ro, err := store.New(path, key, store.ReadOnly())
+	c.Assert(err, qt.IsNil)
+	defer ro.Close()
+	result, err := ro.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.DeepEquals, iface)
+	rows, err := ro.StatusOverview()
+	c.Assert(err, qt.IsNil)
+	c.Assert(rows, qt.HasLen, 1)
+
+	err = ro.EnsureInterface(newTestInterface(c, "test-net", 2, 0))
+	c.Assert(errors.Is(err, store.ErrReadOnly), qt.IsTrue)
+	err = ro.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+		return store.AppendLogTx(tx, iface, store.OpRefreshDevice, store.StateInterfaceUp, false, "")
+	})
+	c.Assert(errors.Is(err, store.ErrReadOnly), qt.IsTrue)
+	err = ro.DeleteInterface(iface.Id)
+	c.Assert(errors.Is(err, store.ErrReadOnly), qt.IsTrue)
+	_, err = ro.PruneLogs(time.Now())
+	c.Assert(errors.Is(err, store.ErrReadOnly), qt.IsTrue)
+
+	// Writes by the read-write store are visible to the read-only store.
+	err = st.DeleteInterface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	_, err = ro.Interface(iface.Id)
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+}
+
 func generateStoreKey(c *qt.C) store.Key {
 	var k store.Key
 	_, err := rand.Reader.Read(k[:])
@@ -36,10 +171,34 @@ func generateStoreKey(c *qt.C) store.Key {
 	return k
 }
 
+// newTestStore returns an empty store for testing. If
+// WIREGARDEN_TEST_POSTGRES is set to the connection string of a disposable
+// PostgreSQL database, the store is created there instead of in sqlite. The
+// database is emptied first. "go test -tags postgres" links the driver and
+// sets it to a PostgreSQL container started for the tests.
+func newTestStore(c *qt.C) *store.Store {
+	dsn := os.Getenv("WIREGARDEN_TEST_POSTGRES")
+	if dsn == "" {
+		st, err := store.New(c.Mkdir()+"/db", generateStoreKey(c))
+		c.Assert(err, qt.IsNil)
+		return st
+	}
+	db, err := sql.Open("postgres", dsn)
+	c.Assert(err, qt.IsNil)
+	_, err = db.Exec(`
+drop schema if exists secret cascade;
+drop schema if exists public cascade;
+create schema public;
+`[1:])
+	c.Assert(err, qt.IsNil)
+	st, err := store.NewWithDB(db, store.Postgres, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	return st
+}
+
 func TestInterfaceNoPeers(t *testing.T) {
 	c := qt.New(t)
-	st, err := store.New(c.Mkdir()+"/db", generateStoreKey(c))
-	c.Assert(err, qt.IsNil)
+	st := newTestStore(c)
 	defer st.Close()
 	k := generateKey(c)
 	iface := &store.Interface{
@@ -60,7 +219,7 @@ func TestInterfaceNoPeers(t *testing.T) {
 		Key:         k,
 		DeviceToken: []byte("itsasecrettoeverybody"),
 	}
-	err = st.EnsureInterface(iface)
+	err := st.EnsureInterface(iface)
 	c.Assert(err, qt.IsNil)
 	c.Assert(iface.Name(), qt.Equals, "wgn001")
 	err = st.EnsureInterface(iface)
@@ -74,8 +233,7 @@ func TestInterfaceNoPeers(t *testing.T) {
 
 func TestInterfacePeers(t *testing.T) {
 	c := qt.New(t)
-	st, err := store.New(c.Mkdir()+"/db", generateStoreKey(c))
-	c.Assert(err, qt.IsNil)
+	st := newTestStore(c)
 	defer st.Close()
 	k := generateKey(c)
 	iface := &store.Interface{
@@ -107,7 +265,7 @@ func TestInterfacePeers(t *testing.T) {
 		Key:         k,
 		DeviceToken: []byte("itsasecrettoeverybody"),
 	}
-	err = st.EnsureInterface(iface)
+	err := st.EnsureInterface(iface)
 	c.Assert(err, qt.IsNil)
 	err = st.EnsureInterface(iface)
 	c.Assert(err, qt.IsNil)
@@ -133,10 +291,95 @@ func TestInterfacePeers(t *testing.T) {
 	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
 }
 
-func TestInterfaceLog(t *testing.T) {
+func TestInterfaceManyPeers(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	// More peers than are inserted in a single statement.
+	iface := newTestInterface(c, "test-net", 1, 250)
+	iface.Peers[150].Endpoints = []api.Endpoint{{Endpoint: "example.com:51820", Priority: 1}}
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.DeepEquals, iface)
+}
+
+func TestInterfaceEndpoints(t *testing.T) {
 	c := qt.New(t)
-	st, err := store.New(c.Mkdir()+"/db", generateStoreKey(c))
+	st := newTestStore(c)
+	defer st.Close()
+	k := generateKey(c)
+	iface := &store.Interface{
+		ApiUrl: "https://wiregarden.io/api",
+		Network: api.Network{
+			Id:   "test-net-id",
+			Name: "test-net",
+			CIDR: parseAddress(c, "1.2.3.0/24"),
+		},
+		Device: api.Device{
+			Id:       "test-device-id",
+			Name:     "test-device",
+			Endpoint: "example.com:51820",
+			Endpoints: []api.Endpoint{{
+				Endpoint: "fast.example.com:51820",
+				Priority: 10,
+			}},
+			Addr:      parseAddress(c, "1.2.3.4/24"),
+			PublicKey: k.PublicKey(),
+		},
+		Peers: []api.Device{{
+			Id:       "test-peer-1-id",
+			Name:     "test-peer-1",
+			Endpoint: "peer1.example.com:51820",
+			Endpoints: []api.Endpoint{{
+				Endpoint: "backup.peer1.example.com:51820",
+				Priority: -1,
+			}, {
+				Endpoint: "lan.peer1.example.com:51820",
+				Priority: 5,
+			}},
+			Addr:      parseAddress(c, "1.2.3.5/24"),
+			PublicKey: generateKey(c).PublicKey(),
+		}, {
+			Id:        "test-peer-2-id",
+			Name:      "test-peer-2",
+			Endpoint:  "peer2.example.com:51820",
+			Addr:      parseAddress(c, "1.2.3.6/24"),
+			PublicKey: generateKey(c).PublicKey(),
+		}},
+		ListenPort:  12345,
+		Key:         k,
+		DeviceToken: []byte("itsasecrettoeverybody"),
+	}
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+
+	iface2, err := st.Interface(iface.Id)
 	c.Assert(err, qt.IsNil)
+	c.Assert(iface2, qt.DeepEquals, iface)
+
+	c.Assert(iface2.Device.PreferredEndpoint(), qt.Equals, "fast.example.com:51820")
+	c.Assert(iface2.Peers[0].SortedEndpoints(), qt.DeepEquals, []api.Endpoint{{
+		Endpoint: "lan.peer1.example.com:51820",
+		Priority: 5,
+	}, {
+		Endpoint: "peer1.example.com:51820",
+	}, {
+		Endpoint: "backup.peer1.example.com:51820",
+		Priority: -1,
+	}})
+	cfg := iface2.Config()
+	c.Assert(cfg.Peers, qt.HasLen, 2)
+	c.Assert(cfg.Peers[0].Endpoint, qt.Equals, "lan.peer1.example.com:51820")
+	c.Assert(cfg.Peers[1].Endpoint, qt.Equals, "peer2.example.com:51820")
+}
+
+func TestInterfaceLog(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
 	defer st.Close()
 	k := generateKey(c)
 	iface := &store.Interface{
@@ -160,7 +403,7 @@ func TestInterfaceLog(t *testing.T) {
 			PublicKey: generateKey(c).PublicKey(),
 		}},
 	}
-	err = st.EnsureInterface(iface)
+	err := st.EnsureInterface(iface)
 	c.Assert(err, qt.IsNil)
 	err = st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
 		c.Assert(lastLog, qt.IsNil)
@@ -195,10 +438,352 @@ func TestInterfaceLog(t *testing.T) {
 	})
 }
 
-func TestInterfaceUpsertUniqueConflict(t *testing.T) {
+func TestOperationStateValid(t *testing.T) {
+	c := qt.New(t)
+	for _, op := range []store.Operation{
+		store.OpJoinDevice, store.OpApplyDevice, store.OpRefreshDevice, store.OpDeleteDevice,
+		store.OpTeardownDevice,
+	} {
+		c.Assert(op.IsValid(), qt.IsTrue, qt.Commentf("%s", op))
+	}
+	c.Assert(store.Operation("bogus").IsValid(), qt.IsFalse)
+	c.Assert(store.Operation("").IsValid(), qt.IsFalse)
+	for _, st := range []store.State{
+		store.StateInterfaceJoined, store.StateInterfaceUp, store.StateInterfaceBlocked,
+		store.StateInterfaceDeparted, store.StateInterfaceRevoked, store.StateInterfaceDown,
+		store.StateInterfaceExpired,
+	} {
+		c.Assert(st.IsValid(), qt.IsTrue, qt.Commentf("%s", st))
+	}
+	c.Assert(store.State("bogus").IsValid(), qt.IsFalse)
+	c.Assert(store.State("").IsValid(), qt.IsFalse)
+
+	// Callers cannot change what is valid.
+	c.Assert(store.Operations(), qt.HasLen, 5)
+	store.Operations()[0] = "bogus"
+	c.Assert(store.OpJoinDevice.IsValid(), qt.IsTrue)
+	c.Assert(store.Operation("bogus").IsValid(), qt.IsFalse)
+	c.Assert(store.States(), qt.HasLen, 7)
+	store.States()[0] = "bogus"
+	c.Assert(store.StateInterfaceJoined.IsValid(), qt.IsTrue)
+	c.Assert(store.State("bogus").IsValid(), qt.IsFalse)
+}
+
+func TestAppendLogInvalid(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 0)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	err = st.Transaction(func(tx *sql.Tx) error {
+		return store.AppendLogTx(tx, iface, "bogus", store.StateInterfaceUp, false, "")
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot append log for interface "wgn001": invalid operation "bogus"`)
+	err = st.Transaction(func(tx *sql.Tx) error {
+		return store.AppendLogTx(tx, iface, store.OpApplyDevice, "bogus", false, "")
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot append log for interface "wgn001": invalid state "bogus"`)
+	_, err = st.LastLog(iface)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestAppendLogCancelled(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 0)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = st.Transaction(func(tx *sql.Tx) error {
+		return store.AppendLogTxContext(ctx, tx, iface, store.OpJoinDevice, store.StateInterfaceJoined, true, "")
+	})
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue, qt.Commentf("err: %v", err))
+	err = st.WithLogContext(ctx, iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+		return store.AppendLogTx(tx, iface, store.OpJoinDevice, store.StateInterfaceJoined, true, "")
+	})
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue, qt.Commentf("err: %v", err))
+	_, err = st.LastLog(iface)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestLookupByDeviceCancelled(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 1)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = st.InterfaceByDeviceContext(ctx, iface.Device.Name, iface.Network.Name)
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue, qt.Commentf("err: %v", err))
+	_, err = st.LastLogByDeviceContext(ctx, iface.Device.Name, iface.Network.Name)
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue, qt.Commentf("err: %v", err))
+
+	// The lookups succeed with a live context.
+	result, err := st.InterfaceByDeviceContext(context.Background(), iface.Device.Name, iface.Network.Name)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Id, qt.Equals, iface.Id)
+	withLog, err := st.LastLogByDeviceContext(context.Background(), iface.Device.Name, iface.Network.Name)
+	c.Assert(err, qt.IsNil)
+	c.Assert(withLog.Id, qt.Equals, iface.Id)
+	c.Assert(withLog.Log.Operation, qt.Equals, store.OpRefreshDevice)
+}
+
+func TestWithLogContextRollback(t *testing.T) {
 	c := qt.New(t)
-	st, err := store.New(c.Mkdir()+"/db", generateStoreKey(c))
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 0)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface, 1)
+
+	// Work done in the transaction is rolled back if f fails.
+	errFailed := errors.New("failed")
+	err = st.WithLogContext(context.Background(), iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+		c.Assert(lastLog, qt.Not(qt.IsNil))
+		c.Assert(lastLog.Message, qt.Equals, "log 0")
+		iface.ListenPort = 40000
+		err := st.EnsureInterfaceTx(tx, iface)
+		c.Assert(err, qt.IsNil)
+		err = store.AppendLogTx(tx, iface, store.OpApplyDevice, store.StateInterfaceUp, false, "applied")
+		c.Assert(err, qt.IsNil)
+		return errFailed
+	})
+	c.Assert(errors.Is(err, errFailed), qt.IsTrue)
+
+	// It is also rolled back if the context is cancelled before commit.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = st.WithLogContext(ctx, iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+		err := store.AppendLogTx(tx, iface, store.OpApplyDevice, store.StateInterfaceUp, false, "applied")
+		c.Assert(err, qt.IsNil)
+		cancel()
+		return nil
+	})
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.ListenPort, qt.Equals, 30001)
+	lastLog, err := st.LastLog(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(lastLog.Message, qt.Equals, "log 0")
+}
+
+func TestMarkDirty(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 0)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+
+	// There is no entry to inherit the operation and state from.
+	err = st.MarkDirty(iface, "dirty")
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue, qt.Commentf("err: %v", err))
+
+	err = st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+		return store.AppendLogTx(tx, iface, store.OpApplyDevice, store.StateInterfaceUp, false, "applied")
+	})
+	c.Assert(err, qt.IsNil)
+	err = st.MarkDirty(iface, "peers changed")
+	c.Assert(err, qt.IsNil)
+	lastLog, err := st.LastLog(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(lastLog.Operation, qt.Equals, store.OpApplyDevice)
+	c.Assert(lastLog.State, qt.Equals, store.StateInterfaceUp)
+	c.Assert(lastLog.Dirty, qt.IsTrue)
+	c.Assert(lastLog.Message, qt.Equals, "peers changed")
+	dirty, err := st.DirtyInterfaces()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dirty, qt.HasLen, 1)
+
+	err = st.MarkClean(iface, "reconciled")
+	c.Assert(err, qt.IsNil)
+	lastLog, err = st.LastLog(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(lastLog.Operation, qt.Equals, store.OpApplyDevice)
+	c.Assert(lastLog.State, qt.Equals, store.StateInterfaceUp)
+	c.Assert(lastLog.Dirty, qt.IsFalse)
+	c.Assert(lastLog.Message, qt.Equals, "reconciled")
+	dirty, err = st.DirtyInterfaces()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dirty, qt.HasLen, 0)
+	history, err := st.LogHistory(iface, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(history, qt.HasLen, 3)
+}
+
+func TestLatestByOperation(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 0)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	other := newTestInterface(c, "test-net", 2, 0)
+	err = st.EnsureInterface(other)
+	c.Assert(err, qt.IsNil)
+	logs := []struct {
+		iface *store.Interface
+		op    store.Operation
+		state store.State
+		msg   string
+	}{
+		{iface, store.OpJoinDevice, store.StateInterfaceJoined, "joined"},
+		{iface, store.OpApplyDevice, store.StateInterfaceUp, "up 1"},
+		{iface, store.OpRefreshDevice, store.StateInterfaceBlocked, "blocked"},
+		{iface, store.OpApplyDevice, store.StateInterfaceUp, "up 2"},
+		{iface, store.OpApplyDevice, store.StateInterfaceBlocked, "apply blocked"},
+		{other, store.OpApplyDevice, store.StateInterfaceUp, "other up"},
+	}
+	err = st.Transaction(func(tx *sql.Tx) error {
+		for _, l := range logs {
+			err := store.AppendLogTx(tx, l.iface, l.op, l.state, false, l.msg)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	c.Assert(err, qt.IsNil)
+
+	l, err := st.LatestByOperation(iface.Id, store.OpApplyDevice, store.StateInterfaceUp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(l.Message, qt.Equals, "up 2")
+	c.Assert(l.Operation, qt.Equals, store.OpApplyDevice)
+	c.Assert(l.State, qt.Equals, store.StateInterfaceUp)
+	l, err = st.LatestByOperation(iface.Id, store.OpJoinDevice, store.StateInterfaceJoined)
+	c.Assert(err, qt.IsNil)
+	c.Assert(l.Message, qt.Equals, "joined")
+
+	_, err = st.LatestByOperation(iface.Id, store.OpRefreshDevice, store.StateInterfaceUp)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+	_, err = st.LatestByOperation(other.Id+1, store.OpApplyDevice, store.StateInterfaceUp)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestDirtyInterfaces(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	// Interface 1 is dirty, 2 was dirty but has since been applied, 3 is
+	// clean, 4 has no logs and 5 is dirty but archived.
+	logs := map[int][]bool{
+		1: {false, true},
+		2: {true, false},
+		3: {false},
+		5: {true},
+	}
+	var ifaces []*store.Interface
+	for n := 1; n <= 5; n++ {
+		iface := newTestInterface(c, "test-net", n, 1)
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		err = st.Transaction(func(tx *sql.Tx) error {
+			for _, dirty := range logs[n] {
+				err := store.AppendLogTx(tx, iface, store.OpRefreshDevice, store.StateInterfaceUp, dirty, "")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		c.Assert(err, qt.IsNil)
+		ifaces = append(ifaces, iface)
+	}
+	err := st.ArchiveInterface(ifaces[4].Id)
+	c.Assert(err, qt.IsNil)
+
+	dirty, err := st.DirtyInterfaces()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dirty, qt.HasLen, 1)
+	c.Assert(dirty[0].Interface, qt.DeepEquals, *ifaces[0])
+	c.Assert(dirty[0].Log.Dirty, qt.IsTrue)
+}
+
+func TestInterfaceTimestamps(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	now := time.Unix(1600000000, 0)
+	store.SetNow(st, func() time.Time { return now })
+
+	iface := newTestInterface(c, "test-net", 1, 1)
+	err := st.EnsureInterface(iface)
 	c.Assert(err, qt.IsNil)
+	c.Assert(iface.CreatedAt, qt.DeepEquals, now)
+	c.Assert(iface.UpdatedAt, qt.DeepEquals, now)
+
+	created := now
+	now = now.Add(time.Hour)
+	iface.ListenPort++
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iface.CreatedAt, qt.DeepEquals, created)
+	c.Assert(iface.UpdatedAt, qt.DeepEquals, now)
+
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.CreatedAt, qt.DeepEquals, created)
+	c.Assert(result.UpdatedAt, qt.DeepEquals, now)
+	result, err = st.InterfaceByDevice(iface.Device.Name, "test-net")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.CreatedAt, qt.DeepEquals, created)
+	c.Assert(result.UpdatedAt, qt.DeepEquals, now)
+	ifaces, _, err := st.Interfaces(store.ListOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ifaces, qt.HasLen, 1)
+	c.Assert(ifaces[0].CreatedAt, qt.DeepEquals, created)
+	c.Assert(ifaces[0].UpdatedAt, qt.DeepEquals, now)
+}
+
+func TestEnsureInterfaces(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	var ifaces []*store.Interface
+	for i := 0; i < 3; i++ {
+		ifaces = append(ifaces, newTestInterface(c, fmt.Sprintf("test-net-%d", i), i+1, 2))
+	}
+	err := st.EnsureInterfaces(ifaces)
+	c.Assert(err, qt.IsNil)
+	for _, iface := range ifaces {
+		c.Assert(iface.Id, qt.Not(qt.Equals), int64(0))
+		result, err := st.Interface(iface.Id)
+		c.Assert(err, qt.IsNil)
+		c.Assert(result, qt.DeepEquals, iface)
+	}
+}
+
+func TestEnsureInterfacesRollback(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface1 := newTestInterface(c, "test-net-1", 1, 2)
+	iface2 := newTestInterface(c, "test-net-2", 2, 2)
+	// The second interface conflicts with the listen port of the first.
+	iface2.ListenPort = iface1.ListenPort
+	err := st.EnsureInterfaces([]*store.Interface{iface1, iface2})
+	c.Assert(errors.Is(err, store.ErrListenPortInUse), qt.IsTrue, qt.Commentf("err: %v", err))
+	c.Assert(err, qt.ErrorMatches, `failed to ensure interface 2 of 2: .*`)
+	// Neither interface is saved, or assigned an id.
+	c.Assert(iface1.Id, qt.Equals, int64(0))
+	ifaces, total, err := st.Interfaces(store.ListOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ifaces, qt.HasLen, 0)
+	c.Assert(total, qt.Equals, 0)
+}
+
+func TestInterfaceUpsertUniqueConflict(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
 	defer st.Close()
 	k := generateKey(c)
 	iface := store.Interface{
@@ -220,7 +805,7 @@ func TestInterfaceUpsertUniqueConflict(t *testing.T) {
 		DeviceToken: []byte("itsasecrettoeverybody"),
 	}
 	iface2 := iface
-	err = st.EnsureInterface(&iface)
+	err := st.EnsureInterface(&iface)
 	c.Assert(err, qt.IsNil)
 	c.Assert(iface.Name(), qt.Equals, "wgn001")
 	err = st.EnsureInterface(&iface)
@@ -239,6 +824,2660 @@ func TestInterfaceUpsertUniqueConflict(t *testing.T) {
 	c.Assert(iface, qt.DeepEquals, iface2)
 }
 
+func TestInterfaceAddressValidation(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 2)
+	iface.Network.CIDR = parseAddress(c, "10.1.0.0/16")
+	iface.Device.Addr = parseAddress(c, "10.1.0.1/16")
+	iface.Peers[0].Addr = parseAddress(c, "10.1.0.2/16")
+	iface.Peers[1].Addr = parseAddress(c, "10.1.255.254/16")
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+
+	iface.Device.Addr = parseAddress(c, "10.2.0.1/16")
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.ErrorMatches, `device "test-net-device-1-id" address "10.2.0.1/16" is not in network "test-net" CIDR "10.1.0.0/16"`)
+
+	// A zero address is rejected rather than persisted, even in a network
+	// which would contain it.
+	iface.Device.Addr = wireguard.Address{}
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.ErrorMatches, `device "test-net-device-1-id" has no address`)
+	iface.Network.CIDR = parseAddress(c, "0.0.0.0/0")
+	iface.Device.Addr = parseAddress(c, "0.0.0.0/0")
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.ErrorMatches, `device "test-net-device-1-id" has no address`)
+	iface.Network.CIDR = parseAddress(c, "10.1.0.0/16")
+
+	iface.Device.Addr = parseAddress(c, "10.1.0.1/16")
+	iface.Peers[1].Addr = parseAddress(c, "192.168.0.1/16")
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.ErrorMatches, `peer "test-net-device-1-peer-1-id" address "192.168.0.1/16" is not in network "test-net" CIDR "10.1.0.0/16"`)
+
+	// Only the address itself must be in the network, not all of its CIDR,
+	// so a device may have a wider mask than its network.
+	iface.Device.Addr = parseAddress(c, "10.1.0.1/8")
+	iface.Peers[1].Addr = parseAddress(c, "10.1.255.254/16")
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestInterfaceDuplicateAddress(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 3)
+	iface.Peers[2].Addr = iface.Peers[0].Addr
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.ErrorMatches, `peer "test-net-device-1-peer-2-id" address "10.1.0.2" duplicates the address of device "test-net-device-1-peer-0-id"`)
+
+	iface.Peers[2].Addr = iface.Device.Addr
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.ErrorMatches, `peer "test-net-device-1-peer-2-id" address "10.0.0.2" duplicates the address of device "test-net-device-1-id"`)
+	n, err := st.CountInterfaces()
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+}
+
+func TestSplitEndpoint(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		endpoint string
+		host     string
+		port     int
+	}{
+		{"", "", 0},
+		{"example.com", "example.com", 0},
+		{"example.com:51820", "example.com", 51820},
+		{"10.20.30.40:50607", "10.20.30.40", 50607},
+		{"[2001:db8::1]:51820", "2001:db8::1", 51820},
+		{"2001:db8::1", "2001:db8::1", 0},
+		{"example.com:http", "example.com:http", 0},
+	}
+	for _, test := range tests {
+		c.Run(test.endpoint, func(c *qt.C) {
+			host, port := store.SplitEndpoint(test.endpoint)
+			c.Assert(host, qt.Equals, test.host)
+			c.Assert(port, qt.Equals, test.port)
+			c.Assert(store.JoinEndpoint(host, port), qt.Equals, test.endpoint)
+		})
+	}
+}
+
+func TestMigrateEndpointColumns(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	db, err := sql.Open("sqlite3", "file:"+path)
+	c.Assert(err, qt.IsNil)
+	_, err = db.Exec(`
+create table iface (
+	id integer primary key autoincrement,
+	created_at integer,
+	updated_at integer,
+	api_url text not null,
+	net_id text not null,
+	net_name text not null,
+	net_cidr text not null,
+	device_id text not null,
+	device_name text not null,
+	device_endpoint text not null,
+	device_addr text not null,
+	public_key text not null,
+	listen_port integer
+);
+create table peer (
+	iface_id integer not null,
+	device_id text not null,
+	device_name text not null,
+	device_endpoint text not null,
+	device_addr text not null,
+	public_key blob not null,
+	foreign key(iface_id) references iface(id)
+);
+insert into iface (
+	id, api_url, net_id, net_name, net_cidr,
+	device_id, device_name, device_endpoint, device_addr, public_key)
+values (
+	1, 'https://wiregarden.io/api', 'test-net-id', 'test-net', '1.2.3.0/24',
+	'test-device-id', 'test-device', '[2001:db8::1]:51820', '1.2.3.4/24', 'key');
+insert into peer (iface_id, device_id, device_name, device_endpoint, device_addr, public_key)
+values (1, 'test-peer-id', 'test-peer', 'peer.example.com:31313', '1.2.3.5/24', 'key');
+`)
+	c.Assert(err, qt.IsNil)
+	c.Assert(db.Close(), qt.IsNil)
+
+	st, err := store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Close(), qt.IsNil)
+	// Opening again does not repeat the migration.
+	st, err = store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Close(), qt.IsNil)
+
+	db, err = sql.Open("sqlite3", "file:"+path)
+	c.Assert(err, qt.IsNil)
+	defer db.Close()
+	var host string
+	var port int
+	err = db.QueryRow(`select endpoint_host, endpoint_port from iface where id = 1`).Scan(&host, &port)
+	c.Assert(err, qt.IsNil)
+	c.Assert(host, qt.Equals, "2001:db8::1")
+	c.Assert(port, qt.Equals, 51820)
+	err = db.QueryRow(`select endpoint_host, endpoint_port from peer where iface_id = 1`).Scan(&host, &port)
+	c.Assert(err, qt.IsNil)
+	c.Assert(host, qt.Equals, "peer.example.com")
+	c.Assert(port, qt.Equals, 31313)
+}
+
+func TestMigrateSchemaVersion(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	db, err := sql.Open("sqlite3", "file:"+path)
+	c.Assert(err, qt.IsNil)
+	_, err = db.Exec(`
+create table schema_version (
+	version integer primary key,
+	applied_at integer not null
+);
+insert into schema_version (version, applied_at) values (1, 0);
+create table iface (
+	id integer primary key autoincrement,
+	created_at integer,
+	updated_at integer,
+	api_url text not null,
+	net_id text not null,
+	net_name text not null,
+	net_cidr text not null,
+	device_id text not null,
+	device_name text not null,
+	device_endpoint text not null,
+	device_addr text not null,
+	public_key text not null,
+	listen_port integer
+);
+create table peer (
+	iface_id integer not null,
+	device_id text not null,
+	device_name text not null,
+	device_endpoint text not null,
+	device_addr text not null,
+	public_key blob not null,
+	foreign key(iface_id) references iface(id)
+);
+create table iface_log (
+	id integer primary key autoincrement,
+	ts integer,
+	iface_id integer not null,
+	operation text not null,
+	state text not null,
+	dirty bool not null default false,
+	message text not null,
+	foreign key(iface_id) references iface(id)
+);
+insert into iface (
+	id, api_url, net_id, net_name, net_cidr,
+	device_id, device_name, device_endpoint, device_addr, public_key)
+values (
+	1, 'https://wiregarden.io/api', 'test-net-id', 'test-net', '1.2.3.0/24',
+	'test-device-id', 'test-device', 'example.com:51820', '1.2.3.4/24', 'key');
+`)
+	c.Assert(err, qt.IsNil)
+	c.Assert(db.Close(), qt.IsNil)
+
+	st, err := store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	version, err := st.SchemaVersion()
+	c.Assert(err, qt.IsNil)
+	c.Assert(version, qt.Equals, store.LatestSchemaVersion)
+	c.Assert(st.Close(), qt.IsNil)
+
+	db, err = sql.Open("sqlite3", "file:"+path)
+	c.Assert(err, qt.IsNil)
+	defer db.Close()
+	// Only the pending migrations were applied, each recorded once.
+	var applied, first int
+	err = db.QueryRow(`select count(*), min(version) from schema_version where applied_at > 0`).Scan(&applied, &first)
+	c.Assert(err, qt.IsNil)
+	c.Assert(applied, qt.Equals, store.LatestSchemaVersion-1)
+	c.Assert(first, qt.Equals, 2)
+	var host, subscriptionId string
+	var port int
+	err = db.QueryRow(`select endpoint_host, endpoint_port, subscription_id from iface where id = 1`).Scan(
+		&host, &port, &subscriptionId)
+	c.Assert(err, qt.IsNil)
+	c.Assert(host, qt.Equals, "example.com")
+	c.Assert(port, qt.Equals, 51820)
+	c.Assert(subscriptionId, qt.Equals, "")
+}
+
+func TestStatusOverview(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+
+	iface1 := newTestInterface(c, "test-net", 1, 2)
+	iface1.Device.Endpoint = "[2001:db8::1]:51820"
+	err := st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	iface2 := newTestInterface(c, "other-net", 2, 0)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+	err = st.WithLog(iface1, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+		err := store.AppendLogTx(tx, iface1, store.OpJoinDevice, store.StateInterfaceJoined, true, "")
+		c.Assert(err, qt.IsNil)
+		err = store.AppendLogTx(tx, iface1, store.OpJoinDevice, store.StateInterfaceUp, false, "hello")
+		c.Assert(err, qt.IsNil)
+		return nil
+	})
+	c.Assert(err, qt.IsNil)
+
+	rows, err := st.StatusOverview()
+	c.Assert(err, qt.IsNil)
+	c.Assert(rows, qt.HasLen, 2)
+	c.Assert(rows[0].Log, qt.Not(qt.IsNil))
+	c.Assert(rows[0], qt.DeepEquals, store.StatusRow{
+		Id:          iface1.Id,
+		NetworkName: "test-net",
+		NetworkCIDR: iface1.Network.CIDR,
+		DeviceName:  iface1.Device.Name,
+		DeviceAddr:  iface1.Device.Addr,
+		Endpoint:    "[2001:db8::1]:51820",
+		ListenPort:  iface1.ListenPort,
+		PeerCount:   2,
+		Log: &store.InterfaceLog{
+			Id:        2,
+			Timestamp: rows[0].Log.Timestamp,
+			Operation: store.OpJoinDevice,
+			State:     store.StateInterfaceUp,
+			Message:   "hello",
+		},
+	})
+	c.Assert(rows[0].Name(), qt.Equals, iface1.Name())
+	c.Assert(rows[1], qt.DeepEquals, store.StatusRow{
+		Id:          iface2.Id,
+		NetworkName: "other-net",
+		NetworkCIDR: iface2.Network.CIDR,
+		DeviceName:  iface2.Device.Name,
+		DeviceAddr:  iface2.Device.Addr,
+		ListenPort:  iface2.ListenPort,
+	})
+}
+
+func TestInterfacesBySubscription(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+
+	var ifaces []*store.Interface
+	for i, subId := range []string{"sub-1", "sub-2", "sub-1", ""} {
+		iface := newTestInterface(c, "test-net", i+1, 1)
+		iface.SubscriptionId = subId
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		err = st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+			return store.AppendLogTx(tx, iface, store.OpJoinDevice, store.StateInterfaceJoined, true, "")
+		})
+		c.Assert(err, qt.IsNil)
+		ifaces = append(ifaces, iface)
+	}
+
+	result, err := st.InterfacesBySubscription("sub-1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 2)
+	c.Assert(&result[0].Interface, qt.DeepEquals, ifaces[0])
+	c.Assert(&result[1].Interface, qt.DeepEquals, ifaces[2])
+	c.Assert(result[0].Log.State, qt.Equals, store.StateInterfaceJoined)
+
+	result, err = st.InterfacesBySubscription("sub-2")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 1)
+	c.Assert(&result[0].Interface, qt.DeepEquals, ifaces[1])
+
+	result, err = st.InterfacesBySubscription("sub-3")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 0)
+}
+
+func TestInterfacesByApiUrl(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+
+	var ifaces []*store.Interface
+	for i, apiUrl := range []string{"https://wiregarden.io/api", "https://example.com/api", "https://wiregarden.io/api"} {
+		iface := newTestInterface(c, "test-net", i+1, 1)
+		iface.ApiUrl = apiUrl
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		ifaces = append(ifaces, iface)
+	}
+	err := st.ArchiveInterface(ifaces[2].Id)
+	c.Assert(err, qt.IsNil)
+
+	result, err := st.InterfacesByApiUrl("https://wiregarden.io/api")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 1)
+	c.Assert(&result[0].Interface, qt.DeepEquals, ifaces[0])
+
+	result, err = st.InterfacesByApiUrl("https://example.com/api")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 1)
+	c.Assert(&result[0].Interface, qt.DeepEquals, ifaces[1])
+
+	result, err = st.InterfacesByApiUrl("https://other.example.com/api")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 0)
+}
+
+func TestInterfacesByMachineId(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+
+	host1 := api.DeriveMachineId([]byte("host-1"), []byte("wiregarden"))
+	host2 := api.DeriveMachineId([]byte("host-2"), []byte("wiregarden"))
+	var ifaces []*store.Interface
+	for i, machineId := range [][]byte{host1, host2, host1, nil} {
+		iface := newTestInterface(c, fmt.Sprintf("net-%d", i+1), i+1, 1)
+		iface.MachineId = machineId
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		ifaces = append(ifaces, iface)
+	}
+
+	result, err := st.InterfacesByMachineId(host1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 2)
+	c.Assert(&result[0].Interface, qt.DeepEquals, ifaces[0])
+	c.Assert(&result[1].Interface, qt.DeepEquals, ifaces[2])
+
+	result, err = st.InterfacesByMachineId(host2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 1)
+	c.Assert(&result[0].Interface, qt.DeepEquals, ifaces[1])
+
+	// Archived interfaces are not included.
+	err = st.ArchiveInterface(ifaces[2].Id)
+	c.Assert(err, qt.IsNil)
+	result, err = st.InterfacesByMachineId(host1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 1)
+	c.Assert(result[0].Id, qt.Equals, ifaces[0].Id)
+
+	result, err = st.InterfacesByMachineId(api.DeriveMachineId([]byte("host-3"), []byte("wiregarden")))
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 0)
+	_, err = st.InterfacesByMachineId(nil)
+	c.Assert(err, qt.ErrorMatches, `cannot query interfaces by machine id: missing machine id`)
+
+	// Machine ids must be as derived for joining.
+	iface := newTestInterface(c, "net-5", 5, 0)
+	iface.MachineId = []byte("too short")
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.ErrorMatches, `device "net-5-device-5-id" has invalid machine id length 9`)
+}
+
+func TestInterfacesByNetwork(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+
+	var ifaces []*store.Interface
+	for i, networkName := range []string{"net-1", "net-2", "net-1", "net-3"} {
+		iface := newTestInterface(c, networkName, i+1, 2)
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		ifaces = append(ifaces, iface)
+	}
+	appendTestLogs(c, st, ifaces[2], 1)
+
+	result, err := st.InterfacesByNetwork("net-1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 2)
+	c.Assert(&result[0].Interface, qt.DeepEquals, ifaces[0])
+	c.Assert(&result[1].Interface, qt.DeepEquals, ifaces[2])
+	c.Assert(result[0].Log, qt.DeepEquals, store.InterfaceLog{})
+	c.Assert(result[1].Log.Message, qt.Equals, "log 0")
+
+	result, err = st.InterfacesByNetwork("net-2")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 1)
+	c.Assert(&result[0].Interface, qt.DeepEquals, ifaces[1])
+
+	// Archived interfaces are excluded.
+	err = st.ArchiveInterface(ifaces[3].Id)
+	c.Assert(err, qt.IsNil)
+	result, err = st.InterfacesByNetwork("net-3")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.HasLen, 0)
+}
+
+func TestSearch(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	for i, names := range [][2]string{
+		{"web-1", "prod-net"},
+		{"db_1", "prod-net"},
+		{"web-1", "dev-net"},
+		{"laptop", "home"},
+	} {
+		iface := newTestInterface(c, names[1], i+1, 0)
+		iface.Device.Name = names[0]
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+	}
+	archived := newTestInterface(c, "prod-net", 5, 0)
+	archived.Device.Name = "web-2"
+	err := st.EnsureInterface(archived)
+	c.Assert(err, qt.IsNil)
+	err = st.ArchiveInterface(archived.Id)
+	c.Assert(err, qt.IsNil)
+
+	search := func(query string) []string {
+		ifaces, err := st.Search(query)
+		c.Assert(err, qt.IsNil)
+		var names []string
+		for i := range ifaces {
+			names = append(names, ifaces[i].Network.Name+"/"+ifaces[i].Device.Name)
+		}
+		return names
+	}
+	c.Assert(search("web"), qt.DeepEquals, []string{"dev-net/web-1", "prod-net/web-1"})
+	c.Assert(search("prod"), qt.DeepEquals, []string{"prod-net/db_1", "prod-net/web-1"})
+	c.Assert(search("o"), qt.DeepEquals, []string{"home/laptop", "prod-net/db_1", "prod-net/web-1"})
+	c.Assert(search("nope"), qt.HasLen, 0)
+	// Wildcards are matched literally.
+	c.Assert(search("_"), qt.DeepEquals, []string{"prod-net/db_1"})
+	c.Assert(search("b_1"), qt.DeepEquals, []string{"prod-net/db_1"})
+	c.Assert(search("b-1"), qt.DeepEquals, []string{"dev-net/web-1", "prod-net/web-1"})
+	c.Assert(search("%"), qt.HasLen, 0)
+	c.Assert(search(`\`), qt.HasLen, 0)
+}
+
+func TestIterateInterfaces(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	defer store.SetIterateBatchSize(2)()
+	var expected []int64
+	for i := 1; i <= 5; i++ {
+		iface := newTestInterface(c, "test-net", i, 1)
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		if i == 3 {
+			err = st.ArchiveInterface(iface.Id)
+			c.Assert(err, qt.IsNil)
+			continue
+		}
+		appendTestLogs(c, st, iface, 1)
+		expected = append(expected, iface.Id)
+	}
+	var ids []int64
+	err := st.IterateInterfaces(func(iface store.InterfaceWithLog) error {
+		c.Assert(iface.Peers, qt.HasLen, 1)
+		c.Assert(iface.Log.Operation, qt.Equals, store.OpRefreshDevice)
+		ids = append(ids, iface.Id)
+		return nil
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ids, qt.DeepEquals, expected)
+}
+
+func TestIterateInterfacesAbort(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	defer store.SetIterateBatchSize(2)()
+	for i := 1; i <= 5; i++ {
+		err := st.EnsureInterface(newTestInterface(c, "test-net", i, 0))
+		c.Assert(err, qt.IsNil)
+	}
+	errStop := errors.New("stop")
+	var ids []int64
+	err := st.IterateInterfaces(func(iface store.InterfaceWithLog) error {
+		ids = append(ids, iface.Id)
+		if len(ids) == 3 {
+			return errStop
+		}
+		return nil
+	})
+	c.Assert(errors.Is(err, errStop), qt.IsTrue)
+	c.Assert(ids, qt.DeepEquals, []int64{1, 2, 3})
+}
+
+func TestInterfacesList(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	var ifaces []*store.Interface
+	for i := 0; i < 5; i++ {
+		networkName := "test-net"
+		if i%2 == 1 {
+			networkName = "other-net"
+		}
+		iface := newTestInterface(c, networkName, i+1, 1)
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		appendTestLogs(c, st, iface, i+1)
+		ifaces = append(ifaces, iface)
+	}
+	ids := func(result []store.InterfaceWithLog) []int64 {
+		var ids []int64
+		for i := range result {
+			ids = append(ids, result[i].Id)
+		}
+		return ids
+	}
+
+	result, total, err := st.Interfaces(store.ListOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(total, qt.Equals, 5)
+	c.Assert(ids(result), qt.DeepEquals, []int64{1, 2, 3, 4, 5})
+	c.Assert(&result[2].Interface, qt.DeepEquals, ifaces[2])
+	c.Assert(result[2].Log.Message, qt.Equals, "log 2")
+
+	result, total, err = st.Interfaces(store.ListOptions{Limit: 2})
+	c.Assert(err, qt.IsNil)
+	c.Assert(total, qt.Equals, 5)
+	c.Assert(ids(result), qt.DeepEquals, []int64{1, 2})
+	result, total, err = st.Interfaces(store.ListOptions{Limit: 2, Offset: 4})
+	c.Assert(err, qt.IsNil)
+	c.Assert(total, qt.Equals, 5)
+	c.Assert(ids(result), qt.DeepEquals, []int64{5})
+	result, total, err = st.Interfaces(store.ListOptions{Offset: 5})
+	c.Assert(err, qt.IsNil)
+	c.Assert(total, qt.Equals, 5)
+	c.Assert(result, qt.HasLen, 0)
+
+	result, total, err = st.Interfaces(store.ListOptions{NetworkName: "other-net"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(total, qt.Equals, 2)
+	c.Assert(ids(result), qt.DeepEquals, []int64{2, 4})
+	for i := range result {
+		c.Assert(result[i].Network.Name, qt.Equals, "other-net")
+	}
+	result, total, err = st.Interfaces(store.ListOptions{NetworkName: "test-net", Limit: 1, Offset: 1})
+	c.Assert(err, qt.IsNil)
+	c.Assert(total, qt.Equals, 3)
+	c.Assert(ids(result), qt.DeepEquals, []int64{3})
+	result, total, err = st.Interfaces(store.ListOptions{NetworkName: "test-net", DeviceName: "test-device-5"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(total, qt.Equals, 1)
+	c.Assert(ids(result), qt.DeepEquals, []int64{5})
+	result, total, err = st.Interfaces(store.ListOptions{NetworkName: "other-net", DeviceName: "test-device-5"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(total, qt.Equals, 0)
+	c.Assert(result, qt.HasLen, 0)
+}
+
+func TestUpdatePeers(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 2)
+	iface.Device.Endpoints = []api.Endpoint{{Endpoint: "example.com:51820", Priority: 1}}
+	iface.Peers[0].Endpoints = []api.Endpoint{{Endpoint: "peer.example.com:51820", Priority: 1}}
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+
+	peers := newTestInterface(c, "test-net", 2, 3).Peers
+	peers[2].Endpoints = []api.Endpoint{{Endpoint: "other.example.com:51820", Priority: 2}}
+	err = st.UpdatePeers(iface.Id, peers)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Peers, qt.DeepEquals, peers)
+	// The rest of the interface is unchanged.
+	result.Peers = iface.Peers
+	result.UpdatedAt = iface.UpdatedAt
+	c.Assert(result, qt.DeepEquals, iface)
+
+	err = st.UpdatePeers(iface.Id, nil)
+	c.Assert(err, qt.IsNil)
+	result, err = st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Peers, qt.HasLen, 0)
+	c.Assert(result.Device.Endpoints, qt.DeepEquals, iface.Device.Endpoints)
+
+	err = st.UpdatePeers(iface.Id+1, peers)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestReKeyInterface(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface1 := newTestInterface(c, "test-net", 1, 1)
+	err := st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	iface2 := newTestInterface(c, "test-net", 2, 1)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+
+	k := generateKey(c)
+	err = st.ReKeyInterface(iface1.Id, k, k.PublicKey())
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface1.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Key, qt.DeepEquals, k)
+	c.Assert(result.Device.PublicKey, qt.DeepEquals, k.PublicKey())
+	// The rest of the interface is unchanged.
+	result.Key, result.Device.PublicKey = iface1.Key, iface1.Device.PublicKey
+	result.UpdatedAt = iface1.UpdatedAt
+	c.Assert(result, qt.DeepEquals, iface1)
+
+	// The public key of another interface cannot be reused.
+	err = st.ReKeyInterface(iface2.Id, k, k.PublicKey())
+	c.Assert(err, qt.ErrorMatches, fmt.Sprintf(`cannot rekey interface %d, public key .* is used by interface %d`, iface2.Id, iface1.Id))
+	result, err = st.Interface(iface2.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.DeepEquals, iface2)
+
+	err = st.ReKeyInterface(iface2.Id+1, k, generateKey(c).PublicKey())
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestListenPortConflict(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface1 := newTestInterface(c, "test-net", 1, 1)
+	err := st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+
+	iface2 := newTestInterface(c, "test-net", 2, 1)
+	iface2.ListenPort = iface1.ListenPort
+	err = st.EnsureInterface(iface2)
+	c.Assert(errors.Is(err, store.ErrListenPortInUse), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, fmt.Sprintf(`port %d is used by interface %d: listen port in use`, iface1.ListenPort, iface1.Id))
+	n, err := st.CountInterfaces()
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+
+	// An interface may be updated without changing its port.
+	err = st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+
+	// The port of an archived interface may be reused.
+	err = st.ArchiveInterface(iface1.Id)
+	c.Assert(err, qt.IsNil)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestAllocateListenPort(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	port, err := st.AllocateListenPort(30001, 30005)
+	c.Assert(err, qt.IsNil)
+	c.Assert(port, qt.Equals, 30001)
+
+	// Taken ports are skipped. Interface n listens on port 30000 + n.
+	for _, n := range []int{1, 2, 4} {
+		err := st.EnsureInterface(newTestInterface(c, "test-net", n, 0))
+		c.Assert(err, qt.IsNil)
+	}
+	port, err = st.AllocateListenPort(30001, 30005)
+	c.Assert(err, qt.IsNil)
+	c.Assert(port, qt.Equals, 30003)
+	port, err = st.AllocateListenPort(30004, 30005)
+	c.Assert(err, qt.IsNil)
+	c.Assert(port, qt.Equals, 30005)
+
+	_, err = st.AllocateListenPort(30001, 30002)
+	c.Assert(errors.Is(err, store.ErrListenPortInUse), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `no listen port available in range 30001-30002: listen port in use`)
+
+	_, err = st.AllocateListenPort(30005, 30001)
+	c.Assert(err, qt.ErrorMatches, `invalid listen port range 30005-30001`)
+}
+
+func TestInterfacesNeedingRefresh(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	now := time.Unix(1600000000, 0)
+	store.SetNow(st, func() time.Time { return now })
+	expiresIn := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+
+	// Interface n's token expires in n hours, except the last, whose
+	// expiry is unknown.
+	var ifaces []*store.Interface
+	for n := 1; n <= 4; n++ {
+		iface := newTestInterface(c, "test-net", n, 0)
+		iface.DeviceTokenIssuedAt = &now
+		if n < 4 {
+			iface.DeviceTokenExpiresAt = expiresIn(time.Duration(n) * time.Hour)
+		}
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		ifaces = append(ifaces, iface)
+	}
+	result, err := st.Interface(ifaces[0].Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.DeviceTokenIssuedAt, qt.DeepEquals, &now)
+	c.Assert(result.DeviceTokenExpiresAt, qt.DeepEquals, expiresIn(time.Hour))
+	result, err = st.Interface(ifaces[3].Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.DeviceTokenExpiresAt, qt.IsNil)
+
+	// Storing an interface without token times keeps those already stored.
+	update := *ifaces[0]
+	update.DeviceTokenIssuedAt, update.DeviceTokenExpiresAt = nil, nil
+	err = st.EnsureInterface(&update)
+	c.Assert(err, qt.IsNil)
+	result, err = st.Interface(ifaces[0].Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.DeviceTokenIssuedAt, qt.DeepEquals, &now)
+	c.Assert(result.DeviceTokenExpiresAt, qt.DeepEquals, expiresIn(time.Hour))
+
+	ids := func(ifaces []store.InterfaceWithLog) []int64 {
+		var ids []int64
+		for i := range ifaces {
+			ids = append(ids, ifaces[i].Id)
+		}
+		return ids
+	}
+	needRefresh, err := st.InterfacesNeedingRefresh(30 * time.Minute)
+	c.Assert(err, qt.IsNil)
+	c.Assert(needRefresh, qt.HasLen, 0)
+	// The window includes tokens expiring exactly at its end.
+	needRefresh, err = st.InterfacesNeedingRefresh(2 * time.Hour)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ids(needRefresh), qt.DeepEquals, []int64{ifaces[0].Id, ifaces[1].Id})
+
+	// Tokens which have already expired need refreshing, soonest first.
+	now = now.Add(150 * time.Minute)
+	needRefresh, err = st.InterfacesNeedingRefresh(time.Hour)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ids(needRefresh), qt.DeepEquals, []int64{ifaces[0].Id, ifaces[1].Id, ifaces[2].Id})
+
+	// Archived interfaces are not refreshed.
+	err = st.ArchiveInterface(ifaces[0].Id)
+	c.Assert(err, qt.IsNil)
+	needRefresh, err = st.InterfacesNeedingRefresh(0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ids(needRefresh), qt.DeepEquals, []int64{ifaces[1].Id})
+}
+
+func TestTouch(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	now := time.Unix(1600000000, 0)
+	store.SetNow(st, func() time.Time { return now })
+	iface := newTestInterface(c, "test-net", 1, 2)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	key, deviceToken, err := store.SecretBlobs(st, iface.Id)
+	c.Assert(err, qt.IsNil)
+
+	now = now.Add(time.Minute)
+	err = st.Touch(iface.Id)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.UpdatedAt, qt.Equals, now)
+	result.UpdatedAt = iface.UpdatedAt
+	c.Assert(result, qt.DeepEquals, iface)
+	// Secrets are not re-encrypted.
+	key2, deviceToken2, err := store.SecretBlobs(st, iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key2, qt.DeepEquals, key)
+	c.Assert(deviceToken2, qt.DeepEquals, deviceToken)
+
+	err = st.Touch(iface.Id + 1)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestLabels(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 0)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	labels, err := st.GetLabels(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(labels, qt.HasLen, 0)
+
+	err = st.SetLabel(iface.Id, "env", "staging")
+	c.Assert(err, qt.IsNil)
+	err = st.SetLabel(iface.Id, "role", "router")
+	c.Assert(err, qt.IsNil)
+	// Setting a label again overwrites it.
+	err = st.SetLabel(iface.Id, "env", "prod")
+	c.Assert(err, qt.IsNil)
+	labels, err = st.GetLabels(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(labels, qt.DeepEquals, map[string]string{"env": "prod", "role": "router"})
+
+	// Labels are loaded with the interface, and kept when it is ensured.
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Labels, qt.DeepEquals, labels)
+
+	err = st.DeleteLabel(iface.Id, "role")
+	c.Assert(err, qt.IsNil)
+	err = st.DeleteLabel(iface.Id, "role")
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+	labels, err = st.GetLabels(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(labels, qt.DeepEquals, map[string]string{"env": "prod"})
+
+	err = st.SetLabel(iface.Id, "", "nope")
+	c.Assert(err, qt.ErrorMatches, `cannot set label on interface 1: missing key`)
+	err = st.SetLabel(iface.Id+1, "env", "prod")
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+	_, err = st.GetLabels(iface.Id + 1)
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+
+	// Labels are deleted with their interface, so they are not inherited by
+	// an interface replacing it with the same id.
+	err = st.ReplaceInterface(iface.Id, newTestInterface(c, "test-net", 1, 0))
+	c.Assert(err, qt.IsNil)
+	labels, err = st.GetLabels(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(labels, qt.HasLen, 0)
+}
+
+func TestReplaceInterface(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 2)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface, 2)
+
+	// The device rejoins the network with the same name but a new device id
+	// and key.
+	rejoined := newTestInterface(c, "test-net", 1, 3)
+	rejoined.Device.Id = "test-net-device-1-rejoined-id"
+	err = st.ReplaceInterface(iface.Id, rejoined)
+	c.Assert(err, qt.IsNil)
+	c.Assert(rejoined.Id, qt.Equals, iface.Id)
+	result, err := st.InterfaceByDevice(iface.Device.Name, "test-net")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.DeepEquals, rejoined)
+	// The logs of the old interface are removed with it.
+	_, err = st.LastLog(rejoined)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+
+	err = st.ReplaceInterface(iface.Id+1, newTestInterface(c, "test-net", 2, 0))
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `failed to replace interface 2: .*`)
+	_, err = st.InterfaceByDevice("test-device-2", "test-net")
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestRebindEndpoint(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	now := time.Unix(1600000000, 0)
+	store.SetNow(st, func() time.Time { return now })
+	iface := newTestInterface(c, "test-net", 1, 2)
+	iface.Device.Endpoint = "old.example.com:51820"
+	iface.Peers[0].Endpoint = "peer0.example.com:51820"
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	key, deviceToken, err := store.SecretBlobs(st, iface.Id)
+	c.Assert(err, qt.IsNil)
+
+	now = now.Add(time.Minute)
+	err = st.RebindEndpoint(iface.Id, "203.0.113.7:51821")
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.UpdatedAt, qt.Equals, now)
+	c.Assert(result.Device.Endpoint, qt.Equals, "203.0.113.7:51821")
+	// Peers and secrets are unchanged.
+	c.Assert(result.Peers, qt.DeepEquals, iface.Peers)
+	key2, deviceToken2, err := store.SecretBlobs(st, iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key2, qt.DeepEquals, key)
+	c.Assert(deviceToken2, qt.DeepEquals, deviceToken)
+
+	err = st.RebindEndpoint(iface.Id, "203.0.113.7")
+	c.Assert(err, qt.ErrorMatches, `invalid endpoint "203.0.113.7" for interface 1: .*`)
+	err = st.RebindEndpoint(iface.Id+1, "203.0.113.7:51821")
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestMoveInterfaceToNetwork(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 2)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	other := newTestInterface(c, "other-net", 1, 0)
+	other.ListenPort++
+	err = st.EnsureInterface(other)
+	c.Assert(err, qt.IsNil)
+
+	newNet := api.Network{
+		Id:   "renamed-net-id",
+		Name: "renamed-net",
+		CIDR: parseAddress(c, "10.0.0.0/8"),
+	}
+	err = st.MoveInterfaceToNetwork(iface.Id, newNet)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Network, qt.DeepEquals, newNet)
+	c.Assert(result.Key, qt.DeepEquals, iface.Key)
+	c.Assert(result.Peers, qt.DeepEquals, iface.Peers)
+	_, err = st.InterfaceByDevice(iface.Device.Name, "renamed-net")
+	c.Assert(err, qt.IsNil)
+	_, err = st.InterfaceByDevice(iface.Device.Name, "test-net")
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+
+	// The device name is already used by an interface in the network.
+	err = st.MoveInterfaceToNetwork(iface.Id, other.Network)
+	c.Assert(errors.Is(err, store.ErrDeviceNameInUse), qt.IsTrue, qt.Commentf("err: %v", err))
+	c.Assert(err, qt.ErrorMatches, `failed to move interface 1: device "test-device-1" is interface 2 in network "other-net": device name in use`)
+
+	// Addresses must be within the new network.
+	err = st.MoveInterfaceToNetwork(iface.Id, api.Network{
+		Id:   "small-net-id",
+		Name: "small-net",
+		CIDR: parseAddress(c, "10.9.0.0/24"),
+	})
+	c.Assert(err, qt.ErrorMatches, `failed to move interface 1: device address "10.0.0.2/8" is not in network "small-net" CIDR "10.9.0.0/24"`)
+
+	// Failed moves leave the interface where it was.
+	result, err = st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Network, qt.DeepEquals, newNet)
+
+	err = st.MoveInterfaceToNetwork(99, newNet)
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+}
+
+func TestSetDeviceEndpoint(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	now := time.Unix(1600000000, 0)
+	store.SetNow(st, func() time.Time { return now })
+	iface := newTestInterface(c, "test-net", 1, 3)
+	iface.Peers[0].Endpoint = "peer0.example.com:51820"
+	iface.Peers[1].Endpoint = "peer1.example.com:51820"
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+
+	now = now.Add(time.Minute)
+	err = st.SetDeviceEndpoint(iface.Id, iface.Peers[1].Id, "[2001:db8::1]:51821")
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.UpdatedAt, qt.Equals, now)
+	c.Assert(result.Peers[1].Endpoint, qt.Equals, "[2001:db8::1]:51821")
+	// The other peers are untouched.
+	result.Peers[1].Endpoint = iface.Peers[1].Endpoint
+	c.Assert(result.Peers, qt.DeepEquals, iface.Peers)
+
+	err = st.SetDeviceEndpoint(iface.Id, iface.Peers[1].Id, "example.com")
+	c.Assert(err, qt.ErrorMatches, `invalid endpoint "example.com" .*`)
+	err = st.SetDeviceEndpoint(iface.Id, "nope", "example.com:51820")
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestPeerAllowedIPs(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 2)
+	iface.Device.Endpoint = "example.com:51820"
+	iface.Peers[0].AllowedIPs = []wireguard.Address{
+		parseAddress(c, iface.Peers[0].Addr.IP.String()+"/32"),
+		parseAddress(c, "192.168.1.0/24"),
+		parseAddress(c, "fd00:1::/64"),
+	}
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Peers[0].AllowedIPs, qt.DeepEquals, iface.Peers[0].AllowedIPs)
+	c.Assert(result.Peers[1].AllowedIPs, qt.IsNil)
+
+	// Peers route their allowed IPs, or only their own address if they
+	// have none.
+	cfg := result.Config()
+	c.Assert(cfg.Peers, qt.HasLen, 2)
+	c.Assert(cfg.Peers[0].AllowedIPs, qt.DeepEquals, iface.Peers[0].AllowedIPs)
+	c.Assert(cfg.Peers[1].AllowedIPs, qt.DeepEquals, []wireguard.Address{
+		parseAddress(c, iface.Peers[1].Addr.IP.String()+"/32"),
+	})
+
+	// Allowed IPs are replaced along with the peers.
+	iface.Peers[0].AllowedIPs = iface.Peers[0].AllowedIPs[1:2]
+	err = st.UpdatePeers(iface.Id, iface.Peers)
+	c.Assert(err, qt.IsNil)
+	peers, err := st.ListPeers(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(peers[0].AllowedIPs, qt.DeepEquals, []wireguard.Address{parseAddress(c, "192.168.1.0/24")})
+}
+
+func TestPeerAllowedIPsV6(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 2)
+	iface.Network.CIDR = parseAddress(c, "fd00:1::/64")
+	iface.Device.Addr = parseAddress(c, "fd00:1::1/64")
+	iface.Device.Endpoint = "example.com:51820"
+	iface.Peers[0].Addr = parseAddress(c, "fd00:1::2/64")
+	iface.Peers[1].Addr = parseAddress(c, "fd00:1::3/64")
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+
+	// Servers route only the peer's own IPv6 address.
+	cfg := result.Config()
+	c.Assert(cfg.Peers, qt.HasLen, 2)
+	c.Assert(cfg.Peers[0].AllowedIPs, qt.DeepEquals, []wireguard.Address{parseAddress(c, "fd00:1::2/128")})
+	c.Assert(cfg.Peers[1].AllowedIPs, qt.DeepEquals, []wireguard.Address{parseAddress(c, "fd00:1::3/128")})
+}
+
+func TestPeerKeepalive(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 3)
+	iface.Peers[0].Endpoint = "example.com:51820"
+	iface.Peers[0].Keepalive = 25
+	iface.Peers[1].Endpoint = "example.com:51821"
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Peers[0].Keepalive, qt.Equals, 25)
+	c.Assert(result.Peers[1].Keepalive, qt.Equals, 0)
+
+	// Zero disables keepalive.
+	cfg := result.Config()
+	c.Assert(cfg.Peers, qt.HasLen, 2)
+	c.Assert(cfg.Peers[0].PersistentKeepalive, qt.Equals, 25)
+	c.Assert(cfg.Peers[1].PersistentKeepalive, qt.Equals, 0)
+
+	// Clients may keep connections to servers alive by default, unless the
+	// server sets its own interval.
+	cfg = result.Config(store.DefaultClientKeepalive(15))
+	c.Assert(cfg.Peers[0].PersistentKeepalive, qt.Equals, 25)
+	c.Assert(cfg.Peers[1].PersistentKeepalive, qt.Equals, 15)
+}
+
+func TestPeerCandidates(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 2)
+	iface.Peers[0].Endpoint = "example.com:51820"
+	iface.Peers[0].Candidates = []string{"192.0.2.1:51820", "198.51.100.1:51821", "example.com:51820"}
+	iface.Peers[1].Endpoint = "example.net:51820"
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Peers[0].Candidates, qt.DeepEquals, iface.Peers[0].Candidates)
+	c.Assert(result.Peers[1].Candidates, qt.IsNil)
+	c.Assert(result, qt.DeepEquals, iface)
+
+	// The first candidate is used, or the peer's endpoint if it has none.
+	cfg := result.Config()
+	c.Assert(cfg.Peers, qt.HasLen, 2)
+	c.Assert(cfg.Peers[0].Endpoint, qt.Equals, "192.0.2.1:51820")
+	c.Assert(cfg.Peers[1].Endpoint, qt.Equals, "example.net:51820")
+
+	// Candidates are replaced along with the peers.
+	iface.Peers[0].Candidates = nil
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	result, err = st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Peers[0].Candidates, qt.IsNil)
+	c.Assert(result.Config().Peers[0].Endpoint, qt.Equals, "example.com:51820")
+
+	// Candidates which cannot be stored are rejected.
+	iface.Peers[0].Candidates = []string{"192.0.2.1:51820\n198.51.100.1:51821"}
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.ErrorMatches, `.*peer ".*" has invalid candidate endpoint "192.0.2.1:51820\\n198.51.100.1:51821"`)
+	iface.Peers[0].Candidates = []string{""}
+	err = st.UpdatePeers(iface.Id, iface.Peers)
+	c.Assert(err, qt.ErrorMatches, `.*peer ".*" has invalid candidate endpoint ""`)
+	result, err = st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Peers[0].Candidates, qt.IsNil)
+}
+
+func TestListPeers(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 3)
+	iface.Device.Endpoints = []api.Endpoint{{Endpoint: "example.com:51820", Priority: 1}}
+	iface.Peers[1].Endpoints = []api.Endpoint{
+		{Endpoint: "peer.example.com:51820", Priority: 2},
+		{Endpoint: "10.20.30.40:51820", Priority: 1},
+	}
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	peers, err := st.ListPeers(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(peers, qt.DeepEquals, result.Peers)
+
+	noPeers := newTestInterface(c, "test-net", 2, 0)
+	err = st.EnsureInterface(noPeers)
+	c.Assert(err, qt.IsNil)
+	peers, err = st.ListPeers(noPeers.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(peers, qt.HasLen, 0)
+
+	_, err = st.ListPeers(noPeers.Id + 1)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestInterfaceErrors(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	st, err := store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	iface := newTestInterface(c, "test-net", 1, 0)
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+
+	_, err = st.Interface(iface.Id + 1)
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+	_, err = st.InterfaceByDevice(iface.Device.Name, "other-net")
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+	_, err = st.InterfaceByPublicKey(generateKey(c).PublicKey())
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+	c.Assert(st.Close(), qt.IsNil)
+
+	// Opening the store with the wrong key fails to decrypt the interface.
+	st, err = store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	_, err = st.Interface(iface.Id)
+	c.Assert(errors.Is(err, store.ErrDecrypt), qt.IsTrue, qt.Commentf("err: %v", err))
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsFalse)
+	_, err = st.InterfaceByDevice(iface.Device.Name, "test-net")
+	c.Assert(errors.Is(err, store.ErrDecrypt), qt.IsTrue, qt.Commentf("err: %v", err))
+}
+
+func TestInterfaceExists(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 1)
+	exists, err := st.InterfaceExists(iface.Device.Name, "test-net")
+	c.Assert(err, qt.IsNil)
+	c.Assert(exists, qt.IsFalse)
+
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	exists, err = st.InterfaceExists(iface.Device.Name, "test-net")
+	c.Assert(err, qt.IsNil)
+	c.Assert(exists, qt.IsTrue)
+	exists, err = st.InterfaceExists(iface.Device.Name, "other-net")
+	c.Assert(err, qt.IsNil)
+	c.Assert(exists, qt.IsFalse)
+
+	// Archived interfaces only exist if included.
+	err = st.ArchiveInterface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	exists, err = st.InterfaceExists(iface.Device.Name, "test-net")
+	c.Assert(err, qt.IsNil)
+	c.Assert(exists, qt.IsFalse)
+	exists, err = st.InterfaceExists(iface.Device.Name, "test-net", store.IncludeArchived)
+	c.Assert(err, qt.IsNil)
+	c.Assert(exists, qt.IsTrue)
+}
+
+func TestInterfaceByPublicKey(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface1 := newTestInterface(c, "test-net", 1, 1)
+	err := st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	iface2 := newTestInterface(c, "test-net", 2, 1)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+
+	result, err := st.InterfaceByPublicKey(iface2.Device.PublicKey)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.DeepEquals, iface2)
+
+	// Peer keys are not interface keys.
+	_, err = st.InterfaceByPublicKey(iface1.Peers[0].PublicKey)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+	_, err = st.InterfaceByPublicKey(generateKey(c).PublicKey())
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestCountInterfaces(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	n, err := st.CountInterfaces()
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+
+	for i := 0; i < 5; i++ {
+		networkName := "test-net"
+		if i >= 3 {
+			networkName = "other-net"
+		}
+		err := st.EnsureInterface(newTestInterface(c, networkName, i+1, 2))
+		c.Assert(err, qt.IsNil)
+	}
+	n, err = st.CountInterfaces()
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 5)
+	n, err = st.CountInterfacesByNetwork("test-net")
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 3)
+	n, err = st.CountInterfacesByNetwork("other-net")
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 2)
+	n, err = st.CountInterfacesByNetwork("no-such-net")
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+}
+
+func TestDeviceTokenFor(t *testing.T) {
+	c := qt.New(t)
+	sealer := &fakeSealer{}
+	st, err := store.New(c.Mkdir()+"/db", sealer)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 3)
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+
+	// Only the device token is decrypted.
+	opened := sealer.opened
+	deviceToken, err := st.DeviceTokenFor(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(deviceToken, qt.DeepEquals, result.DeviceToken)
+	c.Assert(sealer.opened, qt.Equals, opened+1)
+
+	_, err = st.DeviceTokenFor(iface.Id + 1)
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+}
+
+func TestPeerCounts(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	expected := map[int64]int{}
+	for i, peers := range []int{0, 1, 5} {
+		iface := newTestInterface(c, "test-net", i+1, peers)
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		expected[iface.Id] = peers
+		n, err := st.PeerCount(iface.Id)
+		c.Assert(err, qt.IsNil)
+		c.Assert(n, qt.Equals, peers)
+	}
+	archived := newTestInterface(c, "test-net", 4, 2)
+	err := st.EnsureInterface(archived)
+	c.Assert(err, qt.IsNil)
+	err = st.ArchiveInterface(archived.Id)
+	c.Assert(err, qt.IsNil)
+
+	// Archived interfaces are not counted, but may be looked up by id.
+	counts, err := st.PeerCounts()
+	c.Assert(err, qt.IsNil)
+	c.Assert(counts, qt.DeepEquals, expected)
+	n, err := st.PeerCount(archived.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 2)
+
+	_, err = st.PeerCount(99)
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+}
+
+func TestArchiveInterface(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	now := time.Unix(1600000000, 0)
+	store.SetNow(st, func() time.Time { return now })
+	iface1 := newTestInterface(c, "test-net", 1, 1)
+	err := st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface1, 2)
+	iface2 := newTestInterface(c, "test-net", 2, 1)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface2, 1)
+
+	err = st.ArchiveInterface(iface1.Id)
+	c.Assert(err, qt.IsNil)
+	// Archiving again is a no-op.
+	err = st.ArchiveInterface(iface1.Id)
+	c.Assert(err, qt.IsNil)
+	err = st.ArchiveInterface(iface2.Id + 1)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+
+	// Archived interfaces are excluded by default.
+	ifaces, total, err := st.Interfaces(store.ListOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(total, qt.Equals, 1)
+	c.Assert(ifaces, qt.HasLen, 1)
+	c.Assert(ifaces[0].Id, qt.Equals, iface2.Id)
+	n, err := st.CountInterfaces()
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+	_, err = st.InterfaceByDevice(iface1.Device.Name, "test-net")
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+	_, err = st.LastLogByDevice(iface1.Device.Name, "test-net")
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+
+	// Archived interfaces are included when asked, along with their history.
+	ifaces, total, err = st.Interfaces(store.ListOptions{IncludeArchived: true})
+	c.Assert(err, qt.IsNil)
+	c.Assert(total, qt.Equals, 2)
+	c.Assert(ifaces, qt.HasLen, 2)
+	c.Assert(ifaces[0].ArchivedAt, qt.DeepEquals, &now)
+	c.Assert(ifaces[1].ArchivedAt, qt.IsNil)
+	iface, err := st.InterfaceByDevice(iface1.Device.Name, "test-net", store.IncludeArchived)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iface.Id, qt.Equals, iface1.Id)
+	ifaceLog, err := st.LastLogByDevice(iface1.Device.Name, "test-net", store.IncludeArchived)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ifaceLog.Log.Message, qt.Equals, "log 1")
+
+	// Ensuring the interface again restores it.
+	err = st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	iface, err = st.InterfaceByDevice(iface1.Device.Name, "test-net")
+	c.Assert(err, qt.IsNil)
+	c.Assert(iface.ArchivedAt, qt.IsNil)
+}
+
+func TestDeleteInterface(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+
+	iface1 := newTestInterface(c, "test-net", 1, 2)
+	iface1.Peers[0].Endpoints = []api.Endpoint{{Endpoint: "example.com:51820", Priority: 1}}
+	err := st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	err = st.WithLog(iface1, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+		return store.AppendLogTx(tx, iface1, store.OpJoinDevice, store.StateInterfaceJoined, true, "")
+	})
+	c.Assert(err, qt.IsNil)
+	iface2 := newTestInterface(c, "test-net", 2, 1)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+	err = st.WithLog(iface2, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+		return store.AppendLogTx(tx, iface2, store.OpJoinDevice, store.StateInterfaceJoined, true, "")
+	})
+	c.Assert(err, qt.IsNil)
+
+	err = st.DeleteInterface(iface1.Id)
+	c.Assert(err, qt.IsNil)
+	_, err = st.Interface(iface1.Id)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+	_, err = st.LastLog(iface1)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+	ifaces, _, err := st.Interfaces(store.ListOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ifaces, qt.HasLen, 1)
+	c.Assert(&ifaces[0].Interface, qt.DeepEquals, iface2)
+
+	// Already gone
+	err = st.DeleteInterface(iface1.Id)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+
+	err = st.DeleteInterfaceByDevice(iface2.Device.Name, "test-net")
+	c.Assert(err, qt.IsNil)
+	ifaces, _, err = st.Interfaces(store.ListOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ifaces, qt.HasLen, 0)
+	err = st.DeleteInterfaceByDevice(iface2.Device.Name, "test-net")
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestLogHistory(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 1)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	other := newTestInterface(c, "test-net", 2, 1)
+	err = st.EnsureInterface(other)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, other, 1)
+
+	logs, err := st.LogHistory(iface, 10)
+	c.Assert(err, qt.IsNil)
+	c.Assert(logs, qt.HasLen, 0)
+
+	for _, entry := range []struct {
+		op    store.Operation
+		state store.State
+		dirty bool
+	}{
+		{store.OpJoinDevice, store.StateInterfaceJoined, true},
+		{store.OpApplyDevice, store.StateInterfaceUp, false},
+		{store.OpRefreshDevice, store.StateInterfaceJoined, true},
+		{store.OpApplyDevice, store.StateInterfaceBlocked, false},
+	} {
+		err := st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+			return store.AppendLogTx(tx, iface, entry.op, entry.state, entry.dirty, string(entry.state))
+		})
+		c.Assert(err, qt.IsNil)
+	}
+
+	logs, err = st.LogHistory(iface, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(logs, qt.HasLen, 4)
+	lastLog, err := st.LastLog(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(logs[0], qt.DeepEquals, *lastLog)
+	var ops []store.Operation
+	var states []store.State
+	for i := range logs {
+		c.Assert(logs[i].Timestamp.IsZero(), qt.IsFalse)
+		c.Assert(logs[i].Message, qt.Equals, string(logs[i].State))
+		ops = append(ops, logs[i].Operation)
+		states = append(states, logs[i].State)
+	}
+	c.Assert(ops, qt.DeepEquals, []store.Operation{
+		store.OpApplyDevice, store.OpRefreshDevice, store.OpApplyDevice, store.OpJoinDevice})
+	c.Assert(states, qt.DeepEquals, []store.State{
+		store.StateInterfaceBlocked, store.StateInterfaceJoined, store.StateInterfaceUp, store.StateInterfaceJoined})
+	c.Assert(logs[2].Dirty, qt.IsFalse)
+	c.Assert(logs[3].Dirty, qt.IsTrue)
+
+	limited, err := st.LogHistory(iface, 2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(limited, qt.DeepEquals, logs[:2])
+}
+
+func TestPruneLogs(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface1 := newTestInterface(c, "test-net", 1, 0)
+	err := st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface1, 3)
+	iface2 := newTestInterface(c, "test-net", 2, 0)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface2, 2)
+
+	n, err := st.PruneLogs(time.Now().Add(-time.Hour))
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(0))
+
+	// Every entry is older than the cutoff, but the most recent entry of
+	// each interface is kept.
+	lastLog1, err := st.LastLog(iface1)
+	c.Assert(err, qt.IsNil)
+	n, err = st.PruneLogs(time.Now().Add(time.Hour))
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(3))
+	lastLog, err := st.LastLog(iface1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(lastLog, qt.DeepEquals, lastLog1)
+	_, err = st.LastLog(iface2)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestStats(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	stats, err := st.Stats()
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats, qt.DeepEquals, store.StoreStats{})
+
+	iface1 := newTestInterface(c, "test-net", 1, 3)
+	err = st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface1, 2)
+	iface2 := newTestInterface(c, "test-net", 2, 2)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface2, 3)
+	err = st.ArchiveInterface(iface2.Id)
+	c.Assert(err, qt.IsNil)
+	iface3 := newTestInterface(c, "test-net", 3, 0)
+	err = st.EnsureInterface(iface3)
+	c.Assert(err, qt.IsNil)
+
+	logs1, err := st.LogHistory(iface1, 0)
+	c.Assert(err, qt.IsNil)
+	logs2, err := st.LogHistory(iface2, 0)
+	c.Assert(err, qt.IsNil)
+	stats, err = st.Stats()
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats, qt.DeepEquals, store.StoreStats{
+		Interfaces:         2,
+		ArchivedInterfaces: 1,
+		Peers:              5,
+		Logs:               5,
+		OldestLog:          logs1[len(logs1)-1].Timestamp,
+		NewestLog:          logs2[0].Timestamp,
+	})
+}
+
+func TestDBStats(t *testing.T) {
+	c := qt.New(t)
+	st, err := store.New(c.Mkdir()+"/db", generateStoreKey(c),
+		store.MaxOpenConns(2), store.MaxIdleConns(1), store.ConnMaxLifetime(time.Minute))
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	c.Assert(st.DBStats().MaxOpenConnections, qt.Equals, 2)
+
+	iface := newTestInterface(c, "test-net", 1, 2)
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface, 2)
+	_, err = st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	store.WaitStatements(st)
+	stats := st.DBStats()
+	c.Assert(stats.MaxOpenConnections, qt.Equals, 2)
+	c.Assert(stats.OpenConnections > 0, qt.IsTrue, qt.Commentf("stats: %+v", stats))
+	c.Assert(stats.OpenConnections <= 2, qt.IsTrue, qt.Commentf("stats: %+v", stats))
+	c.Assert(stats.InUse, qt.Equals, 0)
+	c.Assert(stats.Idle <= 1, qt.IsTrue, qt.Commentf("stats: %+v", stats))
+}
+
+func TestPruneLogsKeepLast(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface1 := newTestInterface(c, "test-net", 1, 0)
+	err := st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface1, 5)
+	iface2 := newTestInterface(c, "test-net", 2, 0)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+	appendTestLogs(c, st, iface2, 5)
+
+	lastLog1, err := st.LastLog(iface1)
+	c.Assert(err, qt.IsNil)
+	n, err := st.PruneLogsKeepLast(iface1, 2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(3))
+	n, err = st.PruneLogsKeepLast(iface1, 2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(0))
+	lastLog, err := st.LastLog(iface1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(lastLog, qt.DeepEquals, lastLog1)
+
+	n, err = st.PruneLogsKeepLast(iface1, 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(1))
+	_, err = st.PruneLogsKeepLast(iface1, 0)
+	c.Assert(err, qt.ErrorMatches, `cannot keep 0 log entries .*`)
+
+	// Other interfaces are not affected.
+	n, err = st.PruneLogsKeepLast(iface2, 5)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(0))
+}
+
+func TestApiUrl(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range []struct {
+		about   string
+		apiUrl  string
+		options []store.Option
+		err     string
+	}{{
+		about:  "https",
+		apiUrl: "https://wiregarden.io/api",
+	}, {
+		about:  "unmanaged",
+		apiUrl: "",
+	}, {
+		about:  "http",
+		apiUrl: "http://wiregarden.io/api",
+		err:    `"http://wiregarden.io/api" is not https: invalid API URL`,
+	}, {
+		about:   "insecure http",
+		apiUrl:  "http://localhost:8080/api",
+		options: []store.Option{store.InsecureAllowHTTP()},
+	}, {
+		about:  "unsupported scheme",
+		apiUrl: "ftp://wiregarden.io/api",
+		err:    `"ftp://wiregarden.io/api" has unsupported scheme "ftp": invalid API URL`,
+	}, {
+		about:  "missing host",
+		apiUrl: "https:///api",
+		err:    `"https:///api" has no host: invalid API URL`,
+	}, {
+		about:   "allowed host",
+		apiUrl:  "https://WireGarden.io/api",
+		options: []store.Option{store.ApiHosts("wiregarden.io")},
+	}, {
+		about:   "off allowlist host",
+		apiUrl:  "https://wiregarden.example.com/api",
+		options: []store.Option{store.ApiHosts("wiregarden.io")},
+		err:     `"https://wiregarden.example.com/api" host "wiregarden.example.com" is not allowed: invalid API URL`,
+	}} {
+		c.Run(test.about, func(c *qt.C) {
+			st, err := store.New(c.Mkdir()+"/db", generateStoreKey(c), test.options...)
+			c.Assert(err, qt.IsNil)
+			defer st.Close()
+			iface := newTestInterface(c, "test-net", 1, 1)
+			iface.ApiUrl = test.apiUrl
+			err = st.EnsureInterface(iface)
+			if test.err == "" {
+				c.Assert(err, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, test.err)
+			c.Assert(errors.Is(err, store.ErrInvalidApiUrl), qt.IsTrue)
+			ifaces, _, err := st.Interfaces(store.ListOptions{})
+			c.Assert(err, qt.IsNil)
+			c.Assert(ifaces, qt.HasLen, 0)
+		})
+	}
+}
+
+func TestApiUrlKept(t *testing.T) {
+	c := qt.New(t)
+	path, key := c.Mkdir()+"/db", generateStoreKey(c)
+	st, err := store.New(path, key, store.InsecureAllowHTTP())
+	c.Assert(err, qt.IsNil)
+	iface := newTestInterface(c, "test-net", 1, 1)
+	iface.ApiUrl = "http://localhost:8080/api"
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Close(), qt.IsNil)
+
+	// An interface saved with an http API URL may still be saved once http
+	// is no longer allowed, as long as its API URL does not change.
+	st, err = store.New(path, key)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	c.Assert(st.ValidateApiUrl(iface.ApiUrl), qt.ErrorMatches, `"http://localhost:8080/api" is not https: invalid API URL`)
+	iface.Device.Endpoint = "192.168.0.1:30001"
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	iface.ApiUrl = "http://localhost:8081/api"
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.ErrorMatches, `"http://localhost:8081/api" is not https: invalid API URL`)
+}
+
+func TestCompactLogs(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface1 := newTestInterface(c, "test-net", 1, 0)
+	err := st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	iface2 := newTestInterface(c, "test-net", 2, 0)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+	appendLog := func(iface *store.Interface, state store.State, message string) {
+		err := st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+			return store.AppendLogTx(tx, iface, store.OpRefreshDevice, state, true, message)
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	for i := 0; i < 3; i++ {
+		appendLog(iface1, store.StateInterfaceJoined, "retry")
+	}
+	appendLog(iface1, store.StateInterfaceUp, "up")
+	for i := 0; i < 4; i++ {
+		appendLog(iface1, store.StateInterfaceJoined, "retry")
+		appendLog(iface2, store.StateInterfaceJoined, "retry")
+	}
+	before, err := st.LogHistory(iface1, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(before, qt.HasLen, 8)
+
+	n, err := st.CompactLogs(iface1.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(4))
+	after, err := st.LogHistory(iface1, 0)
+	c.Assert(err, qt.IsNil)
+	// The first entry of each run remains, along with the last entry.
+	c.Assert(after, qt.DeepEquals, []store.InterfaceLog{before[0], before[3], before[4], before[7]})
+
+	n, err = st.CompactLogs(iface1.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(0))
+
+	// Other interfaces are not affected.
+	logs, err := st.LogHistory(iface2, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(logs, qt.HasLen, 4)
+}
+
+func TestTransaction(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 1)
+	err := st.Transaction(func(tx *sql.Tx) error {
+		err := st.EnsureInterfaceTx(tx, iface)
+		if err != nil {
+			return err
+		}
+		return store.AppendLogTx(tx, iface, store.OpJoinDevice, store.StateInterfaceJoined, true, "")
+	})
+	c.Assert(err, qt.IsNil)
+	l, err := st.LastLog(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(l.State, qt.Equals, store.StateInterfaceJoined)
+
+	// A returned error rolls back everything in the transaction.
+	iface2 := newTestInterface(c, "test-net", 2, 1)
+	err = st.Transaction(func(tx *sql.Tx) error {
+		err := st.EnsureInterfaceTx(tx, iface2)
+		if err != nil {
+			return err
+		}
+		err = store.AppendLogTx(tx, iface2, store.OpJoinDevice, store.StateInterfaceJoined, true, "")
+		if err != nil {
+			return err
+		}
+		return errors.New("nope")
+	})
+	c.Assert(err, qt.ErrorMatches, "nope")
+	_, err = st.Interface(iface2.Id)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+	n, err := st.CountInterfaces()
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+}
+
+func appendTestLogs(c *qt.C, st *store.Store, iface *store.Interface, n int) {
+	for i := 0; i < n; i++ {
+		err := st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+			return store.AppendLogTx(tx, iface, store.OpRefreshDevice, store.StateInterfaceJoined, true, fmt.Sprintf("log %d", i))
+		})
+		c.Assert(err, qt.IsNil)
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	st, err := store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	var ifaces []*store.Interface
+	for i := 0; i < 20; i++ {
+		iface := newTestInterface(c, "test-net", i+1, 100)
+		err := st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		ifaces = append(ifaces, iface)
+	}
+	for _, iface := range ifaces {
+		err := st.DeleteInterface(iface.Id)
+		c.Assert(err, qt.IsNil)
+	}
+	bloated := databaseSize(c, path)
+	err = st.Vacuum()
+	c.Assert(err, qt.IsNil)
+	c.Assert(databaseSize(c, path) < bloated, qt.IsTrue)
+}
+
+func TestAutoVacuum(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	st, err := store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	mode, err := store.AutoVacuumMode(st)
+	c.Assert(err, qt.IsNil)
+	c.Assert(mode, qt.Equals, 0)
+	c.Assert(st.Close(), qt.IsNil)
+
+	// Auto-vacuum is enabled on an existing store when it is reopened.
+	ticks := make(chan time.Time)
+	defer store.SetVacuumTicker(ticks)()
+	st, err = store.New(path, generateStoreKey(c), store.AutoVacuum(time.Hour))
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	mode, err = store.AutoVacuumMode(st)
+	c.Assert(err, qt.IsNil)
+	c.Assert(mode, qt.Equals, 2)
+
+	// Deleting an interface frees pages, which are reclaimed at the next
+	// interval.
+	iface := newTestInterface(c, "test-net", 1, 500)
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	err = st.DeleteInterface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	freed, err := store.FreePages(st)
+	c.Assert(err, qt.IsNil)
+	c.Assert(freed > 0, qt.IsTrue, qt.Commentf("freed %d pages", freed))
+	// The ticks are unbuffered, so the second is only received once the
+	// first has been handled.
+	ticks <- time.Now()
+	ticks <- time.Now()
+	remaining, err := store.FreePages(st)
+	c.Assert(err, qt.IsNil)
+	c.Assert(remaining < freed, qt.IsTrue, qt.Commentf("%d of %d pages remain free", remaining, freed))
+}
+
+func TestAutoVacuumNewWithDB(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	db, err := sql.Open("sqlite3", "file:"+dir+"/db?_fk=true")
+	c.Assert(err, qt.IsNil)
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("attach database ? as secret", dir+"/db.secret")
+	c.Assert(err, qt.IsNil)
+	st, err := store.NewWithDB(db, store.SQLite, generateStoreKey(c), store.AutoVacuum(time.Hour))
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	mode, err := store.AutoVacuumMode(st)
+	c.Assert(err, qt.IsNil)
+	c.Assert(mode, qt.Equals, 2)
+}
+
+// databaseSize returns the size of a store database and its write-ahead log.
+func databaseSize(c *qt.C, path string) int64 {
+	var size int64
+	for _, name := range []string{path, path + "-wal"} {
+		fi, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		c.Assert(err, qt.IsNil)
+		size += fi.Size()
+	}
+	return size
+}
+
+func TestPing(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	key := generateStoreKey(c)
+	st, err := store.New(path, key)
+	c.Assert(err, qt.IsNil)
+	ctx := context.Background()
+	err = st.Ping(ctx)
+	c.Assert(err, qt.IsNil)
+	err = st.EnsureInterface(newTestInterface(c, "test-net", 1, 1))
+	c.Assert(err, qt.IsNil)
+	err = st.Ping(ctx)
+	c.Assert(err, qt.IsNil)
+
+	// Errors keep their cause.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = st.Ping(cancelled)
+	c.Assert(err, qt.ErrorMatches, `context canceled: database unreachable`)
+	c.Assert(errors.Is(err, store.ErrDatabaseUnreachable), qt.IsTrue)
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue)
+	c.Assert(st.Close(), qt.IsNil)
+	err = st.Ping(ctx)
+	c.Assert(errors.Is(err, store.ErrDatabaseUnreachable), qt.IsTrue)
+	c.Assert(errors.Is(err, store.ErrStoreClosed), qt.IsTrue)
+
+	// A store opened with the wrong key fails to decrypt.
+	st, err = store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	err = st.Ping(ctx)
+	c.Assert(errors.Is(err, store.ErrKeyMismatch), qt.IsTrue)
+	c.Assert(errors.Is(err, store.ErrDecrypt), qt.IsTrue)
+}
+
+// fakeSealer seals secrets by reversing them, standing in for an external
+// key management service.
+type fakeSealer struct {
+	sealed, opened int
+}
+
+var errNotFakeSealed = errors.New("not sealed by fake sealer")
+
+func (s *fakeSealer) Seal(plaintext []byte) ([]byte, error) {
+	s.sealed++
+	return append([]byte("fake:"), reverse(plaintext)...), nil
+}
+
+func (s *fakeSealer) Open(sealed []byte) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, []byte("fake:")) {
+		return nil, errNotFakeSealed
+	}
+	s.opened++
+	return reverse(sealed[len("fake:"):]), nil
+}
+
+// brokenSealer seals secrets it cannot open.
+type brokenSealer struct{}
+
+func (brokenSealer) Seal(plaintext []byte) ([]byte, error) {
+	return plaintext, nil
+}
+
+func (brokenSealer) Open(sealed []byte) ([]byte, error) {
+	return reverse(sealed), nil
+}
+
+func TestSealerSelfTest(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range []struct {
+		name    string
+		sealer  store.Sealer
+		options []store.Option
+		err     string
+	}{{
+		name:   "key",
+		sealer: generateStoreKey(c),
+	}, {
+		name:   "zero key",
+		sealer: store.Key{},
+		err:    `failed to open database ".*": key is all zeros: invalid sealer`,
+	}, {
+		name:   "zero key pointer",
+		sealer: &store.Key{},
+		err:    `failed to open database ".*": key is all zeros: invalid sealer`,
+	}, {
+		name:   "broken sealer",
+		sealer: brokenSealer{},
+		err:    `failed to open database ".*": self-test opened the wrong plaintext: invalid sealer`,
+	}, {
+		name:    "broken token sealer",
+		sealer:  generateStoreKey(c),
+		options: []store.Option{store.TokenSealer(brokenSealer{})},
+		err:     `failed to open database ".*": token sealer: self-test opened the wrong plaintext: invalid sealer`,
+	}, {
+		name:    "broken sealer read-only",
+		sealer:  brokenSealer{},
+		options: []store.Option{store.ReadOnly()},
+		err:     `failed to open database ".*": self-test opened the wrong plaintext: invalid sealer`,
+	}} {
+		c.Run(test.name, func(c *qt.C) {
+			path := c.Mkdir() + "/db"
+			st, err := store.New(path, test.sealer, test.options...)
+			if test.err == "" {
+				c.Assert(err, qt.IsNil)
+				c.Assert(st.Close(), qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, test.err)
+			c.Assert(errors.Is(err, store.ErrInvalidSealer), qt.IsTrue)
+			_, err = os.Stat(path)
+			c.Assert(os.IsNotExist(err), qt.IsTrue)
+		})
+	}
+}
+
+func reverse(b []byte) []byte {
+	result := make([]byte, len(b))
+	for i := range b {
+		result[len(b)-1-i] = b[i]
+	}
+	return result
+}
+
+func TestSealer(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	sealer := &fakeSealer{}
+	st, err := store.New(path, sealer)
+	c.Assert(err, qt.IsNil)
+	// The sealer is self-tested once on New.
+	c.Assert(sealer.sealed, qt.Equals, 1)
+	c.Assert(sealer.opened, qt.Equals, 1)
+	iface := newTestInterface(c, "test-net", 1, 1)
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	c.Assert(sealer.sealed, qt.Equals, 3)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.DeepEquals, iface)
+	c.Assert(sealer.opened, qt.Equals, 3)
+	c.Assert(st.Ping(context.Background()), qt.IsNil)
+
+	// Secrets can be rotated between sealers.
+	key := generateStoreKey(c)
+	err = st.RotateKey(key)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Close(), qt.IsNil)
+
+	st, err = store.New(path, sealer)
+	c.Assert(err, qt.IsNil)
+	_, err = st.Interface(iface.Id)
+	c.Assert(err, qt.ErrorMatches, `.*not sealed by fake sealer: decrypt failed`)
+	c.Assert(errors.Is(err, store.ErrDecrypt), qt.IsTrue)
+	c.Assert(errors.Is(err, errNotFakeSealed), qt.IsTrue)
+	err = st.RotateKey(generateStoreKey(c))
+	c.Assert(errors.Is(err, store.ErrDecrypt), qt.IsTrue)
+	c.Assert(errors.Is(err, errNotFakeSealed), qt.IsTrue)
+	c.Assert(st.Close(), qt.IsNil)
+	st, err = store.New(path, key)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	result, err = st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.DeepEquals, iface)
+}
+
+func TestKeySeal(t *testing.T) {
+	c := qt.New(t)
+	key := generateStoreKey(c)
+	sealed, err := key.Seal([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(sealed[0], qt.Equals, byte(1))
+	c.Assert(sealed, qt.HasLen, 1+24+secretbox.Overhead+len("hello"))
+	opened, err := key.Open(sealed)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(opened), qt.Equals, "hello")
+
+	// Secrets sealed before the format was versioned are not opened; the
+	// store re-seals them when it is opened.
+	var nonce [24]byte
+	_, err = rand.Reader.Read(nonce[:])
+	c.Assert(err, qt.IsNil)
+	nonce[0] = 0
+	k := [32]byte(key)
+	unversioned := secretbox.Seal(nonce[:], []byte("hello"), &nonce, &k)
+	_, err = key.Open(unversioned)
+	c.Assert(err, qt.ErrorMatches, `unknown format version 0: decrypt failed`)
+
+	sealed[0] = 0xff
+	_, err = key.Open(sealed)
+	c.Assert(err, qt.ErrorMatches, `unknown format version 255: decrypt failed`)
+	c.Assert(errors.Is(err, store.ErrDecrypt), qt.IsTrue)
+	sealed[0] = 1
+	_, err = generateStoreKey(c).Open(sealed)
+	c.Assert(err, qt.ErrorMatches, `decrypt failed`)
+	c.Assert(errors.Is(err, store.ErrDecrypt), qt.IsTrue)
+}
+
+func TestResealLegacySecrets(t *testing.T) {
+	c := qt.New(t)
+	path, key := c.Mkdir()+"/db", generateStoreKey(c)
+	st, err := store.New(path, key)
+	c.Assert(err, qt.IsNil)
+	iface := newTestInterface(c, "test-net", 1, 1)
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	iface, err = st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Close(), qt.IsNil)
+
+	// Seal the secrets as they were before the format was versioned. The
+	// key's nonce happens to start with what looks like the version.
+	db, err := sql.Open("sqlite3", path+".secret")
+	c.Assert(err, qt.IsNil)
+	defer db.Close()
+	k := [32]byte(key)
+	sealLegacy := func(plaintext []byte, first byte) []byte {
+		var nonce [24]byte
+		_, err := rand.Reader.Read(nonce[:])
+		c.Assert(err, qt.IsNil)
+		nonce[0] = first
+		return secretbox.Seal(nonce[:], plaintext, &nonce, &k)
+	}
+	_, err = db.Exec(`update iface_secrets set key = ?, device_token = ? where iface_id = ?`,
+		sealLegacy(iface.Key, 1), sealLegacy(iface.DeviceToken, 7), iface.Id)
+	c.Assert(err, qt.IsNil)
+
+	// Opening the store re-seals them in the current format.
+	st, err = store.New(path, key)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.DeepEquals, iface)
+	var sealedKey, sealedToken []byte
+	err = db.QueryRow(`select key, device_token from iface_secrets where iface_id = ?`, iface.Id).Scan(&sealedKey, &sealedToken)
+	c.Assert(err, qt.IsNil)
+	for _, sealed := range [][]byte{sealedKey, sealedToken} {
+		_, err := key.Open(sealed)
+		c.Assert(err, qt.IsNil)
+	}
+}
+
+func TestKeySealFixedNonce(t *testing.T) {
+	c := qt.New(t)
+	var key store.Key
+	for i := range key {
+		key[i] = byte(i)
+	}
+	seal := func() []byte {
+		restore := store.SetNonceReader(bytes.NewReader(make([]byte, 24)))
+		defer restore()
+		sealed, err := key.Seal([]byte("hello"))
+		c.Assert(err, qt.IsNil)
+		return sealed
+	}
+	sealed := seal()
+	c.Assert(seal(), qt.DeepEquals, sealed)
+	c.Assert(sealed[:25], qt.DeepEquals, append([]byte{1}, make([]byte, 24)...))
+	c.Assert(hex.EncodeToString(sealed[25:]), qt.Equals, "9031d88e6447f0b8bf44357c58bf25f4226b9c2df7")
+	opened, err := key.Open(sealed)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(opened), qt.Equals, "hello")
+
+	// Nonces are random once restored.
+	sealed2, err := key.Seal([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(sealed2, qt.Not(qt.DeepEquals), sealed)
+}
+
+func TestRotateKey(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	oldKey, newKey := generateStoreKey(c), generateStoreKey(c)
+	st, err := store.New(path, oldKey)
+	c.Assert(err, qt.IsNil)
+	iface1 := newTestInterface(c, "test-net", 1, 1)
+	err = st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	iface2 := newTestInterface(c, "test-net", 2, 1)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+
+	err = st.RotateKey(newKey)
+	c.Assert(err, qt.IsNil)
+	// The store continues with the new key.
+	iface, err := st.Interface(iface1.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iface, qt.DeepEquals, iface1)
+	c.Assert(st.Close(), qt.IsNil)
+
+	st, err = store.New(path, newKey)
+	c.Assert(err, qt.IsNil)
+	for _, expected := range []*store.Interface{iface1, iface2} {
+		iface, err := st.Interface(expected.Id)
+		c.Assert(err, qt.IsNil)
+		c.Assert(iface.Key, qt.DeepEquals, expected.Key)
+		c.Assert(iface.DeviceToken, qt.DeepEquals, expected.DeviceToken)
+	}
+	c.Assert(st.Close(), qt.IsNil)
+
+	st, err = store.New(path, oldKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	_, err = st.Interface(iface1.Id)
+	c.Assert(err, qt.ErrorMatches, `.*decrypt failed`)
+	// Rotating from the wrong key fails without changing anything.
+	err = st.RotateKey(generateStoreKey(c))
+	c.Assert(err, qt.ErrorMatches, `.*decrypt failed`)
+}
+
+func TestTokenSealer(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	key, tokenKey := generateStoreKey(c), generateStoreKey(c)
+	st, err := store.New(path, key, store.TokenSealer(tokenKey))
+	c.Assert(err, qt.IsNil)
+	iface := newTestInterface(c, "test-net", 1, 1)
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.DeepEquals, iface)
+
+	// The private key and device token are sealed with separate keys.
+	sealedKey, sealedToken, err := store.SecretBlobs(st, iface.Id)
+	c.Assert(err, qt.IsNil)
+	_, err = tokenKey.Open(sealedKey)
+	c.Assert(err, qt.ErrorMatches, `decrypt failed`)
+	_, err = key.Open(sealedToken)
+	c.Assert(err, qt.ErrorMatches, `decrypt failed`)
+	deviceToken, err := tokenKey.Open(sealedToken)
+	c.Assert(err, qt.IsNil)
+	c.Assert(deviceToken, qt.DeepEquals, iface.DeviceToken)
+
+	// Rotating the store key leaves device tokens sealed with the token key.
+	newKey := generateStoreKey(c)
+	err = st.RotateKey(newKey)
+	c.Assert(err, qt.IsNil)
+	_, sealedToken, err = store.SecretBlobs(st, iface.Id)
+	c.Assert(err, qt.IsNil)
+	_, err = tokenKey.Open(sealedToken)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Close(), qt.IsNil)
+
+	// Device tokens cannot be opened without the token key.
+	st, err = store.New(path, newKey)
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	_, err = st.Interface(iface.Id)
+	c.Assert(err, qt.ErrorMatches, `.*decrypt failed`)
+	c.Assert(errors.Is(err, store.ErrDecrypt), qt.IsTrue)
+}
+
+func TestTokenSealerMigrate(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	key, tokenKey := generateStoreKey(c), generateStoreKey(c)
+	st, err := store.New(path, key)
+	c.Assert(err, qt.IsNil)
+	iface1 := newTestInterface(c, "test-net", 1, 1)
+	err = st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	iface2 := newTestInterface(c, "test-net", 2, 1)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Close(), qt.IsNil)
+
+	// Device tokens sealed with the store key still open once a token key
+	// is added.
+	st, err = store.New(path, key, store.TokenSealer(tokenKey))
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	for _, expected := range []*store.Interface{iface1, iface2} {
+		iface, err := st.Interface(expected.Id)
+		c.Assert(err, qt.IsNil)
+		c.Assert(iface, qt.DeepEquals, expected)
+	}
+
+	// Saving an interface re-seals its device token with the token key.
+	err = st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	_, sealedToken, err := store.SecretBlobs(st, iface1.Id)
+	c.Assert(err, qt.IsNil)
+	deviceToken, err := tokenKey.Open(sealedToken)
+	c.Assert(err, qt.IsNil)
+	c.Assert(deviceToken, qt.DeepEquals, iface1.DeviceToken)
+	_, sealedToken, err = store.SecretBlobs(st, iface2.Id)
+	c.Assert(err, qt.IsNil)
+	_, err = key.Open(sealedToken)
+	c.Assert(err, qt.IsNil)
+
+	// Rotating the store key moves the remaining device tokens to the
+	// token key.
+	err = st.RotateKey(generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	_, sealedToken, err = store.SecretBlobs(st, iface2.Id)
+	c.Assert(err, qt.IsNil)
+	_, err = tokenKey.Open(sealedToken)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	key := generateStoreKey(c)
+	// Separate stores contend for the database the way the agent and CLI do.
+	var stores []*store.Store
+	for i := 0; i < 2; i++ {
+		st, err := store.New(path, key, store.BusyTimeout(10*time.Second))
+		c.Assert(err, qt.IsNil)
+		defer st.Close()
+		stores = append(stores, st)
+	}
+
+	const workers, iterations = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		iface := newTestInterface(c, "test-net", i+1, 2)
+		st := stores[i%len(stores)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				// Step by the number of workers, so that interfaces never
+				// share a listen port.
+				iface.ListenPort += workers
+				err := st.EnsureInterface(iface)
+				if err != nil {
+					errs <- err
+					return
+				}
+				_, err = st.Interface(iface.Id)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Check(err, qt.IsNil)
+	}
+
+	rows, err := stores[0].StatusOverview()
+	c.Assert(err, qt.IsNil)
+	c.Assert(rows, qt.HasLen, workers)
+}
+
+func TestSerializeWrites(t *testing.T) {
+	c := qt.New(t)
+	st, err := store.New(c.Mkdir()+"/db", generateStoreKey(c), store.SerializeWrites())
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+
+	const workers, iterations = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers)
+	for i := 0; i < workers; i++ {
+		iface := newTestInterface(c, "test-net", i+1, 2)
+		iface.ListenPort = 0
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				err := st.EnsureInterface(iface)
+				if err == nil {
+					err = st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+						return store.AppendLogTx(tx, iface, store.OpRefreshDevice, store.StateInterfaceUp, false, "")
+					})
+				}
+				if err == nil {
+					_, err = st.PruneLogsKeepLast(iface, 2)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				_, err := st.StatusOverview()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Check(err, qt.IsNil)
+	}
+
+	rows, err := st.StatusOverview()
+	c.Assert(err, qt.IsNil)
+	c.Assert(rows, qt.HasLen, workers)
+}
+
+func TestQueryCancel(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 1)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = st.StatusOverviewContext(ctx)
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue, qt.Commentf("err: %v", err))
+	_, err = st.InterfaceContext(ctx, iface.Id)
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue, qt.Commentf("err: %v", err))
+
+	// Nothing is written once the context is cancelled.
+	err = st.EnsureInterfaceContext(ctx, newTestInterface(c, "other-net", 1, 1))
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue, qt.Commentf("err: %v", err))
+	_, err = st.InterfaceByDevice("test-device-1", "other-net")
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+}
+
+func TestPreparedStatementCache(t *testing.T) {
+	c := qt.New(t)
+	// With a single connection, preparing a statement on the database from
+	// within a transaction would wait forever.
+	st, err := store.New(c.Mkdir()+"/db", generateStoreKey(c), store.MaxOpenConns(1))
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	iface := newTestInterface(c, "test-net", 1, 2)
+	err = st.EnsureInterfaceContext(ctx, iface)
+	c.Assert(err, qt.IsNil)
+
+	// Statements first used within a transaction are cached once the
+	// connection is released, and reused after that.
+	_, err = st.InterfaceContext(ctx, iface.Id)
+	c.Assert(err, qt.IsNil)
+	n := store.CachedStatements(st)
+	c.Assert(n > 0, qt.IsTrue)
+	_, err = st.InterfaceContext(ctx, iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(store.CachedStatements(st), qt.Equals, n)
+
+	// Statements used outside a transaction are cached when first used.
+	err = st.SetLabelContext(ctx, iface.Id, "env", "prod")
+	c.Assert(err, qt.IsNil)
+	c.Assert(store.CachedStatements(st), qt.Equals, n+1)
+	err = st.SetLabelContext(ctx, iface.Id, "env", "dev")
+	c.Assert(err, qt.IsNil)
+	c.Assert(store.CachedStatements(st), qt.Equals, n+1)
+
+	// Cached statements are closed with the store.
+	err = st.Close()
+	c.Assert(err, qt.IsNil)
+	c.Assert(store.CachedStatements(st), qt.Equals, 0)
+}
+
+func TestInterfacesQueryCount(t *testing.T) {
+	c := qt.New(t)
+	// The number of queries made to list interfaces does not depend on the
+	// number of interfaces, peers or endpoints.
+	var counts []int64
+	for _, n := range []int{1, 2, 20} {
+		path := c.Mkdir() + "/db"
+		key := generateStoreKey(c)
+		st := newBenchmarkStoreAt(c, path, key, n)
+		c.Assert(st.Close(), qt.IsNil)
+
+		queries := &countingDriver{Driver: &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				_, err := conn.Exec("attach database ? as secret", []driver.Value{path + ".secret"})
+				return err
+			},
+		}}
+		db := sql.OpenDB(&countingConnector{dsn: "file:" + path + "?_fk=true", driver: queries})
+		st, err := store.NewWithDB(db, store.SQLite, key)
+		c.Assert(err, qt.IsNil)
+		atomic.StoreInt64(&queries.n, 0)
+		ifaces, _, err := st.Interfaces(store.ListOptions{})
+		c.Assert(err, qt.IsNil)
+		c.Assert(ifaces, qt.HasLen, n)
+		counts = append(counts, atomic.LoadInt64(&queries.n))
+		c.Assert(st.Close(), qt.IsNil)
+	}
+	c.Assert(counts[0] > 0, qt.IsTrue)
+	c.Assert(counts[1:], qt.DeepEquals, []int64{counts[0], counts[0]})
+}
+
+// countingDriver counts the statements executed on its connections. It
+// hides the optional interfaces of the wrapped driver, so that every query
+// is prepared and then executed through a counted statement.
+type countingDriver struct {
+	driver.Driver
+	n int64
+}
+
+func (d *countingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, n: &d.n}, nil
+}
+
+type countingConnector struct {
+	dsn    string
+	driver *countingDriver
+}
+
+func (c *countingConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *countingConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type countingConn struct {
+	driver.Conn
+	n *int64
+}
+
+func (c *countingConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &countingStmt{Stmt: stmt, n: c.n}, nil
+}
+
+type countingStmt struct {
+	driver.Stmt
+	n *int64
+}
+
+func (s *countingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	atomic.AddInt64(s.n, 1)
+	return s.Stmt.Exec(args)
+}
+
+func (s *countingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	atomic.AddInt64(s.n, 1)
+	return s.Stmt.Query(args)
+}
+
+func BenchmarkStatusOverview(b *testing.B) {
+	st := newBenchmarkStore(qt.New(b), 100)
+	defer st.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := st.StatusOverview()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStatusComposed(b *testing.B) {
+	st := newBenchmarkStore(qt.New(b), 100)
+	defer st.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := st.Interfaces(store.ListOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInterface(b *testing.B) {
+	c := qt.New(b)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 5)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := st.Interface(iface.Id)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEnsureInterfacePeers(b *testing.B) {
+	c := qt.New(b)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := st.EnsureInterface(iface)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func newBenchmarkStore(c *qt.C, n int) *store.Store {
+	return newBenchmarkStoreAt(c, c.Mkdir()+"/db", generateStoreKey(c), n)
+}
+
+// newBenchmarkStoreAt is like newBenchmarkStore, but creates the store at
+// path, sealed with key.
+func newBenchmarkStoreAt(c *qt.C, path string, key store.Key, n int) *store.Store {
+	st, err := store.New(path, key)
+	c.Assert(err, qt.IsNil)
+	for i := 0; i < n; i++ {
+		iface := newTestInterface(c, "test-net", i+1, 5)
+		err = st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		err = st.WithLog(iface, func(tx *sql.Tx, lastLog *store.InterfaceLog) error {
+			return store.AppendLogTx(tx, iface, store.OpJoinDevice, store.StateInterfaceJoined, true, "")
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	return st
+}
+
+// newTestInterface returns a new interface for device number n in the given
+// network, with the given number of peers.
+func newTestInterface(c *qt.C, networkName string, n int, peers int) *store.Interface {
+	k := generateKey(c)
+	iface := &store.Interface{
+		ApiUrl: "https://wiregarden.io/api",
+		Network: api.Network{
+			Id:   networkName + "-id",
+			Name: networkName,
+			CIDR: parseAddress(c, "10.0.0.0/8"),
+		},
+		Device: api.Device{
+			Id:        fmt.Sprintf("%s-device-%d-id", networkName, n),
+			Name:      fmt.Sprintf("test-device-%d", n),
+			Addr:      parseAddress(c, fmt.Sprintf("10.0.%d.%d/8", n/250, n%250+1)),
+			PublicKey: k.PublicKey(),
+		},
+		ListenPort:  30000 + n,
+		Key:         k,
+		DeviceToken: []byte("itsasecrettoeverybody"),
+	}
+	for i := 0; i < peers; i++ {
+		iface.Peers = append(iface.Peers, api.Device{
+			Id:        fmt.Sprintf("%s-device-%d-peer-%d-id", networkName, n, i),
+			Name:      fmt.Sprintf("test-device-%d-peer-%d", n, i),
+			Addr:      parseAddress(c, fmt.Sprintf("10.%d.%d.%d/8", i%250+1, i/250*16+n/250, n%250+1)),
+			PublicKey: generateKey(c).PublicKey(),
+		})
+	}
+	return iface
+}
+
 func parseAddress(c *qt.C, addr string) wireguard.Address {
 	a, err := wireguard.ParseAddress(addr)
 	c.Assert(err, qt.IsNil)
@@ -0,0 +1,150 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect describes how the store's schema and queries are expressed for a
+// database backend.
+//
+// The schema is written for sqlite, and translated to other backends by
+// rewriting its column types. Queries are written with ? placeholders, which
+// are rebound to numbered placeholders in backends which require them.
+// Secrets are encrypted before they are stored, so encrypted columns are the
+// same in all backends.
+type Dialect struct {
+	name string
+
+	// numbered is whether queries use numbered $N placeholders rather than
+	// ? placeholders.
+	numbered bool
+
+	// types rewrites sqlite column definitions into this dialect.
+	types *strings.Replacer
+
+	// secretSchemaSql creates the interface secrets table in the secret
+	// schema.
+	secretSchemaSql string
+
+	// columnExistsSql counts the columns of a table with a given name,
+	// taking the table and column name as arguments.
+	columnExistsSql string
+
+	// rowidSql adds explicit row ids to tables which are read in insertion
+	// order, if the database does not provide an implicit rowid column.
+	rowidSql string
+
+	// nextIdSql allocates the id of a new interface, if the database does not
+	// assign one when a null id is inserted.
+	nextIdSql string
+
+	// noLimit is a limit argument which selects all rows.
+	noLimit interface{}
+
+	// vacuumSql reclaims unused space in the database. It cannot be run
+	// in a transaction.
+	vacuumSql string
+}
+
+var (
+	// SQLite is the dialect of sqlite3 databases. The secret database must be
+	// attached as "secret" on every connection, as New does.
+	SQLite = Dialect{
+		name:  "sqlite3",
+		types: strings.NewReplacer(),
+		secretSchemaSql: `
+create table if not exists secret.iface_secrets (
+	iface_id integer primary key,
+	key blob not null,
+	device_token blob not null
+);
+`,
+		columnExistsSql: `
+select count(*) from pragma_table_info(?) where name = ?`[1:],
+		noLimit: -1,
+		// Vacuumed pages are written to the WAL, so checkpoint them into
+		// the database files to shrink them.
+		vacuumSql: `
+vacuum main;
+vacuum secret;
+pragma wal_checkpoint(truncate);
+`[1:],
+	}
+
+	// Postgres is the dialect of PostgreSQL databases. Secrets are kept in a
+	// separate "secret" schema, to which access may be restricted.
+	Postgres = Dialect{
+		name:     "postgres",
+		numbered: true,
+		types: strings.NewReplacer(
+			"integer primary key autoincrement", "bigserial primary key",
+			"integer", "bigint",
+			"blob", "bytea",
+		),
+		secretSchemaSql: `
+create schema if not exists secret;
+
+create table if not exists secret.iface_secrets (
+	iface_id bigint primary key,
+	key bytea not null,
+	device_token bytea not null
+);
+`,
+		columnExistsSql: `
+select count(*) from information_schema.columns
+where table_schema = current_schema() and table_name = ? and column_name = ?`[1:],
+		rowidSql: `
+alter table peer add column if not exists rowid bigserial;
+alter table device_endpoint add column if not exists rowid bigserial;
+`,
+		nextIdSql: `select nextval(pg_get_serial_sequence('iface', 'id'))`,
+		noLimit:   nil,
+		vacuumSql: `vacuum`,
+	}
+)
+
+// Name returns the name of the dialect.
+func (d Dialect) Name() string {
+	return d.name
+}
+
+// ddl translates a sqlite schema definition into this dialect.
+func (d Dialect) ddl(stmt string) string {
+	return d.types.Replace(stmt)
+}
+
+// rebind rewrites the ? placeholders in a query into the dialect's
+// placeholders.
+//
+// sqlite also binds numbered $N placeholders positionally, but looks up each
+// of them by name while parsing, which is slow for statements with many
+// placeholders.
+func (d Dialect) rebind(query string) string {
+	if !d.numbered || strings.IndexByte(query, '?') < 0 {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(query[i])
+	}
+	return b.String()
+}
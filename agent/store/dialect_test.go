@@ -0,0 +1,59 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"database/sql"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+)
+
+func TestRebind(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		query, rebound string
+	}{
+		{"select 1", "select 1"},
+		{"select id from iface where id = ?", "select id from iface where id = $1"},
+		{"insert into t (a, b) values (?, ?), (?, ?)", "insert into t (a, b) values ($1, $2), ($3, $4)"},
+	}
+	for _, test := range tests {
+		c.Assert(store.Rebind(test.query), qt.Equals, test.rebound)
+	}
+}
+
+func TestNewWithDB(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	db, err := sql.Open("sqlite3", "file:"+dir+"/db?_fk=true")
+	c.Assert(err, qt.IsNil)
+	// The secret database is only attached to the one connection.
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("attach database ? as secret", dir+"/db.secret")
+	c.Assert(err, qt.IsNil)
+	st, err := store.NewWithDB(db, store.SQLite, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	version, err := st.SchemaVersion()
+	c.Assert(err, qt.IsNil)
+	c.Assert(version, qt.Equals, store.LatestSchemaVersion)
+
+	iface := newTestInterface(c, "test-net", 1, 2)
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	iface2, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iface2.Peers, qt.DeepEquals, iface.Peers)
+	c.Assert(iface2.Key, qt.DeepEquals, iface.Key)
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"io"
+	"time"
+)
+
+var (
+	SplitEndpoint = splitEndpoint
+	JoinEndpoint  = joinEndpoint
+
+	LatestSchemaVersion = latestSchemaVersion
+
+	Rebind = Postgres.rebind
+)
+
+// SetNonceReader replaces the source of nonces for sealing secrets until
+// the returned function is called.
+func SetNonceReader(r io.Reader) (restore func()) {
+	orig := nonceReader
+	nonceReader = r
+	return func() {
+		nonceReader = orig
+	}
+}
+
+// SetIterateBatchSize replaces the number of interfaces loaded at a time by
+// IterateInterfaces until the returned function is called.
+func SetIterateBatchSize(n int) (restore func()) {
+	orig := iterateBatchSize
+	iterateBatchSize = n
+	return func() {
+		iterateBatchSize = orig
+	}
+}
+
+func SetNow(s *Store, now func() time.Time) {
+	s.now = now
+}
+
+func AutoVacuumMode(s *Store) (int, error) {
+	var mode int
+	err := s.db.QueryRow(`pragma main.auto_vacuum`).Scan(&mode)
+	return mode, err
+}
+
+// FreePages returns the number of free pages in the store's main and secret
+// databases.
+func FreePages(s *Store) (int, error) {
+	var main, secret int
+	err := s.db.QueryRow(`pragma main.freelist_count`).Scan(&main)
+	if err != nil {
+		return 0, err
+	}
+	err = s.db.QueryRow(`pragma secret.freelist_count`).Scan(&secret)
+	return main + secret, err
+}
+
+// SetVacuumTicker makes stores opened with auto-vacuum reclaim free pages
+// whenever a time is sent on ticks, until restored.
+func SetVacuumTicker(ticks <-chan time.Time) (restore func()) {
+	orig := vacuumTicker
+	vacuumTicker = func(time.Duration) (<-chan time.Time, func()) {
+		return ticks, func() {}
+	}
+	return func() {
+		vacuumTicker = orig
+	}
+}
+
+func SecretBlobs(s *Store, id int64) (key, deviceToken []byte, err error) {
+	err = s.db.QueryRow(s.dialect.rebind(`select key, device_token from secret.iface_secrets where iface_id = ?`), id).Scan(&key, &deviceToken)
+	return key, deviceToken, err
+}
+
+// CachedStatements returns the number of statements cached by the store,
+// once those being prepared in the background have been cached.
+func CachedStatements(s *Store) int {
+	WaitStatements(s)
+	s.stmtsMu.Lock()
+	defer s.stmtsMu.Unlock()
+	return len(s.stmts)
+}
+
+// WaitStatements waits for the statements being prepared in the background
+// to be cached, releasing their connections.
+func WaitStatements(s *Store) {
+	s.warmWg.Wait()
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UpsertHandshake records the time of the latest handshake with a peer of an
+// interface, as reported by the kernel, so that connectivity status survives
+// restarting the agent. If the interface does not exist, an error wrapping
+// ErrInterfaceNotFound is returned.
+func (s *Store) UpsertHandshake(ifaceId int64, peerDeviceId string, at time.Time) error {
+	return s.UpsertHandshakeContext(context.Background(), ifaceId, peerDeviceId, at)
+}
+
+// UpsertHandshakeContext is like UpsertHandshake, but aborts if the context
+// is cancelled.
+func (s *Store) UpsertHandshakeContext(ctx context.Context, ifaceId int64, peerDeviceId string, at time.Time) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	if peerDeviceId == "" {
+		return errors.Errorf("cannot record handshake on interface %d: missing peer device id", ifaceId)
+	}
+	result, err := s.prepared(nil).ExecContext(ctx, `
+insert into handshake (iface_id, peer_device_id, last_handshake_at)
+select id, ?, ? from iface where id = ?
+on conflict (iface_id, peer_device_id) do update set last_handshake_at = excluded.last_handshake_at`[1:],
+		peerDeviceId, at.Unix(), ifaceId)
+	if err != nil {
+		return errors.Wrapf(err, "failed to record handshake with peer %q on interface %d", peerDeviceId, ifaceId)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to record handshake with peer %q on interface %d", peerDeviceId, ifaceId)
+	}
+	if n == 0 {
+		return errors.Wrapf(ErrInterfaceNotFound, "failed to record handshake with peer %q on interface %d", peerDeviceId, ifaceId)
+	}
+	return nil
+}
+
+// Handshakes returns the time of the latest recorded handshake with each
+// current peer of an interface, keyed by peer device id. Peers without a
+// recorded handshake are omitted. If the interface does not exist, an error
+// wrapping ErrInterfaceNotFound is returned.
+func (s *Store) Handshakes(ifaceId int64) (map[string]time.Time, error) {
+	return s.HandshakesContext(context.Background(), ifaceId)
+}
+
+// HandshakesContext is like Handshakes, but aborts if the context is
+// cancelled.
+func (s *Store) HandshakesContext(ctx context.Context, ifaceId int64) (map[string]time.Time, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	q := s.prepared(tx)
+	var exists bool
+	err = q.QueryRowContext(ctx, `select exists(select 1 from iface where id = ?)`, ifaceId).Scan(&exists)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get handshakes of interface %d", ifaceId)
+	}
+	if !exists {
+		return nil, errors.Wrapf(ErrInterfaceNotFound, "failed to get handshakes of interface %d", ifaceId)
+	}
+	rows, err := q.QueryContext(ctx, `
+select h.peer_device_id, h.last_handshake_at from handshake h
+join peer p on (p.iface_id = h.iface_id and p.device_id = h.peer_device_id)
+where h.iface_id = ?`[1:], ifaceId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get handshakes of interface %d", ifaceId)
+	}
+	defer rows.Close()
+	handshakes := map[string]time.Time{}
+	for rows.Next() {
+		var peerDeviceId string
+		var at int64
+		err := rows.Scan(&peerDeviceId, &at)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to scan handshake of interface %d", ifaceId)
+		}
+		handshakes[peerDeviceId] = time.Unix(at, 0)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to get handshakes of interface %d", ifaceId)
+	}
+	return handshakes, nil
+}
+
+// SelectedEndpoint is the endpoint selected to connect to a peer, among its
+// candidate endpoints, and when it was selected.
+type SelectedEndpoint struct {
+	Endpoint   string
+	SelectedAt time.Time
+}
+
+// SelectEndpoint records the endpoint selected to connect to a peer of an
+// interface, such as when falling back to another of its candidate endpoints
+// because the one in use cannot be reached. The interface's configuration
+// uses the selected endpoint for as long as it is one of the peer's
+// candidates. If the interface does not exist, an error wrapping
+// ErrInterfaceNotFound is returned.
+func (s *Store) SelectEndpoint(ifaceId int64, peerDeviceId, endpoint string, at time.Time) error {
+	return s.SelectEndpointContext(context.Background(), ifaceId, peerDeviceId, endpoint, at)
+}
+
+// SelectEndpointContext is like SelectEndpoint, but aborts if the context is
+// cancelled.
+func (s *Store) SelectEndpointContext(ctx context.Context, ifaceId int64, peerDeviceId, endpoint string, at time.Time) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	if peerDeviceId == "" {
+		return errors.Errorf("cannot select endpoint on interface %d: missing peer device id", ifaceId)
+	}
+	if endpoint == "" {
+		return errors.Errorf("cannot select endpoint of peer %q on interface %d: missing endpoint", peerDeviceId, ifaceId)
+	}
+	result, err := s.prepared(nil).ExecContext(ctx, `
+insert into selected_endpoint (iface_id, peer_device_id, endpoint, selected_at)
+select id, ?, ?, ? from iface where id = ?
+on conflict (iface_id, peer_device_id) do update set
+	endpoint = excluded.endpoint,
+	selected_at = excluded.selected_at`[1:],
+		peerDeviceId, endpoint, at.Unix(), ifaceId)
+	if err != nil {
+		return errors.Wrapf(err, "failed to select endpoint of peer %q on interface %d", peerDeviceId, ifaceId)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to select endpoint of peer %q on interface %d", peerDeviceId, ifaceId)
+	}
+	if n == 0 {
+		return errors.Wrapf(ErrInterfaceNotFound, "failed to select endpoint of peer %q on interface %d", peerDeviceId, ifaceId)
+	}
+	return nil
+}
+
+// querySelectedEndpoints adds the endpoints selected for peers of the
+// selected interfaces to the interfaces by id.
+func querySelectedEndpoints(ctx context.Context, q querier, byId map[int64]*Interface, selected string, args ...interface{}) error {
+	rows, err := q.QueryContext(ctx, `
+select iface_id, peer_device_id, endpoint, selected_at
+from selected_endpoint`[1:]+selected, args...)
+	if err != nil {
+		return errors.Wrap(err, "failed to query selected endpoints")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ifaceId int64
+		var peerDeviceId string
+		var endpoint SelectedEndpoint
+		var selectedAt int64
+		err := rows.Scan(&ifaceId, &peerDeviceId, &endpoint.Endpoint, &selectedAt)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan selected endpoint result row")
+		}
+		iface, ok := byId[ifaceId]
+		if !ok {
+			continue
+		}
+		if iface.SelectedEndpoints == nil {
+			iface.SelectedEndpoints = map[string]SelectedEndpoint{}
+		}
+		endpoint.SelectedAt = time.Unix(selectedAt, 0)
+		iface.SelectedEndpoints[peerDeviceId] = endpoint
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to query selected endpoints")
+	}
+	return nil
+}
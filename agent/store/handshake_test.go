@@ -0,0 +1,129 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+	"github.com/wiregarden-io/wiregarden/api"
+)
+
+func TestHandshakes(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 3)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	handshakes, err := st.Handshakes(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(handshakes, qt.HasLen, 0)
+
+	t0 := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	err = st.UpsertHandshake(iface.Id, iface.Peers[0].Id, t0)
+	c.Assert(err, qt.IsNil)
+	err = st.UpsertHandshake(iface.Id, iface.Peers[1].Id, t0.Add(time.Minute))
+	c.Assert(err, qt.IsNil)
+	err = st.UpsertHandshake(iface.Id, iface.Peers[0].Id, t0.Add(2*time.Minute))
+	c.Assert(err, qt.IsNil)
+	handshakes, err = st.Handshakes(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(handshakes, qt.HasLen, 2)
+	c.Assert(handshakes[iface.Peers[0].Id].Equal(t0.Add(2*time.Minute)), qt.IsTrue)
+	c.Assert(handshakes[iface.Peers[1].Id].Equal(t0.Add(time.Minute)), qt.IsTrue)
+
+	// Handshakes with peers which have left are not returned.
+	iface.Peers = iface.Peers[1:]
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	handshakes, err = st.Handshakes(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(handshakes, qt.HasLen, 1)
+	c.Assert(handshakes[iface.Peers[0].Id].Equal(t0.Add(time.Minute)), qt.IsTrue)
+
+	err = st.UpsertHandshake(iface.Id+1, iface.Peers[0].Id, t0)
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+	_, err = st.Handshakes(iface.Id + 1)
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+
+	// Handshakes are deleted along with their interface.
+	err = st.DeleteInterface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	problems, err := st.Verify()
+	c.Assert(err, qt.IsNil)
+	c.Assert(problems, qt.HasLen, 0)
+}
+
+func TestSelectEndpoint(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 2)
+	iface.Peers[0].Endpoint = "example.com:51820"
+	iface.Peers[0].Candidates = []string{"192.0.2.1:51820", "198.51.100.1:51821"}
+	iface.Peers[1].Endpoint = "example.net:51820"
+	iface.Peers[1].Endpoints = []api.Endpoint{{Endpoint: "fast.example.net:51820", Priority: 1}}
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.SelectedEndpoints, qt.IsNil)
+	c.Assert(result.PeerEndpoint(&result.Peers[0]), qt.Equals, "192.0.2.1:51820")
+	c.Assert(result.PeerEndpoint(&result.Peers[1]), qt.Equals, "fast.example.net:51820")
+
+	t0 := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	err = st.SelectEndpoint(iface.Id, iface.Peers[0].Id, "198.51.100.1:51821", t0)
+	c.Assert(err, qt.IsNil)
+	err = st.SelectEndpoint(iface.Id, iface.Peers[1].Id, "example.net:51820", t0)
+	c.Assert(err, qt.IsNil)
+	err = st.SelectEndpoint(iface.Id, iface.Peers[1].Id, "example.net:51820", t0.Add(time.Minute))
+	c.Assert(err, qt.IsNil)
+	result, err = st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.SelectedEndpoints, qt.HasLen, 2)
+	c.Assert(result.SelectedEndpoints[iface.Peers[0].Id].Endpoint, qt.Equals, "198.51.100.1:51821")
+	c.Assert(result.SelectedEndpoints[iface.Peers[0].Id].SelectedAt.Equal(t0), qt.IsTrue)
+	c.Assert(result.SelectedEndpoints[iface.Peers[1].Id].SelectedAt.Equal(t0.Add(time.Minute)), qt.IsTrue)
+
+	// The configuration connects to peers on their selected endpoints.
+	cfg := result.Config()
+	c.Assert(cfg.Peers, qt.HasLen, 2)
+	c.Assert(cfg.Peers[0].Endpoint, qt.Equals, "198.51.100.1:51821")
+	c.Assert(cfg.Peers[1].Endpoint, qt.Equals, "example.net:51820")
+
+	// Selections are kept when the peers are updated, but no longer used
+	// once the endpoint is not one of the peer's candidates.
+	iface.Peers[0].Candidates = []string{"203.0.113.1:51820", "192.0.2.1:51820"}
+	err = st.UpdatePeers(iface.Id, iface.Peers)
+	c.Assert(err, qt.IsNil)
+	result, err = st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.SelectedEndpoints, qt.HasLen, 2)
+	c.Assert(result.PeerEndpoint(&result.Peers[0]), qt.Equals, "203.0.113.1:51820")
+	c.Assert(result.PeerEndpoint(&result.Peers[1]), qt.Equals, "example.net:51820")
+
+	err = st.SelectEndpoint(iface.Id, iface.Peers[0].Id, "", t0)
+	c.Assert(err, qt.ErrorMatches, `cannot select endpoint of peer ".*" on interface 1: missing endpoint`)
+	err = st.SelectEndpoint(iface.Id+1, iface.Peers[0].Id, "192.0.2.1:51820", t0)
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+
+	// Selections are deleted along with their interface.
+	err = st.DeleteInterface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	problems, err := st.Verify()
+	c.Assert(err, qt.IsNil)
+	c.Assert(problems, qt.HasLen, 0)
+}
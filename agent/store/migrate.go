@@ -0,0 +1,414 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const createSchemaVersionSql = `
+create table if not exists schema_version (
+	version integer primary key,
+	applied_at integer not null
+);
+`
+
+const createBaselineSchemaSql = `
+create table if not exists iface (
+	id integer primary key autoincrement,
+	created_at integer,
+	updated_at integer,
+
+	api_url text not null,
+
+	net_id text not null,
+	net_name text not null,
+	net_cidr text not null,
+
+	device_id text not null,
+	device_name text not null,
+	device_endpoint text not null,
+	device_addr text not null,
+	public_key text not null,
+
+	listen_port integer
+);
+
+create unique index if not exists iface_device_id_unique
+on iface(device_id);
+
+create unique index if not exists iface_device_net_name_unique
+on iface(net_name, device_name);
+
+create unique index if not exists iface_public_key_unique
+on iface(public_key);
+
+create table if not exists peer (
+	iface_id integer not null,
+	device_id text not null,
+	device_name text not null,
+	device_endpoint text not null,
+	device_addr text not null,
+	public_key blob not null,
+	foreign key(iface_id) references iface(id)
+);
+
+create table if not exists iface_log (
+	id integer primary key autoincrement,
+	ts integer,
+	iface_id integer not null,
+	operation text not null,
+    state text not null,
+	dirty bool not null default false,
+    message text not null,
+	foreign key(iface_id) references iface(id)
+);
+`
+
+const createDeviceEndpointSql = `
+create table if not exists device_endpoint (
+	iface_id integer not null,
+	device_id text not null,
+	endpoint text not null,
+	priority integer not null default 0,
+	foreign key(iface_id) references iface(id)
+);
+`
+
+const createIfaceLabelSql = `
+create table if not exists iface_label (
+	iface_id integer not null,
+	key text not null,
+	value text not null,
+	foreign key(iface_id) references iface(id) on delete cascade
+);
+
+create unique index if not exists iface_label_key_unique
+on iface_label(iface_id, key);
+`
+
+const createSettingSql = `
+create table if not exists setting (
+	key text primary key,
+	value text not null,
+	updated_at integer
+);
+`
+
+const createHandshakeSql = `
+create table if not exists handshake (
+	iface_id integer not null,
+	peer_device_id text not null,
+	last_handshake_at integer not null,
+	foreign key(iface_id) references iface(id) on delete cascade
+);
+
+create unique index if not exists handshake_peer_unique
+on handshake(iface_id, peer_device_id);
+`
+
+const createSelectedEndpointSql = `
+create table if not exists selected_endpoint (
+	iface_id integer not null,
+	peer_device_id text not null,
+	endpoint text not null,
+	selected_at integer not null,
+	foreign key(iface_id) references iface(id) on delete cascade
+);
+
+create unique index if not exists selected_endpoint_peer_unique
+on selected_endpoint(iface_id, peer_device_id);
+`
+
+const createPeerNameHistorySql = `
+create table if not exists peer_name_history (
+	id integer primary key autoincrement,
+	iface_id integer not null,
+	device_id text not null,
+	name text not null,
+	changed_at integer not null,
+	foreign key(iface_id) references iface(id) on delete cascade
+);
+
+create index if not exists peer_name_history_device
+on peer_name_history(iface_id, device_id);
+`
+
+// migration is a step which evolves the public schema from the prior version.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx, d Dialect) error
+}
+
+// migrations are the ordered steps which build the current public schema.
+// Steps must be appended with increasing versions and never modified once
+// released. Databases created before schema versioning was introduced are at
+// version 0, so the earliest steps must tolerate an existing schema.
+var migrations = []migration{{
+	version:     1,
+	description: "baseline schema",
+	apply:       execMigration(createBaselineSchemaSql),
+}, {
+	version:     2,
+	description: "prioritized device endpoints",
+	apply:       execMigration(createDeviceEndpointSql),
+}, {
+	version:     3,
+	description: "split endpoint host and port",
+	apply:       migrateEndpointColumns,
+}, {
+	version:     4,
+	description: "interface subscription id",
+	apply: func(tx *sql.Tx, d Dialect) error {
+		_, err := addColumn(tx, d, "iface", "subscription_id", "text not null default ''")
+		return errors.WithStack(err)
+	},
+}, {
+	version:     5,
+	description: "interface archival",
+	apply: func(tx *sql.Tx, d Dialect) error {
+		_, err := addColumn(tx, d, "iface", "deleted_at", "integer")
+		return errors.WithStack(err)
+	},
+}, {
+	version:     6,
+	description: "explicit row ids",
+	apply: func(tx *sql.Tx, d Dialect) error {
+		if d.rowidSql == "" {
+			return nil
+		}
+		_, err := tx.Exec(d.rowidSql)
+		return errors.WithStack(err)
+	},
+}, {
+	version:     7,
+	description: "device token issue and expiry times",
+	apply: func(tx *sql.Tx, d Dialect) error {
+		_, err := addColumn(tx, d, "iface", "device_token_issued_at", "integer")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = addColumn(tx, d, "iface", "device_token_expires_at", "integer")
+		return errors.WithStack(err)
+	},
+}, {
+	version:     8,
+	description: "peer allowed IPs",
+	apply: func(tx *sql.Tx, d Dialect) error {
+		_, err := addColumn(tx, d, "peer", "allowed_ips", "text not null default ''")
+		return errors.WithStack(err)
+	},
+}, {
+	version:     9,
+	description: "peer keepalive",
+	apply: func(tx *sql.Tx, d Dialect) error {
+		_, err := addColumn(tx, d, "peer", "keepalive_seconds", "integer not null default 0")
+		return errors.WithStack(err)
+	},
+}, {
+	version:     10,
+	description: "interface labels",
+	apply:       execMigration(createIfaceLabelSql),
+}, {
+	version:     11,
+	description: "agent settings",
+	apply:       execMigration(createSettingSql),
+}, {
+	version:     12,
+	description: "peer candidate endpoints",
+	apply: func(tx *sql.Tx, d Dialect) error {
+		_, err := addColumn(tx, d, "peer", "candidates", "text not null default ''")
+		return errors.WithStack(err)
+	},
+}, {
+	version:     13,
+	description: "peer handshake times",
+	apply:       execMigration(createHandshakeSql),
+}, {
+	version:     14,
+	description: "peer name history",
+	apply:       execMigration(createPeerNameHistorySql),
+}, {
+	version:     15,
+	description: "pinned peers",
+	apply: func(tx *sql.Tx, d Dialect) error {
+		_, err := addColumn(tx, d, "peer", "pinned", "bool not null default false")
+		return errors.WithStack(err)
+	},
+}, {
+	version:     16,
+	description: "interface machine id",
+	apply: func(tx *sql.Tx, d Dialect) error {
+		_, err := addColumn(tx, d, "iface", "machine_id", "text not null default ''")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = tx.Exec(`create index if not exists iface_machine_id on iface(machine_id)`)
+		return errors.WithStack(err)
+	},
+}, {
+	version:     17,
+	description: "selected peer endpoints",
+	apply:       execMigration(createSelectedEndpointSql),
+}}
+
+// latestSchemaVersion is the schema version of a fully migrated database.
+var latestSchemaVersion = migrations[len(migrations)-1].version
+
+func execMigration(stmt string) func(tx *sql.Tx, d Dialect) error {
+	return func(tx *sql.Tx, d Dialect) error {
+		_, err := tx.Exec(d.ddl(stmt))
+		return errors.WithStack(err)
+	}
+}
+
+// migrate applies all pending migrations to the public schema in a single
+// transaction, recording the version and time of each step applied.
+func migrate(db *sql.DB, d Dialect) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(d.ddl(createSchemaVersionSql))
+	if err != nil {
+		return errors.Wrap(err, "failed to create schema version table")
+	}
+	current, err := schemaVersionTx(context.Background(), tx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if current > latestSchemaVersion {
+		return errors.Errorf("schema version %d is newer than supported version %d", current, latestSchemaVersion)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err = m.apply(tx, d)
+		if err != nil {
+			return errors.Wrapf(err, "failed to apply migration %d (%s)", m.version, m.description)
+		}
+		_, err = tx.Exec(d.rebind(`
+insert into schema_version (version, applied_at) values (?, ?)`[1:]), m.version, time.Now().Unix())
+		if err != nil {
+			return errors.Wrapf(err, "failed to record migration %d", m.version)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+func schemaVersionTx(ctx context.Context, tx *sql.Tx) (int, error) {
+	var version int
+	err := tx.QueryRowContext(ctx, `select coalesce(max(version), 0) from schema_version`).Scan(&version)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to query schema version")
+	}
+	return version, nil
+}
+
+// SchemaVersion returns the version of the public schema.
+func (s *Store) SchemaVersion() (int, error) {
+	return s.SchemaVersionContext(context.Background())
+}
+
+// SchemaVersionContext is like SchemaVersion, but aborts if the context is
+// cancelled.
+func (s *Store) SchemaVersionContext(ctx context.Context) (int, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	return schemaVersionTx(ctx, tx)
+}
+
+// addColumn adds a column to a table if it does not already exist, returning
+// whether the column was added.
+func addColumn(tx *sql.Tx, d Dialect, table, column, definition string) (bool, error) {
+	var n int
+	err := tx.QueryRow(d.rebind(d.columnExistsSql), table, column).Scan(&n)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to query columns of table %q", table)
+	}
+	if n > 0 {
+		return false, nil
+	}
+	_, err = tx.Exec(`alter table ` + table + ` add column ` + column + ` ` + d.ddl(definition))
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to add column %q to table %q", column, table)
+	}
+	return true, nil
+}
+
+// migrateEndpointColumns splits the combined host:port device_endpoint column
+// into separate endpoint_host and endpoint_port columns on the iface and peer
+// tables, so that endpoints may be queried by host or port. The
+// device_endpoint column is still written with the combined form for
+// compatibility.
+func migrateEndpointColumns(tx *sql.Tx, d Dialect) error {
+	for _, table := range []string{"iface", "peer"} {
+		added, err := addColumn(tx, d, table, "endpoint_host", "text not null default ''")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !added {
+			continue
+		}
+		_, err = addColumn(tx, d, table, "endpoint_port", "integer not null default 0")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if d.rowidSql != "" {
+			// Databases without implicit row ids were never written
+			// before the endpoint was split, so there is nothing to
+			// backfill.
+			continue
+		}
+		rows, err := tx.Query(`select rowid, device_endpoint from ` + table)
+		if err != nil {
+			return errors.Wrapf(err, "failed to query endpoints in table %q", table)
+		}
+		endpoints := map[int64]string{}
+		for rows.Next() {
+			var rowid int64
+			var endpoint string
+			err := rows.Scan(&rowid, &endpoint)
+			if err != nil {
+				rows.Close()
+				return errors.Wrapf(err, "failed to scan endpoint in table %q", table)
+			}
+			endpoints[rowid] = endpoint
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return errors.Wrapf(err, "failed to query endpoints in table %q", table)
+		}
+		for rowid, endpoint := range endpoints {
+			host, port := splitEndpoint(endpoint)
+			_, err := tx.Exec(d.rebind(`update `+table+` set endpoint_host = ?, endpoint_port = ? where rowid = ?`),
+				host, port, rowid)
+			if err != nil {
+				return errors.Wrapf(err, "failed to split endpoint %q in table %q", endpoint, table)
+			}
+		}
+	}
+	return nil
+}
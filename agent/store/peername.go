@@ -0,0 +1,129 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/api"
+)
+
+// PeerName is a name a peer device was known by, and when it was first seen
+// with that name.
+type PeerName struct {
+	Name      string
+	ChangedAt time.Time
+}
+
+// recordPeerNamesTx appends the name of each peer to its history, if the
+// peer is new to the interface or its name differs from the last recorded.
+func recordPeerNamesTx(ctx context.Context, q querier, ifaceId int64, peers []api.Device, now int64) error {
+	rows, err := q.QueryContext(ctx, `
+select device_id, name from peer_name_history
+where id in (select max(id) from peer_name_history where iface_id = ? group by device_id)`[1:], ifaceId)
+	if err != nil {
+		return errors.Wrap(err, "failed to query peer name history")
+	}
+	lastNames := map[string]string{}
+	for rows.Next() {
+		var deviceId, name string
+		err := rows.Scan(&deviceId, &name)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "failed to scan peer name history")
+		}
+		lastNames[deviceId] = name
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to query peer name history")
+	}
+	var changed []api.Device
+	for i := range peers {
+		if lastName, ok := lastNames[peers[i].Id]; ok && lastName == peers[i].Name {
+			continue
+		}
+		changed = append(changed, peers[i])
+	}
+	for start := 0; start < len(changed); start += peerInsertBatchSize {
+		end := start + peerInsertBatchSize
+		if end > len(changed) {
+			end = len(changed)
+		}
+		batch := changed[start:end]
+		var args []interface{}
+		for i := range batch {
+			args = append(args, ifaceId, batch[i].Id, batch[i].Name, now)
+		}
+		_, err := q.ExecContext(ctx, `
+insert into peer_name_history (iface_id, device_id, name, changed_at)
+values `[1:]+strings.TrimSuffix(strings.Repeat(`(?, ?, ?, ?), `, len(batch)), `, `),
+			args...)
+		if err != nil {
+			return errors.Wrapf(err, "failed to record names of peers %q through %q", batch[0].Id, batch[len(batch)-1].Id)
+		}
+	}
+	return nil
+}
+
+// PeerNameHistory returns the names a peer of an interface has been known
+// by, oldest first, so that a renamed peer can be correlated with its former
+// names. If the interface does not exist, an error wrapping
+// ErrInterfaceNotFound is returned.
+func (s *Store) PeerNameHistory(ifaceId int64, deviceId string) ([]PeerName, error) {
+	return s.PeerNameHistoryContext(context.Background(), ifaceId, deviceId)
+}
+
+// PeerNameHistoryContext is like PeerNameHistory, but aborts if the context
+// is cancelled.
+func (s *Store) PeerNameHistoryContext(ctx context.Context, ifaceId int64, deviceId string) ([]PeerName, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	q := s.prepared(tx)
+	var exists bool
+	err = q.QueryRowContext(ctx, `select exists(select 1 from iface where id = ?)`, ifaceId).Scan(&exists)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get name history of peer %q on interface %d", deviceId, ifaceId)
+	}
+	if !exists {
+		return nil, errors.Wrapf(ErrInterfaceNotFound, "failed to get name history of peer %q on interface %d", deviceId, ifaceId)
+	}
+	rows, err := q.QueryContext(ctx, `
+select name, changed_at from peer_name_history
+where iface_id = ? and device_id = ?
+order by id`[1:], ifaceId, deviceId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get name history of peer %q on interface %d", deviceId, ifaceId)
+	}
+	defer rows.Close()
+	var history []PeerName
+	for rows.Next() {
+		var name PeerName
+		var changedAt int64
+		err := rows.Scan(&name.Name, &changedAt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to scan name history of peer %q on interface %d", deviceId, ifaceId)
+		}
+		name.ChangedAt = time.Unix(changedAt, 0)
+		history = append(history, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to get name history of peer %q on interface %d", deviceId, ifaceId)
+	}
+	return history, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+)
+
+func TestPeerNameHistory(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	t0 := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	store.SetNow(st, func() time.Time { return t0 })
+	iface := newTestInterface(c, "test-net", 1, 2)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	oldName := iface.Peers[0].Name
+
+	t1 := t0.Add(time.Hour)
+	store.SetNow(st, func() time.Time { return t1 })
+	iface.Peers[0].Name = "renamed-peer"
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	// Saving again without a rename records nothing.
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+
+	history, err := st.PeerNameHistory(iface.Id, iface.Peers[0].Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(history, qt.HasLen, 2)
+	c.Assert(history[0].Name, qt.Equals, oldName)
+	c.Assert(history[0].ChangedAt.Equal(t0), qt.IsTrue)
+	c.Assert(history[1].Name, qt.Equals, "renamed-peer")
+	c.Assert(history[1].ChangedAt.Equal(t1), qt.IsTrue)
+
+	history, err = st.PeerNameHistory(iface.Id, iface.Peers[1].Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(history, qt.HasLen, 1)
+	c.Assert(history[0].Name, qt.Equals, iface.Peers[1].Name)
+
+	history, err = st.PeerNameHistory(iface.Id, "no-such-peer")
+	c.Assert(err, qt.IsNil)
+	c.Assert(history, qt.HasLen, 0)
+	_, err = st.PeerNameHistory(iface.Id+1, iface.Peers[0].Id)
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+
+	// Renames are also recorded when only the peers are updated.
+	t2 := t1.Add(time.Hour)
+	store.SetNow(st, func() time.Time { return t2 })
+	iface.Peers[1].Name = "updated-peer"
+	err = st.UpdatePeers(iface.Id, iface.Peers)
+	c.Assert(err, qt.IsNil)
+	history, err = st.PeerNameHistory(iface.Id, iface.Peers[1].Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(history, qt.HasLen, 2)
+	c.Assert(history[1].Name, qt.Equals, "updated-peer")
+	c.Assert(history[1].ChangedAt.Equal(t2), qt.IsTrue)
+	history, err = st.PeerNameHistory(iface.Id, iface.Peers[0].Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(history, qt.HasLen, 2)
+
+	// History is deleted along with its interface.
+	err = st.DeleteInterface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	problems, err := st.Verify()
+	c.Assert(err, qt.IsNil)
+	c.Assert(problems, qt.HasLen, 0)
+}
+
+func TestPeerNameHistoryManyPeers(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	// More peers than are inserted in a single statement.
+	iface := newTestInterface(c, "test-net", 1, 200)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	for i := range iface.Peers {
+		history, err := st.PeerNameHistory(iface.Id, iface.Peers[i].Id)
+		c.Assert(err, qt.IsNil)
+		c.Assert(history, qt.HasLen, 1)
+		c.Assert(history[0].Name, qt.Equals, iface.Peers[i].Name)
+	}
+}
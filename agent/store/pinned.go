@@ -0,0 +1,213 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/api"
+	"github.com/wiregarden-io/wiregarden/wireguard"
+)
+
+// pinnedPeersTx returns the device ids of the pinned peers of an interface.
+func pinnedPeersTx(ctx context.Context, q querier, ifaceId int64) (map[string]bool, error) {
+	rows, err := q.QueryContext(ctx, `select device_id from peer where iface_id = ? and pinned`, ifaceId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query pinned peers of interface %d", ifaceId)
+	}
+	defer rows.Close()
+	pinned := map[string]bool{}
+	for rows.Next() {
+		var deviceId string
+		err := rows.Scan(&deviceId)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to scan pinned peer of interface %d", ifaceId)
+		}
+		pinned[deviceId] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to query pinned peers of interface %d", ifaceId)
+	}
+	return pinned, nil
+}
+
+// checkPeersTx checks that the given peers, about to be inserted on an
+// interface, do not duplicate the address or public key of each other, of
+// the interface device, or of the peers already stored on the interface.
+// Pinned and dynamic peers are stored together, so this keeps the merged set
+// valid whichever of them is replaced.
+func checkPeersTx(ctx context.Context, q querier, ifaceId int64, peers []api.Device) error {
+	rows, err := q.QueryContext(ctx, `
+select device_id, device_addr, public_key from iface where id = ?
+union all
+select device_id, device_addr, public_key from peer where iface_id = ?`[1:], ifaceId, ifaceId)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query devices of interface %d", ifaceId)
+	}
+	defer rows.Close()
+	addrs, keys := map[string]string{}, map[string]string{}
+	for rows.Next() {
+		var deviceId, addrText, keyText string
+		err := rows.Scan(&deviceId, &addrText, &keyText)
+		if err != nil {
+			return errors.Wrapf(err, "failed to scan device of interface %d", ifaceId)
+		}
+		addr, err := wireguard.ParseAddress(addrText)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse address %q of device %q", addrText, deviceId)
+		}
+		addrs[addr.IP.String()], keys[keyText] = deviceId, deviceId
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrapf(err, "failed to query devices of interface %d", ifaceId)
+	}
+	for i := range peers {
+		ip, key := peers[i].Addr.IP.String(), peers[i].PublicKey.String()
+		if deviceId, ok := addrs[ip]; ok {
+			return errors.Errorf("peer %q address %q duplicates the address of device %q",
+				peers[i].Id, ip, deviceId)
+		}
+		if deviceId, ok := keys[key]; ok {
+			return errors.Errorf("peer %q public key %q duplicates the public key of device %q",
+				peers[i].Id, key, deviceId)
+		}
+		addrs[ip], keys[key] = peers[i].Id, peers[i].Id
+	}
+	return nil
+}
+
+// PinPeer adds a peer to an interface which is kept when its peers are
+// replaced by EnsureInterface or UpdatePeers, such as a static bastion peer
+// which is not known to the API server. If the interface already has a peer
+// with the same device id, it is replaced and pinned. If the interface does
+// not exist, an error wrapping ErrInterfaceNotFound is returned.
+func (s *Store) PinPeer(ifaceId int64, peer api.Device) error {
+	return s.PinPeerContext(context.Background(), ifaceId, peer)
+}
+
+// PinPeerContext is like PinPeer, but aborts if the context is cancelled.
+func (s *Store) PinPeerContext(ctx context.Context, ifaceId int64, peer api.Device) error {
+	if peer.Id == "" {
+		return errors.Errorf("cannot pin peer on interface %d: missing device id", ifaceId)
+	}
+	err := peer.Validate()
+	if err != nil {
+		return errors.Wrapf(err, "cannot pin peer %q on interface %d", peer.Id, ifaceId)
+	}
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	q := s.prepared(tx)
+	var deviceId, cidrText string
+	err = q.QueryRowContext(ctx, `select device_id, net_cidr from iface where id = ?`, ifaceId).Scan(&deviceId, &cidrText)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrapf(ErrInterfaceNotFound, "failed to pin peer %q on interface %d", peer.Id, ifaceId)
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to pin peer %q on interface %d", peer.Id, ifaceId)
+	}
+	if peer.Id == deviceId {
+		return errors.Errorf("cannot pin peer %q on interface %d: peer is the interface device", peer.Id, ifaceId)
+	}
+	network, err := wireguard.ParseAddress(cidrText)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse network CIDR %q of interface %d", cidrText, ifaceId)
+	}
+	if !network.ContainsIP(peer.Addr) {
+		return errors.Errorf("cannot pin peer %q on interface %d: address %q is not in network CIDR %q",
+			peer.Id, ifaceId, peer.Addr.String(), network.CIDR().String())
+	}
+	for _, stmt := range []string{
+		`delete from peer where iface_id = ? and device_id = ?`,
+		`delete from device_endpoint where iface_id = ? and device_id = ?`,
+	} {
+		_, err := q.ExecContext(ctx, stmt, ifaceId, peer.Id)
+		if err != nil {
+			return errors.Wrapf(err, "failed to pin peer %q on interface %d", peer.Id, ifaceId)
+		}
+	}
+	err = checkPeersTx(ctx, q, ifaceId, []api.Device{peer})
+	if err != nil {
+		return errors.Wrapf(err, "cannot pin peer %q on interface %d", peer.Id, ifaceId)
+	}
+	err = insertPeersTx(ctx, q, ifaceId, []api.Device{peer}, true)
+	if err != nil {
+		return errors.Wrapf(err, "failed to pin peer %q on interface %d", peer.Id, ifaceId)
+	}
+	_, err = q.ExecContext(ctx, `update iface set updated_at = ? where id = ?`, s.now().Unix(), ifaceId)
+	if err != nil {
+		return errors.Wrapf(err, "failed to pin peer %q on interface %d", peer.Id, ifaceId)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+// UnpinPeer unpins a peer of an interface, so that it is removed the next
+// time the interface's peers are replaced without it. If the interface has no
+// such pinned peer, an error wrapping sql.ErrNoRows is returned.
+func (s *Store) UnpinPeer(ifaceId int64, deviceId string) error {
+	return s.UnpinPeerContext(context.Background(), ifaceId, deviceId)
+}
+
+// UnpinPeerContext is like UnpinPeer, but aborts if the context is
+// cancelled.
+func (s *Store) UnpinPeerContext(ctx context.Context, ifaceId int64, deviceId string) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	result, err := s.prepared(nil).ExecContext(ctx, `
+update peer set pinned = ? where iface_id = ? and device_id = ? and pinned`[1:], false, ifaceId, deviceId)
+	if err != nil {
+		return errors.Wrapf(err, "failed to unpin peer %q on interface %d", deviceId, ifaceId)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to unpin peer %q on interface %d", deviceId, ifaceId)
+	}
+	if n == 0 {
+		return errors.Wrapf(sql.ErrNoRows, "failed to unpin peer %q on interface %d", deviceId, ifaceId)
+	}
+	return nil
+}
+
+// PinnedPeers returns the device ids of the pinned peers of an interface,
+// in no particular order.
+func (s *Store) PinnedPeers(ifaceId int64) ([]string, error) {
+	return s.PinnedPeersContext(context.Background(), ifaceId)
+}
+
+// PinnedPeersContext is like PinnedPeers, but aborts if the context is
+// cancelled.
+func (s *Store) PinnedPeersContext(ctx context.Context, ifaceId int64) ([]string, error) {
+	pinned, err := pinnedPeersTx(ctx, s.prepared(nil), ifaceId)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var deviceIds []string
+	for deviceId := range pinned {
+		deviceIds = append(deviceIds, deviceId)
+	}
+	return deviceIds, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+	"github.com/wiregarden-io/wiregarden/api"
+)
+
+func TestPinnedPeers(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 2)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+
+	bastion := api.Device{
+		Id:        "bastion-id",
+		Name:      "bastion",
+		Addr:      parseAddress(c, "10.255.0.1/8"),
+		PublicKey: generateKey(c).PublicKey(),
+		Endpoint:  "bastion.example.com:51820",
+		Endpoints: []api.Endpoint{{Endpoint: "bastion.example.com:51820", Priority: 1}},
+	}
+	err = st.PinPeer(iface.Id, bastion)
+	c.Assert(err, qt.IsNil)
+	pinned, err := st.PinnedPeers(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pinned, qt.DeepEquals, []string{"bastion-id"})
+
+	// A refresh from the server swaps the dynamic peers, but keeps the
+	// pinned one.
+	refreshed := newTestInterface(c, "test-net", 1, 3)
+	iface.Peers = refreshed.Peers[1:]
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	peers, err := st.ListPeers(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(peerIds(peers), qt.DeepEquals, []string{
+		"bastion-id", "test-net-device-1-peer-1-id", "test-net-device-1-peer-2-id"})
+	c.Assert(peers[0], qt.DeepEquals, bastion)
+
+	// A pinned peer given in a refresh is not changed by it.
+	renamed := bastion
+	renamed.Name = "renamed-bastion"
+	err = st.UpdatePeers(iface.Id, []api.Device{renamed, refreshed.Peers[0]})
+	c.Assert(err, qt.IsNil)
+	peers, err = st.ListPeers(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(peerIds(peers), qt.DeepEquals, []string{"bastion-id", "test-net-device-1-peer-0-id"})
+	c.Assert(peers[0], qt.DeepEquals, bastion)
+
+	// Pinned peers are kept pinned through a backup.
+	var buf bytes.Buffer
+	err = st.Export(&buf, store.Passphrase([]byte("hunter2")))
+	c.Assert(err, qt.IsNil)
+	st2, err := store.New(c.Mkdir()+"/db", generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	defer st2.Close()
+	err = st2.Import(&buf, store.Passphrase([]byte("hunter2")))
+	c.Assert(err, qt.IsNil)
+	imported, err := st2.InterfaceByDevice(iface.Device.Name, iface.Network.Name)
+	c.Assert(err, qt.IsNil)
+	pinned, err = st2.PinnedPeers(imported.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pinned, qt.DeepEquals, []string{"bastion-id"})
+
+	// Once unpinned, the peer is removed by the next refresh without it.
+	err = st.UnpinPeer(iface.Id, "bastion-id")
+	c.Assert(err, qt.IsNil)
+	err = st.UnpinPeer(iface.Id, "bastion-id")
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+	err = st.UpdatePeers(iface.Id, refreshed.Peers[:1])
+	c.Assert(err, qt.IsNil)
+	peers, err = st.ListPeers(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(peerIds(peers), qt.DeepEquals, []string{"test-net-device-1-peer-0-id"})
+	problems, err := st.Verify()
+	c.Assert(err, qt.IsNil)
+	c.Assert(problems, qt.HasLen, 0)
+}
+
+func TestPinPeerInvalid(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 0)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	peer := api.Device{
+		Id:        "static-id",
+		Addr:      parseAddress(c, "192.168.0.1/24"),
+		PublicKey: generateKey(c).PublicKey(),
+	}
+	err = st.PinPeer(iface.Id, peer)
+	c.Assert(err, qt.ErrorMatches, `cannot pin peer "static-id" on interface 1: address "192.168.0.1/24" is not in network CIDR "10.0.0.0/8"`)
+	peer.Addr = parseAddress(c, "10.9.0.1/8")
+	err = st.PinPeer(iface.Id+1, peer)
+	c.Assert(errors.Is(err, store.ErrInterfaceNotFound), qt.IsTrue)
+	err = st.PinPeer(iface.Id, iface.Device)
+	c.Assert(err, qt.ErrorMatches, `cannot pin peer "test-net-device-1-id" on interface 1: peer is the interface device`)
+}
+
+func TestPinnedPeerConflicts(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 1)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+
+	// A pinned peer may not duplicate the interface device or its dynamic
+	// peers.
+	bastion := api.Device{
+		Id:        "bastion-id",
+		Addr:      iface.Peers[0].Addr,
+		PublicKey: generateKey(c).PublicKey(),
+	}
+	err = st.PinPeer(iface.Id, bastion)
+	c.Assert(err, qt.ErrorMatches, `cannot pin peer "bastion-id" on interface 1: peer "bastion-id" address "10.1.0.2" duplicates the address of device "test-net-device-1-peer-0-id"`)
+	bastion.Addr = parseAddress(c, "10.255.0.1/8")
+	bastion.PublicKey = iface.Device.PublicKey
+	err = st.PinPeer(iface.Id, bastion)
+	c.Assert(err, qt.ErrorMatches, `cannot pin peer "bastion-id" on interface 1: peer "bastion-id" public key ".*" duplicates the public key of device "test-net-device-1-id"`)
+	bastion.PublicKey = generateKey(c).PublicKey()
+	err = st.PinPeer(iface.Id, bastion)
+	c.Assert(err, qt.IsNil)
+
+	// Nor may dynamic peers duplicate a pinned peer, whether they are
+	// replaced with the interface or on their own.
+	peer := iface.Peers[0]
+	peer.Addr = bastion.Addr
+	err = st.UpdatePeers(iface.Id, []api.Device{peer})
+	c.Assert(err, qt.ErrorMatches, `failed to update peers of interface 1: peer "test-net-device-1-peer-0-id" address "10.255.0.1" duplicates the address of device "bastion-id"`)
+	peer = iface.Peers[0]
+	peer.PublicKey = bastion.PublicKey
+	iface.Peers = []api.Device{peer}
+	err = st.EnsureInterface(iface)
+	c.Assert(err, qt.ErrorMatches, `.*peer "test-net-device-1-peer-0-id" public key ".*" duplicates the public key of device "bastion-id"`)
+
+	peers, err := st.ListPeers(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(peerIds(peers), qt.DeepEquals, []string{"test-net-device-1-peer-0-id", "bastion-id"})
+}
+
+func peerIds(peers []api.Device) []string {
+	var ids []string
+	for i := range peers {
+		ids = append(ids, peers[i].Id)
+	}
+	return ids
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+//go:build postgres
+// +build postgres
+
+package store_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	// Link the PostgreSQL driver, so that the store tests may be run
+	// against PostgreSQL.
+	_ "github.com/lib/pq"
+)
+
+// postgresImage is the PostgreSQL container image the store tests run
+// against, unless WIREGARDEN_TEST_POSTGRES names another database.
+const postgresImage = "postgres:12-alpine"
+
+// TestMain runs the store tests against a disposable PostgreSQL container,
+// started with docker. If WIREGARDEN_TEST_POSTGRES is already set, the
+// database it names is used instead, and no container is started.
+func TestMain(m *testing.M) {
+	if os.Getenv("WIREGARDEN_TEST_POSTGRES") != "" {
+		os.Exit(m.Run())
+	}
+	id, dsn, err := startPostgres()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot start PostgreSQL container: %v\n", err)
+		os.Exit(1)
+	}
+	os.Setenv("WIREGARDEN_TEST_POSTGRES", dsn)
+	code := m.Run()
+	if err := exec.Command("docker", "rm", "--force", id).Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot remove PostgreSQL container %s: %v\n", id, err)
+	}
+	os.Exit(code)
+}
+
+// startPostgres starts a PostgreSQL container listening on a random local
+// port, and waits for it to accept connections. It returns the id of the
+// container and the connection string of its database.
+func startPostgres() (string, string, error) {
+	out, err := exec.Command("docker", "run", "--detach", "--rm",
+		"--env", "POSTGRES_PASSWORD=wiregarden",
+		"--publish", "127.0.0.1::5432",
+		postgresImage).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("docker run: %v", err)
+	}
+	id := strings.TrimSpace(string(out))
+	out, err = exec.Command("docker", "port", id, "5432/tcp").Output()
+	if err != nil {
+		exec.Command("docker", "rm", "--force", id).Run()
+		return "", "", fmt.Errorf("docker port: %v", err)
+	}
+	// docker port may list an address for each interface; the first is
+	// the loopback address it was published on.
+	hostPort := strings.Fields(string(out))[0]
+	dsn := fmt.Sprintf("postgres://postgres:wiregarden@%s/postgres?sslmode=disable", hostPort)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		exec.Command("docker", "rm", "--force", id).Run()
+		return "", "", err
+	}
+	defer db.Close()
+	deadline := time.Now().Add(time.Minute)
+	for {
+		err = db.Ping()
+		if err == nil {
+			return id, dsn, nil
+		}
+		if time.Now().After(deadline) {
+			exec.Command("docker", "rm", "--force", id).Run()
+			return "", "", fmt.Errorf("database not ready: %v", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
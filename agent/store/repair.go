@@ -0,0 +1,215 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// RepairOptions select the repairs made by Repair. Each repair deletes data,
+// so none are made unless enabled.
+type RepairOptions struct {
+	// DeleteOrphanedPeers deletes peers which refer to a missing interface.
+	DeleteOrphanedPeers bool
+
+	// DropDuplicateInterfaces deletes interfaces which have the same public
+	// key as a newer interface, keeping only the newest.
+	DropDuplicateInterfaces bool
+
+	// PruneOrphanedLogs deletes log entries which refer to a missing
+	// interface.
+	PruneOrphanedLogs bool
+}
+
+// ActionKind is the kind of repair made by Repair.
+type ActionKind string
+
+const (
+	// ActionDeletedOrphanedPeers means peers of a missing interface were
+	// deleted.
+	ActionDeletedOrphanedPeers = ActionKind("deleted_orphaned_peers")
+
+	// ActionDroppedDuplicateInterface means an interface was deleted
+	// because a newer interface has the same public key.
+	ActionDroppedDuplicateInterface = ActionKind("dropped_duplicate_interface")
+
+	// ActionPrunedOrphanedLogs means log entries of a missing interface were
+	// deleted.
+	ActionPrunedOrphanedLogs = ActionKind("pruned_orphaned_logs")
+)
+
+// Action is a repair made by Repair.
+type Action struct {
+	Kind ActionKind
+
+	// InterfaceId is the interface repaired. For orphaned rows, it is the
+	// missing interface they referred to.
+	InterfaceId int64
+
+	// Rows is the number of rows deleted.
+	Rows int64
+
+	// Message describes the repair.
+	Message string
+}
+
+func (a Action) String() string {
+	return a.Message
+}
+
+// Repair fixes inconsistencies of the kinds reported by Verify, as selected
+// by opts, and reports each repair made. Repairs are made in a single
+// transaction, so if any fails, none are made.
+func (s *Store) Repair(opts RepairOptions) ([]Action, error) {
+	return s.RepairContext(context.Background(), opts)
+}
+
+// RepairContext is like Repair, but aborts if the context is cancelled.
+func (s *Store) RepairContext(ctx context.Context, opts RepairOptions) ([]Action, error) {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer unlock()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	q := s.prepared(tx)
+	var actions []Action
+	if opts.DeleteOrphanedPeers {
+		found, err := deleteOrphansTx(ctx, q, "peer", ActionDeletedOrphanedPeers)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to delete orphaned peers")
+		}
+		actions = append(actions, found...)
+	}
+	if opts.DropDuplicateInterfaces {
+		found, err := dropDuplicateInterfacesTx(ctx, q)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to drop duplicate interfaces")
+		}
+		actions = append(actions, found...)
+	}
+	if opts.PruneOrphanedLogs {
+		found, err := deleteOrphansTx(ctx, q, "iface_log", ActionPrunedOrphanedLogs)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to prune orphaned logs")
+		}
+		actions = append(actions, found...)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to commit transaction")
+	}
+	var changes []Change
+	for _, action := range actions {
+		if action.Kind == ActionDroppedDuplicateInterface {
+			changes = append(changes, Change{Id: action.InterfaceId, Kind: ChangeDeleted})
+		}
+	}
+	s.notify(changes...)
+	return actions, nil
+}
+
+// deleteOrphansTx deletes the rows of table which refer to a missing
+// interface, returning an action of the given kind for each interface.
+func deleteOrphansTx(ctx context.Context, q querier, table string, kind ActionKind) ([]Action, error) {
+	rows, err := q.QueryContext(ctx, `select distinct t.iface_id from `+table+` t
+left join iface i on (i.id = t.iface_id)
+where i.id is null
+order by t.iface_id`)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query orphaned rows in table %q", table)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, errors.Wrapf(err, "failed to scan orphaned rows in table %q", table)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to query orphaned rows in table %q", table)
+	}
+	var actions []Action
+	for _, id := range ids {
+		result, err := q.ExecContext(ctx, `delete from `+table+` where iface_id = ?`, id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to delete rows in table %q of missing interface %d", table, id)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to delete rows in table %q of missing interface %d", table, id)
+		}
+		actions = append(actions, Action{
+			Kind:        kind,
+			InterfaceId: id,
+			Rows:        n,
+			Message:     fmt.Sprintf("deleted %d rows in table %q of missing interface %d", n, table, id),
+		})
+	}
+	return actions, nil
+}
+
+// dropDuplicateInterfacesTx deletes interfaces which have the same public key
+// as a newer interface.
+func dropDuplicateInterfacesTx(ctx context.Context, q querier) ([]Action, error) {
+	rows, err := q.QueryContext(ctx, `select id, public_key from iface order by created_at desc, id desc`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query interfaces")
+	}
+	type duplicate struct {
+		id, newerId int64
+	}
+	var duplicates []duplicate
+	newest := map[string]int64{}
+	for rows.Next() {
+		var id int64
+		var publicKey string
+		err := rows.Scan(&id, &publicKey)
+		if err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "failed to scan interface")
+		}
+		if newerId, ok := newest[publicKey]; ok {
+			duplicates = append(duplicates, duplicate{id: id, newerId: newerId})
+		} else {
+			newest[publicKey] = id
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to query interfaces")
+	}
+	var actions []Action
+	for _, d := range duplicates {
+		err := deleteInterfaceTx(ctx, q, d.id)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		actions = append(actions, Action{
+			Kind:        ActionDroppedDuplicateInterface,
+			InterfaceId: d.id,
+			Rows:        1,
+			Message:     fmt.Sprintf("deleted interface %d with the same public key as newer interface %d", d.id, d.newerId),
+		})
+	}
+	return actions, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"database/sql"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+)
+
+// newRepairStore returns a store at path with interfaces 1 to 3, where
+// interface 3 has the same public key as interface 1, and orphaned peers and
+// logs of missing interface 99.
+func newRepairStore(c *qt.C, path string) (*store.Store, []*store.Interface) {
+	st, err := store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	var ifaces []*store.Interface
+	for i := 1; i <= 3; i++ {
+		iface := newTestInterface(c, "test-net", i, 1)
+		err = st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		appendTestLogs(c, st, iface, 1)
+		ifaces = append(ifaces, iface)
+	}
+	execRaw(c, path, `
+insert into peer (iface_id, device_id, device_name, device_endpoint, device_addr, public_key)
+values (99, 'orphan-peer', 'orphan-peer', '', '10.0.0.99/8', 'orphan-key')`[1:])
+	execRaw(c, path, `insert into iface_log (ts, iface_id, operation, state, message) values (0, 99, 'join_device', 'interface_joined', '')`)
+	execRaw(c, path, `insert into iface_log (ts, iface_id, operation, state, message) values (0, 99, 'apply_device', 'interface_up', '')`)
+	execRaw(c, path, `drop index iface_public_key_unique`)
+	execRaw(c, path, `update iface set public_key = ? where id = ?`, ifaces[0].Device.PublicKey.String(), ifaces[2].Id)
+	return st, ifaces
+}
+
+func problemKinds(c *qt.C, st *store.Store) []store.ProblemKind {
+	problems, err := st.Verify()
+	c.Assert(err, qt.IsNil)
+	var kinds []store.ProblemKind
+	for i := range problems {
+		kinds = append(kinds, problems[i].Kind)
+	}
+	return kinds
+}
+
+func TestRepairNothingByDefault(t *testing.T) {
+	c := qt.New(t)
+	st, _ := newRepairStore(c, c.Mkdir()+"/db")
+	defer st.Close()
+	actions, err := st.Repair(store.RepairOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(actions, qt.HasLen, 0)
+	c.Assert(problemKinds(c, st), qt.DeepEquals, []store.ProblemKind{
+		store.ProblemOrphanedPeer, store.ProblemOrphanedLog, store.ProblemDuplicatePublicKey,
+	})
+}
+
+func TestRepairOrphanedPeers(t *testing.T) {
+	c := qt.New(t)
+	st, _ := newRepairStore(c, c.Mkdir()+"/db")
+	defer st.Close()
+	actions, err := st.Repair(store.RepairOptions{DeleteOrphanedPeers: true})
+	c.Assert(err, qt.IsNil)
+	c.Assert(actions, qt.DeepEquals, []store.Action{{
+		Kind:        store.ActionDeletedOrphanedPeers,
+		InterfaceId: 99,
+		Rows:        1,
+		Message:     `deleted 1 rows in table "peer" of missing interface 99`,
+	}})
+	c.Assert(problemKinds(c, st), qt.DeepEquals, []store.ProblemKind{
+		store.ProblemOrphanedLog, store.ProblemDuplicatePublicKey,
+	})
+}
+
+func TestRepairOrphanedLogs(t *testing.T) {
+	c := qt.New(t)
+	st, _ := newRepairStore(c, c.Mkdir()+"/db")
+	defer st.Close()
+	actions, err := st.Repair(store.RepairOptions{PruneOrphanedLogs: true})
+	c.Assert(err, qt.IsNil)
+	c.Assert(actions, qt.DeepEquals, []store.Action{{
+		Kind:        store.ActionPrunedOrphanedLogs,
+		InterfaceId: 99,
+		Rows:        2,
+		Message:     `deleted 2 rows in table "iface_log" of missing interface 99`,
+	}})
+	c.Assert(problemKinds(c, st), qt.DeepEquals, []store.ProblemKind{
+		store.ProblemOrphanedPeer, store.ProblemDuplicatePublicKey,
+	})
+}
+
+func TestRepairDuplicateInterfaces(t *testing.T) {
+	c := qt.New(t)
+	st, ifaces := newRepairStore(c, c.Mkdir()+"/db")
+	defer st.Close()
+	var changes []store.Change
+	st.OnChange(func(change store.Change) {
+		changes = append(changes, change)
+	})
+	// Repair drops the interface which Verify reports as the duplicate.
+	problems, err := st.Verify()
+	c.Assert(err, qt.IsNil)
+	var duplicateIds []int64
+	for _, problem := range problems {
+		if problem.Kind == store.ProblemDuplicatePublicKey {
+			duplicateIds = append(duplicateIds, problem.InterfaceId)
+		}
+	}
+	c.Assert(duplicateIds, qt.DeepEquals, []int64{ifaces[0].Id})
+	actions, err := st.Repair(store.RepairOptions{DropDuplicateInterfaces: true})
+	c.Assert(err, qt.IsNil)
+	c.Assert(actions, qt.DeepEquals, []store.Action{{
+		Kind:        store.ActionDroppedDuplicateInterface,
+		InterfaceId: ifaces[0].Id,
+		Rows:        1,
+		Message:     `deleted interface 1 with the same public key as newer interface 3`,
+	}})
+	c.Assert(changes, qt.DeepEquals, []store.Change{{Id: ifaces[0].Id, Kind: store.ChangeDeleted}})
+	_, err = st.Interface(ifaces[0].Id)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+	_, err = st.Interface(ifaces[2].Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(problemKinds(c, st), qt.DeepEquals, []store.ProblemKind{
+		store.ProblemOrphanedPeer, store.ProblemOrphanedLog,
+	})
+}
+
+func TestRepairAll(t *testing.T) {
+	c := qt.New(t)
+	st, _ := newRepairStore(c, c.Mkdir()+"/db")
+	defer st.Close()
+	actions, err := st.Repair(store.RepairOptions{
+		DeleteOrphanedPeers:     true,
+		DropDuplicateInterfaces: true,
+		PruneOrphanedLogs:       true,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(actions, qt.HasLen, 3)
+	c.Assert(problemKinds(c, st), qt.HasLen, 0)
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSettingNotFound indicates that a setting looked up does not exist. It
+// wraps sql.ErrNoRows, which callers may also check for.
+var ErrSettingNotFound = errors.WithMessage(sql.ErrNoRows, "setting not found")
+
+// GetSetting returns the value of an agent setting, such as the time of the
+// last sync or the agent instance id. Settings are kept apart from
+// interfaces. If the setting does not exist, an error wrapping
+// ErrSettingNotFound is returned.
+func (s *Store) GetSetting(key string) (string, error) {
+	return s.GetSettingContext(context.Background(), key)
+}
+
+// GetSettingContext is like GetSetting, but aborts if the context is
+// cancelled.
+func (s *Store) GetSettingContext(ctx context.Context, key string) (string, error) {
+	var value string
+	err := s.prepared(nil).QueryRowContext(ctx, `select value from setting where key = ?`, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errors.Wrapf(ErrSettingNotFound, "failed to get setting %q", key)
+	} else if err != nil {
+		return "", errors.Wrapf(err, "failed to get setting %q", key)
+	}
+	return value, nil
+}
+
+// SetSetting sets the value of an agent setting, replacing any existing
+// value.
+func (s *Store) SetSetting(key, value string) error {
+	return s.SetSettingContext(context.Background(), key, value)
+}
+
+// SetSettingContext is like SetSetting, but aborts if the context is
+// cancelled.
+func (s *Store) SetSettingContext(ctx context.Context, key, value string) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	if key == "" {
+		return errors.New("cannot set setting: missing key")
+	}
+	_, err = s.prepared(nil).ExecContext(ctx, `
+insert into setting (key, value, updated_at) values (?, ?, ?)
+on conflict (key) do update set value = excluded.value, updated_at = excluded.updated_at`[1:],
+		key, value, s.now().Unix())
+	if err != nil {
+		return errors.Wrapf(err, "failed to set setting %q", key)
+	}
+	return nil
+}
+
+// DeleteSetting removes an agent setting. If the setting does not exist, an
+// error wrapping ErrSettingNotFound is returned.
+func (s *Store) DeleteSetting(key string) error {
+	return s.DeleteSettingContext(context.Background(), key)
+}
+
+// DeleteSettingContext is like DeleteSetting, but aborts if the context is
+// cancelled.
+func (s *Store) DeleteSettingContext(ctx context.Context, key string) error {
+	unlock, err := s.beginWrite()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unlock()
+	result, err := s.prepared(nil).ExecContext(ctx, `delete from setting where key = ?`, key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete setting %q", key)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete setting %q", key)
+	}
+	if n == 0 {
+		return errors.Wrapf(ErrSettingNotFound, "failed to delete setting %q", key)
+	}
+	return nil
+}
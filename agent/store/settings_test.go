@@ -0,0 +1,67 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"database/sql"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+)
+
+func TestSettings(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	st, err := store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+
+	_, err = st.GetSetting("instance-id")
+	c.Assert(err, qt.ErrorMatches, `failed to get setting "instance-id": setting not found: sql: no rows in result set`)
+	c.Assert(errors.Is(err, store.ErrSettingNotFound), qt.IsTrue)
+	c.Assert(errors.Is(err, sql.ErrNoRows), qt.IsTrue)
+
+	err = st.SetSetting("instance-id", "abc123")
+	c.Assert(err, qt.IsNil)
+	err = st.SetSetting("last-sync", "1600000000")
+	c.Assert(err, qt.IsNil)
+	value, err := st.GetSetting("instance-id")
+	c.Assert(err, qt.IsNil)
+	c.Assert(value, qt.Equals, "abc123")
+
+	// Setting a value again overwrites it.
+	err = st.SetSetting("instance-id", "def456")
+	c.Assert(err, qt.IsNil)
+	value, err = st.GetSetting("instance-id")
+	c.Assert(err, qt.IsNil)
+	c.Assert(value, qt.Equals, "def456")
+
+	err = st.SetSetting("", "value")
+	c.Assert(err, qt.ErrorMatches, `cannot set setting: missing key`)
+
+	err = st.DeleteSetting("instance-id")
+	c.Assert(err, qt.IsNil)
+	_, err = st.GetSetting("instance-id")
+	c.Assert(errors.Is(err, store.ErrSettingNotFound), qt.IsTrue)
+	err = st.DeleteSetting("instance-id")
+	c.Assert(errors.Is(err, store.ErrSettingNotFound), qt.IsTrue)
+
+	// Settings survive reopening the store.
+	c.Assert(st.Close(), qt.IsNil)
+	st, err = store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	value, err = st.GetSetting("last-sync")
+	c.Assert(err, qt.IsNil)
+	c.Assert(value, qt.Equals, "1600000000")
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StoreSnapshot is a point-in-time view of every interface in the store,
+// including archived interfaces, for reporting.
+type StoreSnapshot struct {
+	// TakenAt is when the snapshot was taken.
+	TakenAt time.Time
+
+	// Interfaces are all the interfaces in the store, ordered by id, with
+	// their peers and most recent log entries. Their Key and DeviceToken
+	// are nil unless the IncludeSecrets option is given.
+	Interfaces []InterfaceWithLog
+}
+
+// SnapshotOptions configure how a snapshot is taken.
+type SnapshotOptions struct {
+	// IncludeSecrets includes the private keys and device tokens of
+	// interfaces in the snapshot.
+	IncludeSecrets bool
+}
+
+// SnapshotOption sets an option on how a snapshot is taken.
+type SnapshotOption func(*SnapshotOptions)
+
+// IncludeSecrets includes interface secrets in a snapshot.
+func IncludeSecrets(o *SnapshotOptions) {
+	o.IncludeSecrets = true
+}
+
+// Snapshot returns a consistent view of all interfaces and their peers,
+// read in a single transaction so that concurrent writes are either entirely
+// included or not at all. Secrets are redacted unless the IncludeSecrets
+// option is given.
+func (s *Store) Snapshot(options ...SnapshotOption) (*StoreSnapshot, error) {
+	return s.SnapshotContext(context.Background(), options...)
+}
+
+// SnapshotContext is like Snapshot, but aborts if the context is cancelled.
+func (s *Store) SnapshotContext(ctx context.Context, options ...SnapshotOption) (*StoreSnapshot, error) {
+	var opts SnapshotOptions
+	for i := range options {
+		options[i](&opts)
+	}
+	err := s.checkOpen()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// sqlite transactions always read from a single snapshot of the
+	// database. Other databases must be asked to, as they default to
+	// reading the latest committed data with each statement.
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	snapshot := &StoreSnapshot{TakenAt: s.now()}
+	snapshot.Interfaces, err = s.queryInterfaces(ctx, s.prepared(tx), ` order by i.id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query interfaces for snapshot")
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to commit transaction")
+	}
+	if !opts.IncludeSecrets {
+		for i := range snapshot.Interfaces {
+			snapshot.Interfaces[i].Key = nil
+			snapshot.Interfaces[i].DeviceToken = nil
+		}
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface1 := newTestInterface(c, "test-net", 1, 2)
+	err := st.EnsureInterface(iface1)
+	c.Assert(err, qt.IsNil)
+	iface2 := newTestInterface(c, "test-net", 2, 1)
+	err = st.EnsureInterface(iface2)
+	c.Assert(err, qt.IsNil)
+	err = st.ArchiveInterface(iface2.Id)
+	c.Assert(err, qt.IsNil)
+
+	snapshot, err := st.Snapshot()
+	c.Assert(err, qt.IsNil)
+	c.Assert(snapshot.TakenAt.IsZero(), qt.IsFalse)
+	c.Assert(snapshot.Interfaces, qt.HasLen, 2)
+	c.Assert(snapshot.Interfaces[0].Id, qt.Equals, iface1.Id)
+	c.Assert(snapshot.Interfaces[0].Peers, qt.DeepEquals, iface1.Peers)
+	c.Assert(snapshot.Interfaces[1].Id, qt.Equals, iface2.Id)
+	c.Assert(snapshot.Interfaces[1].ArchivedAt, qt.Not(qt.IsNil))
+	for _, iface := range snapshot.Interfaces {
+		c.Assert(iface.Key, qt.IsNil)
+		c.Assert(iface.DeviceToken, qt.IsNil)
+	}
+
+	snapshot, err = st.Snapshot(store.IncludeSecrets)
+	c.Assert(err, qt.IsNil)
+	c.Assert(snapshot.Interfaces[0].Key, qt.DeepEquals, iface1.Key)
+	c.Assert(snapshot.Interfaces[0].DeviceToken, qt.DeepEquals, iface1.DeviceToken)
+}
+
+func TestSnapshotConcurrentWrites(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 5)
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+
+	// Each write renames the interface's subscription and all of its peers
+	// after a new generation, so a torn read would mix generations.
+	const generations = 50
+	var wg sync.WaitGroup
+	wg.Add(1)
+	writeErrs := make(chan error, 1)
+	go func() {
+		defer wg.Done()
+		for gen := 1; gen <= generations; gen++ {
+			iface.SubscriptionId = fmt.Sprintf("gen-%d", gen)
+			for i := range iface.Peers {
+				iface.Peers[i].Name = fmt.Sprintf("gen-%d-peer-%d", gen, i)
+			}
+			if err := st.EnsureInterface(iface); err != nil {
+				writeErrs <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < generations; i++ {
+		snapshot, err := st.Snapshot()
+		c.Assert(err, qt.IsNil)
+		c.Assert(snapshot.Interfaces, qt.HasLen, 1)
+		result := snapshot.Interfaces[0]
+		c.Assert(result.Peers, qt.HasLen, 5)
+		if result.SubscriptionId == "" {
+			continue
+		}
+		for j, peer := range result.Peers {
+			c.Assert(peer.Name, qt.Equals, fmt.Sprintf("%s-peer-%d", result.SubscriptionId, j))
+		}
+	}
+	wg.Wait()
+	close(writeErrs)
+	c.Assert(<-writeErrs, qt.IsNil)
+}
@@ -11,8 +11,12 @@
 package store
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/pkg/errors"
@@ -26,24 +30,128 @@ var (
 	ErrInterfaceOperationInvalid = errors.New("operation not valid for interface state")
 )
 
+// Sealer encrypts and decrypts the secrets of interfaces kept in the store,
+// such as their private keys and device tokens. Implementations may keep
+// their key material outside of the host, such as in a KMS.
+type Sealer interface {
+	// Seal returns plaintext encrypted.
+	Seal(plaintext []byte) ([]byte, error)
+
+	// Open returns the plaintext of a secret encrypted by Seal, or an error
+	// if it cannot be decrypted.
+	Open(sealed []byte) ([]byte, error)
+}
+
 type Interface struct {
-	ApiUrl      string
-	Id          int64
-	Network     api.Network
-	Device      api.Device
-	Peers       []api.Device
-	Plan        api.PlanDoc
-	ListenPort  int
-	Key         wireguard.Key
-	DeviceToken []byte
+	ApiUrl         string
+	Id             int64
+	Network        api.Network
+	Device         api.Device
+	Peers          []api.Device
+	Plan           api.PlanDoc
+	SubscriptionId string
+	ListenPort     int
+	Key            wireguard.Key
+	DeviceToken    []byte
+	// DeviceTokenIssuedAt and DeviceTokenExpiresAt are when the device
+	// token was issued and when it expires, or nil if unknown. Storing an
+	// interface with a nil time keeps the time already stored.
+	DeviceTokenIssuedAt  *time.Time
+	DeviceTokenExpiresAt *time.Time
+	// MachineId is the id derived from the host which joined the device,
+	// as sent when joining, or nil if unknown. See api.DeriveMachineId.
+	MachineId []byte
+	// SelectedEndpoints are the endpoints selected to connect to peers,
+	// keyed by peer device id. They are set with SelectEndpoint, and not
+	// changed by EnsureInterface. See PeerEndpoint.
+	SelectedEndpoints map[string]SelectedEndpoint
+	// Labels are arbitrary key/value pairs for organizing interfaces, such
+	// as by environment, role or owner. They are set with SetLabel, and not
+	// changed by EnsureInterface.
+	Labels     map[string]string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	ArchivedAt *time.Time
+}
+
+// JoinResponseToInterface returns the interface for a device joined to a
+// network, from the API's response to joining it, the device's private key
+// and the URL of the API it joined with. The response is validated, so that
+// an interface which could not be brought up is never stored. The listen
+// port is left for the caller to set.
+func JoinResponseToInterface(resp *api.JoinDeviceResponse, privKey []byte, apiUrl string) (*Interface, error) {
+	if apiUrl == "" {
+		return nil, errors.New("missing API URL")
+	}
+	if len(privKey) != 32 {
+		return nil, errors.Errorf("invalid private key length %d", len(privKey))
+	}
+	if len(resp.Token) == 0 {
+		return nil, errors.New("missing device token")
+	}
+	err := resp.Network.Validate()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid network")
+	}
+	err = resp.Device.Validate()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid device")
+	}
+	for i := range resp.Peers {
+		err = resp.Peers[i].Validate()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid peer %q", resp.Peers[i].Id)
+		}
+	}
+	return &Interface{
+		ApiUrl:         apiUrl,
+		Network:        resp.Network,
+		Device:         resp.Device,
+		Peers:          resp.Peers,
+		Plan:           resp.Plan,
+		SubscriptionId: resp.SubscriptionId,
+		Key:            wireguard.Key(privKey),
+		DeviceToken:    resp.Token,
+	}, nil
 }
 
 func (iface *Interface) Name() string {
-	return fmt.Sprintf("wgn%03d", iface.Id)
+	return interfaceName(iface.Id)
 }
 
-func (iface *Interface) Config() *wireguard.InterfaceConfig {
-	isServer := iface.Device.Endpoint != ""
+func interfaceName(id int64) string {
+	return fmt.Sprintf("wgn%03d", id)
+}
+
+// ConfigOptions are options for generating the WireGuard configuration of
+// an interface.
+type ConfigOptions struct {
+	// DefaultClientKeepalive is the persistent keepalive interval in seconds
+	// a client uses to connect to a server peer which does not set its own.
+	// Zero leaves keepalive disabled for such peers.
+	DefaultClientKeepalive int
+}
+
+// ConfigOption sets an option for generating the WireGuard configuration of
+// an interface.
+type ConfigOption func(*ConfigOptions)
+
+// DefaultClientKeepalive sets the persistent keepalive interval in seconds a
+// client uses to connect to a server peer which does not set its own, such
+// as to keep the connection open through a NAT.
+func DefaultClientKeepalive(seconds int) ConfigOption {
+	return func(o *ConfigOptions) {
+		o.DefaultClientKeepalive = seconds
+	}
+}
+
+// Config returns the WireGuard configuration of the interface.
+func (iface *Interface) Config(options ...ConfigOption) *wireguard.InterfaceConfig {
+	var opts ConfigOptions
+	for i := range options {
+		options[i](&opts)
+	}
+	isServer := iface.Device.PreferredEndpoint() != ""
 	var postUp string
 	if isServer {
 		postUp = `sysctl -w net.ipv4.ip_forward=1`
@@ -54,43 +162,253 @@ func (iface *Interface) Config() *wireguard.InterfaceConfig {
 		ListenPort: iface.ListenPort,
 		PrivateKey: iface.Key,
 		PostUp:     postUp,
-		Peers:      peersModel(iface.Peers).Config(&iface.Network, iface.Device.Endpoint != ""),
+		Peers:      peersModel(iface.Peers).Config(iface, isServer, &opts),
 	}
 }
 
+// PeerEndpoint returns the endpoint used to connect to a peer of the
+// interface: the endpoint selected for it, if that is still one of its
+// candidate endpoints, or otherwise its first candidate endpoint. It returns
+// an empty string if the peer has no endpoints.
+func (iface *Interface) PeerEndpoint(peer *api.Device) string {
+	candidates := peer.CandidateEndpoints()
+	if len(candidates) == 0 {
+		return ""
+	}
+	if selected, ok := iface.SelectedEndpoints[peer.Id]; ok {
+		for _, candidate := range candidates {
+			if candidate == selected.Endpoint {
+				return candidate
+			}
+		}
+	}
+	return candidates[0]
+}
+
+// WriteConfig writes the interface as a wg-quick configuration file to w,
+// with the decrypted private key of the device and a peer section for each
+// of its peers.
+func (iface *Interface) WriteConfig(w io.Writer, options ...ConfigOption) error {
+	return errors.WithStack(iface.Config(options...).WriteConfig(w))
+}
+
+// Equal returns whether the interface has the same persisted fields as
+// other, such as to skip saving an interface which has not changed. Peers are
+// compared regardless of their order. The id, labels, selected endpoints and
+// creation, update and archival times are not compared, though whether the
+// interfaces are archived is.
+func (iface *Interface) Equal(other *Interface) bool {
+	if iface.ApiUrl != other.ApiUrl ||
+		iface.SubscriptionId != other.SubscriptionId ||
+		iface.ListenPort != other.ListenPort ||
+		!bytes.Equal(iface.Key, other.Key) ||
+		!bytes.Equal(iface.DeviceToken, other.DeviceToken) ||
+		!timesEqual(iface.DeviceTokenIssuedAt, other.DeviceTokenIssuedAt) ||
+		!timesEqual(iface.DeviceTokenExpiresAt, other.DeviceTokenExpiresAt) ||
+		!bytes.Equal(iface.MachineId, other.MachineId) ||
+		(iface.ArchivedAt == nil) != (other.ArchivedAt == nil) {
+		return false
+	}
+	if iface.Network.Id != other.Network.Id ||
+		iface.Network.Name != other.Network.Name ||
+		iface.Network.CIDR.String() != other.Network.CIDR.String() {
+		return false
+	}
+	if !devicesEqual(&iface.Device, &other.Device) {
+		return false
+	}
+	if len(iface.Peers) != len(other.Peers) {
+		return false
+	}
+	peers, otherPeers := sortedPeers(iface.Peers), sortedPeers(other.Peers)
+	for i := range peers {
+		if !devicesEqual(&peers[i], &otherPeers[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedPeers returns a copy of peers sorted by device id.
+func sortedPeers(peers []api.Device) []api.Device {
+	result := make([]api.Device, len(peers))
+	copy(result, peers)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+func devicesEqual(d, other *api.Device) bool {
+	if d.Id != other.Id ||
+		d.Name != other.Name ||
+		d.Endpoint != other.Endpoint ||
+		d.Addr.String() != other.Addr.String() ||
+		!bytes.Equal(d.PublicKey, other.PublicKey) ||
+		d.Keepalive != other.Keepalive ||
+		len(d.Endpoints) != len(other.Endpoints) ||
+		len(d.AllowedIPs) != len(other.AllowedIPs) ||
+		len(d.Candidates) != len(other.Candidates) {
+		return false
+	}
+	for i := range d.Candidates {
+		if d.Candidates[i] != other.Candidates[i] {
+			return false
+		}
+	}
+	for i := range d.Endpoints {
+		if d.Endpoints[i] != other.Endpoints[i] {
+			return false
+		}
+	}
+	for i := range d.AllowedIPs {
+		if d.AllowedIPs[i].String() != other.AllowedIPs[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+func timesEqual(t, other *time.Time) bool {
+	if t == nil || other == nil {
+		return t == other
+	}
+	return t.Equal(*other)
+}
+
+// redactedInterface is the public metadata of an interface, serialized by
+// MarshalJSONRedacted.
+type redactedInterface struct {
+	Id                   int64             `json:"id"`
+	Name                 string            `json:"name"`
+	ApiUrl               string            `json:"apiUrl"`
+	Network              api.Network       `json:"network"`
+	Device               api.Device        `json:"device"`
+	Peers                []api.Device      `json:"peers"`
+	SubscriptionId       string            `json:"subscriptionId,omitempty"`
+	ListenPort           int               `json:"listenPort"`
+	DeviceTokenIssuedAt  *time.Time        `json:"deviceTokenIssuedAt,omitempty"`
+	DeviceTokenExpiresAt *time.Time        `json:"deviceTokenExpiresAt,omitempty"`
+	MachineId            []byte            `json:"machineId,omitempty"`
+	Labels               map[string]string `json:"labels,omitempty"`
+	CreatedAt            time.Time         `json:"createdAt"`
+	UpdatedAt            time.Time         `json:"updatedAt"`
+	ArchivedAt           *time.Time        `json:"archivedAt,omitempty"`
+}
+
+// MarshalJSONRedacted serializes the public metadata of the interface as
+// JSON, such as for sharing when debugging. Its private key and device token
+// are omitted.
+func (iface *Interface) MarshalJSONRedacted() ([]byte, error) {
+	data, err := json.Marshal(&redactedInterface{
+		Id:                   iface.Id,
+		Name:                 iface.Name(),
+		ApiUrl:               iface.ApiUrl,
+		Network:              iface.Network,
+		Device:               iface.Device,
+		Peers:                iface.Peers,
+		SubscriptionId:       iface.SubscriptionId,
+		ListenPort:           iface.ListenPort,
+		DeviceTokenIssuedAt:  iface.DeviceTokenIssuedAt,
+		DeviceTokenExpiresAt: iface.DeviceTokenExpiresAt,
+		MachineId:            iface.MachineId,
+		Labels:               iface.Labels,
+		CreatedAt:            iface.CreatedAt,
+		UpdatedAt:            iface.UpdatedAt,
+		ArchivedAt:           iface.ArchivedAt,
+	})
+	return data, errors.WithStack(err)
+}
+
+// validate checks that the addresses of the device and its peers are unique
+// and within the network CIDR.
+func (iface *Interface) validate() error {
+	if iface.Device.Addr.IsZero() {
+		return errors.Errorf("device %q has no address", iface.Device.Id)
+	}
+	if len(iface.MachineId) != 0 && len(iface.MachineId) != api.MachineIdLen {
+		return errors.Errorf("device %q has invalid machine id length %d", iface.Device.Id, len(iface.MachineId))
+	}
+	network := &iface.Network.CIDR
+	if !network.ContainsIP(iface.Device.Addr) {
+		return errors.Errorf("device %q address %q is not in network %q CIDR %q",
+			iface.Device.Id, iface.Device.Addr.String(), iface.Network.Name, network.CIDR().String())
+	}
+	deviceIds := map[string]string{iface.Device.Addr.IP.String(): iface.Device.Id}
+	for i := range iface.Peers {
+		if !network.ContainsIP(iface.Peers[i].Addr) {
+			return errors.Errorf("peer %q address %q is not in network %q CIDR %q",
+				iface.Peers[i].Id, iface.Peers[i].Addr.String(), iface.Network.Name, network.CIDR().String())
+		}
+		ip := iface.Peers[i].Addr.IP.String()
+		if deviceId, ok := deviceIds[ip]; ok {
+			return errors.Errorf("peer %q address %q duplicates the address of device %q",
+				iface.Peers[i].Id, ip, deviceId)
+		}
+		deviceIds[ip] = iface.Peers[i].Id
+	}
+	return nil
+}
+
 type peersModel []api.Device
 
-func (p peersModel) Config(n *api.Network, isServer bool) []wireguard.PeerConfig {
+func (p peersModel) Config(iface *Interface, isServer bool, opts *ConfigOptions) []wireguard.PeerConfig {
 	var result []wireguard.PeerConfig
 	for i := range p {
+		// WireGuard takes a single endpoint for a peer, so connect on the
+		// endpoint selected among its candidates. The agent selects the
+		// next candidate if a handshake does not complete on this one.
+		endpoint := iface.PeerEndpoint(&p[i])
 		if isServer {
 			// If the interface is configured as a server, all peers need to be
-			// defined. AllowedIPs must be converted to a /32 single address,
-			// as we're basically mapping public key identity to network
-			// address here. Endpoint is ignored, because we're not connecting
-			// out to these peers as a client. Keepalive is not set, because
-			// the server can't maintain the connection with clients behind a
-			// NAT.
-			addr := p[i].Addr
-			if p[i].Endpoint == "" {
-				addr.Mask = net.CIDRMask(32, 32)
+			// defined. AllowedIPs must be converted to a /32 (or /128 for
+			// IPv6) single address, as we're basically mapping public key
+			// identity to network address here, unless the peer routes
+			// other addresses.
+			// Endpoint is ignored, because we're not connecting
+			// out to these peers as a client. Keepalive is only set if the
+			// peer asks for it, because the server can't generally maintain
+			// the connection with clients behind a NAT.
+			allowedIPs := p[i].AllowedIPs
+			if len(allowedIPs) == 0 {
+				addr := p[i].Addr
+				if endpoint == "" {
+					bits := 8 * net.IPv4len
+					if addr.IP.To4() == nil {
+						bits = 8 * net.IPv6len
+					}
+					addr.Mask = net.CIDRMask(bits, bits)
+				}
+				allowedIPs = []wireguard.Address{addr}
 			}
 			result = append(result, wireguard.PeerConfig{
-				Name:       p[i].Name,
-				AllowedIPs: []wireguard.Address{addr},
-				PublicKey:  p[i].PublicKey,
-				Endpoint:   p[i].Endpoint,
+				Name:                p[i].Name,
+				AllowedIPs:          allowedIPs,
+				PublicKey:           p[i].PublicKey,
+				Endpoint:            endpoint,
+				PersistentKeepalive: p[i].Keepalive,
 			})
-		} else if p[i].Endpoint != "" {
+		} else if endpoint != "" {
 			// If the interface is a client, then we only connect to servers.
 			// AllowedIPs is used to determine routing available on the server
-			// peer, so we use the peer's address CIDR.
+			// peer, so we use the peer's address CIDR unless it routes
+			// other addresses.
+			allowedIPs := p[i].AllowedIPs
+			if len(allowedIPs) == 0 {
+				allowedIPs = []wireguard.Address{p[i].Addr}
+			}
+			// Clients may keep the connection open through a NAT with a
+			// default keepalive, if the peer does not set its own interval.
+			keepalive := p[i].Keepalive
+			if keepalive == 0 {
+				keepalive = opts.DefaultClientKeepalive
+			}
 			result = append(result, wireguard.PeerConfig{
 				Name:                p[i].Name,
-				Endpoint:            p[i].Endpoint,
-				AllowedIPs:          []wireguard.Address{p[i].Addr},
+				Endpoint:            endpoint,
+				AllowedIPs:          allowedIPs,
 				PublicKey:           p[i].PublicKey,
-				PersistentKeepalive: 15, // TODO: configurable?
+				PersistentKeepalive: keepalive,
 			})
 		}
 	}
@@ -113,8 +431,29 @@ const (
 
 	// OpDeleteDevice deletes a device and its local interface.
 	OpDeleteDevice = Operation("delete_device")
+
+	// OpTeardownDevice brings down the local interface of a device whose
+	// subscription has expired, without departing its network.
+	OpTeardownDevice = Operation("teardown_device")
 )
 
+var operations = []Operation{OpJoinDevice, OpApplyDevice, OpRefreshDevice, OpDeleteDevice, OpTeardownDevice}
+
+// Operations returns all the valid operations.
+func Operations() []Operation {
+	return append([]Operation(nil), operations...)
+}
+
+// IsValid returns whether the operation is one of Operations.
+func (op Operation) IsValid() bool {
+	for i := range operations {
+		if op == operations[i] {
+			return true
+		}
+	}
+	return false
+}
+
 // State represents the state of a local network interface defined by
 // wiregarden.
 type State string
@@ -141,9 +480,57 @@ const (
 	// StateInterfaceDown means the network interface has been brought down
 	// successfully.
 	StateInterfaceDown = State("interface_down")
+
+	// StateInterfaceExpired means the subscription backing the wiregarden
+	// device has expired. If dirty, the interface is to be brought down.
+	StateInterfaceExpired = State("interface_expired")
 )
 
-type Key = [32]byte
+var states = []State{
+	StateInterfaceJoined,
+	StateInterfaceUp,
+	StateInterfaceBlocked,
+	StateInterfaceDeparted,
+	StateInterfaceRevoked,
+	StateInterfaceDown,
+	StateInterfaceExpired,
+}
+
+// States returns all the valid states.
+func States() []State {
+	return append([]State(nil), states...)
+}
+
+// IsValid returns whether the state is one of States.
+func (st State) IsValid() bool {
+	for i := range states {
+		if st == states[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Key is a secretbox key, which seals the secrets in a store.
+type Key [32]byte
+
+// Seal encrypts plaintext with secretbox, prefixed by a random nonce.
+func (k Key) Seal(plaintext []byte) ([]byte, error) {
+	sealed, err := encryptSecret(plaintext, &k)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return sealed, nil
+}
+
+// Open decrypts a secret sealed by Seal with the same key.
+func (k Key) Open(sealed []byte) ([]byte, error) {
+	plaintext, err := secret(sealed).decrypt(&k)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return plaintext, nil
+}
 
 type InterfaceLog struct {
 	Id        int64
@@ -158,3 +545,42 @@ type InterfaceWithLog struct {
 	Interface
 	Log InterfaceLog
 }
+
+// StatusRow summarizes the current status of an interface, without loading
+// its peers or secrets.
+type StatusRow struct {
+	Id          int64
+	NetworkName string
+	NetworkCIDR wireguard.Address
+	DeviceName  string
+	DeviceAddr  wireguard.Address
+	Endpoint    string
+	ListenPort  int
+	PeerCount   int
+	// Log is the most recent log entry for the interface, or nil if the
+	// interface has not been logged yet.
+	Log *InterfaceLog
+}
+
+func (r *StatusRow) Name() string {
+	return interfaceName(r.Id)
+}
+
+// StoreStats summarizes the contents of a store for monitoring.
+type StoreStats struct {
+	// Interfaces is the number of active interfaces.
+	Interfaces int
+
+	// ArchivedInterfaces is the number of archived interfaces.
+	ArchivedInterfaces int
+
+	// Peers is the number of peers of all interfaces.
+	Peers int
+
+	// Logs is the number of interface log entries.
+	Logs int
+
+	// OldestLog and NewestLog are the times of the oldest and newest
+	// interface log entries, or zero if there are none.
+	OldestLog, NewestLog time.Time
+}
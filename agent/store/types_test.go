@@ -0,0 +1,267 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+	"github.com/wiregarden-io/wiregarden/api"
+	"github.com/wiregarden-io/wiregarden/wireguard"
+)
+
+func TestWriteConfig(t *testing.T) {
+	c := qt.New(t)
+	iface := &store.Interface{
+		Id: 1,
+		Network: api.Network{
+			Id:   "test-net-id",
+			Name: "test-net",
+			CIDR: parseAddress(c, "10.1.0.0/24"),
+		},
+		Device: api.Device{
+			Id:        "device-1",
+			Name:      "device-1",
+			Endpoint:  "server.example.com:51820",
+			Addr:      parseAddress(c, "10.1.0.1/24"),
+			PublicKey: parseKey(c, "AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI="),
+		},
+		Peers: []api.Device{{
+			Id:        "device-2",
+			Name:      "device-2",
+			Endpoint:  "peer.example.com:51820",
+			Addr:      parseAddress(c, "10.1.0.2/24"),
+			PublicKey: parseKey(c, "AwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwM="),
+			Keepalive: 25,
+		}, {
+			// A peer without an endpoint routing a subnet.
+			Id:        "device-3",
+			Name:      "device-3",
+			Addr:      parseAddress(c, "10.1.0.3/24"),
+			PublicKey: parseKey(c, "BAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQ="),
+			AllowedIPs: []wireguard.Address{
+				parseAddress(c, "10.1.0.3/32"),
+				parseAddress(c, "192.168.1.0/24"),
+			},
+		}},
+		ListenPort: 51820,
+		Key:        parseKey(c, "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="),
+	}
+	var buf bytes.Buffer
+	err := iface.WriteConfig(&buf)
+	c.Assert(err, qt.IsNil)
+	expected, err := ioutil.ReadFile("testdata/wgn001.conf")
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, string(expected))
+}
+
+func TestMarshalJSONRedacted(t *testing.T) {
+	c := qt.New(t)
+	iface := newTestInterface(c, "test-net", 1, 2)
+	iface.Labels = map[string]string{"env": "prod"}
+	data, err := iface.MarshalJSONRedacted()
+	c.Assert(err, qt.IsNil)
+
+	// Secrets are absent from the output.
+	c.Assert(string(data), qt.Not(qt.Contains), iface.Key.String())
+	c.Assert(string(data), qt.Not(qt.Contains), base64.StdEncoding.EncodeToString(iface.DeviceToken))
+	var fields map[string]interface{}
+	err = json.Unmarshal(data, &fields)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fields["key"], qt.IsNil)
+	c.Assert(fields["deviceToken"], qt.IsNil)
+
+	// Public metadata is kept.
+	var result struct {
+		Id         int64             `json:"id"`
+		Name       string            `json:"name"`
+		Network    api.Network       `json:"network"`
+		Device     api.Device        `json:"device"`
+		Peers      []api.Device      `json:"peers"`
+		ListenPort int               `json:"listenPort"`
+		Labels     map[string]string `json:"labels"`
+	}
+	err = json.Unmarshal(data, &result)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Id, qt.Equals, iface.Id)
+	c.Assert(result.Name, qt.Equals, iface.Name())
+	c.Assert(result.Network, qt.DeepEquals, iface.Network)
+	c.Assert(result.Device, qt.DeepEquals, iface.Device)
+	c.Assert(result.Peers, qt.DeepEquals, iface.Peers)
+	c.Assert(result.ListenPort, qt.Equals, iface.ListenPort)
+	c.Assert(result.Labels, qt.DeepEquals, iface.Labels)
+}
+
+func TestInterfaceEqual(t *testing.T) {
+	c := qt.New(t)
+	iface := newTestInterface(c, "test-net", 1, 3)
+	expiresAt := time.Unix(1600086400, 0)
+	iface.DeviceTokenExpiresAt = &expiresAt
+	iface.Peers[0].Endpoints = []api.Endpoint{{Endpoint: "example.com:51820", Priority: 1}}
+	c.Assert(iface.Equal(iface), qt.IsTrue)
+
+	// copyInterface returns a deep copy of iface, as loaded from a store.
+	copyInterface := func() *store.Interface {
+		other := *iface
+		other.Key = append(wireguard.Key(nil), iface.Key...)
+		other.DeviceToken = append([]byte(nil), iface.DeviceToken...)
+		otherExpiresAt := time.Unix(1600086400, 0)
+		other.DeviceTokenExpiresAt = &otherExpiresAt
+		other.Peers = append([]api.Device(nil), iface.Peers...)
+		other.Peers[0].Endpoints = append([]api.Endpoint(nil), iface.Peers[0].Endpoints...)
+		return &other
+	}
+	other := copyInterface()
+	c.Assert(iface.Equal(other), qt.IsTrue)
+
+	// The id, labels and timestamps are ignored.
+	other.Id = 99
+	other.Labels = map[string]string{"env": "prod"}
+	other.CreatedAt, other.UpdatedAt = time.Unix(1600000000, 0), time.Unix(1600000001, 0)
+	c.Assert(iface.Equal(other), qt.IsTrue)
+
+	// Peers are compared regardless of order.
+	other = copyInterface()
+	other.Peers[0], other.Peers[2] = other.Peers[2], other.Peers[0]
+	c.Assert(iface.Equal(other), qt.IsTrue)
+	c.Assert(other.Equal(iface), qt.IsTrue)
+
+	for _, test := range []struct {
+		about  string
+		change func(*store.Interface)
+	}{{
+		about:  "network name",
+		change: func(other *store.Interface) { other.Network.Name = "other-net" },
+	}, {
+		about:  "device address",
+		change: func(other *store.Interface) { other.Device.Addr = parseAddress(c, "10.0.0.99/8") },
+	}, {
+		about:  "listen port",
+		change: func(other *store.Interface) { other.ListenPort++ },
+	}, {
+		about:  "private key",
+		change: func(other *store.Interface) { other.Key = generateKey(c) },
+	}, {
+		about:  "device token",
+		change: func(other *store.Interface) { other.DeviceToken = []byte("another secret") },
+	}, {
+		about:  "device token expiry",
+		change: func(other *store.Interface) { other.DeviceTokenExpiresAt = nil },
+	}, {
+		about: "archived",
+		change: func(other *store.Interface) {
+			archivedAt := time.Unix(1600000000, 0)
+			other.ArchivedAt = &archivedAt
+		},
+	}, {
+		about:  "peer removed",
+		change: func(other *store.Interface) { other.Peers = other.Peers[1:] },
+	}, {
+		about:  "peer keepalive",
+		change: func(other *store.Interface) { other.Peers[1].Keepalive = 25 },
+	}, {
+		about:  "peer endpoint priority",
+		change: func(other *store.Interface) { other.Peers[0].Endpoints[0].Priority = 2 },
+	}, {
+		about: "peer allowed IPs",
+		change: func(other *store.Interface) {
+			other.Peers[2].AllowedIPs = []wireguard.Address{parseAddress(c, "192.168.1.0/24")}
+		},
+	}} {
+		c.Run(test.about, func(c *qt.C) {
+			other := copyInterface()
+			test.change(other)
+			c.Assert(iface.Equal(other), qt.IsFalse)
+			c.Assert(other.Equal(iface), qt.IsFalse)
+		})
+	}
+}
+
+func TestInterfaceEqualLoaded(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface := newTestInterface(c, "test-net", 1, 3)
+	iface.Peers[0].Endpoints = []api.Endpoint{{Endpoint: "example.com:51820", Priority: 1}}
+	iface.Peers[1].AllowedIPs = []wireguard.Address{parseAddress(c, "192.168.1.0/24")}
+	err := st.EnsureInterface(iface)
+	c.Assert(err, qt.IsNil)
+	loaded, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(loaded.Equal(iface), qt.IsTrue)
+}
+
+func parseKey(c *qt.C, s string) wireguard.Key {
+	key, err := wireguard.ParseKey(s)
+	c.Assert(err, qt.IsNil)
+	return key
+}
+
+func TestJoinResponseToInterface(t *testing.T) {
+	c := qt.New(t)
+	key := generateKey(c)
+	peerKey := generateKey(c)
+	resp := &api.JoinDeviceResponse{
+		Network: api.Network{
+			Id:   "test-net-id",
+			Name: "test-net",
+			CIDR: parseAddress(c, "10.0.0.0/24"),
+		},
+		Device: api.Device{
+			Id:        "test-device-id",
+			Name:      "test-device",
+			Addr:      parseAddress(c, "10.0.0.1/24"),
+			PublicKey: key.PublicKey(),
+		},
+		Peers: []api.Device{{
+			Id:        "test-peer-id",
+			Name:      "test-peer",
+			Endpoint:  "example.com:51820",
+			Addr:      parseAddress(c, "10.0.0.2/24"),
+			PublicKey: peerKey.PublicKey(),
+		}},
+		Plan:           api.PlanDoc{Name: "test-plan", DeviceLimit: 10},
+		SubscriptionId: "test-sub",
+		Token:          []byte("device-token"),
+	}
+	iface, err := store.JoinResponseToInterface(resp, key, "https://example.com/api")
+	c.Assert(err, qt.IsNil)
+	c.Assert(iface, qt.DeepEquals, &store.Interface{
+		ApiUrl:         "https://example.com/api",
+		Network:        resp.Network,
+		Device:         resp.Device,
+		Peers:          resp.Peers,
+		Plan:           resp.Plan,
+		SubscriptionId: "test-sub",
+		Key:            key,
+		DeviceToken:    []byte("device-token"),
+	})
+
+	_, err = store.JoinResponseToInterface(resp, key[:16], "https://example.com/api")
+	c.Assert(err, qt.ErrorMatches, `invalid private key length 16`)
+	_, err = store.JoinResponseToInterface(resp, key, "")
+	c.Assert(err, qt.ErrorMatches, `missing API URL`)
+	invalid := *resp
+	invalid.Token = nil
+	_, err = store.JoinResponseToInterface(&invalid, key, "https://example.com/api")
+	c.Assert(err, qt.ErrorMatches, `missing device token`)
+	invalid = *resp
+	invalid.Peers = []api.Device{{Id: "test-peer-id", PublicKey: peerKey.PublicKey()}}
+	_, err = store.JoinResponseToInterface(&invalid, key, "https://example.com/api")
+	c.Assert(err, qt.ErrorMatches, `invalid peer "test-peer-id": missing address`)
+}
@@ -0,0 +1,305 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/wireguard"
+)
+
+// ProblemKind is the kind of inconsistency found by Verify.
+type ProblemKind string
+
+const (
+	// ProblemOrphanedPeer means peer rows refer to a missing interface.
+	ProblemOrphanedPeer = ProblemKind("orphaned_peer")
+
+	// ProblemOrphanedEndpoint means device endpoint rows refer to a missing
+	// interface.
+	ProblemOrphanedEndpoint = ProblemKind("orphaned_endpoint")
+
+	// ProblemOrphanedLog means log entries refer to a missing interface.
+	ProblemOrphanedLog = ProblemKind("orphaned_log")
+
+	// ProblemOrphanedLabel means labels refer to a missing interface.
+	ProblemOrphanedLabel = ProblemKind("orphaned_label")
+
+	// ProblemOrphanedSecret means secrets refer to a missing interface.
+	ProblemOrphanedSecret = ProblemKind("orphaned_secret")
+
+	// ProblemOrphanedHandshake means handshake times refer to a missing
+	// interface.
+	ProblemOrphanedHandshake = ProblemKind("orphaned_handshake")
+
+	// ProblemOrphanedPeerName means peer name history refers to a missing
+	// interface.
+	ProblemOrphanedPeerName = ProblemKind("orphaned_peer_name")
+
+	// ProblemOrphanedSelectedEndpoint means selected peer endpoints refer to
+	// a missing interface.
+	ProblemOrphanedSelectedEndpoint = ProblemKind("orphaned_selected_endpoint")
+
+	// ProblemMissingSecret means an interface has no secrets.
+	ProblemMissingSecret = ProblemKind("missing_secret")
+
+	// ProblemInvalidAddress means the address of a device or its network
+	// cannot be parsed.
+	ProblemInvalidAddress = ProblemKind("invalid_address")
+
+	// ProblemAddressOutsideNetwork means the address of a device or peer is
+	// not within the CIDR of its network.
+	ProblemAddressOutsideNetwork = ProblemKind("address_outside_network")
+
+	// ProblemDuplicatePublicKey means an interface has the same public key
+	// as a newer interface, and would be dropped by Repair.
+	ProblemDuplicatePublicKey = ProblemKind("duplicate_public_key")
+)
+
+// Problem is an inconsistency in the store found by Verify.
+type Problem struct {
+	Kind ProblemKind
+
+	// InterfaceId is the interface with the problem. For orphaned rows, it
+	// is the missing interface they refer to.
+	InterfaceId int64
+
+	// DeviceId is the peer with the problem, if the problem concerns a
+	// peer rather than the interface device.
+	DeviceId string
+
+	// Message describes the problem.
+	Message string
+}
+
+func (p Problem) String() string {
+	return p.Message
+}
+
+// orphanTables are the tables with rows which refer to interfaces, and the
+// kind of problem reported for rows referring to a missing interface.
+var orphanTables = []struct {
+	table string
+	kind  ProblemKind
+}{
+	{"peer", ProblemOrphanedPeer},
+	{"device_endpoint", ProblemOrphanedEndpoint},
+	{"iface_log", ProblemOrphanedLog},
+	{"iface_label", ProblemOrphanedLabel},
+	{"secret.iface_secrets", ProblemOrphanedSecret},
+	{"handshake", ProblemOrphanedHandshake},
+	{"peer_name_history", ProblemOrphanedPeerName},
+	{"selected_endpoint", ProblemOrphanedSelectedEndpoint},
+}
+
+// Verify checks the store for inconsistencies which may have crept in, such
+// as from bugs in earlier versions or editing the database by hand, and
+// reports each problem found. Nothing is modified. Archived interfaces are
+// checked along with active ones.
+func (s *Store) Verify() ([]Problem, error) {
+	return s.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify, but aborts if the context is cancelled.
+func (s *Store) VerifyContext(ctx context.Context) ([]Problem, error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	q := s.prepared(tx)
+	var problems []Problem
+	for _, check := range []func(context.Context, querier) ([]Problem, error){
+		verifyOrphans,
+		verifySecrets,
+		verifyInterfaces,
+		verifyPeers,
+	} {
+		found, err := check(ctx, q)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to verify store")
+		}
+		problems = append(problems, found...)
+	}
+	return problems, nil
+}
+
+func verifyOrphans(ctx context.Context, q querier) ([]Problem, error) {
+	var problems []Problem
+	for _, t := range orphanTables {
+		rows, err := q.QueryContext(ctx, `select t.iface_id, count(*) from `+t.table+` t
+left join iface i on (i.id = t.iface_id)
+where i.id is null
+group by t.iface_id
+order by t.iface_id`)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query orphaned rows in table %q", t.table)
+		}
+		for rows.Next() {
+			var id int64
+			var n int
+			err := rows.Scan(&id, &n)
+			if err != nil {
+				rows.Close()
+				return nil, errors.Wrapf(err, "failed to scan orphaned rows in table %q", t.table)
+			}
+			problems = append(problems, Problem{
+				Kind:        t.kind,
+				InterfaceId: id,
+				Message:     fmt.Sprintf("%d rows in table %q refer to missing interface %d", n, t.table, id),
+			})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, errors.Wrapf(err, "failed to query orphaned rows in table %q", t.table)
+		}
+	}
+	return problems, nil
+}
+
+func verifySecrets(ctx context.Context, q querier) ([]Problem, error) {
+	rows, err := q.QueryContext(ctx, `
+select i.id from iface i
+left join secret.iface_secrets s on (s.iface_id = i.id)
+where s.iface_id is null
+order by i.id`[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query interfaces missing secrets")
+	}
+	defer rows.Close()
+	var problems []Problem
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan interface missing secrets")
+		}
+		problems = append(problems, Problem{
+			Kind:        ProblemMissingSecret,
+			InterfaceId: id,
+			Message:     fmt.Sprintf("interface %d has no secrets", id),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to query interfaces missing secrets")
+	}
+	return problems, nil
+}
+
+func verifyInterfaces(ctx context.Context, q querier) ([]Problem, error) {
+	rows, err := q.QueryContext(ctx, `select id, net_cidr, device_id, device_addr, public_key, created_at from iface order by id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query interfaces")
+	}
+	defer rows.Close()
+	type newer struct {
+		id, createdAt int64
+	}
+	var problems []Problem
+	var ids []int64
+	idKeys := map[int64]string{}
+	newest := map[string]newer{}
+	for rows.Next() {
+		var id, createdAt int64
+		var netCIDR, deviceId, deviceAddr, publicKey string
+		err := rows.Scan(&id, &netCIDR, &deviceId, &deviceAddr, &publicKey, &createdAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan interface")
+		}
+		if problem := verifyAddress(id, "", netCIDR, deviceAddr); problem != nil {
+			problem.Message = fmt.Sprintf("interface %d device %q: %s", id, deviceId, problem.Message)
+			problems = append(problems, *problem)
+		}
+		ids = append(ids, id)
+		idKeys[id] = publicKey
+		// The newest interface with a public key is the one kept by
+		// Repair, ordering by creation time and then by id.
+		if n, ok := newest[publicKey]; !ok || createdAt >= n.createdAt {
+			newest[publicKey] = newer{id: id, createdAt: createdAt}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to query interfaces")
+	}
+	for _, id := range ids {
+		if newerId := newest[idKeys[id]].id; newerId != id {
+			problems = append(problems, Problem{
+				Kind:        ProblemDuplicatePublicKey,
+				InterfaceId: id,
+				Message:     fmt.Sprintf("interface %d has the same public key as newer interface %d", id, newerId),
+			})
+		}
+	}
+	return problems, nil
+}
+
+func verifyPeers(ctx context.Context, q querier) ([]Problem, error) {
+	rows, err := q.QueryContext(ctx, `
+select p.iface_id, i.net_cidr, p.device_id, p.device_addr from peer p
+join iface i on (i.id = p.iface_id)
+order by p.iface_id, p.device_id`[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query peers")
+	}
+	defer rows.Close()
+	var problems []Problem
+	for rows.Next() {
+		var id int64
+		var netCIDR, deviceId, deviceAddr string
+		err := rows.Scan(&id, &netCIDR, &deviceId, &deviceAddr)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan peer")
+		}
+		if problem := verifyAddress(id, deviceId, netCIDR, deviceAddr); problem != nil {
+			problem.Message = fmt.Sprintf("interface %d peer %q: %s", id, deviceId, problem.Message)
+			problems = append(problems, *problem)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to query peers")
+	}
+	return problems, nil
+}
+
+// verifyAddress returns a problem if the address of a device is invalid or
+// outside of its network, or nil if it is valid.
+func verifyAddress(ifaceId int64, deviceId string, netCIDR, deviceAddr string) *Problem {
+	network, err := wireguard.ParseAddress(netCIDR)
+	if err != nil {
+		return &Problem{
+			Kind:        ProblemInvalidAddress,
+			InterfaceId: ifaceId,
+			DeviceId:    deviceId,
+			Message:     fmt.Sprintf("invalid network CIDR %q", netCIDR),
+		}
+	}
+	addr, err := wireguard.ParseAddress(deviceAddr)
+	if err != nil {
+		return &Problem{
+			Kind:        ProblemInvalidAddress,
+			InterfaceId: ifaceId,
+			DeviceId:    deviceId,
+			Message:     fmt.Sprintf("invalid address %q", deviceAddr),
+		}
+	}
+	if !network.ContainsIP(*addr) {
+		return &Problem{
+			Kind:        ProblemAddressOutsideNetwork,
+			InterfaceId: ifaceId,
+			DeviceId:    deviceId,
+			Message:     fmt.Sprintf("address %q is not in network CIDR %q", deviceAddr, netCIDR),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"database/sql"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+)
+
+func TestVerify(t *testing.T) {
+	c := qt.New(t)
+	path := c.Mkdir() + "/db"
+	st, err := store.New(path, generateStoreKey(c))
+	c.Assert(err, qt.IsNil)
+	defer st.Close()
+	var ifaces []*store.Interface
+	for i := 1; i <= 3; i++ {
+		iface := newTestInterface(c, "test-net", i, 1)
+		err = st.EnsureInterface(iface)
+		c.Assert(err, qt.IsNil)
+		ifaces = append(ifaces, iface)
+	}
+	problems, err := st.Verify()
+	c.Assert(err, qt.IsNil)
+	c.Assert(problems, qt.HasLen, 0)
+
+	// Inject inconsistencies which the store's constraints would otherwise
+	// prevent.
+	execRaw(c, path, `
+insert into peer (iface_id, device_id, device_name, device_endpoint, device_addr, public_key)
+values (99, 'orphan-peer', 'orphan-peer', '', '10.0.0.99/8', 'orphan-key')`[1:])
+	execRaw(c, path, `insert into device_endpoint (iface_id, device_id, endpoint) values (98, 'orphan-peer', 'example.com:51820')`)
+	execRaw(c, path, `insert into iface_log (ts, iface_id, operation, state, message) values (0, 97, 'join_device', 'interface_joined', '')`)
+	execRaw(c, path, `insert into iface_log (ts, iface_id, operation, state, message) values (0, 97, 'apply_device', 'interface_up', '')`)
+	execRaw(c, path, `insert into iface_label (iface_id, key, value) values (96, 'env', 'prod')`)
+	execRaw(c, path+".secret", `insert into iface_secrets (iface_id, key, device_token) values (95, x'00', x'00')`)
+	execRaw(c, path, `insert into handshake (iface_id, peer_device_id, last_handshake_at) values (94, 'orphan-peer', 0)`)
+	execRaw(c, path, `insert into peer_name_history (iface_id, device_id, name, changed_at) values (93, 'orphan-peer', 'orphan-peer', 0)`)
+	execRaw(c, path, `insert into selected_endpoint (iface_id, peer_device_id, endpoint, selected_at) values (92, 'orphan-peer', 'example.com:51820', 0)`)
+	execRaw(c, path+".secret", `delete from iface_secrets where iface_id = ?`, ifaces[1].Id)
+	execRaw(c, path, `update iface set device_addr = '192.168.0.1/24' where id = ?`, ifaces[0].Id)
+	execRaw(c, path, `update peer set device_addr = '192.168.0.2/24' where iface_id = ?`, ifaces[0].Id)
+	execRaw(c, path, `update peer set device_addr = 'bogus' where iface_id = ?`, ifaces[1].Id)
+	execRaw(c, path, `drop index iface_public_key_unique`)
+	execRaw(c, path, `update iface set public_key = ? where id = ?`, ifaces[0].Device.PublicKey.String(), ifaces[2].Id)
+
+	problems, err = st.Verify()
+	c.Assert(err, qt.IsNil)
+	c.Assert(problems, qt.DeepEquals, []store.Problem{{
+		Kind:        store.ProblemOrphanedPeer,
+		InterfaceId: 99,
+		Message:     `1 rows in table "peer" refer to missing interface 99`,
+	}, {
+		Kind:        store.ProblemOrphanedEndpoint,
+		InterfaceId: 98,
+		Message:     `1 rows in table "device_endpoint" refer to missing interface 98`,
+	}, {
+		Kind:        store.ProblemOrphanedLog,
+		InterfaceId: 97,
+		Message:     `2 rows in table "iface_log" refer to missing interface 97`,
+	}, {
+		Kind:        store.ProblemOrphanedLabel,
+		InterfaceId: 96,
+		Message:     `1 rows in table "iface_label" refer to missing interface 96`,
+	}, {
+		Kind:        store.ProblemOrphanedSecret,
+		InterfaceId: 95,
+		Message:     `1 rows in table "secret.iface_secrets" refer to missing interface 95`,
+	}, {
+		Kind:        store.ProblemOrphanedHandshake,
+		InterfaceId: 94,
+		Message:     `1 rows in table "handshake" refer to missing interface 94`,
+	}, {
+		Kind:        store.ProblemOrphanedPeerName,
+		InterfaceId: 93,
+		Message:     `1 rows in table "peer_name_history" refer to missing interface 93`,
+	}, {
+		Kind:        store.ProblemOrphanedSelectedEndpoint,
+		InterfaceId: 92,
+		Message:     `1 rows in table "selected_endpoint" refer to missing interface 92`,
+	}, {
+		Kind:        store.ProblemMissingSecret,
+		InterfaceId: ifaces[1].Id,
+		Message:     `interface 2 has no secrets`,
+	}, {
+		Kind:        store.ProblemAddressOutsideNetwork,
+		InterfaceId: ifaces[0].Id,
+		Message:     `interface 1 device "test-net-device-1-id": address "192.168.0.1/24" is not in network CIDR "10.0.0.0/8"`,
+	}, {
+		Kind:        store.ProblemDuplicatePublicKey,
+		InterfaceId: ifaces[0].Id,
+		Message:     `interface 1 has the same public key as newer interface 3`,
+	}, {
+		Kind:        store.ProblemAddressOutsideNetwork,
+		InterfaceId: ifaces[0].Id,
+		DeviceId:    ifaces[0].Peers[0].Id,
+		Message:     `interface 1 peer "test-net-device-1-peer-0-id": address "192.168.0.2/24" is not in network CIDR "10.0.0.0/8"`,
+	}, {
+		Kind:        store.ProblemInvalidAddress,
+		InterfaceId: ifaces[1].Id,
+		DeviceId:    ifaces[1].Peers[0].Id,
+		Message:     `interface 2 peer "test-net-device-2-peer-0-id": invalid address "bogus"`,
+	}})
+}
+
+// execRaw executes a statement on the sqlite database at path directly,
+// without the store's foreign key constraints.
+func execRaw(c *qt.C, path string, stmt string, args ...interface{}) {
+	db, err := sql.Open("sqlite3", "file:"+path)
+	c.Assert(err, qt.IsNil)
+	defer db.Close()
+	_, err = db.Exec(stmt, args...)
+	c.Assert(err, qt.IsNil)
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/api"
+	"github.com/wiregarden-io/wiregarden/wireguard"
+)
+
+// ParseWireGuardConfig parses a wg-quick configuration file into an
+// interface with its peers, which may be saved with EnsureInterface.
+//
+// A wg-quick file does not identify devices or networks, so devices are
+// identified by their public keys. The network is named after the interface
+// name, such as wg0 for /etc/wireguard/wg0.conf, or the interface's
+// "# Name = " comment if name is empty, and its CIDR is that of the
+// interface address. Peers are named by their "# Name = " comments if
+// present. Names are normalized with api.NormalizeName, and devices without
+// a usable name are named after their public key. Each peer's address is
+// the first of its allowed IPs within the network.
+func ParseWireGuardConfig(name string, r io.Reader) (*Interface, error) {
+	cfg, err := wireguard.ParseConfig(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse config")
+	}
+	if name == "" {
+		name = cfg.Name
+	}
+	networkName := api.NormalizeName(name)
+	if networkName == "" {
+		return nil, errors.Errorf("invalid config: cannot name network after interface %q", name)
+	}
+	if len(cfg.PrivateKey) == 0 {
+		return nil, errors.New("invalid config: missing private key")
+	}
+	if cfg.Address.IsZero() {
+		return nil, errors.New("invalid config: missing address")
+	}
+	network := wireguard.Address(*cfg.Address.CIDR())
+	publicKey := cfg.PrivateKey.PublicKey()
+	iface := &Interface{
+		Network: api.Network{
+			Name: networkName,
+			CIDR: network,
+		},
+		Device: api.Device{
+			Id:        publicKey.String(),
+			Name:      keyName(publicKey),
+			Addr:      cfg.Address,
+			PublicKey: publicKey,
+		},
+		ListenPort: cfg.ListenPort,
+		Key:        cfg.PrivateKey,
+	}
+	for i := range cfg.Peers {
+		peerCfg := &cfg.Peers[i]
+		if len(peerCfg.PublicKey) == 0 {
+			return nil, errors.Errorf("invalid config: peer %d missing public key", i+1)
+		}
+		peer := api.Device{
+			Id:         peerCfg.PublicKey.String(),
+			Name:       api.NormalizeName(peerCfg.Name),
+			Endpoint:   peerCfg.Endpoint,
+			PublicKey:  peerCfg.PublicKey,
+			AllowedIPs: peerCfg.AllowedIPs,
+			Keepalive:  peerCfg.PersistentKeepalive,
+		}
+		if peer.Name == "" {
+			peer.Name = keyName(peer.PublicKey)
+		}
+		for _, allowedIP := range peerCfg.AllowedIPs {
+			if network.Contains(wireguard.Address{IP: allowedIP.IP, Mask: network.Mask}) {
+				peer.Addr = wireguard.Address{IP: allowedIP.IP, Mask: network.Mask}
+				break
+			}
+		}
+		if peer.Addr.IsZero() {
+			return nil, errors.Errorf("invalid config: peer %q has no allowed IP in network %q",
+				peer.Id, network.String())
+		}
+		iface.Peers = append(iface.Peers, peer)
+	}
+	return iface, nil
+}
+
+// keyName returns a device name derived from a public key, for devices a
+// wg-quick file does not name.
+func keyName(publicKey wireguard.Key) string {
+	return "key-" + hex.EncodeToString(publicKey[:6])
+}
+
+// ImportWireGuardConfig parses a wg-quick configuration file with
+// ParseWireGuardConfig and saves the interface, returning it with its
+// assigned id.
+func (s *Store) ImportWireGuardConfig(name string, r io.Reader) (*Interface, error) {
+	return s.ImportWireGuardConfigContext(context.Background(), name, r)
+}
+
+// ImportWireGuardConfigContext is like ImportWireGuardConfig, but aborts if
+// the context is cancelled.
+func (s *Store) ImportWireGuardConfigContext(ctx context.Context, name string, r io.Reader) (*Interface, error) {
+	iface, err := ParseWireGuardConfig(name, r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = s.EnsureInterfaceContext(ctx, iface)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return iface, nil
+}
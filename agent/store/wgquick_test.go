@@ -0,0 +1,143 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package store_test
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/wiregarden-io/wiregarden/agent/store"
+	"github.com/wiregarden-io/wiregarden/api"
+	"github.com/wiregarden-io/wiregarden/wireguard"
+)
+
+const testWireGuardConfig = `
+[Interface]
+Address = 10.1.0.1/24
+ListenPort = 51820
+PrivateKey = AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=
+SaveConfig = false
+FwMark = 0x1234
+
+[Peer]
+# Name = Laptop
+PublicKey = AwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwM=
+AllowedIPs = 10.1.0.2/32
+Endpoint = laptop.example.com:51820
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = BAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQ=
+AllowedIPs = 192.168.1.0/24, 10.1.0.3/32
+`
+
+func TestParseWireGuardConfig(t *testing.T) {
+	c := qt.New(t)
+	iface, err := store.ParseWireGuardConfig("wg0", strings.NewReader(testWireGuardConfig))
+	c.Assert(err, qt.IsNil)
+	privateKey := parseKey(c, "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=")
+	publicKey := privateKey.PublicKey()
+	c.Assert(iface, qt.DeepEquals, &store.Interface{
+		Network: api.Network{
+			Name: "wg0",
+			CIDR: parseAddress(c, "10.1.0.0/24"),
+		},
+		Device: api.Device{
+			Id:        publicKey.String(),
+			Name:      "key-" + hex.EncodeToString(publicKey[:6]),
+			Addr:      parseAddress(c, "10.1.0.1/24"),
+			PublicKey: publicKey,
+		},
+		Peers: []api.Device{{
+			Id:         "AwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwM=",
+			Name:       "laptop",
+			Endpoint:   "laptop.example.com:51820",
+			Addr:       parseAddress(c, "10.1.0.2/24"),
+			PublicKey:  parseKey(c, "AwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwM="),
+			AllowedIPs: []wireguard.Address{parseAddress(c, "10.1.0.2/32")},
+			Keepalive:  25,
+		}, {
+			Id:        "BAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQ=",
+			Name:      "key-040404040404",
+			Addr:      parseAddress(c, "10.1.0.3/24"),
+			PublicKey: parseKey(c, "BAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQ="),
+			AllowedIPs: []wireguard.Address{
+				parseAddress(c, "192.168.1.0/24"),
+				parseAddress(c, "10.1.0.3/32"),
+			},
+		}},
+		ListenPort: 51820,
+		Key:        privateKey,
+	})
+	// Devices are given valid names.
+	const validName = `[a-z0-9]([a-z0-9-]*[a-z0-9])?`
+	c.Assert(iface.Device.Name, qt.Matches, validName)
+	for i := range iface.Peers {
+		c.Assert(iface.Peers[i].Name, qt.Matches, validName)
+	}
+
+	// Without an interface name, the network is named by the interface's
+	// name comment.
+	iface, err = store.ParseWireGuardConfig("", strings.NewReader("[Interface]\n# Name = Home.lan\n"+
+		"Address = 10.1.0.1/24\nPrivateKey = AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=\n"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(iface.Network.Name, qt.Equals, "home")
+}
+
+func TestParseWireGuardConfigInvalid(t *testing.T) {
+	c := qt.New(t)
+	_, err := store.ParseWireGuardConfig("wg0", strings.NewReader(`
+[Interface]
+Address = 10.1.0.1/24
+`))
+	c.Assert(err, qt.ErrorMatches, `invalid config: missing private key`)
+
+	_, err = store.ParseWireGuardConfig("wg0", strings.NewReader(`
+[Interface]
+Address = 10.1.0.1/24
+PrivateKey = AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=
+
+[Peer]
+PublicKey = AwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwM=
+AllowedIPs = 192.168.1.0/24
+`))
+	c.Assert(err, qt.ErrorMatches, `invalid config: peer .* has no allowed IP in network "10.1.0.0/24"`)
+
+	// Peers with preshared keys could not connect without them.
+	_, err = store.ParseWireGuardConfig("wg0", strings.NewReader(`
+[Interface]
+Address = 10.1.0.1/24
+PrivateKey = AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=
+
+[Peer]
+PublicKey = AwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwM=
+PresharedKey = BQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQU=
+AllowedIPs = 10.1.0.2/32
+`))
+	c.Assert(err, qt.ErrorMatches, `failed to parse config: line 8: invalid PresharedKey .*: preshared keys are not supported`)
+}
+
+func TestImportWireGuardConfig(t *testing.T) {
+	c := qt.New(t)
+	st := newTestStore(c)
+	defer st.Close()
+	iface, err := st.ImportWireGuardConfig("wg0", strings.NewReader(testWireGuardConfig))
+	c.Assert(err, qt.IsNil)
+	c.Assert(iface.Id, qt.Not(qt.Equals), int64(0))
+	result, err := st.Interface(iface.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Key, qt.DeepEquals, iface.Key)
+	c.Assert(result.Device, qt.DeepEquals, iface.Device)
+	c.Assert(result.Peers, qt.DeepEquals, iface.Peers)
+}
@@ -11,8 +11,6 @@
 package agent
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/hex"
 	"io/ioutil"
 	"net"
@@ -20,6 +18,8 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/api"
 )
 
 func MachineId() ([]byte, error) {
@@ -31,9 +31,7 @@ func MachineId() ([]byte, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "invalid machine-id %q", string(buf))
 	}
-	mac := hmac.New(sha256.New, id)
-	mac.Write([]byte("wiregarden"))
-	return mac.Sum(nil), nil
+	return api.DeriveMachineId(id, []byte("wiregarden")), nil
 }
 
 func findListenPort(endpoint string) (int, error) {
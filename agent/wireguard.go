@@ -14,6 +14,9 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -21,7 +24,8 @@ import (
 )
 
 type wireguardManager struct {
-	dataDir string
+	dataDir       string
+	configOptions []store.ConfigOption
 }
 
 func (m *wireguardManager) EnsureInterface(iface *store.Interface) error {
@@ -31,7 +35,7 @@ func (m *wireguardManager) EnsureInterface(iface *store.Interface) error {
 		return errors.Wrap(err, "failed to create interface device config")
 	}
 	defer f.Close()
-	ifaceCfg := iface.Config()
+	ifaceCfg := iface.Config(m.configOptions...)
 	err = ifaceCfg.WriteConfig(f)
 	if err != nil {
 		return errors.Wrap(err, "failed to write interface device config")
@@ -72,3 +76,36 @@ func (*wireguardManager) downUp(cfgPath string) error {
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
+
+func (*wireguardManager) Handshakes(iface *store.Interface) (map[string]time.Time, error) {
+	out, err := exec.Command("/usr/bin/wg", "show", iface.Name(), "latest-handshakes").Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to show handshakes of network interface %q", iface.Name())
+	}
+	return parseHandshakes(out)
+}
+
+// parseHandshakes parses the output of wg show latest-handshakes: a line for
+// each peer, with its public key and the time of the latest handshake in
+// seconds since the epoch, or zero if there has not been one.
+func parseHandshakes(out []byte) (map[string]time.Time, error) {
+	handshakes := map[string]time.Time{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid handshake %q", line)
+		}
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid handshake %q", line)
+		}
+		if sec == 0 {
+			continue
+		}
+		handshakes[fields[0]] = time.Unix(sec, 0)
+	}
+	return handshakes, nil
+}
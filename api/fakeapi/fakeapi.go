@@ -0,0 +1,319 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package fakeapi provides an in-memory fake of the wiregarden.io API, for
+// testing agents and integrations without a live server.
+package fakeapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/api"
+	"github.com/wiregarden-io/wiregarden/wireguard"
+)
+
+// Server is an in-memory fake of the wiregarden.io device API for a single
+// subscription.
+//
+// Server may be used directly as an agent API client, or served over HTTP
+// for use with an api.Client.
+type Server struct {
+	// SubscriptionId identifies the fake subscription.
+	SubscriptionId string
+
+	// SubscriptionToken authorizes devices to join networks on the fake
+	// subscription.
+	SubscriptionToken []byte
+
+	// Plan is the subscription plan. Joins beyond the plan's DeviceLimit
+	// are rejected.
+	Plan api.PlanDoc
+
+	// TokenLifetime is how long device tokens issued to joining devices
+	// are valid for. If zero, tokens do not expire.
+	TokenLifetime time.Duration
+
+	mu       sync.Mutex
+	networks map[string]*api.Network
+	devices  map[string]*device
+}
+
+type device struct {
+	api.Device
+	network string
+	token   string
+}
+
+// New returns a new fake API server for a subscription on the given plan.
+func New(plan api.PlanDoc) *Server {
+	return &Server{
+		SubscriptionId:    randomId(),
+		SubscriptionToken: []byte(randomId()),
+		Plan:              plan,
+		networks:          map[string]*api.Network{},
+		devices:           map[string]*device{},
+	}
+}
+
+// JoinDevice joins a device to a network on the subscription, creating the
+// network if necessary.
+func (s *Server) JoinDevice(ctx context.Context, req *api.JoinDeviceRequest) (*api.JoinDeviceResponse, error) {
+	if !s.authorizeSubscription(ctx) {
+		return nil, errors.Wrap(api.ErrApiForbidden, "invalid subscription token")
+	}
+	if err := req.Valid(); err != nil {
+		return nil, errors.Wrap(api.ErrApiClient, err.Error())
+	}
+	networkName := req.Network
+	if networkName == "" {
+		networkName = "default"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Plan.DeviceLimit > 0 && len(s.devices) >= s.Plan.DeviceLimit {
+		return nil, errors.Wrapf(api.ErrApiClient, "plan device limit %d reached", s.Plan.DeviceLimit)
+	}
+	network, ok := s.networks[networkName]
+	var addr wireguard.Address
+	if !ok {
+		if req.AvailableAddr.IsZero() {
+			return nil, errors.Wrap(api.ErrApiClient, "available address required to start a new network")
+		}
+		network = &api.Network{
+			Id:   randomId(),
+			Name: networkName,
+			CIDR: wireguard.Address{
+				IP:   req.AvailableAddr.IP.Mask(req.AvailableAddr.Mask),
+				Mask: req.AvailableAddr.Mask,
+			},
+		}
+		s.networks[networkName] = network
+		addr = req.AvailableAddr
+	} else {
+		for _, d := range s.devices {
+			if d.network == networkName && d.Name == req.Name {
+				return nil, errors.WithStack(api.ErrDeviceAlreadyJoined)
+			}
+		}
+		var err error
+		addr, err = s.nextAddr(network)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	d := &device{
+		Device: api.Device{
+			Id:        randomId(),
+			Name:      req.Name,
+			Endpoint:  req.Endpoint,
+			Addr:      addr,
+			PublicKey: req.Key,
+		},
+		network: networkName,
+		token:   randomId(),
+	}
+	s.devices[d.Id] = d
+	resp := s.deviceResponse(d)
+	resp.Token = []byte(d.token)
+	if s.TokenLifetime > 0 {
+		expiresAt := time.Now().Add(s.TokenLifetime)
+		resp.TokenExpiresAt = &expiresAt
+	}
+	return resp, nil
+}
+
+// RefreshDevice updates the device authorized by the context's device token.
+func (s *Server) RefreshDevice(ctx context.Context, req *api.RefreshDeviceRequest) (*api.JoinDeviceResponse, error) {
+	if err := req.Valid(); err != nil {
+		return nil, errors.Wrap(api.ErrApiClient, err.Error())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.authorizeDevice(ctx)
+	if !ok {
+		return nil, errors.Wrap(api.ErrApiForbidden, "invalid device token")
+	}
+	if req.Name != "" {
+		d.Name = req.Name
+	}
+	if len(req.Key) > 0 {
+		d.PublicKey = req.Key
+	}
+	if req.Endpoint != "" {
+		d.Endpoint = req.Endpoint
+	} else if req.ClearEndpoint {
+		d.Endpoint = ""
+	}
+	return s.deviceResponse(d), nil
+}
+
+// DepartDevice removes the device authorized by the context's device token
+// from its network.
+func (s *Server) DepartDevice(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.authorizeDevice(ctx)
+	if !ok {
+		return errors.Wrap(api.ErrApiForbidden, "invalid device token")
+	}
+	delete(s.devices, d.Id)
+	return nil
+}
+
+// ListDevices lists all devices joined on the subscription.
+func (s *Server) ListDevices(ctx context.Context) (*api.ListDevicesResponse, error) {
+	if !s.authorizeSubscription(ctx) {
+		return nil, errors.Wrap(api.ErrApiForbidden, "invalid subscription token")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &api.ListDevicesResponse{Devices: []api.GetDeviceResponse{}}
+	for _, d := range s.devices {
+		resp.Devices = append(resp.Devices, api.GetDeviceResponse{
+			Network: *s.networks[d.network],
+			Device:  d.Device,
+		})
+	}
+	return resp, nil
+}
+
+// RemoveDevice removes a device from its network, as if it had been deleted
+// by the subscription owner. Subsequent requests authorized by the device's
+// token are forbidden.
+func (s *Server) RemoveDevice(deviceId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.devices[deviceId]
+	delete(s.devices, deviceId)
+	return ok
+}
+
+func (s *Server) authorizeSubscription(ctx context.Context) bool {
+	token, _ := ctx.Value("token").([]byte)
+	return string(token) == string(s.SubscriptionToken)
+}
+
+func (s *Server) authorizeDevice(ctx context.Context) (*device, bool) {
+	token, _ := ctx.Value("token").([]byte)
+	for _, d := range s.devices {
+		if d.token == string(token) {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+func (s *Server) deviceResponse(d *device) *api.JoinDeviceResponse {
+	resp := &api.JoinDeviceResponse{
+		Network:        *s.networks[d.network],
+		Device:         d.Device,
+		Peers:          []api.Device{},
+		Plan:           s.Plan,
+		SubscriptionId: s.SubscriptionId,
+	}
+	for _, peer := range s.devices {
+		if peer.network == d.network && peer.Id != d.Id {
+			resp.Peers = append(resp.Peers, peer.Device)
+		}
+	}
+	return resp
+}
+
+// nextAddr returns the lowest unassigned host address in the network.
+func (s *Server) nextAddr(network *api.Network) (wireguard.Address, error) {
+	var taken []wireguard.Address
+	for _, d := range s.devices {
+		if d.network == network.Name {
+			taken = append(taken, d.Addr)
+		}
+	}
+	addr, err := wireguard.AllocateAddress(network.CIDR, taken)
+	if err != nil {
+		return wireguard.Address{}, errors.Wrapf(api.ErrApiClient, "network %q has no available addresses: %v", network.Name, err)
+	}
+	return addr, nil
+}
+
+// ServeHTTP serves the fake device API over HTTP.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if auth := r.Header.Get("authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			http.Error(w, "invalid authorization", http.StatusForbidden)
+			return
+		}
+		ctx = context.WithValue(ctx, "token", token)
+	}
+	if r.URL.Path != "/v1/device" {
+		http.NotFound(w, r)
+		return
+	}
+	var resp interface{}
+	var err error
+	switch r.Method {
+	case "POST":
+		var req api.JoinDeviceRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			err = errors.Wrap(api.ErrApiClient, err.Error())
+			break
+		}
+		resp, err = s.JoinDevice(ctx, &req)
+	case "PUT":
+		var req api.RefreshDeviceRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			err = errors.Wrap(api.ErrApiClient, err.Error())
+			break
+		}
+		resp, err = s.RefreshDevice(ctx, &req)
+	case "DELETE":
+		err = s.DepartDevice(ctx)
+	case "GET":
+		resp, err = s.ListDevices(ctx)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, api.ErrApiForbidden):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, api.ErrDeviceAlreadyJoined):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, api.ErrApiClient):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	if resp != nil {
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func randomId() string {
+	var buf [16]byte
+	if _, err := rand.Reader.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package fakeapi_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/agent"
+	"github.com/wiregarden-io/wiregarden/api"
+	"github.com/wiregarden-io/wiregarden/api/fakeapi"
+	"github.com/wiregarden-io/wiregarden/wireguard"
+)
+
+func TestDeviceLimit(t *testing.T) {
+	c := qt.New(t)
+	srv := fakeapi.New(api.PlanDoc{Name: "test-plan", DeviceLimit: 2})
+	ctx := agent.WithToken(context.Background(), srv.SubscriptionToken)
+	resp1, err := srv.JoinDevice(ctx, joinRequest(c, "device-1", "1.2.3.4/24"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp1.Device.Addr.String(), qt.Equals, "1.2.3.4/24")
+	c.Assert(resp1.Network.CIDR.String(), qt.Equals, "1.2.3.0/24")
+	c.Assert(resp1.Peers, qt.HasLen, 0)
+	c.Assert(resp1.SubscriptionId, qt.Equals, srv.SubscriptionId)
+
+	resp2, err := srv.JoinDevice(ctx, joinRequest(c, "device-2", "10.0.0.1/24"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp2.Device.Addr.String(), qt.Equals, "1.2.3.1/24")
+	c.Assert(resp2.Peers, qt.DeepEquals, []api.Device{resp1.Device})
+
+	_, err = srv.JoinDevice(ctx, joinRequest(c, "device-3", "10.0.0.1/24"))
+	c.Assert(errors.Is(err, api.ErrApiClient), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `plan device limit 2 reached.*`)
+
+	// Departing frees up a device for the plan.
+	err = srv.DepartDevice(agent.WithToken(context.Background(), resp2.Token))
+	c.Assert(err, qt.IsNil)
+	_, err = srv.JoinDevice(ctx, joinRequest(c, "device-3", "10.0.0.1/24"))
+	c.Assert(err, qt.IsNil)
+}
+
+func TestHTTP(t *testing.T) {
+	c := qt.New(t)
+	srv := fakeapi.New(api.PlanDoc{Name: "test-plan"})
+	httpSrv := httptest.NewServer(srv)
+	defer httpSrv.Close()
+	cl := api.New(httpSrv.URL)
+
+	_, err := cl.JoinDevice(agent.WithToken(context.Background(), []byte("nope")),
+		joinRequest(c, "device-1", "1.2.3.4/24"))
+	c.Assert(errors.Is(err, api.ErrApiForbidden), qt.IsTrue)
+
+	joinResp, err := cl.JoinDevice(agent.WithToken(context.Background(), srv.SubscriptionToken),
+		joinRequest(c, "device-1", "1.2.3.4/24"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(joinResp.Device.Name, qt.Equals, "device-1")
+
+	deviceCtx := agent.WithToken(context.Background(), joinResp.Token)
+	refreshResp, err := cl.RefreshDevice(deviceCtx, &api.RefreshDeviceRequest{Endpoint: "example.com:51820"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(refreshResp.Device.Endpoint, qt.Equals, "example.com:51820")
+
+	listResp, err := cl.ListDevices(agent.WithToken(context.Background(), srv.SubscriptionToken))
+	c.Assert(err, qt.IsNil)
+	c.Assert(listResp.Devices, qt.HasLen, 1)
+	c.Assert(listResp.Devices[0].Device, qt.DeepEquals, refreshResp.Device)
+
+	err = cl.DepartDevice(deviceCtx)
+	c.Assert(err, qt.IsNil)
+	_, err = cl.RefreshDevice(deviceCtx, &api.RefreshDeviceRequest{})
+	c.Assert(errors.Is(err, api.ErrApiForbidden), qt.IsTrue)
+}
+
+func TestRefreshEndpoint(t *testing.T) {
+	c := qt.New(t)
+	srv := fakeapi.New(api.PlanDoc{Name: "test-plan"})
+	joinResp, err := srv.JoinDevice(agent.WithToken(context.Background(), srv.SubscriptionToken),
+		joinRequest(c, "device-1", "1.2.3.4/24"))
+	c.Assert(err, qt.IsNil)
+	ctx := agent.WithToken(context.Background(), joinResp.Token)
+
+	resp, err := srv.RefreshDevice(ctx, &api.RefreshDeviceRequest{Endpoint: "example.com:51820"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Device.Endpoint, qt.Equals, "example.com:51820")
+
+	// An empty endpoint leaves it unchanged.
+	resp, err = srv.RefreshDevice(ctx, &api.RefreshDeviceRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Device.Endpoint, qt.Equals, "example.com:51820")
+
+	resp, err = srv.RefreshDevice(ctx, &api.RefreshDeviceRequest{ClearEndpoint: true})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Device.Endpoint, qt.Equals, "")
+
+	_, err = srv.RefreshDevice(ctx, &api.RefreshDeviceRequest{Endpoint: "example.com:51820", ClearEndpoint: true})
+	c.Assert(errors.Is(err, api.ErrApiClient), qt.IsTrue)
+}
+
+func TestHarnessJoin(t *testing.T) {
+	c := qt.New(t)
+	h, err := fakeapi.NewHarness(c.Mkdir(), api.PlanDoc{Name: "test-plan", DeviceLimit: 5})
+	c.Assert(err, qt.IsNil)
+	ctx := h.SubscriptionContext(context.Background())
+
+	iface1, err := h.Agent.JoinDevice(ctx, "device-1", "test-net", "example.com:51820")
+	c.Assert(err, qt.IsNil)
+	c.Assert(iface1.SubscriptionId, qt.Equals, h.Server.SubscriptionId)
+	err = h.Agent.ApplyInterfaceChanges(iface1)
+	c.Assert(err, qt.IsNil)
+	iface2, err := h.Agent.JoinDevice(ctx, "device-2", "test-net", "")
+	c.Assert(err, qt.IsNil)
+	err = h.Agent.ApplyInterfaceChanges(iface2)
+	c.Assert(err, qt.IsNil)
+
+	// The client device connects out to the server device.
+	cfg2, ok := h.Network.Config(iface2.Name())
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(cfg2.Address, qt.DeepEquals, iface2.Device.Addr)
+	c.Assert(cfg2.Peers, qt.HasLen, 1)
+	c.Assert(cfg2.Peers[0].Endpoint, qt.Equals, "example.com:51820")
+	c.Assert(cfg2.Peers[0].PublicKey, qt.DeepEquals, iface1.Device.PublicKey)
+
+	// Refreshing the server device picks up the new client peer.
+	iface1, err = h.Agent.RefreshDevice(ctx, "device-1", "test-net", "")
+	c.Assert(err, qt.IsNil)
+	err = h.Agent.ApplyInterfaceChanges(iface1)
+	c.Assert(err, qt.IsNil)
+	cfg1, ok := h.Network.Config(iface1.Name())
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(cfg1.Peers, qt.HasLen, 1)
+	c.Assert(cfg1.Peers[0].PublicKey, qt.DeepEquals, iface2.Device.PublicKey)
+
+	// Departing removes the interface configuration.
+	iface2, err = h.Agent.DeleteDevice(ctx, "device-2", "test-net")
+	c.Assert(err, qt.IsNil)
+	err = h.Agent.ApplyInterfaceChanges(iface2)
+	c.Assert(err, qt.IsNil)
+	_, ok = h.Network.Config(iface2.Name())
+	c.Assert(ok, qt.IsFalse)
+}
+
+func joinRequest(c *qt.C, name, addr string) *api.JoinDeviceRequest {
+	k, err := wireguard.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	availAddr, err := wireguard.ParseAddress(addr)
+	c.Assert(err, qt.IsNil)
+	return &api.JoinDeviceRequest{
+		Name:          name,
+		Network:       "test-net",
+		MachineId:     make([]byte, 32),
+		Key:           k.PublicKey(),
+		AvailableAddr: *availAddr,
+	}
+}
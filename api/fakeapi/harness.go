@@ -0,0 +1,94 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package fakeapi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/wiregarden-io/wiregarden/agent"
+	"github.com/wiregarden-io/wiregarden/agent/store"
+	"github.com/wiregarden-io/wiregarden/api"
+	"github.com/wiregarden-io/wiregarden/wireguard"
+)
+
+// Harness wires an agent to a fake API server. The agent keeps its store in
+// the given data directory, and applies interface changes to a fake network
+// manager rather than the host.
+type Harness struct {
+	Server  *Server
+	Agent   *agent.Agent
+	Network *NetworkManager
+}
+
+// NewHarness returns a new harness with an agent storing its data in dataDir,
+// joined to a fake API server for a subscription on the given plan.
+func NewHarness(dataDir string, plan api.PlanDoc) (*Harness, error) {
+	srv := New(plan)
+	nm := &NetworkManager{}
+	a, err := agent.New(dataDir, api.DefaultApiUrl,
+		agent.WithClient(func(string) agent.Client { return srv }),
+		agent.WithNetworkManager(nm))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Harness{Server: srv, Agent: a, Network: nm}, nil
+}
+
+// SubscriptionContext returns a context authorized to join devices to the
+// fake subscription.
+func (h *Harness) SubscriptionContext(ctx context.Context) context.Context {
+	return agent.WithToken(ctx, h.Server.SubscriptionToken)
+}
+
+// NetworkManager is a fake agent network manager, which records interface
+// configuration rather than applying it to the host.
+type NetworkManager struct {
+	mu      sync.Mutex
+	configs map[string]*wireguard.InterfaceConfig
+}
+
+// EnsureInterface records the interface configuration.
+func (m *NetworkManager) EnsureInterface(iface *store.Interface) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.configs == nil {
+		m.configs = map[string]*wireguard.InterfaceConfig{}
+	}
+	m.configs[iface.Name()] = iface.Config()
+	return nil
+}
+
+// RemoveInterface removes the recorded interface configuration.
+func (m *NetworkManager) RemoveInterface(iface *store.Interface) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.configs, iface.Name())
+	return nil
+}
+
+// Handshakes returns no handshakes, as there are no real peers to complete
+// them with.
+func (m *NetworkManager) Handshakes(iface *store.Interface) (map[string]time.Time, error) {
+	return nil, nil
+}
+
+// Config returns the configuration last applied to the named interface, if
+// it is up.
+func (m *NetworkManager) Config(name string) (*wireguard.InterfaceConfig, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cfg, ok := m.configs[name]
+	return cfg, ok
+}
@@ -11,7 +11,14 @@
 package api
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
 	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -31,6 +38,19 @@ type GetSubscriptionResponse struct {
 	Plan      PlanDoc    `json:"plan"`
 }
 
+// Active returns whether the subscription is valid at the given time, which
+// is from NotBefore, inclusive, until NotAfter, exclusive. A nil NotBefore or
+// NotAfter leaves the subscription unbounded on that side.
+func (r *GetSubscriptionResponse) Active(at time.Time) bool {
+	if r.NotBefore != nil && at.Before(*r.NotBefore) {
+		return false
+	}
+	if r.NotAfter != nil && !at.Before(*r.NotAfter) {
+		return false
+	}
+	return true
+}
+
 type PlanDoc struct {
 	Name          string `json:"name"`
 	Free          bool   `json:"free"`
@@ -38,6 +58,15 @@ type PlanDoc struct {
 	ExpiresInDays int    `json:"expiresInDays"`
 }
 
+// ExpiresAt returns when a subscription to the plan created at the given
+// time expires, or the zero time if subscriptions to the plan do not expire.
+func (p *PlanDoc) ExpiresAt(created time.Time) time.Time {
+	if p.ExpiresInDays <= 0 {
+		return time.Time{}
+	}
+	return created.AddDate(0, 0, p.ExpiresInDays)
+}
+
 type GetSubscriptionTokenResponse struct {
 	Id    string `json:"id"`
 	Token []byte `json:"token"`
@@ -60,19 +89,123 @@ type JoinDeviceRequest struct {
 	AvailablePort int `json:"availablePort,omitempty"`
 }
 
+// MachineIdLen is the length of a machine ID sent when joining a device.
+const MachineIdLen = sha256.Size
+
+// DeriveMachineId is the canonical derivation of the machine ID sent when
+// joining a device, from a raw host identifier such as /etc/machine-id.
+// The raw identifier is used as an HMAC-SHA256 key over salt, so that it
+// cannot be recovered from the machine ID, and the result is always
+// MachineIdLen bytes.
+func DeriveMachineId(rawId []byte, salt []byte) []byte {
+	mac := hmac.New(sha256.New, rawId)
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+// nameRegexp matches a valid device or network name, which is a DNS label:
+// lowercase letters, digits and hyphens, starting and ending with a letter or
+// digit.
+var nameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// maxNameLength is the maximum length of a device or network name.
+const maxNameLength = 63
+
+func validName(kind, name string) error {
+	if len(name) > maxNameLength {
+		return errors.Errorf("invalid %s name %q: longer than %d characters", kind, name, maxNameLength)
+	}
+	if !nameRegexp.MatchString(name) {
+		return errors.Errorf("invalid %s name %q: must be lowercase letters, digits and hyphens, "+
+			"starting and ending with a letter or digit", kind, name)
+	}
+	return nil
+}
+
+// invalidNameChars matches runs of characters which are not valid in a
+// device or network name.
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// NormalizeName converts a host name into a device name: it is lowercased,
+// anything after its first label is dropped, and runs of other characters
+// which are not valid in a name are replaced with a hyphen. The result is
+// trimmed of leading and trailing hyphens and truncated to the maximum name
+// length, and is empty if nothing valid remains.
+func NormalizeName(hostname string) string {
+	name := strings.ToLower(hostname)
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.Trim(invalidNameChars.ReplaceAllString(name, "-"), "-")
+	if len(name) > maxNameLength {
+		name = strings.TrimRight(name[:maxNameLength], "-")
+	}
+	return name
+}
+
 func (r *JoinDeviceRequest) Valid() error {
-	if len(r.MachineId) != 32 {
+	if err := validName("device", r.Name); err != nil {
+		return errors.WithStack(err)
+	}
+	if r.Network != "" {
+		if err := validName("network", r.Network); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if len(r.MachineId) != MachineIdLen {
 		return errors.Errorf("invalid machine ID length %d", len(r.MachineId))
 	}
 	if len(r.Key) != 32 {
 		return errors.Errorf("invalid key length %d", len(r.Key))
 	}
+	if r.Endpoint != "" {
+		if err := validEndpoint(r.Endpoint); err != nil {
+			return errors.WithStack(err)
+		}
+	}
 	if r.AvailablePort < 0 || r.AvailablePort > 65535 {
 		return errors.Errorf("invalid port %d", r.AvailablePort)
 	}
 	return nil
 }
 
+// validEndpoint checks that endpoint is a host and port. IPv6 hosts must be
+// bracketed.
+func validEndpoint(endpoint string) error {
+	if strings.ContainsAny(endpoint, " \t\r\n") {
+		return errors.Errorf("invalid endpoint %q: contains whitespace", endpoint)
+	}
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "invalid endpoint")
+	}
+	if host == "" {
+		return errors.Errorf("invalid endpoint %q: missing host", endpoint)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return errors.Errorf("invalid endpoint %q: invalid port %q", endpoint, port)
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes the request and checks that it is valid, so that an
+// invalid request cannot be acted upon.
+func (r *JoinDeviceRequest) UnmarshalJSON(data []byte) error {
+	type plain JoinDeviceRequest
+	var req plain
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return err
+	}
+	err = (*JoinDeviceRequest)(&req).Valid()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	*r = JoinDeviceRequest(req)
+	return nil
+}
+
 type JoinDeviceResponse struct {
 	Network Network `json:"network"`
 	// Assigned device, which persists for the lifetime of this device's
@@ -82,8 +215,43 @@ type JoinDeviceResponse struct {
 	Peers []Device `json:"peers"`
 	// Plan information about subscription
 	Plan PlanDoc `json:"plan"`
+	// Subscription backing this device.
+	SubscriptionId string `json:"subscriptionId,omitempty"`
 	// Device token, stored and used for making subsequent device requests
 	Token []byte `json:"token"`
+	// When the subscription backing this device expires, if ever.
+	NotAfter *time.Time `json:"notAfter,omitempty"`
+	// When Token expires, if ever. The device should be refreshed for a new
+	// token before then.
+	TokenExpiresAt *time.Time `json:"tokenExpiresAt,omitempty"`
+}
+
+// UnmarshalJSON decodes the response and checks that its network and devices
+// are valid, so that malformed data from the server is caught before it is
+// stored.
+func (r *JoinDeviceResponse) UnmarshalJSON(data []byte) error {
+	type plain JoinDeviceResponse
+	var resp plain
+	err := json.Unmarshal(data, &resp)
+	if err != nil {
+		return err
+	}
+	err = resp.Network.Validate()
+	if err != nil {
+		return errors.Wrap(err, "invalid network")
+	}
+	err = resp.Device.Validate()
+	if err != nil {
+		return errors.Wrap(err, "invalid device")
+	}
+	for i := range resp.Peers {
+		err = resp.Peers[i].Validate()
+		if err != nil {
+			return errors.Wrapf(err, "invalid peer %q", resp.Peers[i].Id)
+		}
+	}
+	*r = JoinDeviceResponse(resp)
+	return nil
 }
 
 type ListDevicesResponse struct {
@@ -96,11 +264,106 @@ type GetDeviceResponse struct {
 }
 
 type Device struct {
-	Id        string            `json:"id"`
-	Name      string            `json:"name"`
-	Endpoint  string            `json:"endpoint"`
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+	// Additional endpoints where this device can be reached, for devices
+	// with multiple network paths.
+	Endpoints []Endpoint        `json:"endpoints,omitempty"`
 	Addr      wireguard.Address `json:"addr"`
 	PublicKey wireguard.Key     `json:"publicKey"`
+	// AllowedIPs are the addresses routed to the device as a peer, such as
+	// the subnets behind a subnet router. If empty, only the device's own
+	// address is routed.
+	AllowedIPs []wireguard.Address `json:"allowedIPs,omitempty"`
+	// Keepalive is the persistent keepalive interval in seconds for
+	// connections to the device, such as a device behind a NAT. Zero
+	// disables keepalive.
+	Keepalive int `json:"keepalive,omitempty"`
+	// Candidates are endpoints to try in order when connecting to the
+	// device, such as those discovered for NAT traversal. If set, they are
+	// preferred over Endpoint and Endpoints. See CandidateEndpoints.
+	Candidates []string `json:"candidates,omitempty"`
+}
+
+// Validate checks that the device has an address and a public key, and that
+// its endpoint, if any, is a host and port.
+func (d *Device) Validate() error {
+	if d.Addr.IsZero() {
+		return errors.New("missing address")
+	}
+	if len(d.PublicKey) != 32 {
+		return errors.Errorf("invalid public key length %d", len(d.PublicKey))
+	}
+	if d.Endpoint != "" {
+		if err := validEndpoint(d.Endpoint); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for i := range d.Endpoints {
+		if err := validEndpoint(d.Endpoints[i].Endpoint); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for i := range d.Candidates {
+		if err := validEndpoint(d.Candidates[i]); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Endpoint is a public endpoint where a device can be reached, weighted by
+// priority. Endpoints with a higher priority are preferred.
+type Endpoint struct {
+	Endpoint string `json:"endpoint"`
+	Priority int    `json:"priority"`
+}
+
+// SortedEndpoints returns all the endpoints where the device can be reached,
+// in order of preference. Endpoints of equal priority retain their original
+// order. The primary Endpoint is included with a priority of zero if it is
+// not already listed.
+func (d *Device) SortedEndpoints() []Endpoint {
+	var result []Endpoint
+	hasPrimary := d.Endpoint == ""
+	for i := range d.Endpoints {
+		if d.Endpoints[i].Endpoint == d.Endpoint {
+			hasPrimary = true
+		}
+		result = append(result, d.Endpoints[i])
+	}
+	if !hasPrimary {
+		result = append(result, Endpoint{Endpoint: d.Endpoint})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Priority > result[j].Priority
+	})
+	return result
+}
+
+// PreferredEndpoint returns the highest priority endpoint where the device can
+// be reached, or an empty string if the device has no endpoints.
+func (d *Device) PreferredEndpoint() string {
+	endpoints := d.SortedEndpoints()
+	if len(endpoints) == 0 {
+		return ""
+	}
+	return endpoints[0].Endpoint
+}
+
+// CandidateEndpoints returns the endpoints to try in order when connecting
+// to the device: its Candidates if it has any, or otherwise its endpoints in
+// order of preference. It returns nil if the device has no endpoints.
+func (d *Device) CandidateEndpoints() []string {
+	if len(d.Candidates) > 0 {
+		return d.Candidates
+	}
+	var result []string
+	for _, endpoint := range d.SortedEndpoints() {
+		result = append(result, endpoint.Endpoint)
+	}
+	return result
 }
 
 type Network struct {
@@ -109,24 +372,100 @@ type Network struct {
 	CIDR wireguard.Address `json:"address"`
 }
 
+// minNetworkHostBits is the fewest host bits a network CIDR may have, leaving
+// room for at least a couple of device addresses.
+const minNetworkHostBits = 2
+
+// Validate checks that the network has an ID and name, and that its CIDR is a
+// network rather than a single host, with room for at least a couple of
+// device addresses.
+func (n *Network) Validate() error {
+	if n.Id == "" {
+		return errors.New("missing network ID")
+	}
+	if n.Name == "" {
+		return errors.New("missing network name")
+	}
+	if len(n.CIDR.IP) == 0 {
+		return errors.New("missing network CIDR")
+	}
+	size, bits := n.CIDR.Mask.Size()
+	if bits == 0 {
+		return errors.Errorf("invalid network CIDR %q: non-canonical mask", n.CIDR.String())
+	}
+	if bits-size < minNetworkHostBits {
+		return errors.Errorf("invalid network CIDR %q: too small for device addresses", n.CIDR.String())
+	}
+	return nil
+}
+
 type RefreshDeviceRequest struct {
 	// Assigned logical device name
 	Name string `json:"name,omitempty"`
 	// Public key of this device.
 	Key wireguard.Key `json:"key,omitempty"`
-	// Public endpoint where this device can be reached, if possible.
+	// Public endpoint where this device can be reached, if possible. The
+	// endpoint is unchanged if empty.
 	Endpoint string `json:"endpoint,omitempty"`
+	// ClearEndpoint removes the device's endpoint, such as when it can no
+	// longer be reached from outside a NAT. Endpoint must be empty.
+	ClearEndpoint bool `json:"clearEndpoint,omitempty"`
 }
 
 func (r *RefreshDeviceRequest) Valid() error {
 	if len(r.Key) > 0 && len(r.Key) != 32 {
 		return errors.Errorf("invalid key length %d", len(r.Key))
 	}
+	if r.ClearEndpoint && r.Endpoint != "" {
+		return errors.Errorf("cannot both set and clear endpoint %q", r.Endpoint)
+	}
 	if len(r.Endpoint) > 0 {
-		_, _, err := net.SplitHostPort(r.Endpoint)
-		if err != nil {
-			return errors.Wrapf(err, "invalid endpoint")
+		if err := validEndpoint(r.Endpoint); err != nil {
+			return errors.WithStack(err)
 		}
 	}
 	return nil
 }
+
+// UnmarshalJSON decodes the request and checks that it is valid, so that an
+// invalid request cannot be acted upon.
+func (r *RefreshDeviceRequest) UnmarshalJSON(data []byte) error {
+	type plain RefreshDeviceRequest
+	var req plain
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return err
+	}
+	err = (*RefreshDeviceRequest)(&req).Valid()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	*r = RefreshDeviceRequest(req)
+	return nil
+}
+
+type LeaveDeviceRequest struct {
+	// Id of the device leaving the network.
+	DeviceId string `json:"deviceId"`
+	// Network to leave. Default network for this subscription if empty.
+	Network string `json:"network,omitempty"`
+}
+
+func (r *LeaveDeviceRequest) Valid() error {
+	if r.DeviceId == "" {
+		return errors.New("missing device ID")
+	}
+	if r.Network != "" {
+		if err := validName("network", r.Network); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+type LeaveDeviceResponse struct {
+	// Network the device has left.
+	Network Network `json:"network"`
+	// Device removed from the network.
+	Device Device `json:"device"`
+}
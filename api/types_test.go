@@ -0,0 +1,611 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package api_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/wiregarden-io/wiregarden/api"
+	"github.com/wiregarden-io/wiregarden/wireguard"
+)
+
+func TestRefreshDeviceRequestValid(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		about string
+		req   api.RefreshDeviceRequest
+		err   string
+	}{{
+		about: "unchanged",
+		req:   api.RefreshDeviceRequest{},
+	}, {
+		about: "set endpoint",
+		req:   api.RefreshDeviceRequest{Endpoint: "example.com:51820"},
+	}, {
+		about: "clear endpoint",
+		req:   api.RefreshDeviceRequest{ClearEndpoint: true},
+	}, {
+		about: "set and clear endpoint",
+		req:   api.RefreshDeviceRequest{Endpoint: "example.com:51820", ClearEndpoint: true},
+		err:   `cannot both set and clear endpoint "example.com:51820"`,
+	}, {
+		about: "invalid endpoint",
+		req:   api.RefreshDeviceRequest{Endpoint: "example.com"},
+		err:   `invalid endpoint: .*missing port in address`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			err := test.req.Valid()
+			if test.err == "" {
+				c.Assert(err, qt.IsNil)
+			} else {
+				c.Assert(err, qt.ErrorMatches, test.err)
+			}
+		})
+	}
+}
+
+func TestJoinDeviceRequestValidNames(t *testing.T) {
+	c := qt.New(t)
+	k, err := wireguard.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	tests := []struct {
+		about   string
+		name    string
+		network string
+		err     string
+	}{{
+		about: "default network",
+		name:  "device-1",
+	}, {
+		about:   "named network",
+		name:    "device-1",
+		network: "test-net",
+	}, {
+		about: "single character",
+		name:  "a",
+	}, {
+		about: "maximum length",
+		name:  strings.Repeat("a", 63),
+	}, {
+		about: "empty device name",
+		name:  "",
+		err:   `invalid device name "": must be lowercase letters, digits and hyphens, starting and ending with a letter or digit`,
+	}, {
+		about: "too long",
+		name:  strings.Repeat("a", 64),
+		err:   `invalid device name "a+": longer than 63 characters`,
+	}, {
+		about: "space",
+		name:  "my device",
+		err:   `invalid device name "my device": .*`,
+	}, {
+		about: "slash",
+		name:  "my/device",
+		err:   `invalid device name "my/device": .*`,
+	}, {
+		about: "uppercase",
+		name:  "Device",
+		err:   `invalid device name "Device": .*`,
+	}, {
+		about: "dot",
+		name:  "device.example.com",
+		err:   `invalid device name "device.example.com": .*`,
+	}, {
+		about: "leading hyphen",
+		name:  "-device",
+		err:   `invalid device name "-device": .*`,
+	}, {
+		about: "trailing hyphen",
+		name:  "device-",
+		err:   `invalid device name "device-": .*`,
+	}, {
+		about:   "invalid network",
+		name:    "device-1",
+		network: "test_net",
+		err:     `invalid network name "test_net": .*`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			req := api.JoinDeviceRequest{
+				Name:      test.name,
+				Network:   test.network,
+				MachineId: make([]byte, 32),
+				Key:       k.PublicKey(),
+			}
+			err := req.Valid()
+			if test.err == "" {
+				c.Assert(err, qt.IsNil)
+			} else {
+				c.Assert(err, qt.ErrorMatches, test.err)
+			}
+		})
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	c := qt.New(t)
+	k, err := wireguard.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	for _, test := range []struct {
+		hostname, name string
+	}{
+		{"device-1", "device-1"},
+		{"MyLaptop", "mylaptop"},
+		{"device.example.com", "device"},
+		{"Jane's MacBook Pro", "jane-s-macbook-pro"},
+		{"_gateway_", "gateway"},
+		{strings.Repeat("a", 62) + "-b", strings.Repeat("a", 62)},
+		{".example.com", ""},
+	} {
+		c.Run(test.hostname, func(c *qt.C) {
+			name := api.NormalizeName(test.hostname)
+			c.Assert(name, qt.Equals, test.name)
+			if name == "" {
+				return
+			}
+			req := api.JoinDeviceRequest{
+				Name:      name,
+				MachineId: make([]byte, api.MachineIdLen),
+				Key:       k.PublicKey(),
+			}
+			c.Assert(req.Valid(), qt.IsNil)
+		})
+	}
+}
+
+func TestJoinDeviceRequestValidEndpoint(t *testing.T) {
+	c := qt.New(t)
+	k, err := wireguard.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	tests := []struct {
+		about    string
+		endpoint string
+		err      string
+	}{{
+		about: "empty",
+	}, {
+		about:    "hostname",
+		endpoint: "example.com:51820",
+	}, {
+		about:    "IPv4",
+		endpoint: "1.2.3.4:51820",
+	}, {
+		about:    "bracketed IPv6",
+		endpoint: "[2001:db8::1]:51820",
+	}, {
+		about:    "unbracketed IPv6",
+		endpoint: "2001:db8::1:51820",
+		err:      `invalid endpoint: .*too many colons in address`,
+	}, {
+		about:    "missing port",
+		endpoint: "1.2.3.4",
+		err:      `invalid endpoint: .*missing port in address`,
+	}, {
+		about:    "missing host",
+		endpoint: ":51820",
+		err:      `invalid endpoint ":51820": missing host`,
+	}, {
+		about:    "non-numeric port",
+		endpoint: "example.com:wireguard",
+		err:      `invalid endpoint "example.com:wireguard": invalid port "wireguard"`,
+	}, {
+		about:    "port out of range",
+		endpoint: "example.com:65536",
+		err:      `invalid endpoint "example.com:65536": invalid port "65536"`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			req := api.JoinDeviceRequest{
+				Name:      "device-1",
+				MachineId: make([]byte, 32),
+				Key:       k.PublicKey(),
+				Endpoint:  test.endpoint,
+			}
+			err := req.Valid()
+			if test.err == "" {
+				c.Assert(err, qt.IsNil)
+			} else {
+				c.Assert(err, qt.ErrorMatches, test.err)
+			}
+		})
+	}
+}
+
+func TestLeaveDeviceRequestValid(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		about string
+		req   api.LeaveDeviceRequest
+		err   string
+	}{{
+		about: "default network",
+		req:   api.LeaveDeviceRequest{DeviceId: "device-id"},
+	}, {
+		about: "named network",
+		req:   api.LeaveDeviceRequest{DeviceId: "device-id", Network: "test-net"},
+	}, {
+		about: "missing device id",
+		req:   api.LeaveDeviceRequest{Network: "test-net"},
+		err:   `missing device ID`,
+	}, {
+		about: "invalid network",
+		req:   api.LeaveDeviceRequest{DeviceId: "device-id", Network: "Test Net"},
+		err:   `invalid network name "Test Net": .*`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			err := test.req.Valid()
+			if test.err == "" {
+				c.Assert(err, qt.IsNil)
+			} else {
+				c.Assert(err, qt.ErrorMatches, test.err)
+			}
+		})
+	}
+}
+
+func TestLeaveDeviceRequestJSON(t *testing.T) {
+	c := qt.New(t)
+	buf, err := json.Marshal(&api.LeaveDeviceRequest{DeviceId: "device-id"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, `{"deviceId":"device-id"}`)
+	var req api.LeaveDeviceRequest
+	err = json.Unmarshal([]byte(`{"deviceId":"device-id","network":"test-net"}`), &req)
+	c.Assert(err, qt.IsNil)
+	c.Assert(req, qt.DeepEquals, api.LeaveDeviceRequest{DeviceId: "device-id", Network: "test-net"})
+}
+
+func TestSubscriptionActive(t *testing.T) {
+	c := qt.New(t)
+	notBefore := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		about     string
+		notBefore *time.Time
+		notAfter  *time.Time
+		at        time.Time
+		active    bool
+	}{{
+		about:  "unbounded",
+		at:     notBefore,
+		active: true,
+	}, {
+		about:     "before not before",
+		notBefore: &notBefore,
+		notAfter:  &notAfter,
+		at:        notBefore.Add(-time.Nanosecond),
+	}, {
+		about:     "at not before",
+		notBefore: &notBefore,
+		notAfter:  &notAfter,
+		at:        notBefore,
+		active:    true,
+	}, {
+		about:     "before not after",
+		notBefore: &notBefore,
+		notAfter:  &notAfter,
+		at:        notAfter.Add(-time.Nanosecond),
+		active:    true,
+	}, {
+		about:     "at not after",
+		notBefore: &notBefore,
+		notAfter:  &notAfter,
+		at:        notAfter,
+	}, {
+		about:    "no not before",
+		notAfter: &notAfter,
+		at:       notBefore.AddDate(-10, 0, 0),
+		active:   true,
+	}, {
+		about:     "no not after",
+		notBefore: &notBefore,
+		at:        notAfter.AddDate(10, 0, 0),
+		active:    true,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			sub := api.GetSubscriptionResponse{NotBefore: test.notBefore, NotAfter: test.notAfter}
+			c.Assert(sub.Active(test.at), qt.Equals, test.active)
+		})
+	}
+}
+
+func TestPlanExpiresAt(t *testing.T) {
+	c := qt.New(t)
+	created := time.Date(2020, 2, 20, 12, 0, 0, 0, time.UTC)
+	plan := api.PlanDoc{ExpiresInDays: 10}
+	c.Assert(plan.ExpiresAt(created), qt.Equals, time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC))
+	plan = api.PlanDoc{}
+	c.Assert(plan.ExpiresAt(created).IsZero(), qt.IsTrue)
+}
+
+func TestUnmarshalJoinDeviceRequest(t *testing.T) {
+	c := qt.New(t)
+	k, err := wireguard.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	addr, err := wireguard.ParseAddress("10.1.2.3/16")
+	c.Assert(err, qt.IsNil)
+	valid := api.JoinDeviceRequest{
+		Name:          "device-1",
+		Network:       "test-net",
+		MachineId:     make([]byte, 32),
+		Key:           k.PublicKey(),
+		Endpoint:      "example.com:51820",
+		AvailableAddr: *addr,
+		AvailablePort: 51820,
+	}
+	buf, err := json.Marshal(&valid)
+	c.Assert(err, qt.IsNil)
+	var req api.JoinDeviceRequest
+	err = json.Unmarshal(buf, &req)
+	c.Assert(err, qt.IsNil)
+	c.Assert(req, qt.DeepEquals, valid)
+
+	invalid := valid
+	invalid.Name = "Device 1"
+	buf, err = json.Marshal(&invalid)
+	c.Assert(err, qt.IsNil)
+	req = api.JoinDeviceRequest{}
+	err = json.Unmarshal(buf, &req)
+	c.Assert(err, qt.ErrorMatches, `invalid device name "Device 1": .*`)
+	c.Assert(req, qt.DeepEquals, api.JoinDeviceRequest{})
+
+	err = json.Unmarshal([]byte(`{"name": "device-1",`), &req)
+	c.Assert(err, qt.ErrorMatches, `unexpected end of JSON input`)
+	err = json.Unmarshal([]byte(`{"name": 1}`), &req)
+	c.Assert(err, qt.ErrorMatches, `json: cannot unmarshal number into Go .* of type string`)
+}
+
+func TestUnmarshalRefreshDeviceRequest(t *testing.T) {
+	c := qt.New(t)
+	var req api.RefreshDeviceRequest
+	err := json.Unmarshal([]byte(`{"endpoint": "example.com:51820"}`), &req)
+	c.Assert(err, qt.IsNil)
+	c.Assert(req, qt.DeepEquals, api.RefreshDeviceRequest{Endpoint: "example.com:51820"})
+
+	req = api.RefreshDeviceRequest{}
+	err = json.Unmarshal([]byte(`{"endpoint": "example.com:51820", "clearEndpoint": true}`), &req)
+	c.Assert(err, qt.ErrorMatches, `cannot both set and clear endpoint "example.com:51820"`)
+	c.Assert(req, qt.DeepEquals, api.RefreshDeviceRequest{})
+
+	err = json.Unmarshal([]byte(`{"endpoint": }`), &req)
+	c.Assert(err, qt.ErrorMatches, `invalid character .*`)
+
+	// Requests embedded in other documents are validated too.
+	var doc struct {
+		Request api.RefreshDeviceRequest `json:"request"`
+	}
+	err = json.Unmarshal([]byte(`{"request": {"endpoint": "example.com"}}`), &doc)
+	c.Assert(err, qt.ErrorMatches, `invalid endpoint: .*missing port in address`)
+}
+
+func TestCandidateEndpoints(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range []struct {
+		about    string
+		device   api.Device
+		expected []string
+	}{{
+		about:  "no endpoints",
+		device: api.Device{},
+	}, {
+		about:    "endpoint only",
+		device:   api.Device{Endpoint: "example.com:51820"},
+		expected: []string{"example.com:51820"},
+	}, {
+		about: "sorted endpoints",
+		device: api.Device{
+			Endpoint:  "example.com:51820",
+			Endpoints: []api.Endpoint{{Endpoint: "fast.example.com:51820", Priority: 1}},
+		},
+		expected: []string{"fast.example.com:51820", "example.com:51820"},
+	}, {
+		about: "candidates",
+		device: api.Device{
+			Endpoint:   "example.com:51820",
+			Candidates: []string{"192.0.2.1:51820", "example.com:51820"},
+		},
+		expected: []string{"192.0.2.1:51820", "example.com:51820"},
+	}} {
+		c.Run(test.about, func(c *qt.C) {
+			c.Assert(test.device.CandidateEndpoints(), qt.DeepEquals, test.expected)
+		})
+	}
+}
+
+func TestDeviceValidate(t *testing.T) {
+	c := qt.New(t)
+	k, err := wireguard.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	addr, err := wireguard.ParseAddress("10.1.2.3/16")
+	c.Assert(err, qt.IsNil)
+	tests := []struct {
+		about  string
+		device api.Device
+		err    string
+	}{{
+		about:  "valid",
+		device: api.Device{Addr: *addr, PublicKey: k.PublicKey(), Endpoint: "example.com:51820"},
+	}, {
+		about:  "empty endpoint",
+		device: api.Device{Addr: *addr, PublicKey: k.PublicKey()},
+	}, {
+		about:  "zero address",
+		device: api.Device{PublicKey: k.PublicKey()},
+		err:    `missing address`,
+	}, {
+		about:  "missing public key",
+		device: api.Device{Addr: *addr},
+		err:    `invalid public key length 0`,
+	}, {
+		about:  "short public key",
+		device: api.Device{Addr: *addr, PublicKey: k.PublicKey()[:31]},
+		err:    `invalid public key length 31`,
+	}, {
+		about:  "invalid endpoint",
+		device: api.Device{Addr: *addr, PublicKey: k.PublicKey(), Endpoint: "example.com"},
+		err:    `invalid endpoint: .*missing port in address`,
+	}, {
+		about: "valid endpoints and candidates",
+		device: api.Device{
+			Addr: *addr, PublicKey: k.PublicKey(),
+			Endpoints:  []api.Endpoint{{Endpoint: "example.com:51820", Priority: 1}, {Endpoint: "10.0.0.1:51820"}},
+			Candidates: []string{"10.0.0.1:51820", "example.com:51820"},
+		},
+	}, {
+		about: "invalid endpoints entry",
+		device: api.Device{
+			Addr: *addr, PublicKey: k.PublicKey(),
+			Endpoints: []api.Endpoint{{Endpoint: "example.com:51820"}, {Endpoint: "example.com:0"}},
+		},
+		err: `invalid endpoint "example.com:0": invalid port "0"`,
+	}, {
+		about: "invalid candidate",
+		device: api.Device{
+			Addr: *addr, PublicKey: k.PublicKey(),
+			Candidates: []string{"example.com:51820", ":51820"},
+		},
+		err: `invalid endpoint ":51820": missing host`,
+	}, {
+		about: "candidate with newline",
+		device: api.Device{
+			Addr: *addr, PublicKey: k.PublicKey(),
+			Candidates: []string{"example.com:51820\nexample.org:51820"},
+		},
+		err: `invalid endpoint "example.com:51820\\nexample.org:51820": contains whitespace`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			err := test.device.Validate()
+			if test.err == "" {
+				c.Assert(err, qt.IsNil)
+			} else {
+				c.Assert(err, qt.ErrorMatches, test.err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalJoinDeviceResponse(t *testing.T) {
+	c := qt.New(t)
+	k, err := wireguard.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	addr, err := wireguard.ParseAddress("10.1.2.3/16")
+	c.Assert(err, qt.IsNil)
+	network, err := wireguard.ParseAddress("10.1.0.0/16")
+	c.Assert(err, qt.IsNil)
+	valid := api.JoinDeviceResponse{
+		Network: api.Network{Id: "net-1", Name: "test-net", CIDR: *network},
+		Device:  api.Device{Id: "device-1", Addr: *addr, PublicKey: k.PublicKey()},
+		Peers: []api.Device{{
+			Id: "peer-1", Addr: *addr, PublicKey: k.PublicKey(), Endpoint: "example.com:51820",
+		}},
+		Token: []byte("token"),
+	}
+	buf, err := json.Marshal(&valid)
+	c.Assert(err, qt.IsNil)
+	var resp api.JoinDeviceResponse
+	err = json.Unmarshal(buf, &resp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Device, qt.DeepEquals, valid.Device)
+	c.Assert(resp.Peers, qt.DeepEquals, valid.Peers)
+
+	invalid := valid
+	invalid.Peers = []api.Device{{Id: "peer-1", Addr: *addr, PublicKey: k.PublicKey(), Endpoint: "example.com"}}
+	buf, err = json.Marshal(&invalid)
+	c.Assert(err, qt.IsNil)
+	resp = api.JoinDeviceResponse{}
+	err = json.Unmarshal(buf, &resp)
+	c.Assert(err, qt.ErrorMatches, `invalid peer "peer-1": invalid endpoint: .*missing port in address`)
+	c.Assert(resp.Token, qt.IsNil)
+
+	invalid = valid
+	invalid.Network.Name = ""
+	buf, err = json.Marshal(&invalid)
+	c.Assert(err, qt.IsNil)
+	err = json.Unmarshal(buf, &resp)
+	c.Assert(err, qt.ErrorMatches, `invalid network: missing network name`)
+}
+
+func TestNetworkValidate(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		about string
+		id    string
+		name  string
+		cidr  string
+		err   string
+	}{{
+		about: "valid",
+		id:    "net-1",
+		name:  "test-net",
+		cidr:  "10.1.2.0/24",
+	}, {
+		about: "host route",
+		id:    "net-1",
+		name:  "test-net",
+		cidr:  "10.1.2.3/32",
+		err:   `invalid network CIDR "10.1.2.3/32": too small for device addresses`,
+	}, {
+		about: "single address pair",
+		id:    "net-1",
+		name:  "test-net",
+		cidr:  "10.1.2.2/31",
+		err:   `invalid network CIDR "10.1.2.2/31": too small for device addresses`,
+	}, {
+		about: "empty name",
+		id:    "net-1",
+		cidr:  "10.1.2.0/24",
+		err:   `missing network name`,
+	}, {
+		about: "empty ID",
+		name:  "test-net",
+		cidr:  "10.1.2.0/24",
+		err:   `missing network ID`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			cidr, err := wireguard.ParseAddress(test.cidr)
+			c.Assert(err, qt.IsNil)
+			network := api.Network{Id: test.id, Name: test.name, CIDR: *cidr}
+			err = network.Validate()
+			if test.err == "" {
+				c.Assert(err, qt.IsNil)
+			} else {
+				c.Assert(err, qt.ErrorMatches, test.err)
+			}
+		})
+	}
+	var network api.Network
+	c.Assert(network.Validate(), qt.ErrorMatches, `missing network ID`)
+	network = api.Network{Id: "net-1", Name: "test-net"}
+	c.Assert(network.Validate(), qt.ErrorMatches, `missing network CIDR`)
+}
+
+func TestDeriveMachineId(t *testing.T) {
+	c := qt.New(t)
+	rawId := []byte("0123456789abcdef")
+	id := api.DeriveMachineId(rawId, []byte("wiregarden"))
+	c.Assert(id, qt.HasLen, api.MachineIdLen)
+	c.Assert(api.DeriveMachineId(rawId, []byte("wiregarden")), qt.DeepEquals, id)
+	c.Assert(api.DeriveMachineId(rawId, []byte("other")), qt.Not(qt.DeepEquals), id)
+	c.Assert(api.DeriveMachineId([]byte("fedcba9876543210"), []byte("wiregarden")), qt.Not(qt.DeepEquals), id)
+
+	// Derived IDs are always the same length, however long the raw ID.
+	c.Assert(api.DeriveMachineId(nil, nil), qt.HasLen, api.MachineIdLen)
+	c.Assert(api.DeriveMachineId(make([]byte, 1024), []byte("wiregarden")), qt.HasLen, api.MachineIdLen)
+}
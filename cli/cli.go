@@ -46,6 +46,8 @@ var CommandLine = cli.App{
 		&cli.PathFlag{Name: "datadir", Hidden: true},
 		&cli.StringFlag{Name: "url", Hidden: true},
 		&cli.BoolFlag{Name: "debug", Hidden: true, Destination: &debug},
+		&cli.BoolFlag{Name: "insecure-allow-http", Hidden: true},
+		&cli.IntFlag{Name: "keepalive", Hidden: true, Value: 15},
 	},
 	Commands: []*cli.Command{{
 		Name: "up",
@@ -61,7 +63,7 @@ var CommandLine = cli.App{
 					return errors.Wrap(err, "invalid endpoint, must be in the form host:port")
 				}
 			}
-			a, err := agent.New(c.Path("datadir"), c.String("url"), agent.NotifyWatcher)
+			a, err := newAgent(c, agent.NotifyWatcher)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -92,7 +94,7 @@ var CommandLine = cli.App{
 			&cli.StringFlag{Name: "network"},
 		},
 		Action: func(c *cli.Context) error {
-			a, err := agent.New(c.Path("datadir"), c.String("url"), agent.NotifyWatcher)
+			a, err := newAgent(c, agent.NotifyWatcher)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -124,7 +126,7 @@ var CommandLine = cli.App{
 					return errors.Wrap(err, "invalid endpoint, must be in the form host:port")
 				}
 			}
-			a, err := agent.New(c.Path("datadir"), c.String("url"), agent.NotifyWatcher)
+			a, err := newAgent(c, agent.NotifyWatcher)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -165,6 +167,15 @@ var CommandLine = cli.App{
 				if ifaces, err = a.Interfaces(); err != nil {
 					zapctx.Warn(ctx, "failed to list interfaces", zap.Error(err))
 				} else {
+					for i := range ifaces {
+						err := a.FallBackEndpoints(ctx, &ifaces[i])
+						if err != nil {
+							zapctx.Warn(ctx, "failed to fall back peer endpoints",
+								zap.String("interface", ifaces[i].Name()),
+								zap.Error(err),
+							)
+						}
+					}
 					printStatus(ifaces, false, false)
 				}
 				return lastErr
@@ -191,7 +202,7 @@ var CommandLine = cli.App{
 		},
 		Action: func(c *cli.Context) error {
 			ctx := NewLoggerContext(c)
-			a, err := agent.New(c.Path("datadir"), c.String("url"))
+			a, err := newAgent(c)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -215,7 +226,7 @@ var CommandLine = cli.App{
 			if err := lf.TryLock(); err != nil {
 				return errors.Wrap(err, "failed to obtain lock file")
 			}
-			a, err := agent.New(c.Path("datadir"), c.String("url"))
+			a, err := newAgent(c)
 			if err != nil {
 				return errors.Wrap(err, "failed to create agent")
 			}
@@ -327,6 +338,24 @@ func NewLoggerContext(c *cli.Context) context.Context {
 	return log.WithLog(context.Background(), debug)
 }
 
+// newAgent returns an agent for the data directory and API URL given on the
+// command line.
+func newAgent(c *cli.Context, options ...agent.AgentOption) (*agent.Agent, error) {
+	if c.Bool("insecure-allow-http") {
+		options = append(options, agent.InsecureAllowHTTP)
+	}
+	options = append(options, agent.DefaultClientKeepalive(c.Int("keepalive")))
+	return agent.New(c.Path("datadir"), c.String("url"), options...)
+}
+
+// firstCandidate returns the endpoint used to connect to a device.
+func firstCandidate(d *api.Device) string {
+	if candidates := d.CandidateEndpoints(); len(candidates) > 0 {
+		return candidates[0]
+	}
+	return ""
+}
+
 func PrintJson(v interface{}) error {
 	enc := json.NewEncoder(os.Stdout)
 	enc.SetIndent("", "  ")
@@ -353,14 +382,14 @@ func printStatus(ifaces []store.InterfaceWithLog, json, down bool) {
 	}
 	table := uitable.New()
 	table.MaxColWidth = 50
-	table.AddRow("Interface", "Network", "Address", "Port", "Peers", "Status")
+	table.AddRow("Interface", "Network", "Address", "Port", "Peers", "Subscription", "Status")
 	for _, iface := range ifaces {
 		if iface.Log.State == store.StateInterfaceDown && !down {
 			continue
 		}
 		table.AddRow(iface.Name(), iface.Network.Name,
 			iface.Device.Addr.String(), iface.ListenPort,
-			len(iface.Peers), iface.Log.State)
+			len(iface.Peers), iface.SubscriptionId, iface.Log.State)
 	}
 	fmt.Println(table)
 	for _, iface := range ifaces {
@@ -372,11 +401,11 @@ func printStatus(ifaces []store.InterfaceWithLog, json, down bool) {
 		table.MaxColWidth = 50
 		table.AddRow("Network", "Peer", "Address", "Endpoint", "Key")
 		table.AddRow(iface.Network.Name, iface.Device.Name+" (this host)",
-			iface.Device.Addr.String(), iface.Device.Endpoint,
+			iface.Device.Addr.String(), firstCandidate(&iface.Device),
 			iface.Device.PublicKey.String())
 		for _, peer := range iface.Peers {
 			table.AddRow(iface.Network.Name, peer.Name,
-				peer.Addr.String(), peer.Endpoint, peer.PublicKey.String())
+				peer.Addr.String(), iface.PeerEndpoint(&peer), peer.PublicKey.String())
 		}
 		fmt.Println(table)
 	}
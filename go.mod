@@ -11,6 +11,7 @@ require (
 	github.com/go-chi/chi v4.1.2+incompatible
 	github.com/gosuri/uitable v0.0.4
 	github.com/juju/zaputil v0.0.0-20190326175239-ef53049637ac
+	github.com/lib/pq v1.7.0
 	github.com/mattn/go-colorable v0.1.6 // indirect
 	github.com/mattn/go-runewidth v0.0.9 // indirect
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
@@ -0,0 +1,182 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package wireguard
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseConfig parses a wg-quick configuration file, such as one written by
+// InterfaceConfig.WriteConfig. Names are read from "# Name = " comments;
+// other comments are ignored.
+//
+// SaveConfig and FwMark are checked but otherwise ignored, as the agent does
+// not manage them. Settings which cannot be represented in an
+// InterfaceConfig are rejected rather than dropped, including more than one
+// interface address, such as the IPv6 half of a dual-stack interface, and
+// peer preshared keys, without which such a peer could not connect.
+func ParseConfig(r io.Reader) (*InterfaceConfig, error) {
+	var cfg InterfaceConfig
+	var section string
+	var peer *PeerConfig
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			switch section {
+			case "Interface":
+				peer = nil
+			case "Peer":
+				cfg.Peers = append(cfg.Peers, PeerConfig{})
+				peer = &cfg.Peers[len(cfg.Peers)-1]
+			default:
+				return nil, errors.Errorf("line %d: unsupported section %q", lineNo, section)
+			}
+			continue
+		}
+		isComment := strings.HasPrefix(line, "#")
+		if isComment {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		}
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			if isComment {
+				continue
+			}
+			return nil, errors.Errorf("line %d: expected key = value", lineNo)
+		}
+		key, value := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		if isComment {
+			if key != "Name" {
+				continue
+			}
+		} else if section == "" {
+			return nil, errors.Errorf("line %d: key %q outside of a section", lineNo, key)
+		}
+		var err error
+		if peer != nil {
+			err = parsePeerKey(peer, key, value)
+		} else {
+			err = parseInterfaceKey(&cfg, key, value)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNo)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &cfg, nil
+}
+
+func parseInterfaceKey(cfg *InterfaceConfig, key, value string) error {
+	var err error
+	switch key {
+	case "Name":
+		cfg.Name = value
+	case "Address":
+		var addrs []Address
+		addrs, err = parseAddressList(value)
+		switch {
+		case err != nil:
+		case len(addrs) == 0:
+			err = errors.New("expected an address")
+		case len(addrs) > 1 || !cfg.Address.IsZero():
+			err = errors.New("multiple addresses are not supported")
+		default:
+			cfg.Address = addrs[0]
+		}
+	case "ListenPort":
+		cfg.ListenPort, err = strconv.Atoi(value)
+	case "PrivateKey":
+		cfg.PrivateKey, err = ParseKey(value)
+	case "DNS":
+		cfg.DNS = splitList(value)
+	case "Table":
+		cfg.Table = value
+	case "MTU":
+		cfg.MTU, err = strconv.Atoi(value)
+	case "PreUp":
+		cfg.PreUp = value
+	case "PostUp":
+		cfg.PostUp = value
+	case "PreDown":
+		cfg.PreDown = value
+	case "PostDown":
+		cfg.PostDown = value
+	case "SaveConfig":
+		_, err = strconv.ParseBool(value)
+	case "FwMark":
+		if value != "off" {
+			_, err = strconv.ParseUint(value, 0, 32)
+		}
+	default:
+		return errors.Errorf("unsupported interface key %q", key)
+	}
+	return errors.Wrapf(err, "invalid %s %q", key, value)
+}
+
+func parsePeerKey(peer *PeerConfig, key, value string) error {
+	var err error
+	switch key {
+	case "Name":
+		peer.Name = value
+	case "Endpoint":
+		peer.Endpoint = value
+	case "AllowedIPs":
+		peer.AllowedIPs, err = parseAddressList(value)
+	case "PublicKey":
+		peer.PublicKey, err = ParseKey(value)
+	case "PersistentKeepalive":
+		if value != "off" {
+			peer.PersistentKeepalive, err = strconv.Atoi(value)
+		}
+	case "PresharedKey":
+		_, err = ParseKey(value)
+		if err == nil {
+			err = errors.New("preshared keys are not supported")
+		}
+	default:
+		return errors.Errorf("unsupported peer key %q", key)
+	}
+	return errors.Wrapf(err, "invalid %s %q", key, value)
+}
+
+func parseAddressList(s string) ([]Address, error) {
+	var addrs []Address
+	for _, text := range splitList(s) {
+		addr, err := ParseAddress(text)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, *addr)
+	}
+	return addrs, nil
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
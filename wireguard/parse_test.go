@@ -0,0 +1,137 @@
+// Copyright 2020 Cmars Technologies LLC.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package wireguard_test
+
+import (
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	wg "github.com/wiregarden-io/wiregarden/wireguard"
+)
+
+func TestParseConfigRoundTrip(t *testing.T) {
+	c := qt.New(t)
+	for _, cfg := range []*wg.InterfaceConfig{newSimpleConfig(c), newCompleteConfig(c)} {
+		parsed, err := wg.ParseConfig(strings.NewReader(cfg.RenderConfig()))
+		c.Assert(err, qt.IsNil)
+		c.Assert(parsed, qt.DeepEquals, cfg)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	c := qt.New(t)
+	privKey := assertGenerateKey(c)
+	pubKey := assertGenerateKey(c).PublicKey()
+	cfg, err := wg.ParseConfig(strings.NewReader(`
+# Managed by hand
+[Interface]
+Address = 10.0.0.1/24
+PrivateKey = ` + privKey.String() + `
+ListenPort = 51820
+DNS = 1.1.1.1, 8.8.8.8
+
+[Peer]
+PublicKey = ` + pubKey.String() + `
+AllowedIPs = 10.0.0.2/32, 192.168.1.0/24
+Endpoint = peer.example.com:51820
+PersistentKeepalive = off
+`))
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg, qt.DeepEquals, &wg.InterfaceConfig{
+		Address:    assertNewAddress(c, "10.0.0.1/24"),
+		ListenPort: 51820,
+		PrivateKey: privKey,
+		DNS:        []string{"1.1.1.1", "8.8.8.8"},
+		Peers: []wg.PeerConfig{{
+			Endpoint: "peer.example.com:51820",
+			AllowedIPs: []wg.Address{
+				assertNewAddress(c, "10.0.0.2/32"),
+				assertNewAddress(c, "192.168.1.0/24"),
+			},
+			PublicKey: pubKey,
+		}},
+	})
+}
+
+func TestParseConfigUnmanaged(t *testing.T) {
+	c := qt.New(t)
+	privKey := assertGenerateKey(c)
+	pubKey := assertGenerateKey(c).PublicKey()
+	cfg, err := wg.ParseConfig(strings.NewReader(`
+[Interface]
+Address = 10.0.0.1/24
+PrivateKey = ` + privKey.String() + `
+SaveConfig = true
+FwMark = 0xca6c
+
+[Peer]
+PublicKey = ` + pubKey.String() + `
+AllowedIPs = 10.0.0.2/32
+`))
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg, qt.DeepEquals, &wg.InterfaceConfig{
+		Address:    assertNewAddress(c, "10.0.0.1/24"),
+		PrivateKey: privKey,
+		Peers: []wg.PeerConfig{{
+			AllowedIPs: []wg.Address{assertNewAddress(c, "10.0.0.2/32")},
+			PublicKey:  pubKey,
+		}},
+	})
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		config string
+		err    string
+	}{{
+		config: "Address = 10.0.0.1/24\n",
+		err:    `line 1: key "Address" outside of a section`,
+	}, {
+		config: "[Interface]\nAddress\n",
+		err:    `line 2: expected key = value`,
+	}, {
+		config: "[Interface]\nListenPort = nope\n",
+		err:    `line 2: invalid ListenPort "nope": .*`,
+	}, {
+		config: "[Interface]\nAddress = ,\n",
+		err:    `line 2: invalid Address ",": expected an address`,
+	}, {
+		config: "[Interface]\nFwMark = nope\n",
+		err:    `line 2: invalid FwMark "nope": .*`,
+	}, {
+		config: "[Interface]\nAddress = 10.0.0.1/24, fd00::1/64\n",
+		err:    `line 2: invalid Address "10.0.0.1/24, fd00::1/64": multiple addresses are not supported`,
+	}, {
+		config: "[Interface]\nAddress = 10.0.0.1/24\nAddress = fd00::1/64\n",
+		err:    `line 3: invalid Address "fd00::1/64": multiple addresses are not supported`,
+	}, {
+		config: "[Peer]\nPresharedKey = abc\n",
+		err:    `line 2: invalid PresharedKey "abc": .*`,
+	}, {
+		config: "[Peer]\nPresharedKey = BQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQU=\n",
+		err:    `line 2: invalid PresharedKey "BQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQU=": preshared keys are not supported`,
+	}, {
+		config: "[Peer]\nTable = off\n",
+		err:    `line 2: unsupported peer key "Table"`,
+	}, {
+		config: "[Wat]\n",
+		err:    `line 1: unsupported section "Wat"`,
+	}}
+	for _, test := range tests {
+		c.Run(test.config, func(c *qt.C) {
+			_, err := wg.ParseConfig(strings.NewReader(test.config))
+			c.Assert(err, qt.ErrorMatches, test.err)
+		})
+	}
+}
@@ -13,6 +13,7 @@ package wireguard
 
 import (
 	"encoding/base64"
+	"encoding/hex"
 	"io"
 	"net"
 	"strconv"
@@ -106,10 +107,16 @@ func (k Key) PublicKey() Key {
 
 func (k Key) String() string { return base64.StdEncoding.EncodeToString(k[:]) }
 
+// MarshalText encodes the key in the standard WireGuard base64 form. An empty
+// key encodes as empty text.
 func (k Key) MarshalText() ([]byte, error) {
+	if len(k) != 0 && len(k) != wgtypes.KeyLen {
+		return nil, errors.Errorf("invalid key length %d, expected %d", len(k), wgtypes.KeyLen)
+	}
 	return []byte(k.String()), nil
 }
 
+// UnmarshalText decodes a key with ParseKey.
 func (k *Key) UnmarshalText(data []byte) error {
 	key, err := ParseKey(string(data))
 	if err != nil {
@@ -119,15 +126,24 @@ func (k *Key) UnmarshalText(data []byte) error {
 	return nil
 }
 
+// ParseKey parses a key in the standard WireGuard base64 form, or in the hex
+// form used by the WireGuard configuration protocol. The key must decode to
+// exactly 32 bytes.
 func ParseKey(s string) (Key, error) {
-	buf, err := base64.StdEncoding.DecodeString(string(s))
+	var buf []byte
+	var err error
+	if len(s) == hex.EncodedLen(wgtypes.KeyLen) {
+		buf, err = hex.DecodeString(s)
+	} else {
+		buf, err = base64.StdEncoding.DecodeString(s)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if len(buf) < wgtypes.KeyLen {
-		return nil, errors.Errorf("invalid key length %d", len(buf))
+	if len(buf) != wgtypes.KeyLen {
+		return nil, errors.Errorf("invalid key length %d, expected %d", len(buf), wgtypes.KeyLen)
 	}
-	return Key(buf[:wgtypes.KeyLen]), nil
+	return Key(buf), nil
 }
 
 type Address net.IPNet
@@ -146,6 +162,11 @@ func (a Address) MarshalJSON() ([]byte, error) {
 
 func (a *Address) String() string {
 	size, _ := a.Mask.Size()
+	if ip4 := a.IP.To4(); ip4 != nil && len(a.Mask) == net.IPv6len {
+		// net.IP formats IPv4-mapped IPv6 addresses as IPv4, which would
+		// not parse with an IPv6 prefix length.
+		return "::ffff:" + ip4.String() + "/" + strconv.Itoa(size)
+	}
 	return a.IP.String() + "/" + strconv.Itoa(size)
 }
 
@@ -158,20 +179,113 @@ func (a *Address) UnmarshalText(data []byte) error {
 	return nil
 }
 
+// IsZero returns whether a has no IP address, or only the unspecified
+// address, and so does not identify a host or network.
+func (a *Address) IsZero() bool {
+	return len(a.IP) == 0 || a.IP.IsUnspecified()
+}
+
 func (a *Address) CIDR() *net.IPNet {
-	ipNet := net.IPNet{IP: a.IP.To4(), Mask: a.Mask}
-	for i := 0; i < 4; i++ {
-		ipNet.IP[i] &= ipNet.Mask[i]
+	return &net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask}
+}
+
+// Contains returns whether all the addresses in other's CIDR are within a's
+// CIDR. Addresses of different families are never contained. An address
+// whose mask is wider than a's is not contained, even if its IP is; use
+// ContainsIP to check that an address is in a network.
+func (a *Address) Contains(other Address) bool {
+	size, bits := a.Mask.Size()
+	otherSize, otherBits := other.Mask.Size()
+	if bits == 0 || bits != otherBits || otherSize < size {
+		return false
+	}
+	return a.CIDR().Contains(other.IP)
+}
+
+// ContainsIP returns whether other's IP is within a's CIDR, regardless of
+// other's mask. Addresses of different families are never contained.
+func (a *Address) ContainsIP(other Address) bool {
+	_, bits := a.Mask.Size()
+	_, otherBits := other.Mask.Size()
+	if bits == 0 || bits != otherBits {
+		return false
+	}
+	return a.CIDR().Contains(other.IP)
+}
+
+// Overlaps returns whether any address is in both a's and other's CIDR.
+func (a *Address) Overlaps(other Address) bool {
+	_, bits := a.Mask.Size()
+	_, otherBits := other.Mask.Size()
+	if bits == 0 || bits != otherBits {
+		return false
 	}
-	return &ipNet
+	return a.CIDR().Contains(other.IP.Mask(other.Mask)) || other.CIDR().Contains(a.IP.Mask(a.Mask))
 }
 
+// AllocateAddress returns the lowest host address in cidr which is not
+// taken, with cidr's mask. The network address is never allocated, nor for
+// IPv4 is the broadcast address. The masks of taken addresses are ignored.
+// An error is returned if every address is taken.
+func AllocateAddress(cidr Address, taken []Address) (Address, error) {
+	network := cidr.CIDR()
+	_, bits := network.Mask.Size()
+	if bits == 0 || len(network.IP) != len(network.Mask) {
+		return Address{}, errors.Errorf("invalid network %q", cidr.String())
+	}
+	isTaken := map[string]bool{}
+	for i := range taken {
+		isTaken[taken[i].IP.String()] = true
+	}
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP)
+	for {
+		if !incrementIP(ip) || !network.Contains(ip) {
+			return Address{}, errors.Errorf("no available addresses in network %q", network.String())
+		}
+		if bits == 8*net.IPv4len && isBroadcast(ip, network.Mask) {
+			return Address{}, errors.Errorf("no available addresses in network %q", network.String())
+		}
+		if !isTaken[ip.String()] {
+			return Address{IP: ip, Mask: network.Mask}, nil
+		}
+	}
+}
+
+// incrementIP increments ip in place, returning false if it overflows.
+func incrementIP(ip net.IP) bool {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isBroadcast returns whether ip is the broadcast address of its network,
+// with every host bit set.
+func isBroadcast(ip net.IP, mask net.IPMask) bool {
+	for i := range ip {
+		if ip[i]|mask[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseAddress parses an IPv4 or IPv6 address in CIDR notation, such as
+// "192.168.0.1/24" or "fd00::1/64". IPv4 addresses are 4 bytes long, and
+// IPv6 addresses, including IPv4-mapped IPv6 addresses, are 16 bytes long.
 func ParseAddress(s string) (*Address, error) {
 	ip, ipNet, err := net.ParseCIDR(s)
 	if err != nil {
 		return nil, err
 	}
-	addr := Address(net.IPNet{IP: ip.To4(), Mask: ipNet.Mask})
+	if len(ipNet.Mask) == net.IPv4len {
+		ip = ip.To4()
+	}
+	addr := Address(net.IPNet{IP: ip, Mask: ipNet.Mask})
 	return &addr, nil
 }
 
@@ -11,6 +11,8 @@
 package wireguard_test
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"strings"
 	"testing"
@@ -26,6 +28,55 @@ func TestInvalidKey(t *testing.T) {
 	c.Assert(err, qt.ErrorMatches, ".*invalid key length 2.*")
 }
 
+func TestKeyText(t *testing.T) {
+	c := qt.New(t)
+	k := assertGenerateKey(c)
+	text, err := k.MarshalText()
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(text), qt.Equals, base64.StdEncoding.EncodeToString(k))
+	var k2 wg.Key
+	err = k2.UnmarshalText(text)
+	c.Assert(err, qt.IsNil)
+	c.Assert(k2, qt.DeepEquals, k)
+
+	// Keys also parse from hex.
+	k3, err := wg.ParseKey(hex.EncodeToString(k))
+	c.Assert(err, qt.IsNil)
+	c.Assert(k3, qt.DeepEquals, k)
+
+	// Keys are encoded as base64 in JSON.
+	buf, err := json.Marshal(map[string]wg.Key{"key": k})
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, `{"key":"`+k.String()+`"}`)
+	var doc struct {
+		Key wg.Key `json:"key"`
+	}
+	err = json.Unmarshal(buf, &doc)
+	c.Assert(err, qt.IsNil)
+	c.Assert(doc.Key, qt.DeepEquals, k)
+}
+
+func TestKeyTextInvalidLength(t *testing.T) {
+	c := qt.New(t)
+	_, err := wg.Key(make([]byte, 31)).MarshalText()
+	c.Assert(err, qt.ErrorMatches, `invalid key length 31, expected 32`)
+
+	var k wg.Key
+	err = k.UnmarshalText([]byte(base64.StdEncoding.EncodeToString(make([]byte, 33))))
+	c.Assert(err, qt.ErrorMatches, `invalid key length 33, expected 32`)
+	err = k.UnmarshalText([]byte(strings.Repeat("zz", 32)))
+	c.Assert(err, qt.ErrorMatches, `encoding/hex: invalid byte: .*`)
+	err = k.UnmarshalText([]byte(""))
+	c.Assert(err, qt.ErrorMatches, `invalid key length 0, expected 32`)
+	c.Assert(k, qt.IsNil)
+
+	var doc struct {
+		Key wg.Key `json:"key"`
+	}
+	err = json.Unmarshal([]byte(`{"key":"MAo="}`), &doc)
+	c.Assert(err, qt.ErrorMatches, `invalid key length 2, expected 32`)
+}
+
 func TestInvalidAddress(t *testing.T) {
 	c := qt.New(t)
 	var addr wg.Address
@@ -53,6 +104,208 @@ func TestMarshalAddress(t *testing.T) {
 	c.Assert(string(buf), qt.Equals, `{"addr":"192.168.42.5/24","port":31337}`)
 }
 
+func TestParseAddress(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		about string
+		addr  string
+		ipLen int
+		cidr  string
+	}{{
+		about: "IPv4",
+		addr:  "192.168.42.5/24",
+		ipLen: 4,
+		cidr:  "192.168.42.0/24",
+	}, {
+		about: "IPv4 host",
+		addr:  "10.0.0.1/32",
+		ipLen: 4,
+		cidr:  "10.0.0.1/32",
+	}, {
+		about: "IPv6",
+		addr:  "fd00:1234::5/64",
+		ipLen: 16,
+		cidr:  "fd00:1234::/64",
+	}, {
+		about: "IPv6 host",
+		addr:  "2001:db8::1/128",
+		ipLen: 16,
+		cidr:  "2001:db8::1/128",
+	}, {
+		about: "IPv6 link-local",
+		addr:  "fe80::1:2/10",
+		ipLen: 16,
+		cidr:  "fe80::/10",
+	}, {
+		about: "IPv4-mapped IPv6",
+		addr:  "::ffff:192.168.42.5/120",
+		ipLen: 16,
+		cidr:  "::ffff:192.168.42.0/120",
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			addr, err := wg.ParseAddress(test.addr)
+			c.Assert(err, qt.IsNil)
+			c.Assert(addr.IP, qt.HasLen, test.ipLen)
+			c.Assert(addr.String(), qt.Equals, test.addr)
+			cidr := wg.Address(*addr.CIDR())
+			c.Assert(cidr.String(), qt.Equals, test.cidr)
+
+			// Addresses round-trip through their text and JSON encodings,
+			// as they are persisted and sent over the API.
+			reparsed, err := wg.ParseAddress(addr.String())
+			c.Assert(err, qt.IsNil)
+			c.Assert(reparsed, qt.DeepEquals, addr)
+			buf, err := json.Marshal(addr)
+			c.Assert(err, qt.IsNil)
+			c.Assert(string(buf), qt.Equals, `"`+test.addr+`"`)
+			var unmarshaled wg.Address
+			err = json.Unmarshal(buf, &unmarshaled)
+			c.Assert(err, qt.IsNil)
+			c.Assert(&unmarshaled, qt.DeepEquals, addr)
+		})
+	}
+}
+
+func TestParseAddressInvalid(t *testing.T) {
+	c := qt.New(t)
+	for _, s := range []string{
+		"192.168.42.5",
+		"192.168.42.5/33",
+		"fd00::1/129",
+		"fe80::1%eth0/64",
+	} {
+		_, err := wg.ParseAddress(s)
+		c.Assert(err, qt.ErrorMatches, `invalid CIDR address: .*`, qt.Commentf("%s", s))
+	}
+}
+
+func TestAddressContains(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		a, b       string
+		contains   bool
+		overlaps   bool
+		containsIP bool
+	}{
+		{"10.1.0.0/16", "10.1.2.3/16", true, true, true},
+		{"10.1.0.0/16", "10.1.2.3/32", true, true, true},
+		{"10.1.0.0/16", "10.1.2.0/24", true, true, true},
+		{"10.1.2.0/24", "10.1.0.0/16", false, true, false},
+		{"10.1.0.0/16", "10.2.0.1/16", false, false, false},
+		{"10.1.0.0/16", "192.168.0.1/24", false, false, false},
+		{"10.1.255.0/24", "10.1.254.0/23", false, true, false},
+		// An address with a wider mask than the network is not contained,
+		// though its IP is.
+		{"10.1.2.0/24", "10.1.2.3/16", false, true, true},
+		{"fd00:1::/64", "fd00:1::5/128", true, true, true},
+		{"fd00:1::/64", "fd00:2::5/64", false, false, false},
+		{"fd00::/16", "fd00:1::/64", true, true, true},
+		{"fd00:1::/64", "fd00::/16", false, true, false},
+		// Addresses of different families neither contain nor overlap.
+		{"0.0.0.0/0", "fd00::1/128", false, false, false},
+		{"::/0", "10.1.2.3/32", false, false, false},
+	}
+	for _, test := range tests {
+		a, err := wg.ParseAddress(test.a)
+		c.Assert(err, qt.IsNil)
+		b, err := wg.ParseAddress(test.b)
+		c.Assert(err, qt.IsNil)
+		c.Check(a.Contains(*b), qt.Equals, test.contains, qt.Commentf("%s contains %s", test.a, test.b))
+		c.Check(a.ContainsIP(*b), qt.Equals, test.containsIP, qt.Commentf("%s contains IP of %s", test.a, test.b))
+		c.Check(a.Overlaps(*b), qt.Equals, test.overlaps, qt.Commentf("%s overlaps %s", test.a, test.b))
+		c.Check(b.Overlaps(*a), qt.Equals, test.overlaps, qt.Commentf("%s overlaps %s", test.b, test.a))
+	}
+}
+
+func TestAddressIsZero(t *testing.T) {
+	c := qt.New(t)
+	c.Assert((&wg.Address{}).IsZero(), qt.IsTrue)
+	for _, s := range []string{"0.0.0.0/0", "0.0.0.0/24", "::/0", "::/64"} {
+		addr, err := wg.ParseAddress(s)
+		c.Assert(err, qt.IsNil)
+		c.Check(addr.IsZero(), qt.IsTrue, qt.Commentf("%s", s))
+	}
+	for _, s := range []string{"10.1.2.3/16", "10.0.0.0/8", "fd00::1/64"} {
+		addr, err := wg.ParseAddress(s)
+		c.Assert(err, qt.IsNil)
+		c.Check(addr.IsZero(), qt.IsFalse, qt.Commentf("%s", s))
+	}
+}
+
+func TestAllocateAddress(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		about    string
+		cidr     string
+		taken    []string
+		expected string
+		err      string
+	}{{
+		about:    "empty",
+		cidr:     "10.1.2.0/24",
+		expected: "10.1.2.1/24",
+	}, {
+		about:    "partially allocated",
+		cidr:     "10.1.2.0/24",
+		taken:    []string{"10.1.2.1/24", "10.1.2.2/32", "10.1.2.4/24"},
+		expected: "10.1.2.3/24",
+	}, {
+		about:    "unaligned network",
+		cidr:     "10.1.2.3/24",
+		taken:    []string{"10.1.2.1/24"},
+		expected: "10.1.2.2/24",
+	}, {
+		about:    "last host",
+		cidr:     "10.1.2.0/30",
+		taken:    []string{"10.1.2.1/30"},
+		expected: "10.1.2.2/30",
+	}, {
+		about: "exhausted",
+		cidr:  "10.1.2.0/30",
+		taken: []string{"10.1.2.1/30", "10.1.2.2/30"},
+		err:   `no available addresses in network "10.1.2.0/30"`,
+	}, {
+		about: "host route",
+		cidr:  "10.1.2.3/32",
+		err:   `no available addresses in network "10.1.2.3/32"`,
+	}, {
+		about:    "ipv6",
+		cidr:     "fd00:1::/64",
+		taken:    []string{"fd00:1::1/64"},
+		expected: "fd00:1::2/64",
+	}, {
+		about:    "ipv6 all ones host",
+		cidr:     "fd00:1::/126",
+		taken:    []string{"fd00:1::1/126", "fd00:1::2/126"},
+		expected: "fd00:1::3/126",
+	}, {
+		about: "ipv6 exhausted",
+		cidr:  "fd00:1::/127",
+		taken: []string{"fd00:1::1/127"},
+		err:   `no available addresses in network "fd00:1::/127"`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			cidr, err := wg.ParseAddress(test.cidr)
+			c.Assert(err, qt.IsNil)
+			var taken []wg.Address
+			for _, s := range test.taken {
+				addr, err := wg.ParseAddress(s)
+				c.Assert(err, qt.IsNil)
+				taken = append(taken, *addr)
+			}
+			addr, err := wg.AllocateAddress(*cidr, taken)
+			if test.err != "" {
+				c.Assert(err, qt.ErrorMatches, test.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(addr.String(), qt.Equals, test.expected)
+		})
+	}
+}
+
 func TestSimple(t *testing.T) {
 	c := qt.New(t)
 